@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jpraynaud/fizzbuzz-server/pkg/auth"
+	"github.com/jpraynaud/fizzbuzz-server/pkg/render"
+	log "github.com/sirupsen/logrus"
+)
+
+// statisticsImportMaxBytes is the maximum size of the body of the statistics import endpoint
+const statisticsImportMaxBytes = 64 << 20
+
+// parseImportMode parses the mode parameter of imported statistics (merge or replace), merge by default
+func parseImportMode(value string) (bool, error) {
+	switch value {
+	case "", "merge":
+		return false, nil
+	case "replace":
+		return true, nil
+	}
+	return false, &render.ParameterError{Parameter: "mode", Reason: "must be merge or replace", Value: value}
+}
+
+// authorizeAdmin checks that a request is authenticated by the admin token as a bearer token, or by a client with the admin role
+// An empty admin token disables the administration endpoints, unless authentication is enabled
+func authorizeAdmin(r *http.Request, token string) (int, error) {
+	if identity := auth.FromContext(r.Context()); identity != nil {
+		if !identity.HasRole(auth.RoleAdmin) {
+			return http.StatusForbidden, fmt.Errorf("client %s must have the %s role", identity.Subject, auth.RoleAdmin)
+		}
+		return http.StatusOK, nil
+	}
+	if token == "" {
+		return http.StatusForbidden, errors.New("administration endpoints are disabled, no admin token is configured")
+	}
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") || subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(authorization, "Bearer ")), []byte(token)) != 1 {
+		return http.StatusUnauthorized, errors.New("a valid admin token must be given as a bearer token")
+	}
+	return http.StatusOK, nil
+}
+
+// requireAdmin authorizes a request to an administration endpoint, and writes the error response if it is not authorized
+func requireAdmin(w http.ResponseWriter, r *http.Request, token string) bool {
+	status, err := authorizeAdmin(r, token)
+	if err == nil {
+		if auth.FromContext(r.Context()) == nil {
+			logClient(r, "admin")
+			auditClient(r, "admin")
+		}
+		return true
+	}
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	apiFailure(w, r, status, err)
+	return false
+}
+
+// auditResponseWriter records the status code written to a response, and the client of the request once authorized by the handler
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+	client string
+}
+
+// WriteHeader records the status code and writes it
+func (w *auditResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// auditKey is the context key of the audit log entry of a request
+type auditKey struct{}
+
+// auditClient records the authorized client of a request in its audit log entry
+func auditClient(r *http.Request, subject string) {
+	if entry, ok := r.Context().Value(auditKey{}).(*auditResponseWriter); ok {
+		entry.client = subject
+	}
+}
+
+// auditMiddleware writes an audit log entry for each call of an administration endpoint, with its caller (and its client if authenticated, admin for the admin token) and its status code
+func auditMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auditWriter := &auditResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next(auditWriter, r.WithContext(context.WithValue(r.Context(), auditKey{}, auditWriter)))
+		client := auditWriter.client
+		if identity := auth.FromContext(r.Context()); identity != nil {
+			client = identity.Subject
+		}
+		log.WithFields(log.Fields{
+			"audit":      true,
+			"client":     client,
+			"method":     r.Method,
+			"uri":        r.RequestURI,
+			"remote":     r.RemoteAddr,
+			"user_agent": r.UserAgent(),
+			"status":     auditWriter.status,
+		}).Info("Administration call")
+	}
+}
+
+// parseDelta parses the delta parameter of an adjustment of statistics, a non zero integer
+func parseDelta(value string) (int, error) {
+	delta, err := strconv.Atoi(value)
+	if err != nil || delta == 0 {
+		return 0, &render.ParameterError{Parameter: "delta", Reason: "must be a non zero integer", Value: value}
+	}
+	return delta, nil
+}
+
+// importResponse represents the summary of an import of statistics
+type importResponse struct {
+	Mode     string `json:"mode"`
+	Requests int    `json:"requests"`
+	Total    int    `json:"total"`
+}
+
+// Handles the import of rendering statistics exported as a JSON or CSV file, that are merged into the statistics or replace them
+func importHandler(renderer render.Renderer, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Authenticate request
+		if !requireAdmin(w, r, token) {
+			return
+		}
+
+		// Prepare input parameters
+		vars := r.URL.Query()
+		format, err := parseFormat(vars.Get("format"))
+		if err != nil {
+			apiFailure(w, r, http.StatusBadRequest, err)
+			return
+		}
+		replace, err := parseImportMode(vars.Get("mode"))
+		if err != nil {
+			apiFailure(w, r, http.StatusBadRequest, err)
+			return
+		}
+		importRecorder, ok := renderer.Statistics().(render.ImportStatisticRecorder)
+		if !ok {
+			apiError(w, r, http.StatusNotImplemented, "statistics import is not supported")
+			return
+		}
+
+		// Read export
+		body := http.MaxBytesReader(w, r.Body, statisticsImportMaxBytes)
+		export := &render.Export{}
+		if format == "csv" {
+			export, err = render.ReadExportCSV(body)
+		} else {
+			err = json.NewDecoder(body).Decode(export)
+		}
+		if err == nil {
+			err = export.Validate()
+		}
+		if err != nil {
+			apiError(w, r, http.StatusBadRequest, fmt.Sprintf("body must be a statistics export in %s format: %v", format, err))
+			return
+		}
+
+		// Import statistics
+		if err := importRecorder.ImportStatistics(export.Statistics, replace); err != nil {
+			apiFailure(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		response := importResponse{Mode: "merge", Requests: len(export.Statistics)}
+		if replace {
+			response.Mode = "replace"
+		}
+		for _, statistic := range export.Statistics {
+			response.Total += statistic.Total
+		}
+		log.WithFields(log.Fields{
+			"mode":     response.Mode,
+			"requests": response.Requests,
+			"total":    response.Total,
+		}).Info("Statistics imported")
+
+		// Write response
+		writeResponse(w, r, response)
+	}
+}
+
+// adminResponse represents the outcome of an administration of statistics: the statistics deleted, or adjusted
+type adminResponse struct {
+	Action     string                     `json:"action"`
+	Statistics []*render.RequestStatistic `json:"statistics"`
+}
+
+// adminStatistics returns the statistics of a recorder that can be managed request by request, if supported
+func adminStatistics(recorder render.StatisticRecorder) (render.AdminStatisticRecorder, error) {
+	adminRecorder, ok := recorder.(render.AdminStatisticRecorder)
+	if !ok {
+		return nil, errors.New("statistics management by request is not supported")
+	}
+	return adminRecorder, nil
+}
+
+// adminFailure writes the error response of a failed administration of statistics: a conflict when federated statistics refuse to lower their totals, an internal error otherwise
+func adminFailure(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusInternalServerError
+	if err == render.ErrFederatedLowering {
+		status = http.StatusConflict
+	}
+	apiFailure(w, r, status, err)
+}
+
+// Handles the reset of the rendering statistics, of all requests or of the requests matching filters only
+func resetHandler(renderer render.Renderer, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Authenticate request
+		if !requireAdmin(w, r, token) {
+			return
+		}
+
+		// Prepare input parameters
+		filters, err := parseFilters(r.URL.Query())
+		if err != nil {
+			apiFailure(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		// Reset statistics
+		response := adminResponse{Action: "reset", Statistics: make([]*render.RequestStatistic, 0)}
+		if len(filters) == 0 {
+			renderer.Statistics().ResetStatistics()
+		} else {
+			adminRecorder, err := adminStatistics(renderer.Statistics())
+			if err != nil {
+				apiFailure(w, r, http.StatusNotImplemented, err)
+				return
+			}
+			if response.Statistics, err = adminRecorder.DeleteStatistics(filters); err != nil {
+				adminFailure(w, r, err)
+				return
+			}
+		}
+		filterFields := make([]string, 0, len(filters))
+		for _, filter := range filters {
+			filterFields = append(filterFields, filter.String())
+		}
+		log.WithFields(log.Fields{
+			"filters":  filterFields,
+			"requests": len(response.Statistics),
+		}).Info("Statistics reset")
+
+		// Write response
+		writeResponse(w, r, response)
+	}
+}
+
+// Handles the deletion of the rendering statistics of a request
+func deleteHandler(renderer render.Renderer, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Authenticate request
+		if !requireAdmin(w, r, token) {
+			return
+		}
+
+		// Prepare input parameters
+		request, err := parseRequest(r.URL.Query())
+		if err != nil {
+			apiFailure(w, r, http.StatusBadRequest, err)
+			return
+		}
+		adminRecorder, err := adminStatistics(renderer.Statistics())
+		if err != nil {
+			apiFailure(w, r, http.StatusNotImplemented, err)
+			return
+		}
+
+		// Delete statistic
+		statistic, err := adminRecorder.DeleteStatistic(request)
+		if err != nil {
+			adminFailure(w, r, err)
+			return
+		}
+		if statistic == nil {
+			apiError(w, r, http.StatusNotFound, "no rendering of the request was recorded")
+			return
+		}
+		log.WithFields(log.Fields{
+			"request": request,
+			"total":   statistic.Total,
+		}).Info("Statistics deleted")
+
+		// Write response
+		writeResponse(w, r, adminResponse{Action: "delete", Statistics: []*render.RequestStatistic{statistic}})
+	}
+}
+
+// Handles the adjustment of the total of the rendering statistics of a request, by a number of hits added or removed
+func adjustHandler(renderer render.Renderer, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Authenticate request
+		if !requireAdmin(w, r, token) {
+			return
+		}
+
+		// Prepare input parameters
+		vars := r.URL.Query()
+		request, err := parseRequest(vars)
+		if err != nil {
+			apiFailure(w, r, http.StatusBadRequest, err)
+			return
+		}
+		delta, err := parseDelta(vars.Get("delta"))
+		if err != nil {
+			apiFailure(w, r, http.StatusBadRequest, err)
+			return
+		}
+		adminRecorder, err := adminStatistics(renderer.Statistics())
+		if err != nil {
+			apiFailure(w, r, http.StatusNotImplemented, err)
+			return
+		}
+
+		// Adjust statistic
+		statistic, err := adminRecorder.AdjustStatistic(request, delta)
+		if err == render.ErrNegativeTotal {
+			apiFailure(w, r, http.StatusBadRequest, &render.ParameterError{Parameter: "delta", Reason: "must not bring the total of the request below 0", Value: strconv.Itoa(delta)})
+			return
+		}
+		if err != nil {
+			adminFailure(w, r, err)
+			return
+		}
+		response := adminResponse{Action: "adjust", Statistics: make([]*render.RequestStatistic, 0, 1)}
+		total := 0
+		if statistic != nil {
+			response.Statistics, total = append(response.Statistics, statistic), statistic.Total
+		}
+		log.WithFields(log.Fields{
+			"request": request,
+			"delta":   delta,
+			"total":   total,
+		}).Info("Statistics adjusted")
+
+		// Write response
+		writeResponse(w, r, response)
+	}
+}
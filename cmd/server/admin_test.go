@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jpraynaud/fizzbuzz-server/pkg/render"
+	log "github.com/sirupsen/logrus"
+)
+
+func Test_importHandler(t *testing.T) {
+	// Create new renderers and record a request
+	renderer := render.NewRenderer()
+	renderer.RecordStatistic(render.NewRequest(20, 3, 5, "A", "B"))
+	approximateRenderer := render.NewRendererWithStatistics(render.NewApproximateStatistics(0.01, 0.01, 10))
+	jsonExport := `{"time":"2019-10-01T12:00:00Z","statistics":[{"request":{"limit":20,"int1":3,"int2":5,"str1":"A","str2":"B"},"total":3},{"request":{"limit":10,"int1":2,"int2":7,"str1":"C","str2":"D"},"total":2}]}`
+	csvExport := "limit,int1,int2,str1,str2,total,first_seen,last_seen,latency_count,latency_mean_ms,latency_max_ms\n10,2,7,C,D,5,,,,,\n"
+	tests := []struct {
+		name              string
+		renderer          render.Renderer
+		token             string
+		authorization     string
+		query             string
+		body              string
+		codeWanted        int
+		apiResponseWanted apiResponse
+		topWanted         *render.RequestStatistic
+	}{
+		{"Import Merge", renderer, "secret", "Bearer secret", "", jsonExport, http.StatusOK, apiResponse{false, importResponse{"merge", 2, 5}}, &render.RequestStatistic{Request: *render.NewRequest(20, 3, 5, "A", "B"), Total: 4}},
+		{"Import Replace", renderer, "secret", "Bearer secret", "format=csv&mode=replace", csvExport, http.StatusOK, apiResponse{false, importResponse{"replace", 1, 5}}, &render.RequestStatistic{Request: *render.NewRequest(10, 2, 7, "C", "D"), Total: 5}},
+		{"Import Bad Request", renderer, "secret", "Bearer secret", "format=xml", jsonExport, http.StatusBadRequest, apiResponse{true, "format parameter must be json or csv, value xml was given"}, nil},
+		{"Import Bad Request", renderer, "secret", "Bearer secret", "mode=append", jsonExport, http.StatusBadRequest, apiResponse{true, "mode parameter must be merge or replace, value append was given"}, nil},
+		{"Import Bad Request", renderer, "secret", "Bearer secret", "format=csv", strings.Replace(csvExport, "total", "count", 1), http.StatusBadRequest, apiResponse{true, "body must be a statistics export in csv format: CSV header must be limit,int1,int2,str1,str2,total,first_seen,last_seen,latency_count,latency_mean_ms,latency_max_ms, column count was given"}, nil},
+		{"Import Bad Request", renderer, "secret", "Bearer secret", "", `{"statistics":[{"total":0}]}`, http.StatusBadRequest, apiResponse{true, "body must be a statistics export in json format: statistic 1 must have a total >= 1"}, nil},
+		{"Import Unauthorized", renderer, "secret", "Bearer guess", "", jsonExport, http.StatusUnauthorized, apiResponse{true, "a valid admin token must be given as a bearer token"}, nil},
+		{"Import Unauthorized", renderer, "secret", "", "", jsonExport, http.StatusUnauthorized, apiResponse{true, "a valid admin token must be given as a bearer token"}, nil},
+		{"Import Forbidden", renderer, "", "Bearer ", "", jsonExport, http.StatusForbidden, apiResponse{true, "administration endpoints are disabled, no admin token is configured"}, nil},
+		{"Import Not Implemented", approximateRenderer, "secret", "Bearer secret", "", jsonExport, http.StatusNotImplemented, apiResponse{true, "statistics import is not supported"}, nil},
+	}
+	// Run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := http.NewRequest("POST", "/statistics/import?"+tt.query, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.authorization != "" {
+				request.Header.Set("Authorization", tt.authorization)
+			}
+			validateHandler(t, importHandler(tt.renderer, tt.token), request, tt.codeWanted, tt.apiResponseWanted)
+			if tt.topWanted == nil {
+				return
+			}
+			if got := tt.renderer.Statistics().GetTopStatistic(); got.Request != tt.topWanted.Request || got.Total != tt.topWanted.Total {
+				t.Errorf("imported statistics top = %+v, want %+v", got, tt.topWanted)
+			}
+		})
+	}
+}
+
+// failingStatistics represents statistics whose backend fails to manage them request by request
+type failingStatistics struct {
+	render.StatisticRecorder
+}
+
+var errBackendUnavailable = errors.New("statistics backend is unavailable")
+
+func (fs *failingStatistics) DeleteStatistics(filters []*render.Filter) ([]*render.RequestStatistic, error) {
+	return nil, errBackendUnavailable
+}
+
+func (fs *failingStatistics) DeleteStatistic(request *render.Request) (*render.RequestStatistic, error) {
+	return nil, errBackendUnavailable
+}
+
+func (fs *failingStatistics) AdjustStatistic(request *render.Request, delta int) (*render.RequestStatistic, error) {
+	return nil, errBackendUnavailable
+}
+
+func Test_adminHandlers(t *testing.T) {
+	// Create new renderers and record requests
+	renderer := render.NewRenderer()
+	first, second, third := render.NewRequest(20, 3, 5, "A", "B"), render.NewRequest(10, 2, 7, "C", "D"), render.NewRequest(3, 2, 7, "E", "F")
+	for _, request := range []*render.Request{first, first, first, second, second, third} {
+		renderer.RecordStatistic(request)
+	}
+	approximateRenderer := render.NewRendererWithStatistics(render.NewApproximateStatistics(0.01, 0.01, 10))
+	federatedRenderer := render.NewRendererWithStatistics(render.NewFederatedStatistics("a", render.NewStatistics()))
+	failingRenderer := render.NewRendererWithStatistics(&failingStatistics{render.NewStatistics()})
+	firstQuery, secondQuery := "limit=20&int1=3&int2=5&str1=A&str2=B", "limit=10&int1=2&int2=7&str1=C&str2=D"
+	tests := []struct {
+		name              string
+		handler           func(render.Renderer, string) http.HandlerFunc
+		method            string
+		renderer          render.Renderer
+		authorization     string
+		query             string
+		codeWanted        int
+		apiResponseWanted apiResponse
+	}{
+		{"Adjust", adjustHandler, "PATCH", renderer, "Bearer secret", firstQuery + "&delta=2", http.StatusOK, apiResponse{false, adminResponse{"adjust", []*render.RequestStatistic{{Request: *first, Total: 5, Outcomes: succeeded(3)}}}}},
+		{"Adjust Bad Request", adjustHandler, "PATCH", renderer, "Bearer secret", firstQuery + "&delta=0", http.StatusBadRequest, apiResponse{true, "delta parameter must be a non zero integer, value 0 was given"}},
+		{"Adjust Bad Request", adjustHandler, "PATCH", renderer, "Bearer secret", firstQuery + "&delta=-6", http.StatusBadRequest, apiResponse{true, "delta parameter must not bring the total of the request below 0, value -6 was given"}},
+		{"Adjust Bad Request", adjustHandler, "PATCH", renderer, "Bearer secret", "limit=Z&delta=1", http.StatusBadRequest, apiResponse{true, "limit parameter must be an integer, value Z was given"}},
+		{"Adjust Not Implemented", adjustHandler, "PATCH", approximateRenderer, "Bearer secret", firstQuery + "&delta=1", http.StatusNotImplemented, apiResponse{true, "statistics management by request is not supported"}},
+		{"Adjust Conflict", adjustHandler, "PATCH", federatedRenderer, "Bearer secret", firstQuery + "&delta=-1", http.StatusConflict, apiResponse{true, "lowering totals is not supported by federated statistics"}},
+		{"Adjust Internal Server Error", adjustHandler, "PATCH", failingRenderer, "Bearer secret", firstQuery + "&delta=1", http.StatusInternalServerError, apiResponse{true, "statistics backend is unavailable"}},
+		{"Adjust Unauthorized", adjustHandler, "PATCH", renderer, "Bearer guess", firstQuery + "&delta=1", http.StatusUnauthorized, apiResponse{true, "a valid admin token must be given as a bearer token"}},
+		{"Adjust Unauthorized", adjustHandler, "PATCH", renderer, "secret", firstQuery + "&delta=1", http.StatusUnauthorized, apiResponse{true, "a valid admin token must be given as a bearer token"}},
+		{"Delete", deleteHandler, "DELETE", renderer, "Bearer secret", secondQuery, http.StatusOK, apiResponse{false, adminResponse{"delete", []*render.RequestStatistic{{Request: *second, Total: 2, Outcomes: succeeded(2)}}}}},
+		{"Delete Not Found", deleteHandler, "DELETE", renderer, "Bearer secret", secondQuery, http.StatusNotFound, apiResponse{true, "no rendering of the request was recorded"}},
+		{"Delete Conflict", deleteHandler, "DELETE", federatedRenderer, "Bearer secret", secondQuery, http.StatusConflict, apiResponse{true, "lowering totals is not supported by federated statistics"}},
+		{"Delete Internal Server Error", deleteHandler, "DELETE", failingRenderer, "Bearer secret", secondQuery, http.StatusInternalServerError, apiResponse{true, "statistics backend is unavailable"}},
+		{"Delete Unauthorized", deleteHandler, "DELETE", renderer, "", secondQuery, http.StatusUnauthorized, apiResponse{true, "a valid admin token must be given as a bearer token"}},
+		{"Reset Filtered", resetHandler, "POST", renderer, "Bearer secret", "filter=limit<10&int2=7", http.StatusOK, apiResponse{false, adminResponse{"reset", []*render.RequestStatistic{{Request: *third, Total: 1, Rank: 1, Outcomes: succeeded(1)}}}}},
+		{"Reset Bad Request", resetHandler, "POST", renderer, "Bearer secret", "filter=limit~10", http.StatusBadRequest, apiResponse{true, "filter parameter must compare limit, int1 or int2 to an integer with =, !=, <, <=, > or >=, or str1 or str2 to a string with = or !=, value limit~10 was given"}},
+		{"Reset Not Implemented", resetHandler, "POST", approximateRenderer, "Bearer secret", "limit=20", http.StatusNotImplemented, apiResponse{true, "statistics management by request is not supported"}},
+		{"Reset Conflict", resetHandler, "POST", federatedRenderer, "Bearer secret", "limit=20", http.StatusConflict, apiResponse{true, "lowering totals is not supported by federated statistics"}},
+		{"Reset Internal Server Error", resetHandler, "POST", failingRenderer, "Bearer secret", "limit=20", http.StatusInternalServerError, apiResponse{true, "statistics backend is unavailable"}},
+		{"Reset", resetHandler, "POST", renderer, "Bearer secret", "", http.StatusOK, apiResponse{false, adminResponse{"reset", []*render.RequestStatistic{}}}},
+	}
+	// Run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := http.NewRequest(tt.method, "/statistics/request?"+tt.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.authorization != "" {
+				request.Header.Set("Authorization", tt.authorization)
+			}
+			validateHandler(t, tt.handler(tt.renderer, "secret"), request, tt.codeWanted, tt.apiResponseWanted)
+		})
+	}
+	// Check the statistics left
+	if got := renderer.Statistics().GetTopStatistic(); got != nil {
+		t.Errorf("reset statistics top = %+v, want nil", got)
+	}
+}
+
+func Test_auditMiddleware(t *testing.T) {
+	// Capture logs
+	buffer := &bytes.Buffer{}
+	log.SetOutput(buffer)
+	log.SetFormatter(&log.JSONFormatter{})
+	defer func() {
+		log.SetOutput(os.Stdout)
+		log.SetFormatter(&log.TextFormatter{})
+	}()
+	// Check that each call is logged with its status code, authorized or not
+	for _, authorization := range []string{"Bearer secret", "Bearer guess"} {
+		request, err := http.NewRequest("POST", "/statistics/reset", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Authorization", authorization)
+		request.RemoteAddr = "192.0.2.1:1234"
+		auditMiddleware(resetHandler(render.NewRenderer(), "secret"))(httptest.NewRecorder(), request)
+	}
+	entries := make([]map[string]interface{}, 0)
+	decoder := json.NewDecoder(buffer)
+	for decoder.More() {
+		entry := make(map[string]interface{})
+		if err := decoder.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry["audit"] == true {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) != 2 || entries[0]["status"] != float64(http.StatusOK) || entries[0]["client"] != "admin" || entries[1]["status"] != float64(http.StatusUnauthorized) || entries[1]["client"] != "" || entries[1]["remote"] != "192.0.2.1:1234" {
+		t.Errorf("audit log entries = %v, want the calls of the admin with status code 200 and of an unknown client with status code 401", entries)
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jpraynaud/fizzbuzz-server/pkg/auth"
+	"github.com/jpraynaud/fizzbuzz-server/pkg/encode"
+	"github.com/jpraynaud/fizzbuzz-server/pkg/render"
+	"github.com/jpraynaud/fizzbuzz-server/pkg/usage"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// apiV1Deprecation is the date of the deprecation of the version 1 of the API, in favor of the version 2
+	apiV1Deprecation = time.Date(2026, time.November, 1, 0, 0, 0, 0, time.UTC)
+	// apiV1Sunset is the date after which the version 1 of the API may be removed
+	apiV1Sunset = time.Date(2027, time.May, 1, 0, 0, 0, 0, time.UTC)
+	// apiVersions are the path prefixes under which the API endpoints are served, and their version (the version 1 without prefix)
+	apiVersions = []struct {
+		prefix  string
+		version int
+	}{{"/v1", 1}, {"/v2", 2}, {"", 1}}
+)
+
+const (
+	// problemMediaType is the media type of the problem details of errors (RFC 7807)
+	problemMediaType = "application/problem+json"
+	// problemTypeBase is the base of the type URIs of the problem details of errors, followed by their code (e.g. invalid-parameter)
+	problemTypeBase = "https://github.com/jpraynaud/fizzbuzz-server/problems/"
+)
+
+// dependencies represents the dependencies of the router of the HTTP server and of its handlers, created once the server is set up
+type dependencies struct {
+	// renderer renders the requests and records their statistics
+	renderer render.Renderer
+	// authenticator authenticates the clients of the API endpoints, nil if authentication is disabled (the admin token still guards administration)
+	authenticator *auth.Authenticator
+	// usageMeter meters the usage of the authenticated clients of the API endpoints, nil if authentication is disabled
+	usageMeter *usage.Meter
+	// rateLimits are the rate limits of the clients of the API endpoints, nil if they are not limited
+	rateLimits *apiRateLimits
+}
+
+// createRouter creates the router of the HTTP server
+// Its OpenAPI document is generated from its routes, and the requests are validated against it if enabled
+func createRouter(deps *dependencies) *mux.Router {
+	validate, err := strconv.ParseBool(validateRequests)
+	if err != nil && validateRequests != "" {
+		log.Warnf("validate must be true or false, value %s was given: requests are not validated", validateRequests)
+	}
+	log.WithFields(log.Fields{
+		"environment": environment,
+		"address":     addr,
+		"TLS":         (tlsCertFile != "" && tlsKeyFile != ""),
+		"datadir":     dataDirectory,
+		"statistics":  statisticsBackend,
+		"validate":    validate,
+	}).Info("Create server")
+	router := mux.NewRouter()
+	// The federation endpoint is not part of the versions of the API, it is authenticated on its own
+	federation := federationHandler(deps.renderer)
+	if deps.authenticator != nil {
+		federation = federationAuthMiddleware(deps.authenticator, federation)
+	}
+	router.HandleFunc(render.FederationPath, federation).Methods(http.MethodGet)
+	subrouters := make([]*mux.Router, 0, len(apiVersions))
+	for _, api := range apiVersions {
+		subrouter := router.PathPrefix(api.prefix).Subrouter()
+		createRoutes(subrouter, deps)
+		subrouters = append(subrouters, subrouter)
+	}
+	document := newOpenAPIDocument(router, deps.authenticator != nil)
+	router.HandleFunc("/openapi.json", openAPIHandler(document)).Methods(http.MethodGet)
+	// Middlewares run in the order they are added, whatever the routes they wrap were created before
+	for i, api := range apiVersions {
+		subrouter := subrouters[i]
+		subrouter.Use(apiVersionMiddleware(api.version))
+		// Validation follows the version middleware, so that its errors are written in the shape of the version called,
+		// and precedes rate limiting and metering, so that invalid requests take no token and are not billed
+		if validate {
+			subrouter.Use(validationMiddleware(document))
+		}
+		// Authentication precedes rate limiting, so that authenticated clients are limited by their identity
+		if deps.authenticator != nil {
+			subrouter.Use(authMiddleware(deps.authenticator, api.prefix))
+		}
+		if deps.rateLimits != nil {
+			subrouter.Use(rateLimitMiddleware(deps.rateLimits))
+		}
+		if deps.usageMeter != nil {
+			subrouter.Use(usageMiddleware(deps.usageMeter))
+		}
+	}
+	router.Use(loggingMiddleware)
+	return router
+}
+
+// createRoutes creates the routes of the API endpoints, served by each version of the API
+func createRoutes(router *mux.Router, deps *dependencies) {
+	router.HandleFunc("/render", renderHandler(deps)).Methods(http.MethodGet)
+	router.HandleFunc("/render", renderBodyHandler(deps)).Methods(http.MethodPost)
+	router.HandleFunc("/statistics", cacheMiddleware(deps.cacheControl(statisticsMaxAge), statisticsHandler(deps.renderer))).Methods(http.MethodGet)
+	router.HandleFunc("/statistics/timeseries", cacheMiddleware(deps.cacheControl(statisticsMaxAge), timeSeriesHandler(deps.renderer))).Methods(http.MethodGet)
+	router.HandleFunc("/statistics/aggregate", cacheMiddleware(deps.cacheControl(statisticsMaxAge), aggregateHandler(deps.renderer))).Methods(http.MethodGet)
+	router.HandleFunc("/statistics/requests", cacheMiddleware(deps.cacheControl(statisticsMaxAge), requestsHandler(deps.renderer))).Methods(http.MethodGet)
+	router.HandleFunc("/statistics/request", cacheMiddleware(deps.cacheControl(statisticsMaxAge), requestHandler(deps.renderer))).Methods(http.MethodGet)
+	router.HandleFunc("/statistics/export", exportHandler(deps.renderer)).Methods(http.MethodGet)
+	router.HandleFunc("/statistics/stream", streamHandler(deps.renderer, streamsClosing)).Methods(http.MethodGet)
+	router.HandleFunc("/usage", usageHandler(deps.usageMeter)).Methods(http.MethodGet)
+	router.HandleFunc("/statistics/import", auditMiddleware(importHandler(deps.renderer, adminToken))).Methods(http.MethodPost)
+	router.HandleFunc("/statistics/reset", auditMiddleware(resetHandler(deps.renderer, adminToken))).Methods(http.MethodPost)
+	router.HandleFunc("/statistics/request", auditMiddleware(deleteHandler(deps.renderer, adminToken))).Methods(http.MethodDelete)
+	router.HandleFunc("/statistics/request", auditMiddleware(adjustHandler(deps.renderer, adminToken))).Methods(http.MethodPatch)
+}
+
+// accessLog represents the access log entry of a request, written once the request is served
+// It records the status code of the response, and the client of the request once authenticated by a later middleware or handler
+type accessLog struct {
+	http.ResponseWriter
+	status int
+	client string
+}
+
+// WriteHeader records the status code and writes it
+func (l *accessLog) WriteHeader(status int) {
+	if l.status == 0 {
+		l.status = status
+	}
+	l.ResponseWriter.WriteHeader(status)
+}
+
+// Write records the status code 200 OK if none was written, as the ResponseWriter does
+func (l *accessLog) Write(p []byte) (int, error) {
+	if l.status == 0 {
+		l.status = http.StatusOK
+	}
+	return l.ResponseWriter.Write(p)
+}
+
+// Flush flushes the response, so that streamed responses are still flushed
+func (l *accessLog) Flush() {
+	if flusher, ok := l.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// accessLogKey is the context key of the access log entry of a request
+type accessLogKey struct{}
+
+// logClient records the authenticated client of a request in its access log entry
+func logClient(r *http.Request, subject string) {
+	if entry, ok := r.Context().Value(accessLogKey{}).(*accessLog); ok {
+		entry.client = subject
+	}
+}
+
+// loggingMiddleware writes the access log entry of the requests once served, with their client (empty if anonymous) and status code
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entry := &accessLog{ResponseWriter: w}
+		next.ServeHTTP(entry, r.WithContext(context.WithValue(r.Context(), accessLogKey{}, entry)))
+		if entry.status == 0 {
+			entry.status = http.StatusOK
+		}
+		log.WithFields(log.Fields{"client": entry.client, "status": entry.status}).Infof("%s - %s", r.Method, r.RequestURI)
+	})
+}
+
+// apiResponse represents a page response (version 1 of the API)
+type apiResponse struct {
+	Error    bool        `json:"error"`
+	Response interface{} `json:"response"`
+}
+
+// apiDocument represents a response of the version 2 of the API: its data or its error, along with its metadata
+type apiDocument struct {
+	Data  interface{}     `json:"data,omitempty"`
+	Error *apiErrorDetail `json:"error,omitempty"`
+	Meta  *apiMeta        `json:"meta"`
+}
+
+// apiErrorDetail represents an error of the version 2 of the API, with the parameter in fault and its value if any
+type apiErrorDetail struct {
+	Status    int    `json:"status"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Parameter string `json:"parameter,omitempty"`
+	Value     string `json:"value,omitempty"`
+}
+
+// apiProblem represents the problem details of an error (RFC 7807), extended with the stable code of the error and its invalid parameters
+type apiProblem struct {
+	Type          string            `json:"type"`
+	Title         string            `json:"title"`
+	Status        int               `json:"status"`
+	Detail        string            `json:"detail"`
+	Instance      string            `json:"instance"`
+	Code          string            `json:"code"`
+	InvalidParams []apiInvalidParam `json:"invalid-params,omitempty"`
+}
+
+// apiInvalidParam represents an invalid parameter of a call, the reason why it is invalid and its value
+type apiInvalidParam struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+	Value  string `json:"value"`
+}
+
+// apiMeta represents the metadata of a response of the version 2 of the API: the number of items rendered (for renders only),
+// the parameters of the call (the request for renders, else the query parameters) and its timing
+type apiMeta struct {
+	Count      *int        `json:"count,omitempty"`
+	Parameters interface{} `json:"parameters"`
+	Timing     apiTiming   `json:"timing"`
+}
+
+// apiTiming represents the timing of a call of the API, its duration is in milliseconds
+type apiTiming struct {
+	Started    time.Time `json:"started"`
+	DurationMS float64   `json:"duration_ms"`
+}
+
+// apiCall represents the version of the API called, and when it was called
+type apiCall struct {
+	version int
+	started time.Time
+}
+
+// apiCallKey is the key of the apiCall in the context of a request
+type apiCallKey struct{}
+
+// apiVersionMiddleware attaches the version of the API called to the context of the requests
+// The version 1 is deprecated: its responses advertise its deprecation and sunset dates, and their successor in the version 2
+func apiVersionMiddleware(version int) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if version == 1 {
+				w.Header().Set("Deprecation", fmt.Sprintf("@%d", apiV1Deprecation.Unix()))
+				w.Header().Set("Sunset", apiV1Sunset.Format(http.TimeFormat))
+				w.Header().Set("Link", fmt.Sprintf("</v2%s>; rel=\"successor-version\"", strings.TrimPrefix(r.URL.Path, "/v1")))
+			}
+			call := &apiCall{version: version, started: time.Now()}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiCallKey{}, call)))
+		})
+	}
+}
+
+// apiCallOf returns the version of the API called by a request and when it was called, the version 1 called now by default
+func apiCallOf(r *http.Request) *apiCall {
+	if call, ok := r.Context().Value(apiCallKey{}).(*apiCall); ok {
+		return call
+	}
+	return &apiCall{version: 1, started: time.Now()}
+}
+
+// newAPIMeta returns the metadata of a response of the version 2 of the API
+func newAPIMeta(call *apiCall, parameters interface{}, count *int) *apiMeta {
+	return &apiMeta{
+		Count:      count,
+		Parameters: parameters,
+		Timing: apiTiming{
+			Started:    call.started,
+			DurationMS: float64(time.Since(call.started)) / float64(time.Millisecond),
+		},
+	}
+}
+
+// writeResponse writes a response in the shape of the version of the API called
+func writeResponse(w http.ResponseWriter, r *http.Request, response interface{}) {
+	if call := apiCallOf(r); call.version == 2 {
+		json.NewEncoder(w).Encode(apiDocument{Data: response, Meta: newAPIMeta(call, r.URL.Query(), nil)})
+		return
+	}
+	apiResponse := apiResponse{false, response}
+	json.NewEncoder(w).Encode(apiResponse)
+}
+
+// Api error
+func apiError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	apiFailure(w, r, status, errors.New(message))
+}
+
+// apiFailure writes an error along with the parameter in fault of a *render.ParameterError: as problem details (RFC 7807)
+// when the Accept header explicitly accepts them, else in the shape of the version of the API called
+func apiFailure(w http.ResponseWriter, r *http.Request, status int, err error) {
+	log.Errorf("%s - %s - %d - %s", r.Method, r.RequestURI, status, err)
+	code := apiErrorCode(status, err)
+	parameterError, _ := err.(*render.ParameterError)
+	if encode.Accepts(strings.Join(r.Header["Accept"], ","), problemMediaType) {
+		problem := &apiProblem{
+			Type:     problemTypeBase + strings.Replace(code, "_", "-", -1),
+			Title:    http.StatusText(status),
+			Status:   status,
+			Detail:   err.Error(),
+			Instance: r.URL.RequestURI(),
+			Code:     code,
+		}
+		if parameterError != nil {
+			problem.Title = "Invalid parameter"
+			problem.InvalidParams = []apiInvalidParam{{Name: parameterError.Parameter, Reason: parameterError.Reason, Value: parameterError.Value}}
+		}
+		w.Header().Set("Content-Type", problemMediaType)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(problem)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if call := apiCallOf(r); call.version == 2 {
+		detail := &apiErrorDetail{Status: status, Code: code, Message: err.Error()}
+		if parameterError != nil {
+			detail.Parameter, detail.Value = parameterError.Parameter, parameterError.Value
+		}
+		json.NewEncoder(w).Encode(apiDocument{Error: detail, Meta: newAPIMeta(call, r.URL.Query(), nil)})
+		return
+	}
+	apiResponse := apiResponse{true, err.Error()}
+	json.NewEncoder(w).Encode(apiResponse)
+}
+
+// apiErrorCode returns the stable code of an error: invalid_parameter for a *render.ParameterError, else the status text in snake case
+func apiErrorCode(status int, err error) string {
+	if _, ok := err.(*render.ParameterError); ok {
+		return "invalid_parameter"
+	}
+	return strings.ToLower(strings.Replace(http.StatusText(status), " ", "_", -1))
+}
+
+// cacheControl returns the Cache-Control directives of a response that may be cached for maxAge,
+// by the clients only when they are authenticated (so that shared caches do not bypass authentication nor usage metering)
+func (d *dependencies) cacheControl(maxAge time.Duration) string {
+	scope := "public"
+	if d.authenticator != nil {
+		scope = "private"
+	}
+	return fmt.Sprintf("%s, max-age=%d", scope, int64(maxAge/time.Second))
+}
+
+// cacheResponseWriter represents a ResponseWriter that sets the Cache-Control header of a successful response, errors are not cached
+type cacheResponseWriter struct {
+	http.ResponseWriter
+	cacheControl string
+	wroteHeader  bool
+}
+
+// WriteHeader sets the Cache-Control header if the status code is 200 OK, and writes it
+func (w *cacheResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader && status == http.StatusOK {
+		w.Header().Set("Cache-Control", w.cacheControl)
+	}
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write writes the status code 200 OK first if none was written, as the ResponseWriter does
+func (w *cacheResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// cacheMiddleware lets the successful responses of an endpoint be cached with the given Cache-Control directives
+func cacheMiddleware(cacheControl string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		next(&cacheResponseWriter{ResponseWriter: w, cacheControl: cacheControl}, r)
+	}
+}
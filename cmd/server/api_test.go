@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jpraynaud/fizzbuzz-server/pkg/auth"
+	"github.com/jpraynaud/fizzbuzz-server/pkg/render"
+	log "github.com/sirupsen/logrus"
+)
+
+func Test_apiVersions(t *testing.T) {
+	// Prepare test server
+	renderer := render.NewRenderer()
+	server := httptest.NewServer(createRouter(&dependencies{renderer: renderer}))
+	defer server.Close()
+	// Prepare tests data
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		codeWanted int
+		bodyWanted string
+		successor  string
+	}{
+		{"Unversioned", "GET", "/render?limit=5&int1=2&int2=3&str1=A&str2=B", "", http.StatusOK, `{"error":false,"response":"1,A,B,A,5"}`, "</v2/render>"},
+		{"V1", "GET", "/v1/render?limit=5&int1=2&int2=3&str1=A&str2=B", "", http.StatusOK, `{"error":false,"response":"1,A,B,A,5"}`, "</v2/render>"},
+		{"V1 error", "GET", "/v1/statistics?top=0", "", http.StatusBadRequest, `{"error":true,"response":"top parameter must be an integer between 1 and 1000, value 0 was given"}`, "</v2/statistics>"},
+		{"V2", "GET", "/v2/render?limit=5&int1=2&int2=3&str1=A,&str2=B", "", http.StatusOK, `{"data":["1","A,","B","A,","5"],"meta":{"count":5,"parameters":{"int1":2,"int2":3,"limit":5,"str1":"A,","str2":"B"}}}`, ""},
+		{"V2 body", "POST", "/v2/render", `{"limit":3,"int1":2,"int2":3}`, http.StatusOK, `{"data":["1","",""],"meta":{"count":3,"parameters":{"int1":2,"int2":3,"limit":3,"str1":"","str2":""}}}`, ""},
+		{"V2 stream", "GET", "/v2/render?limit=3&int1=2&int2=3&stream=true", "", http.StatusOK, `{"data":["1","",""],"meta":{"count":3,"parameters":{"int1":2,"int2":3,"limit":3,"str1":"","str2":""}}}`, ""},
+		{"V2 format", "GET", "/v2/render?limit=3&int1=2&int2=3&format=array", "", http.StatusOK, `["1","",""]`, ""},
+		{"V2 invalid parameter", "GET", "/v2/render?limit=0&int1=2&int2=3", "", http.StatusBadRequest, `{"error":{"code":"invalid_parameter","message":"limit parameter must be \u003e= 1, value 0 was given","parameter":"limit","status":400,"value":"0"},"meta":{"parameters":{"int1":["2"],"int2":["3"],"limit":["0"]}}}`, ""},
+		{"V2 invalid body", "POST", "/v2/render", `{`, http.StatusBadRequest, `{"error":{"code":"bad_request","message":"body must be a JSON render request: unexpected EOF","status":400},"meta":{"parameters":{}}}`, ""},
+		{"V2 statistics", "GET", "/v2/statistics/request?limit=5&int1=2&int2=3&str1=A&str2=B", "", http.StatusOK, `{"data":{"outcomes":{"success":{"total":2}},"request":{"int1":2,"int2":3,"limit":5,"str1":"A","str2":"B"},"total":2},"meta":{"parameters":{"int1":["2"],"int2":["3"],"limit":["5"],"str1":["A"],"str2":["B"]}}}`, ""},
+		{"V2 not found", "GET", "/v2/statistics/request?limit=6&int1=2&int2=3", "", http.StatusNotFound, `{"error":{"code":"not_found","message":"no rendering of the request was recorded","status":404},"meta":{"parameters":{"int1":["2"],"int2":["3"],"limit":["6"]}}}`, ""},
+	}
+	// Run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := http.NewRequest(tt.method, server.URL+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+			body, err := ioutil.ReadAll(response.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.StatusCode != tt.codeWanted {
+				t.Errorf("server returned status code %v, want %v", response.StatusCode, tt.codeWanted)
+			}
+			if got, want := normalizeBody(t, body), normalizeBody(t, []byte(tt.bodyWanted)); got != want {
+				t.Errorf("server returned body %s, want %s", got, want)
+			}
+			// Check that the version 1 is deprecated in favor of the version 2
+			deprecation, sunset, link := response.Header.Get("Deprecation"), response.Header.Get("Sunset"), response.Header.Get("Link")
+			if tt.successor == "" && (deprecation != "" || sunset != "" || link != "") {
+				t.Errorf("server returned deprecation headers %s, %s and %s, want none", deprecation, sunset, link)
+			}
+			if tt.successor != "" && (deprecation != fmt.Sprintf("@%d", apiV1Deprecation.Unix()) || sunset != "Sat, 01 May 2027 00:00:00 GMT" || link != tt.successor+`; rel="successor-version"`) {
+				t.Errorf("server returned deprecation headers %s, %s and %s, want the deprecation of the version 1", deprecation, sunset, link)
+			}
+		})
+	}
+}
+
+func Test_apiProblem(t *testing.T) {
+	// Prepare test server
+	server := httptest.NewServer(createRouter(&dependencies{renderer: render.NewRenderer()}))
+	defer server.Close()
+	// Prepare tests data
+	tests := []struct {
+		name        string
+		path        string
+		accept      string
+		codeWanted  int
+		contentType string
+		bodyWanted  string
+	}{
+		{"Invalid parameter", "/render?limit=0&int1=3&int2=5", "application/json, application/problem+json", http.StatusBadRequest, "application/problem+json", `{"type":"https://github.com/jpraynaud/fizzbuzz-server/problems/invalid-parameter","title":"Invalid parameter","status":400,"detail":"limit parameter must be \u003e= 1, value 0 was given","instance":"/render?limit=0\u0026int1=3\u0026int2=5","code":"invalid_parameter","invalid-params":[{"name":"limit","reason":"must be \u003e= 1","value":"0"}]}`},
+		{"Invalid parameter V2", "/v2/statistics?top=x", "application/problem+json", http.StatusBadRequest, "application/problem+json", `{"type":"https://github.com/jpraynaud/fizzbuzz-server/problems/invalid-parameter","title":"Invalid parameter","status":400,"detail":"top parameter must be an integer between 1 and 1000, value x was given","instance":"/v2/statistics?top=x","code":"invalid_parameter","invalid-params":[{"name":"top","reason":"must be an integer between 1 and 1000","value":"x"}]}`},
+		{"Not found", "/v2/statistics/request?limit=6&int1=2&int2=3", "application/problem+json", http.StatusNotFound, "application/problem+json", `{"type":"https://github.com/jpraynaud/fizzbuzz-server/problems/not-found","title":"Not Found","status":404,"detail":"no rendering of the request was recorded","instance":"/v2/statistics/request?limit=6\u0026int1=2\u0026int2=3","code":"not_found"}`},
+		{"Not acceptable", "/render?limit=20&int1=3&int2=5", "application/problem+json", http.StatusNotAcceptable, "application/problem+json", `{"type":"https://github.com/jpraynaud/fizzbuzz-server/problems/not-acceptable","title":"Not Acceptable","status":406,"detail":"Accept header must accept a format among json, array, text, csv, ndjson, xml, cbor, msgpack, value application/problem+json was given","instance":"/render?limit=20\u0026int1=3\u0026int2=5","code":"not_acceptable"}`},
+		{"Invalid parameter not acceptable", "/v2/render?limit=0&int1=3&int2=5", "application/problem+json", http.StatusBadRequest, "application/problem+json", `{"type":"https://github.com/jpraynaud/fizzbuzz-server/problems/invalid-parameter","title":"Invalid parameter","status":400,"detail":"limit parameter must be \u003e= 1, value 0 was given","instance":"/v2/render?limit=0\u0026int1=3\u0026int2=5","code":"invalid_parameter","invalid-params":[{"name":"limit","reason":"must be \u003e= 1","value":"0"}]}`},
+		{"Wildcard", "/render?limit=0&int1=3&int2=5", "*/*", http.StatusBadRequest, "application/json", `{"error":true,"response":"limit parameter must be \u003e= 1, value 0 was given"}`},
+		{"Refused", "/v2/render?limit=0&int1=3&int2=5", "application/problem+json;q=0, application/json", http.StatusBadRequest, "application/json", `{"error":{"code":"invalid_parameter","message":"limit parameter must be \u003e= 1, value 0 was given","parameter":"limit","status":400,"value":"0"},"meta":{"parameters":{"int1":["3"],"int2":["5"],"limit":["0"]}}}`},
+	}
+	// Run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := http.NewRequest("GET", server.URL+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.Header.Set("Accept", tt.accept)
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+			body, err := ioutil.ReadAll(response.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.StatusCode != tt.codeWanted {
+				t.Errorf("server returned status code %v, want %v", response.StatusCode, tt.codeWanted)
+			}
+			if got := response.Header.Get("Content-Type"); got != tt.contentType {
+				t.Errorf("server returned Content-Type %s, want %s", got, tt.contentType)
+			}
+			if got, want := normalizeBody(t, body), normalizeBody(t, []byte(tt.bodyWanted)); got != want {
+				t.Errorf("server returned body %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func Test_loggingMiddleware(t *testing.T) {
+	// Capture logs
+	buffer := &bytes.Buffer{}
+	log.SetOutput(buffer)
+	log.SetFormatter(&log.JSONFormatter{})
+	defer func() {
+		log.SetOutput(os.Stdout)
+		log.SetFormatter(&log.TextFormatter{})
+	}()
+	// Prepare a router without authentication and an admin token, and a router authenticating a reader API key
+	adminToken = "secret"
+	defer func() {
+		adminToken = ""
+	}()
+	anonymous := createRouter(&dependencies{renderer: render.NewRenderer()})
+	authenticator := auth.NewAuthenticator()
+	authenticator.AddAPIKey("reader-key", &auth.Identity{Subject: "reader", Roles: []auth.Role{auth.RoleReader}, Method: auth.MethodAPIKey})
+	authenticated := createRouter(&dependencies{renderer: render.NewRenderer(), authenticator: authenticator})
+	// Prepare tests data
+	tests := []struct {
+		name         string
+		router       http.Handler
+		method       string
+		path         string
+		credential   string
+		clientWanted string
+		statusWanted int
+	}{
+		{"Anonymous", anonymous, "GET", "/render?limit=5&int1=2&int2=3", "", "", http.StatusOK},
+		{"Admin token", anonymous, "POST", "/statistics/reset", "secret", "admin", http.StatusOK},
+		{"Unauthenticated", authenticated, "GET", "/v2/statistics", "", "", http.StatusUnauthorized},
+		{"Authenticated", authenticated, "GET", "/v2/statistics", "reader-key", "reader", http.StatusOK},
+		{"Streamed", authenticated, "GET", "/statistics/stream?threshold=1", "reader-key", "reader", http.StatusOK},
+	}
+	// Run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buffer.Reset()
+			ctx, cancel := context.WithCancel(context.Background())
+			request, err := http.NewRequest(tt.method, tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.RequestURI = tt.path
+			if tt.credential != "" {
+				request.Header.Set("Authorization", "Bearer "+tt.credential)
+			}
+			// Streams end once the client is gone
+			if strings.Contains(tt.path, "stream") {
+				cancel()
+			}
+			tt.router.ServeHTTP(httptest.NewRecorder(), request.WithContext(ctx))
+			cancel()
+			// Check that the request is logged once served, with its client and its status code
+			var entry map[string]interface{}
+			decoder := json.NewDecoder(buffer)
+			for decoder.More() {
+				logged := make(map[string]interface{})
+				if err := decoder.Decode(&logged); err != nil {
+					t.Fatal(err)
+				}
+				if logged["msg"] == tt.method+" - "+tt.path {
+					entry = logged
+				}
+			}
+			if entry == nil || entry["level"] != "info" || entry["client"] != tt.clientWanted || entry["status"] != float64(tt.statusWanted) {
+				t.Errorf("access log entry = %v, want client %q and status code %d", entry, tt.clientWanted, tt.statusWanted)
+			}
+		})
+	}
+}
+
+func Test_createRouter(t *testing.T) {
+	// Prepare tests data
+	type args struct {
+		method     string
+		path       string
+		codeWanted int
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{"Render", args{"GET", "/render", http.StatusBadRequest}},
+		{"Render Body", args{"POST", "/render", http.StatusBadRequest}},
+		{"Render V1", args{"GET", "/v1/render", http.StatusBadRequest}},
+		{"Render V2", args{"POST", "/v2/render", http.StatusBadRequest}},
+		{"Statistics V2", args{"GET", "/v2/statistics", http.StatusOK}},
+		{"Not Found V2", args{"GET", "/v2/test123", http.StatusNotFound}},
+		{"Statistics", args{"GET", "/statistics", http.StatusOK}},
+		{"Statistics Time Series", args{"GET", "/statistics/timeseries", http.StatusBadRequest}},
+		{"Statistics Aggregate", args{"GET", "/statistics/aggregate?group_by=int1", http.StatusOK}},
+		{"Statistics Requests", args{"GET", "/statistics/requests", http.StatusOK}},
+		{"Statistics Export", args{"GET", "/statistics/export", http.StatusOK}},
+		{"Statistics Import", args{"POST", "/statistics/import", http.StatusForbidden}},
+		{"Statistics Reset", args{"POST", "/statistics/reset", http.StatusForbidden}},
+		{"Statistics Delete", args{"DELETE", "/statistics/request?limit=20&int1=3&int2=5", http.StatusForbidden}},
+		{"Statistics Adjust", args{"PATCH", "/statistics/request?limit=20&int1=3&int2=5&delta=1", http.StatusForbidden}},
+		{"Statistics Request", args{"GET", "/statistics/request?limit=20&int1=3&int2=5", http.StatusNotFound}},
+		{"Statistics Federation", args{"GET", "/statistics/federation", http.StatusNotImplemented}},
+		{"Not Found", args{"GET", "/test123", http.StatusNotFound}},
+	}
+	// Prepare test server
+	router := createRouter(&dependencies{renderer: render.NewRenderer()})
+	server := httptest.NewServer(router)
+	defer server.Close()
+	// Run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Create request
+			request, err := http.NewRequest(tt.args.method, fmt.Sprintf("%s%s", server.URL, tt.args.path), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Checks that server responds correctly
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+			if response.StatusCode != tt.args.codeWanted {
+				t.Errorf("server returned status code %v, want %v", response.StatusCode, tt.args.codeWanted)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jpraynaud/fizzbuzz-server/pkg/auth"
+	log "github.com/sirupsen/logrus"
+)
+
+// authSetup creates the authenticator of the clients from the API keys file and the keys of the JSON Web Tokens, nil if none is set
+// The admin token then authenticates the administrator as a client with the admin role
+func authSetup() (*auth.Authenticator, error) {
+	if apiKeysFile == "" && jwtSecretFile == "" && jwtPublicKeyFile == "" {
+		return nil, nil
+	}
+	authenticator := auth.NewAuthenticator()
+	authenticator.SetAdminToken(adminToken)
+	if apiKeysFile != "" {
+		file, err := os.Open(apiKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		if err := authenticator.LoadAPIKeys(file); err != nil {
+			return nil, err
+		}
+	}
+	if jwtSecretFile != "" {
+		secret, err := ioutil.ReadFile(jwtSecretFile)
+		if err != nil {
+			return nil, err
+		}
+		if secret = []byte(strings.TrimSpace(string(secret))); len(secret) == 0 {
+			return nil, fmt.Errorf("jwtsecret file %s is empty", jwtSecretFile)
+		}
+		authenticator.SetHMACKey(secret)
+	}
+	if jwtPublicKeyFile != "" {
+		encoded, err := ioutil.ReadFile(jwtPublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := authenticator.SetRSAKey(encoded); err != nil {
+			return nil, err
+		}
+	}
+	log.WithFields(log.Fields{
+		"apikeys":     apiKeysFile,
+		"jwt_hs256":   jwtSecretFile != "",
+		"jwt_rs256":   jwtPublicKeyFile != "",
+		"admin_token": adminToken != "",
+	}).Info("Authentication enabled")
+	return authenticator, nil
+}
+
+// authMiddleware authenticates the client of the requests and authorizes it for the operation of their route (under a prefix)
+func authMiddleware(authenticator *auth.Authenticator, prefix string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r, ok := authorize(w, r, authenticator, apiOperationOf(r, prefix)); ok {
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+// federationAuthMiddleware requires the peers pulling the federation state, that holds the counts of every request, to have the reader role
+func federationAuthMiddleware(authenticator *auth.Authenticator, next http.HandlerFunc) http.HandlerFunc {
+	operation := &apiOperation{role: auth.RoleReader}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r, ok := authorize(w, r, authenticator, operation); ok {
+			next(w, r)
+		}
+	}
+}
+
+// authorize authenticates the client of a request and attaches its identity to its context, then authorizes it if the operation
+// of the request (nil if not described) requires a role or an authenticated client: anonymous clients are rejected with a 401 error,
+// and clients without the role with a 403 error. It returns the request with the identity, and whether the client is authorized
+func authorize(w http.ResponseWriter, r *http.Request, authenticator *auth.Authenticator, operation *apiOperation) (*http.Request, bool) {
+	identity, err := authenticator.Authenticate(r, time.Now())
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		apiFailure(w, r, http.StatusUnauthorized, err)
+		return r, false
+	}
+	if identity != nil {
+		log.WithFields(log.Fields{"client": identity.Subject, "auth_method": identity.Method, "roles": identity.Roles}).Debugf("%s - %s - authenticated", r.Method, r.RequestURI)
+		r = r.WithContext(auth.NewContext(r.Context(), identity))
+		logClient(r, identity.Subject)
+	}
+	switch {
+	case operation == nil || (operation.role == "" && !operation.authenticated):
+	case identity == nil:
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		apiFailure(w, r, http.StatusUnauthorized, auth.ErrNoCredentials)
+		return r, false
+	case operation.role != "" && !identity.HasRole(operation.role):
+		apiError(w, r, http.StatusForbidden, fmt.Sprintf("client %s must have the %s role", identity.Subject, operation.role))
+		return r, false
+	}
+	return r, true
+}
+
+// apiOperationOf returns the operation of the route of a request served under a prefix, nil if it is not described
+func apiOperationOf(r *http.Request, prefix string) *apiOperation {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return nil
+	}
+	path, _ := route.GetPathTemplate()
+	return apiOperations[r.Method+" "+strings.TrimPrefix(path, prefix)]
+}
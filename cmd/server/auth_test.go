@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jpraynaud/fizzbuzz-server/pkg/auth"
+	"github.com/jpraynaud/fizzbuzz-server/pkg/render"
+)
+
+func Test_federationAuthentication(t *testing.T) {
+	// Prepare an authenticated federated server
+	authenticator := auth.NewAuthenticator()
+	authenticator.AddAPIKey("peer-key", &auth.Identity{Subject: "peer", Roles: []auth.Role{auth.RoleReader}, Method: auth.MethodAPIKey})
+	authenticator.AddAPIKey("renderer-key", &auth.Identity{Subject: "renderer", Roles: []auth.Role{auth.RoleRenderer}, Method: auth.MethodAPIKey})
+	renderer := render.NewRendererWithStatistics(render.NewFederatedStatistics("a", render.NewStatistics()))
+	server := httptest.NewServer(createRouter(&dependencies{renderer: renderer, authenticator: authenticator}))
+	defer server.Close()
+	// Prepare tests data
+	tests := []struct {
+		name               string
+		credential         string
+		codeWanted         int
+		authenticateWanted string
+	}{
+		{"Anonymous", "", http.StatusUnauthorized, "Bearer"},
+		{"Invalid credential", "guess", http.StatusUnauthorized, `Bearer error="invalid_token"`},
+		{"Without the reader role", "renderer-key", http.StatusForbidden, ""},
+		{"Peer", "peer-key", http.StatusOK, ""},
+	}
+	// Run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := http.NewRequest("GET", server.URL+render.FederationPath, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.credential != "" {
+				request.Header.Set("Authorization", "Bearer "+tt.credential)
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+			if response.StatusCode != tt.codeWanted {
+				t.Errorf("server returned status code %v, want %v", response.StatusCode, tt.codeWanted)
+			}
+			if got := response.Header.Get("WWW-Authenticate"); got != tt.authenticateWanted {
+				t.Errorf("server returned WWW-Authenticate %s, want %s", got, tt.authenticateWanted)
+			}
+			// Check that a node pulls the federation state with its credential
+			node := render.NewFederatedStatistics("b", render.NewStatistics())
+			node.SetCredential(tt.credential)
+			if err := node.Pull(context.Background(), server.Client(), server.URL); (err != nil) != (tt.codeWanted != http.StatusOK) {
+				t.Errorf("Pull() error = %v, want an error %v", err, tt.codeWanted != http.StatusOK)
+			}
+		})
+	}
+}
+
+func Test_authSetup(t *testing.T) {
+	// Prepare the credentials files
+	directory, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	files := map[string]string{
+		"apikeys":         "key partner reader\n",
+		"invalid-apikeys": "key partner\n",
+		"secret":          "secret\n",
+		"empty-secret":    "\n",
+		"invalid-key":     "not a key",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(directory+"/"+name, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name      string
+		apiKeys   string
+		secret    string
+		publicKey string
+		wantNil   bool
+		wantErr   bool
+	}{
+		{"Disabled", "", "", "", true, false},
+		{"API keys", "apikeys", "", "", false, false},
+		{"HS256", "", "secret", "", false, false},
+		{"Missing file", "missing", "", "", true, true},
+		{"Invalid API keys", "invalid-apikeys", "", "", true, true},
+		{"Empty secret", "", "empty-secret", "", true, true},
+		{"Invalid public key", "", "", "invalid-key", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := func(name string) string {
+				if name == "" {
+					return ""
+				}
+				return directory + "/" + name
+			}
+			apiKeysFile, jwtSecretFile, jwtPublicKeyFile = path(tt.apiKeys), path(tt.secret), path(tt.publicKey)
+			defer func() {
+				apiKeysFile, jwtSecretFile, jwtPublicKeyFile = "", "", ""
+			}()
+			authenticator, err := authSetup()
+			if (err != nil) != tt.wantErr || (authenticator == nil) != tt.wantNil {
+				t.Fatalf("authSetup() = %+v, %v, want nil %v and error %v", authenticator, err, tt.wantNil, tt.wantErr)
+			}
+			if tt.apiKeys == "apikeys" {
+				request := httptest.NewRequest("GET", "/render", nil)
+				request.Header.Set("X-API-Key", "key")
+				if identity, err := authenticator.Authenticate(request, time.Now()); err != nil || identity == nil || identity.Subject != "partner" {
+					t.Errorf("authSetup() authenticator identifies the API key as %+v, %v, want the partner client", identity, err)
+				}
+			}
+		})
+	}
+}
+
+func Test_authMiddleware(t *testing.T) {
+	// Prepare test server, with a reader and a renderer API keys, JSON Web Tokens signed with a secret and the admin token
+	adminToken = "secret"
+	authenticator := auth.NewAuthenticator()
+	authenticator.AddAPIKey("reader-key", &auth.Identity{Subject: "reader", Roles: []auth.Role{auth.RoleReader}, Method: auth.MethodAPIKey})
+	authenticator.AddAPIKey("renderer-key", &auth.Identity{Subject: "renderer", Roles: []auth.Role{auth.RoleRenderer}, Method: auth.MethodAPIKey})
+	authenticator.SetHMACKey([]byte("jwt-secret"))
+	authenticator.SetAdminToken(adminToken)
+	defer func() {
+		adminToken = ""
+	}()
+	deps := &dependencies{renderer: render.NewRenderer(), authenticator: authenticator}
+	server := httptest.NewServer(createRouter(deps))
+	defer server.Close()
+	// A JSON Web Token of a renderer, signed with HS256
+	encode := func(value string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(value))
+	}
+	signed := encode(`{"alg":"HS256","typ":"JWT"}`) + "." + encode(fmt.Sprintf(`{"sub":"service","exp":%d,"roles":["renderer"]}`, time.Now().Add(time.Hour).Unix()))
+	mac := hmac.New(sha256.New, []byte("jwt-secret"))
+	mac.Write([]byte(signed))
+	token := signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	// Prepare tests data
+	tests := []struct {
+		name          string
+		method        string
+		path          string
+		apiKey        string
+		authorization string
+		codeWanted    int
+		messageWanted string
+	}{
+		{"Anonymous", "GET", "/render?limit=1&int1=3&int2=5", "", "", http.StatusUnauthorized, "an API key (X-API-Key header) or a bearer token must be given"},
+		{"Invalid API key", "GET", "/v2/statistics", "guess", "", http.StatusUnauthorized, "API key is invalid"},
+		{"Reader", "GET", "/v2/statistics/requests", "reader-key", "", http.StatusOK, ""},
+		{"Reader renders", "GET", "/v2/render?limit=1&int1=3&int2=5", "reader-key", "", http.StatusForbidden, "client reader must have the renderer role"},
+		{"Renderer", "POST", "/v1/render", "renderer-key", "", http.StatusOK, ""},
+		{"JSON Web Token", "GET", "/render?limit=1&int1=3&int2=5", "", "Bearer " + token, http.StatusOK, ""},
+		{"Forged JSON Web Token", "GET", "/render?limit=1&int1=3&int2=5", "", "Bearer " + token[:len(token)-2] + "xx", http.StatusUnauthorized, "bearer token signature is invalid"},
+		{"Renderer administrates", "POST", "/statistics/reset", "renderer-key", "", http.StatusForbidden, "client renderer must have the admin role"},
+		{"Admin token", "POST", "/v2/statistics/reset", "", "Bearer secret", http.StatusOK, ""},
+		{"Admin token reads", "GET", "/statistics", "", "Bearer secret", http.StatusOK, ""},
+		{"OpenAPI document", "GET", "/openapi.json", "", "", http.StatusOK, ""},
+	}
+	// Run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := http.NewRequest(tt.method, server.URL+tt.path, strings.NewReader(`{"limit":1,"int1":3,"int2":5}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.apiKey != "" {
+				request.Header.Set("X-API-Key", tt.apiKey)
+			}
+			if tt.authorization != "" {
+				request.Header.Set("Authorization", tt.authorization)
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+			if response.StatusCode != tt.codeWanted {
+				t.Errorf("server returned status code %v, want %v", response.StatusCode, tt.codeWanted)
+			}
+			if authenticate := response.Header.Get("WWW-Authenticate"); (authenticate != "") != (tt.codeWanted == http.StatusUnauthorized) {
+				t.Errorf("server returned WWW-Authenticate %s with status code %v", authenticate, response.StatusCode)
+			}
+			if tt.messageWanted == "" {
+				return
+			}
+			body := make(map[string]interface{})
+			if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			message := body["response"]
+			if detail, ok := body["error"].(map[string]interface{}); ok {
+				message = detail["message"]
+			}
+			if message != tt.messageWanted {
+				t.Errorf("server returned message %s, want %s", message, tt.messageWanted)
+			}
+		})
+	}
+	// The OpenAPI document describes the security of the operations
+	document := newOpenAPIDocument(createRouter(deps), true)
+	if operation := document.Operation("/v2/render", "GET"); len(operation.Security) != 2 || !strings.HasSuffix(operation.Summary, "(renderer role)") {
+		t.Errorf("render operation = %+v, want the bearer and apiKey security and the renderer role", operation)
+	}
+	if operation := document.Operation("/statistics/reset", "POST"); len(operation.Security) != 3 {
+		t.Errorf("reset operation security = %+v, want the bearer, apiKey and admin security", operation.Security)
+	}
+}
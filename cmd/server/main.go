@@ -1,22 +1,53 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/gorilla/mux"
 	"github.com/jpraynaud/fizzbuzz-server/pkg/render"
+	"github.com/jpraynaud/fizzbuzz-server/pkg/resp"
 	log "github.com/sirupsen/logrus"
 )
 
 var (
-	environment, addr, tlsCertFile, tlsKeyFile string
+	environment, addr, tlsCertFile, tlsKeyFile, dataDirectory, statisticsBackend, redisAddr, adminToken, node, peers, peerCredential, retentionAge, retentionMax, retentionHalfLife, validateRequests, rateLimit, itemRateLimit, rateLimitKey, apiKeysFile, jwtSecretFile, jwtPublicKeyFile, quotas string
+	// streamsClosing is closed when the server shuts down, so that statistics streams end
+	streamsClosing = make(chan struct{})
+)
+
+const (
+	// statisticsSnapshotInterval is the interval between snapshots of the persisted statistics
+	statisticsSnapshotInterval = 5 * time.Minute
+	// retentionInterval is the interval between applications of the statistics retention policy
+	retentionInterval = time.Minute
+	// federationInterval is the interval between pulls of the statistics of the peers
+	federationInterval = 5 * time.Second
+	// federationTimeout is the timeout of a pull of the statistics of a peer
+	federationTimeout = 2 * time.Second
+	// shutdownTimeout is the maximum duration of the graceful shutdown of the server
+	shutdownTimeout = 30 * time.Second
+	// redisTimeout is the timeout of the commands sent to the Redis server of the redis statistics backend
+	redisTimeout = time.Second
+	// redisPoolSize is the maximum number of idle connections to the Redis server of the redis statistics backend
+	redisPoolSize = 64
+	// redisKeyPrefix is the prefix of the keys of the redis statistics backend
+	redisKeyPrefix = "fizzbuzz:"
+	// approximateEpsilon is the relative error bound of the totals of the approximate statistics backend
+	approximateEpsilon = 0.0001
+	// approximateDelta is the probability that a total of the approximate statistics backend exceeds its error bound
+	approximateDelta = 0.001
+	// approximateCapacity is the number of top requests tracked by the approximate statistics backend
+	approximateCapacity = 1000
 )
 
 func main() {
@@ -25,13 +56,62 @@ func main() {
 	flag.StringVar(&environment, "environment", os.Getenv("SERVER_ENV"), "server environment (development or production). Equivalent to environment variable SERVER_ENV")
 	flag.StringVar(&tlsCertFile, "tlscert", os.Getenv("SERVER_TLSCERTFILE"), "server TLS certificate file. Equivalent to environment variable SERVER_TLSCERTFILE")
 	flag.StringVar(&tlsKeyFile, "tlskey", os.Getenv("SERVER_TLSKEYFILE"), "server TLS key file. Equivalent to environment variable SERVER_TLSKEYFILE")
+	flag.StringVar(&dataDirectory, "datadir", os.Getenv("SERVER_DATADIR"), "server data directory where statistics are persisted by the file statistics backend. Equivalent to environment variable SERVER_DATADIR")
+	flag.StringVar(&statisticsBackend, "statistics", os.Getenv("SERVER_STATISTICS"), "server statistics backend (memory, approximate, file or redis), defaults to file if a data directory is set, else to memory. Equivalent to environment variable SERVER_STATISTICS")
+	flag.StringVar(&redisAddr, "redisaddr", os.Getenv("SERVER_REDISADDR"), "Redis server address used by the redis statistics backend. Equivalent to environment variable SERVER_REDISADDR")
+	flag.StringVar(&adminToken, "admintoken", os.Getenv("SERVER_ADMINTOKEN"), "server admin token, that authenticates the administration endpoints (disabled if empty). Equivalent to environment variable SERVER_ADMINTOKEN")
+	flag.StringVar(&node, "node", os.Getenv("SERVER_NODE"), "server node name in a statistics federation, defaults to the host name. Equivalent to environment variable SERVER_NODE")
+	flag.StringVar(&peers, "peers", os.Getenv("SERVER_PEERS"), "comma separated base URLs of the peers whose statistics are federated (disabled if empty). Equivalent to environment variable SERVER_PEERS")
+	flag.StringVar(&peerCredential, "peercredential", os.Getenv("SERVER_PEERCREDENTIAL"), "credential (API key or bearer token with the reader role) sent to the peers that authenticate their clients in a statistics federation. Equivalent to environment variable SERVER_PEERCREDENTIAL")
+	flag.StringVar(&retentionAge, "retentionage", os.Getenv("SERVER_RETENTIONAGE"), "statistics retention: requests not seen for this duration (e.g. 30d or 12h) are evicted (disabled if empty). Equivalent to environment variable SERVER_RETENTIONAGE")
+	flag.StringVar(&retentionMax, "retentionmax", os.Getenv("SERVER_RETENTIONMAX"), "statistics retention: maximum number of requests tracked, the least recently seen ones are evicted (disabled if empty). Equivalent to environment variable SERVER_RETENTIONMAX")
+	flag.StringVar(&retentionHalfLife, "retentionhalflife", os.Getenv("SERVER_RETENTIONHALFLIFE"), "statistics retention: totals are halved every half-life (e.g. 7d), requests are evicted once their total is 0 (disabled if empty). Equivalent to environment variable SERVER_RETENTIONHALFLIFE")
+	flag.StringVar(&apiKeysFile, "apikeys", os.Getenv("SERVER_APIKEYS"), "file of the API keys of the clients, one per line with their subject and roles (e.g. 3f9a... partner-a reader,renderer). Equivalent to environment variable SERVER_APIKEYS")
+	flag.StringVar(&jwtSecretFile, "jwtsecret", os.Getenv("SERVER_JWTSECRET"), "file of the secret that verifies the JSON Web Tokens of the clients signed with HS256. Equivalent to environment variable SERVER_JWTSECRET")
+	flag.StringVar(&jwtPublicKeyFile, "jwtpublickey", os.Getenv("SERVER_JWTPUBLICKEY"), "PEM file of the RSA public key that verifies the JSON Web Tokens of the clients signed with RS256. Equivalent to environment variable SERVER_JWTPUBLICKEY")
+	flag.StringVar(&quotas, "quotas", os.Getenv("SERVER_QUOTAS"), "comma separated daily and monthly quotas of each authenticated client (e.g. requests/day=10000,items/month=100000000), unlimited if empty. Equivalent to environment variable SERVER_QUOTAS")
+	flag.StringVar(&rateLimit, "ratelimit", os.Getenv("SERVER_RATELIMIT"), "rate limit of the requests of each client, in requests per second optionally followed by a burst (e.g. 10:20), disabled if empty. Equivalent to environment variable SERVER_RATELIMIT")
+	flag.StringVar(&itemRateLimit, "itemratelimit", os.Getenv("SERVER_ITEMRATELIMIT"), "rate limit of the items rendered for each client, in items per second optionally followed by a burst (e.g. 100000:1000000), disabled if empty. Equivalent to environment variable SERVER_ITEMRATELIMIT")
+	flag.StringVar(&rateLimitKey, "ratelimitkey", os.Getenv("SERVER_RATELIMITKEY"), "key that identifies the clients in the rate limits (ip or apikey, the authenticated client), defaults to ip. Equivalent to environment variable SERVER_RATELIMITKEY")
+	flag.StringVar(&validateRequests, "validate", os.Getenv("SERVER_VALIDATE"), "validate the requests against the OpenAPI document of the server (true or false), false by default. Equivalent to environment variable SERVER_VALIDATE")
 	flag.Parse()
 
 	// Logging setup
 	loggingSetup()
 
+	// Statistics setup
+	ctx, cancel := context.WithCancel(context.Background())
+	statistics, closeStatistics, err := statisticsSetup(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if statistics, err = federationSetup(ctx, statistics); err != nil {
+		log.Fatal(err)
+	}
+	if err := retentionSetup(ctx, statistics); err != nil {
+		log.Fatal(err)
+	}
+
+	// Authentication setup
+	deps := &dependencies{renderer: render.NewRendererWithStatistics(statistics)}
+	if deps.authenticator, err = authSetup(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Usage metering setup
+	meter, closeUsage, err := usageSetup(ctx, deps.authenticator)
+	if err != nil {
+		log.Fatal(err)
+	}
+	deps.usageMeter = meter
+
+	// Rate limiting setup
+	if deps.rateLimits, err = rateLimitSetup(ctx); err != nil {
+		log.Fatal(err)
+	}
+
 	// Start HTTP server
-	router := createRouter()
+	router := createRouter(deps)
 	server := &http.Server{
 		Addr:         addr,
 		WriteTimeout: time.Second * 60,
@@ -39,109 +119,171 @@ func main() {
 		IdleTimeout:  time.Second * 60,
 		Handler:      router,
 	}
-	if tlsCertFile != "" && tlsKeyFile != "" {
-		log.Fatal(server.ListenAndServeTLS(tlsCertFile, tlsKeyFile))
-	} else {
-		log.Fatal(server.ListenAndServe())
-	}
-
-}
-
-// createRouter creates the router of the HTTP server
-func createRouter() *mux.Router {
-	log.WithFields(log.Fields{
-		"environment": environment,
-		"address":     addr,
-		"TLS":         (tlsCertFile != "" && tlsKeyFile != ""),
-	}).Info("Create server")
-	renderer := render.NewRenderer()
-	router := mux.NewRouter()
-	router.HandleFunc("/render", renderHandler(renderer)).Methods(http.MethodGet)
-	router.HandleFunc("/statistics", statisticsHandler(renderer)).Methods(http.MethodGet)
-	router.Use(loggingMiddleware)
-	return router
-}
+	server.RegisterOnShutdown(func() { close(streamsClosing) })
+	serverErrors := make(chan error, 1)
+	go func() {
+		if tlsCertFile != "" && tlsKeyFile != "" {
+			serverErrors <- server.ListenAndServeTLS(tlsCertFile, tlsKeyFile)
+		} else {
+			serverErrors <- server.ListenAndServe()
+		}
+	}()
 
-// loggingSetup sets up logging
-func loggingSetup() log.Level {
-	log.SetOutput(os.Stdout)
-	if environment == "production" {
-		log.SetFormatter(&log.JSONFormatter{})
-		log.SetLevel(log.InfoLevel)
-	} else {
-		log.SetLevel(log.DebugLevel)
+	// Shutdown HTTP server gracefully on signal, then flush statistics
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	exitCode := 0
+	select {
+	case err := <-serverErrors:
+		log.Error(err)
+		exitCode = 1
+	case sig := <-signals:
+		log.Infof("Shutdown server on signal %s", sig)
+		shutdownCtx, shutdownCancel := context.WithTimeout(ctx, shutdownTimeout)
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Error(err)
+		}
+		shutdownCancel()
 	}
-	return log.GetLevel()
-}
-
-// Logging middleware
-func loggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Infof("%s - %s", r.Method, r.RequestURI)
-		next.ServeHTTP(w, r)
-	})
-}
-
-// apiResponse represents a page response
-type apiResponse struct {
-	Error    bool        `json:"error"`
-	Response interface{} `json:"response"`
+	cancel()
+	if err := closeStatistics(); err != nil {
+		log.Error(err)
+		exitCode = 1
+	}
+	if err := closeUsage(); err != nil {
+		log.Error(err)
+		exitCode = 1
+	}
+	os.Exit(exitCode)
 }
 
-// Api error
-func apiError(w http.ResponseWriter, r *http.Request, status int, message string) {
-	log.Errorf("%s - %s - %d - %s", r.Method, r.RequestURI, status, message)
-	w.WriteHeader(status)
-	apiResponse := apiResponse{true, message}
-	json.NewEncoder(w).Encode(apiResponse)
+// statisticsBackendName returns the name of the selected statistics backend, file by default if a data directory is set
+func statisticsBackendName() string {
+	if statisticsBackend == "" && dataDirectory != "" {
+		return "file"
+	}
+	return statisticsBackend
 }
 
-// Handle FizzBuzz render
-func renderHandler(renderer render.Renderer) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// Prepare input parameters
-		vars := r.URL.Query()
-		limit, err := strconv.Atoi(vars.Get("limit"))
-		if err != nil {
-			apiError(w, r, http.StatusBadRequest, fmt.Sprintf("limit parameter must be an integer, value %s was given", vars.Get("limit")))
-			return
+// statisticsSetup creates the statistics recorder of the selected backend, and returns the function that closes it
+func statisticsSetup(ctx context.Context) (render.StatisticRecorder, func() error, error) {
+	backend := statisticsBackendName()
+	switch backend {
+	case "", "memory":
+		return render.NewStatistics(), func() error { return nil }, nil
+	case "approximate":
+		return render.NewApproximateStatistics(approximateEpsilon, approximateDelta, approximateCapacity), func() error { return nil }, nil
+	case "file":
+		if dataDirectory == "" {
+			return nil, nil, errors.New("file statistics backend requires a data directory")
 		}
-		int1, err := strconv.Atoi(vars.Get("int1"))
+		statistics := render.NewStatistics()
+		persister, err := render.OpenPersister(dataDirectory, statistics)
 		if err != nil {
-			apiError(w, r, http.StatusBadRequest, fmt.Sprintf("int1 parameter must be an integer, value %s was given", vars.Get("int1")))
-			return
+			return nil, nil, err
+		}
+		go persister.Run(ctx, statisticsSnapshotInterval)
+		return statistics, persister.Close, nil
+	case "redis":
+		if redisAddr == "" {
+			return nil, nil, errors.New("redis statistics backend requires a Redis server address")
 		}
-		int2, err := strconv.Atoi(vars.Get("int2"))
+		client := resp.NewClient(redisAddr, redisTimeout, redisPoolSize)
+		if _, err := client.Do("PING"); err != nil {
+			return nil, nil, fmt.Errorf("redis statistics backend connection failed: %v", err)
+		}
+		return render.NewRedisStatistics(client, redisKeyPrefix), client.Close, nil
+	}
+	return nil, nil, fmt.Errorf("statistics backend must be memory, approximate, file or redis, value %s was given", backend)
+}
+
+// federationSetup federates statistics with the peers, if any, and starts pulling their statistics periodically
+func federationSetup(ctx context.Context, statistics render.StatisticRecorder) (render.StatisticRecorder, error) {
+	if peers == "" {
+		return statistics, nil
+	}
+	local, ok := statistics.(*render.Statistics)
+	if !ok {
+		return nil, errors.New("statistics federation requires the memory or file statistics backend")
+	}
+	if node == "" {
+		hostname, err := os.Hostname()
 		if err != nil {
-			apiError(w, r, http.StatusBadRequest, fmt.Sprintf("int2 parameter must be an integer, value %s was given", vars.Get("int2")))
-			return
+			return nil, fmt.Errorf("statistics federation requires a node name: %v", err)
 		}
-		str1 := vars.Get("str1")
-		str2 := vars.Get("str2")
-
-		// Render request
-		request := render.NewRequest(limit, int1, int2, str1, str2)
-		response := renderer.Render(r.Context(), request)
-		if err := response.Error; err != nil {
-			apiError(w, r, http.StatusBadRequest, err.Error())
-			return
+		node = hostname
+	}
+	peerURLs := strings.Split(peers, ",")
+	for i, peer := range peerURLs {
+		peerURLs[i] = strings.TrimSpace(peer)
+		if peerURL, err := url.Parse(peerURLs[i]); err != nil || peerURL.Scheme == "" || peerURL.Host == "" {
+			return nil, fmt.Errorf("peers must be comma separated base URLs, value %s was given", peer)
 		}
-		items := make([]string, 0)
-		for item := range response.Items {
-			items = append(items, item)
+	}
+	federated := render.NewFederatedStatistics(node, local)
+	federated.SetCredential(peerCredential)
+	go federated.Run(ctx, &http.Client{Timeout: federationTimeout}, peerURLs, federationInterval)
+	log.WithFields(log.Fields{"node": node, "peers": peerURLs}).Info("Statistics federated")
+	return federated, nil
+}
+
+// parseRetentionDuration parses a duration of the statistics retention policy, in days (e.g. 30d) or as a Go duration (e.g. 12h)
+func parseRetentionDuration(name, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if strings.HasSuffix(value, "d") {
+		if days, err := strconv.Atoi(strings.TrimSuffix(value, "d")); err == nil && days >= 1 {
+			return time.Duration(days) * 24 * time.Hour, nil
 		}
+	} else if duration, err := time.ParseDuration(value); err == nil && duration > 0 {
+		return duration, nil
+	}
+	return 0, fmt.Errorf("%s must be a positive duration such as 30d or 12h, value %s was given", name, value)
+}
 
-		// Write response
-		apiResponse := apiResponse{false, strings.Join(items, ",")}
-		json.NewEncoder(w).Encode(apiResponse)
+// retentionSetup parses the statistics retention policy, and starts applying it periodically if any rule is enabled
+func retentionSetup(ctx context.Context, statistics render.StatisticRecorder) error {
+	policy := &render.RetentionPolicy{}
+	var err error
+	if policy.MaxAge, err = parseRetentionDuration("retentionage", retentionAge); err != nil {
+		return err
+	}
+	if policy.HalfLife, err = parseRetentionDuration("retentionhalflife", retentionHalfLife); err != nil {
+		return err
+	}
+	if retentionMax != "" {
+		if policy.MaxRequests, err = strconv.Atoi(retentionMax); err != nil || policy.MaxRequests < 1 {
+			return fmt.Errorf("retentionmax must be an integer >= 1, value %s was given", retentionMax)
+		}
+	}
+	if !policy.Enabled() {
+		return nil
 	}
+	if _, ok := statistics.(render.FederatedStatisticRecorder); ok {
+		return errors.New("statistics retention is not supported with statistics federation")
+	}
+	retentionRecorder, ok := statistics.(render.RetentionStatisticRecorder)
+	if !ok {
+		return errors.New("statistics retention requires the memory or file statistics backend")
+	}
+	go render.RunRetention(ctx, retentionRecorder, policy, retentionInterval)
+	log.WithFields(log.Fields{
+		"max_age":      policy.MaxAge,
+		"max_requests": policy.MaxRequests,
+		"half_life":    policy.HalfLife,
+	}).Info("Statistics retention enabled")
+	return nil
 }
 
-// Handles rendering statistics
-func statisticsHandler(renderer render.Renderer) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		topStatistic := renderer.GetTopStatistic()
-		apiResponse := apiResponse{false, topStatistic}
-		json.NewEncoder(w).Encode(apiResponse)
+// loggingSetup sets up logging
+func loggingSetup() log.Level {
+	log.SetOutput(os.Stdout)
+	if environment == "production" {
+		log.SetFormatter(&log.JSONFormatter{})
+		log.SetLevel(log.InfoLevel)
+	} else {
+		log.SetLevel(log.DebugLevel)
 	}
+	return log.GetLevel()
 }
@@ -1,20 +1,23 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
-	"net/url"
+	"os"
 	"reflect"
-	"strings"
 	"testing"
 
 	"github.com/jpraynaud/fizzbuzz-server/pkg/render"
+	"github.com/jpraynaud/fizzbuzz-server/pkg/resp/resptest"
 	log "github.com/sirupsen/logrus"
 )
 
 // validateHandler is a helper that validates a handler given a request, a wanted http code and a wanted http body
+// Rendering latencies and seen times are not deterministic, they are ignored (see normalizeBody)
 func validateHandler(t *testing.T, handler http.HandlerFunc, request *http.Request, code int, body apiResponse) {
 	// Create handler recorder
 	recorder := httptest.NewRecorder()
@@ -24,111 +27,164 @@ func validateHandler(t *testing.T, handler http.HandlerFunc, request *http.Reque
 	if recorder.Code != code {
 		t.Errorf("handler returned status code %v, want %v", recorder.Code, code)
 	}
-	got := strings.Trim(recorder.Body.String(), "\n")
+	got := normalizeBody(t, recorder.Body.Bytes())
 	bodyJSON, err := json.Marshal(body)
 	if err != nil {
 		t.Fatal(err)
 	}
-	want := strings.Trim(string(bodyJSON), "\n")
+	want := normalizeBody(t, bodyJSON)
 	if got != want {
 		t.Errorf("handler returned body %q want %q", got, want)
 	}
 }
 
-func Test_renderHandler(t *testing.T) {
-	// Create new renderer
-	renderer := render.NewRenderer()
-	// Prepare tests data
-	type args struct {
-		handler           http.HandlerFunc
-		method            string
-		path              string
-		query             string
-		codeWanted        int
-		apiResponseWanted apiResponse
+// normalizeBody is a helper that re-encodes a JSON body with sorted keys and without its timing fields
+func normalizeBody(t *testing.T, body []byte) string {
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		t.Fatalf("handler returned invalid JSON body %q: %v", body, err)
+	}
+	normalized, err := json.Marshal(removeTimings(value))
+	if err != nil {
+		t.Fatal(err)
 	}
+	return string(normalized)
+}
+
+// removeTimings removes the latency, seen time and timing fields of a decoded JSON value
+func removeTimings(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		delete(value, "latency")
+		delete(value, "first_seen")
+		delete(value, "last_seen")
+		delete(value, "timing")
+		for key, item := range value {
+			value[key] = removeTimings(item)
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = removeTimings(item)
+		}
+	}
+	return value
+}
+
+// succeeded returns the breakdown by outcome of a total of successes
+func succeeded(total int) map[render.Outcome]*render.OutcomeStatistic {
+	return map[render.Outcome]*render.OutcomeStatistic{render.OutcomeSuccess: {Total: total}}
+}
+
+func Test_federationSetup(t *testing.T) {
 	tests := []struct {
-		name string
-		args args
+		name       string
+		statistics render.StatisticRecorder
+		peers      string
+		wantType   string
+		wantErr    bool
 	}{
-		{"Render Bad Request", args{renderHandler(renderer), "GET", "/render", "", http.StatusBadRequest, apiResponse{true, "limit parameter must be an integer, value  was given"}}},
-		{"Render Bad Request", args{renderHandler(renderer), "GET", "/render", "limit=Z&int1=Z&int2=Z&str1=A&str2=B", http.StatusBadRequest, apiResponse{true, "limit parameter must be an integer, value Z was given"}}},
-		{"Render Bad Request", args{renderHandler(renderer), "GET", "/render", "limit=20&int1=Z&int2=Z&str1=A&str2=B", http.StatusBadRequest, apiResponse{true, "int1 parameter must be an integer, value Z was given"}}},
-		{"Render Bad Request", args{renderHandler(renderer), "GET", "/render", "limit=20&int1=3&int2=Z&str1=A&str2=B", http.StatusBadRequest, apiResponse{true, "int2 parameter must be an integer, value Z was given"}}},
-		{"Render Bad Request", args{renderHandler(renderer), "GET", "/render", "limit=0&int1=3&int2=5&str1=A&str2=B", http.StatusBadRequest, apiResponse{true, "limit parameter must be >= 1, value 0 was given"}}},
-		{"Render Bad Request", args{renderHandler(renderer), "GET", "/render", "limit=20&int1=0&int2=5&str1=A&str2=B", http.StatusBadRequest, apiResponse{true, "int1 parameter must be >= 1, value 0 was given"}}},
-		{"Render Bad Request", args{renderHandler(renderer), "GET", "/render", "limit=20&int1=3&int2=0&str1=A&str2=B", http.StatusBadRequest, apiResponse{true, "int2 parameter must be >= 1, value 0 was given"}}},
-		{"Render OK", args{renderHandler(renderer), "GET", "/render", "limit=20&int1=3&int2=5&str1=A&str2=B", http.StatusOK, apiResponse{false, "1,2,A,4,B,A,7,8,A,B,11,A,13,14,AB,16,17,A,19,B"}}},
-		{"Render OK", args{renderHandler(renderer), "GET", "/render", "limit=20&int1=3&int2=5&str1=AA&str2=BBB", http.StatusOK, apiResponse{false, "1,2,AA,4,BBB,AA,7,8,AA,BBB,11,AA,13,14,AABBB,16,17,AA,19,BBB"}}},
-		{"Render OK", args{renderHandler(renderer), "GET", "/render", "limit=30&int1=2&int2=7&str1=AAA&str2=BBB", http.StatusOK, apiResponse{false, "1,AAA,3,AAA,5,AAA,BBB,AAA,9,AAA,11,AAA,13,AAABBB,15,AAA,17,AAA,19,AAA,BBB,AAA,23,AAA,25,AAA,27,AAABBB,29,AAA"}}},
-		{"Render OK", args{renderHandler(renderer), "GET", "/render", "limit=30&int1=3&int2=5&str1=喂&str2=世界", http.StatusOK, apiResponse{false, "1,2,喂,4,世界,喂,7,8,喂,世界,11,喂,13,14,喂世界,16,17,喂,19,世界,喂,22,23,喂,世界,26,喂,28,29,喂世界"}}},
+		{"Not federated", render.NewStatistics(), "", "*render.Statistics", false},
+		{"Federated", render.NewStatistics(), "http://b:8080, http://c:8080", "*render.FederatedStatistics", false},
+		{"Invalid peer", render.NewStatistics(), "http://b:8080,c", "", true},
+		{"Unsupported backend", render.NewRedisStatistics(nil, ""), "http://b:8080", "", true},
 	}
-	// Reset statistics
-	renderer.ResetStatistics()
-	// Run tests
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			// Create request
-			request, err := http.NewRequest(tt.args.method, tt.args.path, nil)
-			if err != nil {
-				t.Fatal(err)
+			node, peers = "a", tt.peers
+			defer func() {
+				node, peers = "", ""
+			}()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			got, err := federationSetup(ctx, tt.statistics)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("federationSetup() error = %v, wantErr %v", err, tt.wantErr)
 			}
-			if tt.args.query != "" {
-				mappedQuery, err := url.ParseQuery(tt.args.query)
-				if err != nil {
-					t.Fatal(err)
-				}
-				request.URL.RawQuery = mappedQuery.Encode()
+			if gotType := fmt.Sprintf("%T", got); err == nil && gotType != tt.wantType {
+				t.Errorf("federationSetup() = %v, want %v", gotType, tt.wantType)
 			}
-			// Validate handler
-			validateHandler(t, tt.args.handler, request, tt.args.codeWanted, tt.args.apiResponseWanted)
 		})
 	}
 }
 
-func Test_statisticsHandler(t *testing.T) {
-	// Create new renderer
-	renderer := render.NewRenderer()
+func Test_retentionSetup(t *testing.T) {
+	tests := []struct {
+		name       string
+		statistics render.StatisticRecorder
+		age        string
+		max        string
+		halfLife   string
+		wantErr    bool
+	}{
+		{"Disabled", render.NewRedisStatistics(nil, ""), "", "", "", false},
+		{"Enabled", render.NewStatistics(), "30d", "1000", "12h", false},
+		{"Invalid age", render.NewStatistics(), "30 days", "", "", true},
+		{"Invalid days", render.NewStatistics(), "0d", "", "", true},
+		{"Invalid max", render.NewStatistics(), "", "0", "", true},
+		{"Invalid half-life", render.NewStatistics(), "", "", "-1h", true},
+		{"Unsupported backend", render.NewRedisStatistics(nil, ""), "30d", "", "", true},
+		{"Federated", render.NewFederatedStatistics("a", render.NewStatistics()), "30d", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			retentionAge, retentionMax, retentionHalfLife = tt.age, tt.max, tt.halfLife
+			defer func() {
+				retentionAge, retentionMax, retentionHalfLife = "", "", ""
+			}()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if err := retentionSetup(ctx, tt.statistics); (err != nil) != tt.wantErr {
+				t.Errorf("retentionSetup() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_statisticsSetup(t *testing.T) {
 	// Prepare tests data
-	type args struct {
-		handler           http.HandlerFunc
-		method            string
-		path              string
-		query             string
-		codeWanted        int
-		apiResponseWanted apiResponse
+	directory, err := ioutil.TempDir("", "statistics")
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer os.RemoveAll(directory)
+	redisServer := resptest.NewServer()
+	defer redisServer.Close()
 	tests := []struct {
-		name string
-		args args
+		name          string
+		backend       string
+		dataDirectory string
+		redisAddr     string
+		wantType      string
+		wantErr       bool
 	}{
-		{"Render OK", args{renderHandler(renderer), "GET", "/render", "limit=20&int1=3&int2=5&str1=A&str2=B", http.StatusOK, apiResponse{false, "1,2,A,4,B,A,7,8,A,B,11,A,13,14,AB,16,17,A,19,B"}}},
-		{"Render OK", args{renderHandler(renderer), "GET", "/render", "limit=20&int1=3&int2=5&str1=AA&str2=BBB", http.StatusOK, apiResponse{false, "1,2,AA,4,BBB,AA,7,8,AA,BBB,11,AA,13,14,AABBB,16,17,AA,19,BBB"}}},
-		{"Render OK", args{renderHandler(renderer), "GET", "/render", "limit=20&int1=3&int2=5&str1=A&str2=B", http.StatusOK, apiResponse{false, "1,2,A,4,B,A,7,8,A,B,11,A,13,14,AB,16,17,A,19,B"}}},
-		{"Statistics OK", args{statisticsHandler(renderer), "GET", "/statistics", "", http.StatusOK, apiResponse{false, render.RequestStatistic{Request: render.Request{Limit: 20, Int1: 3, Int2: 5, Str1: "A", Str2: "B"}, Total: 2}}}},
-		{"Render OK", args{renderHandler(renderer), "GET", "/render", "limit=20&int1=3&int2=5&str1=AA&str2=BBB", http.StatusOK, apiResponse{false, "1,2,AA,4,BBB,AA,7,8,AA,BBB,11,AA,13,14,AABBB,16,17,AA,19,BBB"}}},
-		{"Render OK", args{renderHandler(renderer), "GET", "/render", "limit=20&int1=3&int2=5&str1=AA&str2=BBB", http.StatusOK, apiResponse{false, "1,2,AA,4,BBB,AA,7,8,AA,BBB,11,AA,13,14,AABBB,16,17,AA,19,BBB"}}},
-		{"Statistics OK", args{statisticsHandler(renderer), "GET", "/statistics", "", http.StatusOK, apiResponse{false, render.RequestStatistic{Request: render.Request{Limit: 20, Int1: 3, Int2: 5, Str1: "AA", Str2: "BBB"}, Total: 3}}}},
+		{"Default", "", "", "", "*render.Statistics", false},
+		{"Default with data directory", "", directory, "", "*render.Statistics", false},
+		{"Memory", "memory", "", "", "*render.Statistics", false},
+		{"Approximate", "approximate", "", "", "*render.ApproximateStatistics", false},
+		{"File", "file", directory, "", "*render.Statistics", false},
+		{"File without data directory", "file", "", "", "", true},
+		{"Redis", "redis", "", redisServer.Addr, "*render.RedisStatistics", false},
+		{"Redis without address", "redis", "", "", "", true},
+		{"Unknown", "unknown", "", "", "", true},
 	}
-	// Reset statistics
-	renderer.ResetStatistics()
 	// Run tests
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			// Create request
-			request, err := http.NewRequest(tt.args.method, tt.args.path, nil)
+			statisticsBackend, dataDirectory, redisAddr = tt.backend, tt.dataDirectory, tt.redisAddr
+			defer func() {
+				statisticsBackend, dataDirectory, redisAddr = "", "", ""
+			}()
+			got, closeStatistics, err := statisticsSetup(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("statisticsSetup() error = %v, wantErr %v", err, tt.wantErr)
+			}
 			if err != nil {
-				t.Fatal(err)
+				return
 			}
-			if tt.args.query != "" {
-				mappedQuery, err := url.ParseQuery(tt.args.query)
-				if err != nil {
-					t.Fatal(err)
-				}
-				request.URL.RawQuery = mappedQuery.Encode()
+			defer closeStatistics()
+			if gotType := fmt.Sprintf("%T", got); gotType != tt.wantType {
+				t.Errorf("statisticsSetup() = %v, want %v", gotType, tt.wantType)
 			}
-			// Validate handler
-			validateHandler(t, tt.args.handler, request, tt.args.codeWanted, tt.args.apiResponseWanted)
 		})
 	}
 }
@@ -153,43 +209,3 @@ func Test_loggingSetup(t *testing.T) {
 		})
 	}
 }
-
-func Test_createRouter(t *testing.T) {
-	// Prepare tests data
-	type args struct {
-		method     string
-		path       string
-		codeWanted int
-	}
-	tests := []struct {
-		name string
-		args args
-	}{
-		{"Render", args{"GET", "/render", http.StatusBadRequest}},
-		{"Statistics", args{"GET", "/statistics", http.StatusOK}},
-		{"Not Found", args{"GET", "/test123", http.StatusNotFound}},
-	}
-	// Prepare test server
-	router := createRouter()
-	server := httptest.NewServer(router)
-	defer server.Close()
-	// Run tests
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			// Create request
-			request, err := http.NewRequest(tt.args.method, fmt.Sprintf("%s%s", server.URL, tt.args.path), nil)
-			if err != nil {
-				t.Fatal(err)
-			}
-			// Checks that server responds correctly
-			response, err := http.DefaultClient.Do(request)
-			if err != nil {
-				t.Fatal(err)
-			}
-			defer response.Body.Close()
-			if response.StatusCode != tt.args.codeWanted {
-				t.Errorf("server returned status code %v, want %v", response.StatusCode, tt.args.codeWanted)
-			}
-		})
-	}
-}
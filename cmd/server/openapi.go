@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jpraynaud/fizzbuzz-server/pkg/auth"
+	"github.com/jpraynaud/fizzbuzz-server/pkg/openapi"
+	"github.com/jpraynaud/fizzbuzz-server/pkg/render"
+	"github.com/jpraynaud/fizzbuzz-server/pkg/usage"
+)
+
+// apiOperations describe the operations of the API endpoints in the OpenAPI document, keyed by method and path (without prefix)
+var apiOperations = newAPIOperations()
+
+// apiOperation describes an operation of the API endpoints in the OpenAPI document: its parameters, its body by media type (if any),
+// the data of its JSON response (in the shape of the version of the API) and its other responses by media type
+// The responses of the render endpoints are their items, in each of the renderFormats, and the role of its clients (or an authenticated client) is enforced if authentication is enabled
+type apiOperation struct {
+	id            string
+	summary       string
+	parameters    []*openapi.Parameter
+	body          map[string]interface{}
+	data          interface{}
+	content       map[string]interface{}
+	items         bool
+	role          auth.Role
+	authenticated bool
+}
+
+// apiOneOf is the data of an operation that is one of several types
+type apiOneOf []interface{}
+
+// newAPIOperations describes the operations of the API endpoints, the parameters of the FizzBuzz requests are reflected from render.Request
+func newAPIOperations() map[string]*apiOperation {
+	stringSchema := func(description string, values ...string) *openapi.Schema {
+		return &openapi.Schema{Type: "string", Description: description, Enum: values}
+	}
+	query := func(name, description string, schema *openapi.Schema) *openapi.Parameter {
+		return &openapi.Parameter{Name: name, In: "query", Description: description, Schema: schema}
+	}
+	outcomes, dimensions, orders := make([]string, 0), make([]string, 0), make([]string, 0)
+	for _, outcome := range render.Outcomes {
+		outcomes = append(outcomes, string(outcome))
+	}
+	for _, dimension := range render.Dimensions {
+		dimensions = append(dimensions, string(dimension))
+	}
+	for _, order := range render.Orders {
+		orders = append(orders, string(order))
+	}
+	request := openapi.QueryParameters(render.Request{})
+	filters := make([]*openapi.Parameter, 0, len(request)+1)
+	for _, parameter := range request {
+		filters = append(filters, query(parameter.Name, "filters the requests whose "+parameter.Name+" equals the value", parameter.Schema))
+	}
+	filters = append(filters, query("filter", "filters the requests whose parameter compares to a value (e.g. limit>1000), repeatable",
+		&openapi.Schema{Type: "array", Items: stringSchema("")}))
+	format := query("format", "output format, negotiated with the Accept header if not set", stringSchema("", renderFormats.Names()...))
+	stream := query("stream", "streams the items in chunks as they are rendered, with a truncation trailer", &openapi.Schema{Type: "boolean"})
+	view := query("view", "statistics view, raw by default", stringSchema("", "raw", "canonical"))
+	outcome := query("outcome", "statistics of the renderings of an outcome only", stringSchema("", outcomes...))
+	top := query("top", "number of top statistics returned", &openapi.Schema{Type: "integer", Minimum: openapi.Bound(1), Maximum: openapi.Bound(statisticsTopMax)})
+	window := query("window", "duration of whole minutes of the statistics (e.g. 5m, 1h, 24h)", stringSchema(""))
+	exportFormat := query("format", "format of the export, json by default", stringSchema("", "json", "csv"))
+	export := map[string]interface{}{"application/json": render.Export{}, "text/csv": ""}
+	groupBy := query("group_by", "comma separated list of distinct parameters among "+strings.Join(dimensions, ", "), stringSchema(""))
+	groupBy.Required = true
+	delta := query("delta", "non zero number of hits added to (or removed from) the total of the request", &openapi.Schema{Type: "integer"})
+	delta.Required = true
+	parameters := func(list []*openapi.Parameter, more ...*openapi.Parameter) []*openapi.Parameter {
+		return append(append(make([]*openapi.Parameter, 0, len(list)+len(more)), list...), more...)
+	}
+	order := query("sort", "order of the statistics, total by default", stringSchema("", orders...))
+	cursor := query("cursor", "next_cursor of the previous page", stringSchema(""))
+	pageSize := query("page_size", "number of statistics of the page", &openapi.Schema{Type: "integer", Minimum: openapi.Bound(1), Maximum: openapi.Bound(statisticsPageSizeMax)})
+	threshold := query("threshold", "total of a request that sends a threshold event", &openapi.Schema{Type: "integer", Minimum: openapi.Bound(1)})
+	mode := query("mode", "import mode, merge by default", stringSchema("", "merge", "replace"))
+	date := query("date", "day of the usage (and its month), today by default", &openapi.Schema{Type: "string", Format: "date"})
+	client := query("client", "client whose usage is returned (administrators only for other clients), all the clients of the month by default for administrators", stringSchema(""))
+	return map[string]*apiOperation{
+		"GET /render": {id: "render", summary: "Renders a FizzBuzz request sent as query parameters",
+			parameters: parameters(request, format, stream), items: true, role: auth.RoleRenderer},
+		"POST /render": {id: "renderBody", summary: "Renders a FizzBuzz request sent as a JSON body",
+			parameters: parameters(nil, format, stream), body: map[string]interface{}{"application/json": render.Request{}}, items: true, role: auth.RoleRenderer},
+		"GET /statistics": {id: "getStatistics", summary: "Returns the top request (or the top requests), over a window if set",
+			parameters: parameters(nil, view, outcome, top, window), data: apiOneOf{render.RequestStatistic{}, []*render.RequestStatistic{}}, role: auth.RoleReader},
+		"GET /statistics/timeseries": {id: "getTimeSeries", summary: "Returns the per minute statistics of a request over a window, 1h by default",
+			parameters: parameters(request, view, outcome, window), data: render.TimeSeries{}, role: auth.RoleReader},
+		"GET /statistics/aggregate": {id: "getAggregation", summary: "Returns the statistics aggregated by request parameters",
+			parameters: parameters(nil, view, outcome, groupBy, top), data: render.Aggregation{}, role: auth.RoleReader},
+		"GET /statistics/requests": {id: "browseStatistics", summary: "Returns a page of the statistics of the requests, sorted and filtered",
+			parameters: append(parameters(nil, view, outcome, order, cursor, pageSize), filters...), data: render.Page{}, role: auth.RoleReader},
+		"GET /statistics/request": {id: "getStatistic", summary: "Returns the statistics of a request",
+			parameters: parameters(request, view, outcome), data: render.RequestStatistic{}, role: auth.RoleReader},
+		"GET /statistics/export": {id: "exportStatistics", summary: "Exports the statistics of all the requests",
+			parameters: parameters(nil, view, outcome, exportFormat), content: export, role: auth.RoleReader},
+		"GET /statistics/stream": {id: "streamStatistics", summary: "Streams the changes of the statistics as server-sent events",
+			parameters: parameters(nil, view, outcome, threshold), content: map[string]interface{}{"text/event-stream": ""}, role: auth.RoleReader},
+		"GET /usage": {id: "getUsage", summary: "Returns the daily and monthly usage of the client, or of the clients for administrators",
+			parameters: parameters(nil, date, client), data: []*usage.Report{}, authenticated: true},
+		"POST /statistics/import": {id: "importStatistics", summary: "Imports statistics exported, merged into the statistics or replacing them",
+			parameters: parameters(nil, exportFormat, mode), body: export, data: importResponse{}, role: auth.RoleAdmin},
+		"POST /statistics/reset": {id: "resetStatistics", summary: "Resets the statistics of all the requests, or of the requests filtered",
+			parameters: filters, data: adminResponse{}, role: auth.RoleAdmin},
+		"DELETE /statistics/request": {id: "deleteStatistic", summary: "Deletes the statistics of a request",
+			parameters: request, data: adminResponse{}, role: auth.RoleAdmin},
+		"PATCH /statistics/request": {id: "adjustStatistic", summary: "Adjusts the total of the statistics of a request",
+			parameters: parameters(request, delta), data: adminResponse{}, role: auth.RoleAdmin},
+	}
+}
+
+// newOpenAPIDocument generates the OpenAPI document of the API endpoints from the routes of a router, described by apiOperations
+// The operations of the version 1 of the API are deprecated, the routes that are not described (e.g. federation) are left out
+// The operations require the role of their clients if authentication is enabled, else the administration ones the admin token only
+func newOpenAPIDocument(router *mux.Router, authenticated bool) *openapi.Document {
+	document := openapi.NewDocument("FizzBuzz server", "Renders FizzBuzz requests and their statistics (see README for details)", "2")
+	document.AddSecurityScheme("admin", &openapi.SecurityScheme{Type: "http", Scheme: "bearer", Description: "admin token of the server"})
+	if authenticated {
+		document.AddSecurityScheme("bearer", &openapi.SecurityScheme{Type: "http", Scheme: "bearer", Description: "JSON Web Token (HS256 or RS256) with sub, exp and roles claims, or API key"})
+		document.AddSecurityScheme("apiKey", &openapi.SecurityScheme{Type: "apiKey", In: "header", Name: "X-API-Key", Description: "API key"})
+	}
+	router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		prefix := ""
+		if len(ancestors) > 0 {
+			prefix, _ = ancestors[0].GetPathTemplate()
+		}
+		for _, api := range apiVersions {
+			if api.prefix != prefix {
+				continue
+			}
+			for _, method := range methods {
+				if operation, ok := apiOperations[method+" "+strings.TrimPrefix(path, prefix)]; ok {
+					document.AddOperation(path, method, operation.openAPI(document, api.prefix, api.version, authenticated))
+				}
+			}
+		}
+		return nil
+	})
+	return document
+}
+
+// openAPI returns the operation served under a prefix, in the shape of its version of the API, and secured if authentication is enabled
+func (o *apiOperation) openAPI(document *openapi.Document, prefix string, version int, authenticated bool) *openapi.Operation {
+	operation := &openapi.Operation{
+		OperationID: o.id + strings.Title(strings.TrimPrefix(prefix, "/")),
+		Summary:     o.summary,
+		Deprecated:  version == 1,
+		Parameters:  o.parameters,
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "Success", Content: make(map[string]*openapi.MediaType)},
+			"default": {Description: "Error", Content: map[string]*openapi.MediaType{
+				"application/json": {Schema: apiErrorSchema(document, version)},
+				problemMediaType:   {Schema: document.Schema(apiProblem{})},
+			}},
+		},
+	}
+	if o.body != nil {
+		operation.RequestBody = &openapi.RequestBody{Required: true, Content: make(map[string]*openapi.MediaType)}
+		for mediaType, body := range o.body {
+			operation.RequestBody.Content[mediaType] = &openapi.MediaType{Schema: document.Schema(body)}
+		}
+	}
+	switch {
+	case authenticated && (o.role != "" || o.authenticated):
+		if o.role != "" {
+			operation.Summary += fmt.Sprintf(" (%s role)", o.role)
+		}
+		operation.Security = []map[string][]string{{"bearer": {}}, {"apiKey": {}}}
+		if o.role == auth.RoleAdmin {
+			operation.Security = append(operation.Security, map[string][]string{"admin": {}})
+		}
+	case o.role == auth.RoleAdmin:
+		operation.Security = []map[string][]string{{"admin": {}}}
+	}
+	content := operation.Responses["200"].Content
+	if o.items && o.body == nil {
+		operation.Responses["304"] = &openapi.Response{Description: "Not Modified, the render of the entity tag given in the If-None-Match header"}
+	}
+	if o.items {
+		for _, name := range renderFormats.Names() {
+			format, schema := renderFormats.Lookup(name), &openapi.Schema{Type: "string"}
+			switch {
+			case name == "json" && version == 2:
+				schema = apiDataSchema(document, version, document.Schema([]string{}))
+			case name == "json":
+				schema = apiDataSchema(document, version, &openapi.Schema{Type: "string", Description: "items joined with commas"})
+			case strings.HasSuffix(format.MediaType, "+json"):
+				schema = document.Schema([]string{})
+			}
+			content[format.MediaType] = &openapi.MediaType{Schema: schema}
+		}
+	}
+	if oneOf, ok := o.data.(apiOneOf); ok {
+		schema := &openapi.Schema{OneOf: make([]*openapi.Schema, 0, len(oneOf))}
+		for _, data := range oneOf {
+			schema.OneOf = append(schema.OneOf, document.Schema(data))
+		}
+		content["application/json"] = &openapi.MediaType{Schema: apiDataSchema(document, version, schema)}
+	} else if o.data != nil {
+		content["application/json"] = &openapi.MediaType{Schema: apiDataSchema(document, version, document.Schema(o.data))}
+	}
+	for mediaType, value := range o.content {
+		content[mediaType] = &openapi.MediaType{Schema: document.Schema(value)}
+	}
+	return operation
+}
+
+// apiDataSchema returns the schema of a response of a version of the API, given the schema of its data
+func apiDataSchema(document *openapi.Document, version int, data *openapi.Schema) *openapi.Schema {
+	if version == 2 {
+		return &openapi.Schema{
+			Type:       "object",
+			Properties: map[string]*openapi.Schema{"data": data, "meta": document.Schema(apiMeta{})},
+			Required:   []string{"meta"},
+		}
+	}
+	return &openapi.Schema{
+		Type:       "object",
+		Properties: map[string]*openapi.Schema{"error": {Type: "boolean"}, "response": data},
+		Required:   []string{"error", "response"},
+	}
+}
+
+// apiErrorSchema returns the schema of an error of a version of the API
+func apiErrorSchema(document *openapi.Document, version int) *openapi.Schema {
+	if version == 2 {
+		return &openapi.Schema{
+			Type:       "object",
+			Properties: map[string]*openapi.Schema{"error": document.Schema(apiErrorDetail{}), "meta": document.Schema(apiMeta{})},
+			Required:   []string{"error", "meta"},
+		}
+	}
+	return apiDataSchema(document, version, &openapi.Schema{Type: "string", Description: "error message"})
+}
+
+// Handles the OpenAPI document of the API endpoints
+func openAPIHandler(document *openapi.Document) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(document)
+	}
+}
+
+// validationMiddleware validates the requests against the operation of their route in the OpenAPI document
+// An invalid query parameter or property of the body is written as a *render.ParameterError
+func validationMiddleware(document *openapi.Document) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if route := mux.CurrentRoute(r); route != nil {
+				path, _ := route.GetPathTemplate()
+				if err := document.ValidateRequest(r, path); err != nil {
+					if validationError, ok := err.(*openapi.ValidationError); ok {
+						err = &render.ParameterError{Parameter: validationError.Name, Reason: validationError.Reason, Value: validationError.Value}
+					}
+					apiFailure(w, r, http.StatusBadRequest, err)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
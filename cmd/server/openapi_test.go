@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jpraynaud/fizzbuzz-server/pkg/openapi"
+	"github.com/jpraynaud/fizzbuzz-server/pkg/ratelimit"
+	"github.com/jpraynaud/fizzbuzz-server/pkg/render"
+)
+
+func Test_openAPIHandler(t *testing.T) {
+	// Get the OpenAPI document of the router
+	router := createRouter(&dependencies{renderer: render.NewRenderer()})
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/openapi.json", nil))
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("server returned status code %v and Content-Type %s, want 200 and application/json", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+	document := &openapi.Document{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), document); err != nil {
+		t.Fatal(err)
+	}
+	if document.OpenAPI != openapi.Version || len(document.Paths) != 33 {
+		t.Errorf("document is OpenAPI %s with %d paths, want OpenAPI %s with the 11 paths of each version", document.OpenAPI, len(document.Paths), openapi.Version)
+	}
+	if _, ok := document.Paths[render.FederationPath]; ok {
+		t.Errorf("document describes %s, want it left out", render.FederationPath)
+	}
+	// Check the operations of the routes, described in the shape of their version
+	tests := []struct {
+		path       string
+		method     string
+		id         string
+		deprecated bool
+		parameters string
+		security   bool
+	}{
+		{"/render", "get", "render", true, "limit,int1,int2,str1,str2,format,stream", false},
+		{"/v1/render", "post", "renderBodyV1", true, "format,stream", false},
+		{"/v2/render", "get", "renderV2", false, "limit,int1,int2,str1,str2,format,stream", false},
+		{"/v2/statistics", "get", "getStatisticsV2", false, "view,outcome,top,window", false},
+		{"/v2/statistics/request", "patch", "adjustStatisticV2", false, "limit,int1,int2,str1,str2,delta", true},
+		{"/v2/usage", "get", "getUsageV2", false, "date,client", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			operation := document.Paths[tt.path][tt.method]
+			if operation == nil {
+				t.Fatalf("document does not describe %s %s", tt.method, tt.path)
+			}
+			names := make([]string, 0)
+			for _, parameter := range operation.Parameters {
+				names = append(names, parameter.Name)
+			}
+			if got := strings.Join(names, ","); got != tt.parameters {
+				t.Errorf("operation has parameters %s, want %s", got, tt.parameters)
+			}
+			if operation.OperationID != tt.id || operation.Deprecated != tt.deprecated || (len(operation.Security) > 0) != tt.security {
+				t.Errorf("operation is %s (deprecated %v, security %v), want %s (deprecated %v, security %v)",
+					operation.OperationID, operation.Deprecated, operation.Security, tt.id, tt.deprecated, tt.security)
+			}
+			if operation.Responses["200"] == nil || operation.Responses["default"].Content[problemMediaType] == nil {
+				t.Errorf("operation has responses %+v, want a success and problem details", operation.Responses)
+			}
+		})
+	}
+	// Check the schemas reflected from the definitions
+	request := document.Components.Schemas["Request"]
+	if request == nil || strings.Join(request.Required, ",") != "int1,int2,limit" || *request.Properties["limit"].Minimum != 1 {
+		t.Errorf("Request schema is %+v, want limit, int1 and int2 required and >= 1", request)
+	}
+	content := document.Paths["/v2/render"]["get"].Responses["200"].Content
+	if len(content) != len(renderFormats.Names()) || content["application/json"].Schema.Properties["data"].Type != "array" {
+		t.Errorf("render responses are %+v, want one by format, the JSON data being an array", content)
+	}
+}
+
+func Test_validationMiddleware(t *testing.T) {
+	// Prepare test server, validating requests
+	validateRequests = "true"
+	defer func() {
+		validateRequests = ""
+	}()
+	server := httptest.NewServer(createRouter(&dependencies{renderer: render.NewRenderer()}))
+	defer server.Close()
+	// Prepare tests data
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		codeWanted int
+		bodyWanted string
+	}{
+		{"Valid", "GET", "/render?limit=3&int1=2&int2=3", "", http.StatusOK, `{"error":false,"response":"1,,"}`},
+		{"Missing", "GET", "/render?int1=2&int2=3", "", http.StatusBadRequest, `{"error":true,"response":"limit parameter is required, value  was given"}`},
+		{"Below minimum", "GET", "/v1/render?limit=0&int1=2&int2=3", "", http.StatusBadRequest, `{"error":true,"response":"limit parameter must be an integer >= 1, value 0 was given"}`},
+		{"Enum", "GET", "/statistics?view=all", "", http.StatusBadRequest, `{"error":true,"response":"view parameter must be one of raw, canonical, value all was given"}`},
+		{"Repeated", "GET", "/statistics/requests?filter=limit>1&page_size=0", "", http.StatusBadRequest, `{"error":true,"response":"page_size parameter must be an integer between 1 and 1000, value 0 was given"}`},
+		{"Boolean V2", "GET", "/v2/render?limit=3&int1=2&int2=3&stream=yes", "", http.StatusBadRequest, `{"error":{"code":"invalid_parameter","message":"stream parameter must be true or false, value yes was given","parameter":"stream","status":400,"value":"yes"},"meta":{"parameters":{"int1":["2"],"int2":["3"],"limit":["3"],"stream":["yes"]}}}`},
+		{"Valid body", "POST", "/render", `{"limit":3,"int1":2,"int2":3}`, http.StatusOK, `{"error":false,"response":"1,,"}`},
+		{"Body type", "POST", "/render", `{"limit":"3","int1":2,"int2":3}`, http.StatusBadRequest, `{"error":true,"response":"limit parameter must be an integer >= 1, value \"3\" was given"}`},
+		{"Body required", "POST", "/render", `{"limit":3,"int2":3}`, http.StatusBadRequest, `{"error":true,"response":"int1 parameter is required, value  was given"}`},
+		{"Body unknown", "POST", "/render", `{"limit":3,"int1":2,"int2":3,"str3":"x"}`, http.StatusBadRequest, `{"error":true,"response":"str3 parameter is not allowed, value \"x\" was given"}`},
+		{"Body malformed", "POST", "/render", `{"limit":3`, http.StatusBadRequest, `{"error":true,"response":"body must be a JSON render request: unexpected EOF"}`},
+		{"Not described", "GET", "/openapi.json?limit=x", "", http.StatusOK, ""},
+	}
+	// Run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := http.NewRequest(tt.method, server.URL+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+			body, err := ioutil.ReadAll(response.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.StatusCode != tt.codeWanted {
+				t.Errorf("server returned status code %v, want %v", response.StatusCode, tt.codeWanted)
+			}
+			if tt.bodyWanted == "" {
+				return
+			}
+			if got, want := normalizeBody(t, body), normalizeBody(t, []byte(tt.bodyWanted)); got != want {
+				t.Errorf("server returned body %s, want %s", got, want)
+			}
+		})
+	}
+	// Invalid requests are rejected before rate limiting, they take no token
+	rateLimits := &apiRateLimits{requests: ratelimit.NewLimiter(0.001, 1)}
+	limited := httptest.NewServer(createRouter(&dependencies{renderer: render.NewRenderer(), rateLimits: rateLimits}))
+	defer limited.Close()
+	for _, want := range []struct {
+		path string
+		code int
+	}{{"/render?limit=0&int1=2&int2=3", http.StatusBadRequest}, {"/render?limit=3&int1=2&int2=3", http.StatusOK}, {"/render?limit=3&int1=2&int2=3", http.StatusTooManyRequests}} {
+		response, err := http.Get(limited.URL + want.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != want.code {
+			t.Errorf("server returned status code %v for %s, want %v", response.StatusCode, want.path, want.code)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jpraynaud/fizzbuzz-server/pkg/auth"
+	"github.com/jpraynaud/fizzbuzz-server/pkg/ratelimit"
+	"github.com/jpraynaud/fizzbuzz-server/pkg/render"
+	log "github.com/sirupsen/logrus"
+)
+
+// rateLimitPruneInterval is the interval between prunings of the full token buckets of the rate limits of the clients
+const rateLimitPruneInterval = time.Minute
+
+// apiRateLimits represents the rate limits of the clients of the API endpoints: of their requests and of the items rendered for them
+// (nil if not limited), the clients being identified by their IP address, or by their authenticated identity if byAPIKey is set
+type apiRateLimits struct {
+	requests *ratelimit.Limiter
+	items    *ratelimit.Limiter
+	byAPIKey bool
+}
+
+// parseRateLimit parses a rate limit, a rate per second optionally followed by a burst (e.g. 10:20), the burst being the rate rounded up by default
+func parseRateLimit(name, value string) (*ratelimit.Limiter, error) {
+	if value == "" {
+		return nil, nil
+	}
+	rateValue, burstValue := value, ""
+	if i := strings.Index(value, ":"); i >= 0 {
+		rateValue, burstValue = value[:i], value[i+1:]
+	}
+	rate, err := strconv.ParseFloat(rateValue, 64)
+	if err != nil || rate <= 0 || math.IsInf(rate, 0) {
+		return nil, fmt.Errorf("%s must be a positive rate per second optionally followed by a burst (e.g. 10:20), value %s was given", name, value)
+	}
+	burst := int(math.Ceil(rate))
+	if burstValue != "" {
+		if burst, err = strconv.Atoi(burstValue); err != nil || burst < 1 {
+			return nil, fmt.Errorf("%s burst must be an integer >= 1, value %s was given", name, value)
+		}
+	}
+	return ratelimit.NewLimiter(rate, burst), nil
+}
+
+// rateLimitSetup parses the rate limits of the clients, and starts pruning their token buckets periodically if any limit is enabled
+func rateLimitSetup(ctx context.Context) (*apiRateLimits, error) {
+	limits := &apiRateLimits{}
+	var err error
+	if limits.requests, err = parseRateLimit("ratelimit", rateLimit); err != nil {
+		return nil, err
+	}
+	if limits.items, err = parseRateLimit("itemratelimit", itemRateLimit); err != nil {
+		return nil, err
+	}
+	switch rateLimitKey {
+	case "", "ip":
+	case "apikey":
+		limits.byAPIKey = true
+	default:
+		return nil, fmt.Errorf("ratelimitkey must be ip or apikey, value %s was given", rateLimitKey)
+	}
+	if limits.requests == nil && limits.items == nil {
+		return nil, nil
+	}
+	fields := log.Fields{"by_api_key": limits.byAPIKey}
+	for name, limiter := range map[string]*ratelimit.Limiter{"requests": limits.requests, "items": limits.items} {
+		if limiter != nil {
+			fields[name] = fmt.Sprintf("%g/s burst %d", limiter.Rate(), limiter.Burst())
+			go limiter.Run(ctx, rateLimitPruneInterval)
+		}
+	}
+	log.WithFields(fields).Info("Rate limiting enabled")
+	return limits, nil
+}
+
+// clientKey returns the key that identifies the client of a request in the rate limits, its IP address for anonymous clients
+func (l *apiRateLimits) clientKey(r *http.Request) string {
+	if identity := auth.FromContext(r.Context()); l.byAPIKey && identity != nil {
+		return "client:" + identity.Subject
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// rateLimitClient represents the client of a request in the rate limits, and its budget of rendered items (nil if not limited)
+type rateLimitClient struct {
+	key   string
+	items *ratelimit.Limiter
+}
+
+// rateLimitClientKey is the key of the rateLimitClient in the context of a request
+type rateLimitClientKey struct{}
+
+// rateLimitMiddleware limits the rate of the requests of each client, and attaches its budget of rendered items to the context of the requests
+func rateLimitMiddleware(limits *apiRateLimits) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			client := &rateLimitClient{key: limits.clientKey(r), items: limits.items}
+			if limits.requests != nil && !takeRateLimit(w, r, limits.requests, client.key, 1, "requests") {
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), rateLimitClientKey{}, client)))
+		})
+	}
+}
+
+// takeRenderItems takes the items of a render from the budget of rendered items of its client, if limited
+// A valid request whose limit exceeds the burst of the budget is rejected as invalid, as it would never be allowed
+func takeRenderItems(w http.ResponseWriter, r *http.Request, request *render.Request) bool {
+	client, ok := r.Context().Value(rateLimitClientKey{}).(*rateLimitClient)
+	if !ok || client.items == nil || request.Validate() != nil {
+		return true
+	}
+	if burst := client.items.Burst(); request.Limit > burst {
+		apiFailure(w, r, http.StatusBadRequest, &render.ParameterError{Parameter: "limit", Reason: fmt.Sprintf("must be <= %d, the rendered items budget of a client", burst), Value: strconv.Itoa(request.Limit)})
+		return false
+	}
+	return takeRateLimit(w, r, client.items, client.key, request.Limit, "rendered items")
+}
+
+// takeRateLimit takes tokens from the budget of a client, and writes the RateLimit-* headers of the budget (its burst, the tokens remaining
+// and the seconds until it is full again), along with a 429 error and its Retry-After header if the take is not allowed
+func takeRateLimit(w http.ResponseWriter, r *http.Request, limiter *ratelimit.Limiter, key string, tokens int, budget string) bool {
+	result := limiter.Take(key, tokens, time.Now())
+	seconds := func(duration time.Duration) string {
+		return strconv.Itoa(int(math.Ceil(duration.Seconds())))
+	}
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("RateLimit-Reset", seconds(result.Reset))
+	w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%s", result.Limit, seconds(time.Duration(float64(result.Limit)/limiter.Rate()*float64(time.Second)))))
+	if result.Allowed {
+		return true
+	}
+	w.Header().Set("Retry-After", seconds(result.RetryAfter))
+	apiError(w, r, http.StatusTooManyRequests, fmt.Sprintf("%s rate limit of %g per second exceeded, retry after %s seconds", budget, limiter.Rate(), seconds(result.RetryAfter)))
+	return false
+}
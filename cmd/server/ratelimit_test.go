@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jpraynaud/fizzbuzz-server/pkg/auth"
+	"github.com/jpraynaud/fizzbuzz-server/pkg/ratelimit"
+	"github.com/jpraynaud/fizzbuzz-server/pkg/render"
+)
+
+func Test_rateLimitSetup(t *testing.T) {
+	tests := []struct {
+		name      string
+		requests  string
+		items     string
+		key       string
+		wantBurst int
+		wantNil   bool
+		wantErr   bool
+	}{
+		{"Disabled", "", "", "", 0, true, false},
+		{"Rate", "2.5", "", "", 3, false, false},
+		{"Rate and burst", "10:20", "", "apikey", 20, false, false},
+		{"Items only", "", "1000:100000", "ip", 0, false, false},
+		{"Invalid rate", "0", "", "", 0, true, true},
+		{"Invalid burst", "10:0", "", "", 0, true, true},
+		{"Invalid items", "", "many", "", 0, true, true},
+		{"Invalid key", "10", "", "token", 0, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rateLimit, itemRateLimit, rateLimitKey = tt.requests, tt.items, tt.key
+			defer func() {
+				rateLimit, itemRateLimit, rateLimitKey = "", "", ""
+			}()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			limits, err := rateLimitSetup(ctx)
+			if (err != nil) != tt.wantErr || (limits == nil) != tt.wantNil {
+				t.Fatalf("rateLimitSetup() = %+v, %v, want nil %v and error %v", limits, err, tt.wantNil, tt.wantErr)
+			}
+			if limits != nil && limits.requests != nil && limits.requests.Burst() != tt.wantBurst {
+				t.Errorf("rateLimitSetup() burst = %d, want %d", limits.requests.Burst(), tt.wantBurst)
+			}
+			if limits != nil && limits.byAPIKey != (tt.key == "apikey") {
+				t.Errorf("rateLimitSetup() byAPIKey = %v, want %v", limits.byAPIKey, tt.key == "apikey")
+			}
+		})
+	}
+}
+
+func Test_rateLimitMiddleware(t *testing.T) {
+	// Prepare test server, with budgets that are not refilled during the test
+	// and with the clients identified by their API keys
+	rateLimits := &apiRateLimits{requests: ratelimit.NewLimiter(0.001, 3), items: ratelimit.NewLimiter(0.001, 100), byAPIKey: true}
+	authenticator := auth.NewAuthenticator()
+	authenticator.AddAPIKey("a", &auth.Identity{Subject: "a", Roles: []auth.Role{auth.RoleReader, auth.RoleRenderer}})
+	authenticator.AddAPIKey("b", &auth.Identity{Subject: "b", Roles: []auth.Role{auth.RoleReader, auth.RoleRenderer}})
+	server := httptest.NewServer(createRouter(&dependencies{renderer: render.NewRenderer(), authenticator: authenticator, rateLimits: rateLimits}))
+	defer server.Close()
+	// Prepare tests data, the requests of a client are limited to 3, and its rendered items to 100
+	tests := []struct {
+		name          string
+		path          string
+		apiKey        string
+		codeWanted    int
+		limitWanted   string
+		remaining     string
+		retryAfter    bool
+		messageWanted string
+	}{
+		{"Request", "/statistics", "b", http.StatusOK, "3", "2", false, ""},
+		{"Items", "/render?limit=60&int1=3&int2=5", "b", http.StatusOK, "100", "40", false, ""},
+		{"Items exceeded", "/v2/render?limit=60&int1=3&int2=5", "b", http.StatusTooManyRequests, "100", "40", true, "rendered items rate limit of 0.001 per second exceeded, retry after 20000 seconds"},
+		{"Requests exceeded", "/statistics", "b", http.StatusTooManyRequests, "3", "0", true, "requests rate limit of 0.001 per second exceeded, retry after 1000 seconds"},
+		{"Other API key", "/render?limit=101&int1=3&int2=5", "a", http.StatusBadRequest, "3", "2", false, "limit parameter must be <= 100, the rendered items budget of a client, value 101 was given"},
+		{"Invalid request", "/render?limit=0&int1=3&int2=5", "a", http.StatusBadRequest, "3", "1", false, "limit parameter must be >= 1, value 0 was given"},
+	}
+	// Run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := http.NewRequest("GET", server.URL+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.Header.Set("X-API-Key", tt.apiKey)
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+			if response.StatusCode != tt.codeWanted {
+				t.Errorf("server returned status code %v, want %v", response.StatusCode, tt.codeWanted)
+			}
+			if limit, remaining := response.Header.Get("RateLimit-Limit"), response.Header.Get("RateLimit-Remaining"); limit != tt.limitWanted || remaining != tt.remaining {
+				t.Errorf("server returned RateLimit-Limit %s and RateLimit-Remaining %s, want %s and %s", limit, remaining, tt.limitWanted, tt.remaining)
+			}
+			if retryAfter := response.Header.Get("Retry-After"); (retryAfter != "") != tt.retryAfter {
+				t.Errorf("server returned Retry-After %s, want it set %v", retryAfter, tt.retryAfter)
+			}
+			if tt.messageWanted == "" {
+				return
+			}
+			body := make(map[string]interface{})
+			if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			message := body["response"]
+			if detail, ok := body["error"].(map[string]interface{}); ok {
+				message = detail["message"]
+				if detail["code"] != "too_many_requests" {
+					t.Errorf("server returned code %s, want too_many_requests", detail["code"])
+				}
+			}
+			if message != tt.messageWanted {
+				t.Errorf("server returned message %s, want %s", message, tt.messageWanted)
+			}
+		})
+	}
+}
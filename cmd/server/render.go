@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jpraynaud/fizzbuzz-server/pkg/encode"
+	"github.com/jpraynaud/fizzbuzz-server/pkg/render"
+	log "github.com/sirupsen/logrus"
+)
+
+// renderFormats are the output formats of the render endpoints, the default one being the JSON apiResponse
+var renderFormats = newRenderFormats()
+
+const (
+	// renderRequestMaxBytes is the maximum size of the body of the render endpoint
+	renderRequestMaxBytes = 64 << 10
+	// renderStreamDuration is the maximum duration of a streamed render, shorter than the server write timeout (the render is truncated afterwards)
+	renderStreamDuration = 50 * time.Second
+	// renderMaxAge is the duration the renders may be cached, a render never changes for a version of the FizzBuzz algorithm
+	renderMaxAge = 365 * 24 * time.Hour
+)
+
+// parseRequest parses a FizzBuzz request from query parameters
+func parseRequest(vars url.Values) (*render.Request, error) {
+	limit, err := strconv.Atoi(vars.Get("limit"))
+	if err != nil {
+		return nil, &render.ParameterError{Parameter: "limit", Reason: "must be an integer", Value: vars.Get("limit")}
+	}
+	int1, err := strconv.Atoi(vars.Get("int1"))
+	if err != nil {
+		return nil, &render.ParameterError{Parameter: "int1", Reason: "must be an integer", Value: vars.Get("int1")}
+	}
+	int2, err := strconv.Atoi(vars.Get("int2"))
+	if err != nil {
+		return nil, &render.ParameterError{Parameter: "int2", Reason: "must be an integer", Value: vars.Get("int2")}
+	}
+	str1 := vars.Get("str1")
+	str2 := vars.Get("str2")
+	return render.NewRequest(limit, int1, int2, str1, str2), nil
+}
+
+// decodeRequest decodes a FizzBuzz request from a JSON body, whose size is limited and whose fields must all be known
+func decodeRequest(w http.ResponseWriter, r *http.Request) (*render.Request, error) {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, renderRequestMaxBytes))
+	decoder.DisallowUnknownFields()
+	request := &render.Request{}
+	if err := decoder.Decode(request); err != nil {
+		return nil, fmt.Errorf("body must be a JSON render request: %v", err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("body must be a JSON render request: a single JSON object is expected")
+	}
+	return request, nil
+}
+
+// newRenderFormats creates the registry of the output formats of the render endpoints:
+// the JSON apiResponse whose response joins the items with commas (json, the default one), then the built-in formats
+func newRenderFormats() *encode.Registry {
+	registry := encode.NewRegistry()
+	registry.Register("json", "application/json", &encode.Stream{
+		Header:    `{"error":false,"response":"`,
+		Separator: ",",
+		Footer:    "\"}\n",
+		Item: func(w *bufio.Writer, item string) error {
+			value, err := json.Marshal(item)
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(value[1 : len(value)-1])
+			return err
+		},
+	})
+	encode.RegisterBuiltins(registry)
+	return registry
+}
+
+// renderDocument represents the JSON document of a render in the version 2 of the API: the items as a data array, then their metadata
+type renderDocument struct {
+	call    *apiCall
+	request *render.Request
+}
+
+// Encode encodes the items at once
+func (d *renderDocument) Encode(w io.Writer, items []string) error {
+	writer := d.NewItemWriter(w)
+	for _, item := range items {
+		if err := writer.WriteItem(item); err != nil {
+			return err
+		}
+	}
+	return writer.Close()
+}
+
+// NewItemWriter returns an ItemWriter that encodes items one by one, the metadata are written on close
+func (d *renderDocument) NewItemWriter(w io.Writer) encode.ItemWriter {
+	items := &encode.Stream{Header: `{"data":[`, Separator: ",", Footer: "]", Item: encode.WriteJSONString}
+	return &renderDocumentWriter{document: d, w: w, items: items.NewItemWriter(w)}
+}
+
+// renderDocumentWriter represents the ItemWriter of a renderDocument
+type renderDocumentWriter struct {
+	document *renderDocument
+	w        io.Writer
+	items    encode.ItemWriter
+	count    int
+}
+
+// WriteItem encodes an item
+func (dw *renderDocumentWriter) WriteItem(item string) error {
+	dw.count++
+	return dw.items.WriteItem(item)
+}
+
+// Close writes the end of the data array, then the metadata
+func (dw *renderDocumentWriter) Close() error {
+	if err := dw.items.Close(); err != nil {
+		return err
+	}
+	meta, err := json.Marshal(newAPIMeta(dw.document.call, dw.document.request, &dw.count))
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(dw.w, `,"meta":%s}`+"\n", meta)
+	return err
+}
+
+// parseStream parses the stream parameter of a render (a boolean), false by default
+func parseStream(value string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+	stream, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, &render.ParameterError{Parameter: "stream", Reason: "must be true or false", Value: value}
+	}
+	return stream, nil
+}
+
+// renderOutput represents how the items of a render are written: their format, and its StreamEncoder when they are streamed
+type renderOutput struct {
+	format *encode.Format
+	stream encode.StreamEncoder
+}
+
+// parseRenderOutput parses how the items of a render are written, from its format and stream parameters and its Accept header
+// along with the status code of the error when they can not be written as requested
+// The json format of the version 2 of the API is the renderDocument of the request
+func parseRenderOutput(r *http.Request, request *render.Request) (*renderOutput, int, error) {
+	format, status, err := renderFormat(r)
+	if err != nil {
+		// An invalid request is reported rather than its format, even when only problem details are accepted
+		if invalid := request.Validate(); invalid != nil {
+			return nil, http.StatusBadRequest, invalid
+		}
+		return nil, status, err
+	}
+	if call := apiCallOf(r); call.version == 2 && format.Name == "json" {
+		format = &encode.Format{Name: format.Name, MediaType: format.MediaType, Encoder: &renderDocument{call: call, request: request}}
+	}
+	value := r.URL.Query().Get("stream")
+	stream, err := parseStream(value)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	output := &renderOutput{format: format}
+	if stream {
+		encoder, ok := format.Encoder.(encode.StreamEncoder)
+		if !ok {
+			return nil, http.StatusBadRequest, &render.ParameterError{Parameter: "stream", Reason: fmt.Sprintf("is not supported by the %s format", format.Name), Value: value}
+		}
+		output.stream = encoder
+	}
+	return output, http.StatusOK, nil
+}
+
+// renderFormat returns the output format of a render, selected by the format parameter if set, else negotiated with the Accept header
+// along with the status code of the error when there is no such format
+func renderFormat(r *http.Request) (*encode.Format, int, error) {
+	if name := r.URL.Query().Get("format"); name != "" {
+		format := renderFormats.Lookup(name)
+		if format == nil {
+			return nil, http.StatusBadRequest, &render.ParameterError{Parameter: "format", Reason: "must be one of " + strings.Join(renderFormats.Names(), ", "), Value: name}
+		}
+		return format, http.StatusOK, nil
+	}
+	accept := strings.Join(r.Header["Accept"], ",")
+	format := renderFormats.Negotiate(accept)
+	if format == nil {
+		return nil, http.StatusNotAcceptable, fmt.Errorf("Accept header must accept a format among %s, value %s was given", strings.Join(renderFormats.Names(), ", "), accept)
+	}
+	return format, http.StatusOK, nil
+}
+
+// Handle FizzBuzz render
+func renderHandler(deps *dependencies) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Prepare input parameters
+		request, err := parseRequest(r.URL.Query())
+		if err != nil {
+			apiFailure(w, r, http.StatusBadRequest, err)
+			return
+		}
+		output, status, err := parseRenderOutput(r, request)
+		if err != nil {
+			apiFailure(w, r, status, err)
+			return
+		}
+
+		// Render request
+		writeRender(w, r, deps, request, output)
+	}
+}
+
+// Handle FizzBuzz render of a request sent as a JSON body
+func renderBodyHandler(deps *dependencies) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Prepare input parameters
+		if contentType := r.Header.Get("Content-Type"); contentType != "" {
+			if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || mediaType != "application/json" {
+				apiError(w, r, http.StatusUnsupportedMediaType, fmt.Sprintf("Content-Type header must be application/json, value %s was given", contentType))
+				return
+			}
+		}
+		request, err := decodeRequest(w, r)
+		if err != nil {
+			apiFailure(w, r, http.StatusBadRequest, err)
+			return
+		}
+		output, status, err := parseRenderOutput(r, request)
+		if err != nil {
+			apiFailure(w, r, status, err)
+			return
+		}
+
+		// Render request
+		writeRender(w, r, deps, request, output)
+	}
+}
+
+// writeRender renders a FizzBuzz request and writes its items as requested, whatever the way the request was sent
+// The items are either streamed, or written once all rendered, once taken from the budget of rendered items of the client
+// A render sent with the GET method (not streamed) may be cached: it is revalidated with its entity tag, a matching If-None-Match header
+// is answered with a 304 Not Modified status without rendering (nor taking items), and recorded as a successful rendering
+func writeRender(w http.ResponseWriter, r *http.Request, deps *dependencies, request *render.Request, output *renderOutput) {
+	etag := ""
+	if r.Method == http.MethodGet && output.stream == nil && request.Validate() == nil {
+		etag = renderETag(r, request, output.format)
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			recordRevalidation(deps.renderer, request, apiCallOf(r).started)
+			setRenderCache(w, etag, deps.cacheControl(renderMaxAge))
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	if !takeRenderItems(w, r, request) || !takeUsageItems(w, r, deps.usageMeter, request) {
+		return
+	}
+	if output.stream != nil {
+		writeRenderStream(w, r, deps.renderer, request, output)
+		return
+	}
+	response := deps.renderer.Render(r.Context(), request)
+	if err := response.Error; err != nil {
+		apiFailure(w, r, http.StatusBadRequest, err)
+		return
+	}
+	items := make([]string, 0)
+	for item := range response.Items {
+		items = append(items, item)
+	}
+
+	// Write response
+	w.Header().Set("Content-Type", output.format.ContentType())
+	if etag != "" {
+		setRenderCache(w, etag, deps.cacheControl(renderMaxAge))
+	} else {
+		w.Header().Add("Vary", "Accept")
+	}
+	if err := output.format.Encode(w, items); err != nil {
+		log.Errorf("%s - %s - encoding in %s format failed: %v", r.Method, r.RequestURI, output.format.Name, err)
+	}
+}
+
+// recordRevalidation records the revalidation of a render as a successful rendering, so that the statistics count the renders served
+// from the caches of the clients, along with its latency if supported by the StatisticRecorder
+func recordRevalidation(renderer render.Renderer, request *render.Request, started time.Time) {
+	if outcomeRecorder, ok := renderer.Statistics().(render.OutcomeStatisticRecorder); ok {
+		outcomeRecorder.RecordOutcome(request, render.OutcomeSuccess, time.Since(started))
+		return
+	}
+	renderer.RecordStatistic(request)
+}
+
+// renderETag returns the entity tag of the render of a request in a format, derived from the version of the FizzBuzz algorithm,
+// the version of the API and the canonical form of the request, so that equivalent requests share the same strong entity tag
+// The JSON document of the version 2 of the API holds the parameters of the request and the timing of the call: its entity tag is weak,
+// and derived from the request itself
+func renderETag(r *http.Request, request *render.Request, format *encode.Format) string {
+	call := apiCallOf(r)
+	weak := call.version == 2 && format.Name == "json"
+	tagged := *request
+	if !weak {
+		tagged = request.Canonical()
+	}
+	data, _ := json.Marshal(&tagged)
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%d/v%d/%s/%s", render.AlgorithmVersion, call.version, format.Name, data)))
+	etag := `"` + hex.EncodeToString(hash[:16]) + `"`
+	if weak {
+		return "W/" + etag
+	}
+	return etag
+}
+
+// etagMatches reports whether an If-None-Match header (a list of entity tags, or *) matches an entity tag, with the weak comparison (RFC 7232)
+func etagMatches(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// setRenderCache sets the headers that let a render be cached, then revalidated with its entity tag
+func setRenderCache(w http.ResponseWriter, etag, cacheControl string) {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", cacheControl+", immutable")
+	w.Header().Add("Vary", "Accept")
+}
+
+// flushWriter represents a writer that flushes each write to the client
+type flushWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+// Write writes to the client, and flushes
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if fw.flusher != nil {
+		fw.flusher.Flush()
+	}
+	return n, err
+}
+
+// writeRenderStream renders a FizzBuzz request and writes its items in chunks as they are rendered (with chunked transfer encoding)
+// The render stops when the client goes away or after renderStreamDuration, the X-Render-Items and X-Render-Truncated trailers
+// report the number of items written and whether they were truncated
+func writeRenderStream(w http.ResponseWriter, r *http.Request, renderer render.Renderer, request *render.Request, output *renderOutput) {
+	ctx, cancel := context.WithTimeout(r.Context(), renderStreamDuration)
+	defer cancel()
+	response := renderer.Render(ctx, request)
+	if err := response.Error; err != nil {
+		apiFailure(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	// Write items as they are rendered
+	w.Header().Set("Content-Type", output.format.ContentType())
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set("Trailer", "X-Render-Items, X-Render-Truncated")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	writer := output.stream.NewItemWriter(&flushWriter{w, flusher})
+	count := 0
+	var err error
+	for item := range response.Items {
+		if err = writer.WriteItem(item); err != nil {
+			cancel()
+			break
+		}
+		count++
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	truncated := count < request.Limit
+	w.Header().Set("X-Render-Items", strconv.Itoa(count))
+	w.Header().Set("X-Render-Truncated", strconv.FormatBool(truncated))
+	if err != nil || truncated {
+		log.WithFields(log.Fields{
+			"items": count,
+			"error": err,
+		}).Warnf("%s - %s - render stream truncated", r.Method, r.RequestURI)
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/jpraynaud/fizzbuzz-server/pkg/auth"
+	"github.com/jpraynaud/fizzbuzz-server/pkg/render"
+)
+
+func Test_renderHandler(t *testing.T) {
+	// Create new renderer
+	renderer := render.NewRenderer()
+	deps := &dependencies{renderer: renderer}
+	// Prepare tests data
+	type args struct {
+		handler           http.HandlerFunc
+		method            string
+		path              string
+		query             string
+		codeWanted        int
+		apiResponseWanted apiResponse
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{"Render Bad Request", args{renderHandler(deps), "GET", "/render", "", http.StatusBadRequest, apiResponse{true, "limit parameter must be an integer, value  was given"}}},
+		{"Render Bad Request", args{renderHandler(deps), "GET", "/render", "limit=Z&int1=Z&int2=Z&str1=A&str2=B", http.StatusBadRequest, apiResponse{true, "limit parameter must be an integer, value Z was given"}}},
+		{"Render Bad Request", args{renderHandler(deps), "GET", "/render", "limit=20&int1=Z&int2=Z&str1=A&str2=B", http.StatusBadRequest, apiResponse{true, "int1 parameter must be an integer, value Z was given"}}},
+		{"Render Bad Request", args{renderHandler(deps), "GET", "/render", "limit=20&int1=3&int2=Z&str1=A&str2=B", http.StatusBadRequest, apiResponse{true, "int2 parameter must be an integer, value Z was given"}}},
+		{"Render Bad Request", args{renderHandler(deps), "GET", "/render", "limit=0&int1=3&int2=5&str1=A&str2=B", http.StatusBadRequest, apiResponse{true, "limit parameter must be >= 1, value 0 was given"}}},
+		{"Render Bad Request", args{renderHandler(deps), "GET", "/render", "limit=20&int1=0&int2=5&str1=A&str2=B", http.StatusBadRequest, apiResponse{true, "int1 parameter must be >= 1, value 0 was given"}}},
+		{"Render Bad Request", args{renderHandler(deps), "GET", "/render", "limit=20&int1=3&int2=0&str1=A&str2=B", http.StatusBadRequest, apiResponse{true, "int2 parameter must be >= 1, value 0 was given"}}},
+		{"Render OK", args{renderHandler(deps), "GET", "/render", "limit=20&int1=3&int2=5&str1=A&str2=B", http.StatusOK, apiResponse{false, "1,2,A,4,B,A,7,8,A,B,11,A,13,14,AB,16,17,A,19,B"}}},
+		{"Render OK", args{renderHandler(deps), "GET", "/render", "limit=20&int1=3&int2=5&str1=AA&str2=BBB", http.StatusOK, apiResponse{false, "1,2,AA,4,BBB,AA,7,8,AA,BBB,11,AA,13,14,AABBB,16,17,AA,19,BBB"}}},
+		{"Render OK", args{renderHandler(deps), "GET", "/render", "limit=30&int1=2&int2=7&str1=AAA&str2=BBB", http.StatusOK, apiResponse{false, "1,AAA,3,AAA,5,AAA,BBB,AAA,9,AAA,11,AAA,13,AAABBB,15,AAA,17,AAA,19,AAA,BBB,AAA,23,AAA,25,AAA,27,AAABBB,29,AAA"}}},
+		{"Render OK", args{renderHandler(deps), "GET", "/render", "limit=30&int1=3&int2=5&str1=喂&str2=世界", http.StatusOK, apiResponse{false, "1,2,喂,4,世界,喂,7,8,喂,世界,11,喂,13,14,喂世界,16,17,喂,19,世界,喂,22,23,喂,世界,26,喂,28,29,喂世界"}}},
+	}
+	// Reset statistics
+	renderer.ResetStatistics()
+	// Run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Create request
+			request, err := http.NewRequest(tt.args.method, tt.args.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.args.query != "" {
+				mappedQuery, err := url.ParseQuery(tt.args.query)
+				if err != nil {
+					t.Fatal(err)
+				}
+				request.URL.RawQuery = mappedQuery.Encode()
+			}
+			// Validate handler
+			validateHandler(t, tt.args.handler, request, tt.args.codeWanted, tt.args.apiResponseWanted)
+		})
+	}
+}
+
+func Test_renderBodyHandler(t *testing.T) {
+	// Create new renderer
+	renderer := render.NewRenderer()
+	deps := &dependencies{renderer: renderer}
+	// Prepare tests data
+	tests := []struct {
+		name              string
+		contentType       string
+		body              string
+		codeWanted        int
+		apiResponseWanted apiResponse
+	}{
+		{"Render Bad Request", "application/json", "", http.StatusBadRequest, apiResponse{true, "body must be a JSON render request: EOF"}},
+		{"Render Bad Request", "application/json", `{"limit":"20"}`, http.StatusBadRequest, apiResponse{true, "body must be a JSON render request: json: cannot unmarshal string into Go struct field Request.limit of type int"}},
+		{"Render Bad Request", "application/json", `{"limit":20,"int3":7}`, http.StatusBadRequest, apiResponse{true, "body must be a JSON render request: json: unknown field \"int3\""}},
+		{"Render Bad Request", "application/json", `{"limit":20,"int1":3,"int2":5} {}`, http.StatusBadRequest, apiResponse{true, "body must be a JSON render request: a single JSON object is expected"}},
+		{"Render Bad Request", "application/json", `{"limit":20,"int1":3,"int2":5,"str1":"` + strings.Repeat("A", renderRequestMaxBytes) + `"}`, http.StatusBadRequest, apiResponse{true, "body must be a JSON render request: http: request body too large"}},
+		{"Render Bad Request", "application/json", `{"limit":20,"int2":5}`, http.StatusBadRequest, apiResponse{true, "int1 parameter must be >= 1, value 0 was given"}},
+		{"Render Unsupported Media Type", "text/plain", `{"limit":20,"int1":3,"int2":5}`, http.StatusUnsupportedMediaType, apiResponse{true, "Content-Type header must be application/json, value text/plain was given"}},
+		{"Render OK", "application/json; charset=utf-8", `{"limit":20,"int1":3,"int2":5,"str1":"A","str2":"B"}`, http.StatusOK, apiResponse{false, "1,2,A,4,B,A,7,8,A,B,11,A,13,14,AB,16,17,A,19,B"}},
+		{"Render OK", "", `{"limit":15,"int1":3,"int2":5,"str1":"喂,","str2":"世界"}` + "\n", http.StatusOK, apiResponse{false, "1,2,喂,,4,世界,喂,,7,8,喂,,世界,11,喂,,13,14,喂,世界"}},
+	}
+	// Run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Create request
+			request, err := http.NewRequest("POST", "/render", strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.contentType != "" {
+				request.Header.Set("Content-Type", tt.contentType)
+			}
+			// Validate handler
+			validateHandler(t, renderBodyHandler(deps), request, tt.codeWanted, tt.apiResponseWanted)
+		})
+	}
+	// Check that renderings share their statistics with the query parameters ones
+	request, err := http.NewRequest("GET", "/render?limit=20&int1=3&int2=5&str1=A&str2=B", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validateHandler(t, renderHandler(deps), request, http.StatusOK, apiResponse{false, "1,2,A,4,B,A,7,8,A,B,11,A,13,14,AB,16,17,A,19,B"})
+	if got := renderer.GetStatistic(render.NewRequest(20, 3, 5, "A", "B")); got == nil || got.Total != 2 {
+		t.Errorf("GetStatistic() = %+v, want total 2", got)
+	}
+}
+
+func Test_renderFormat(t *testing.T) {
+	// Prepare tests data, a request whose strings hold commas
+	renderer := render.NewRenderer()
+	deps := &dependencies{renderer: renderer}
+	query := "limit=5&int1=2&int2=3&str1=A,&str2=B"
+	tests := []struct {
+		name            string
+		query           string
+		accept          string
+		codeWanted      int
+		contentTypeWant string
+		bodyWanted      string
+	}{
+		{"Default", query, "", http.StatusOK, "application/json", `{"error":false,"response":"1,A,,B,A,,5"}` + "\n"},
+		{"Accept any", query, "text/html, */*;q=0.8", http.StatusOK, "application/json", `{"error":false,"response":"1,A,,B,A,,5"}` + "\n"},
+		{"Accept text", query, "text/plain", http.StatusOK, "text/plain; charset=utf-8", "1\nA,\nB\nA,\n5\n"},
+		{"Accept CSV", query, "application/xml;q=0.5, text/csv", http.StatusOK, "text/csv; charset=utf-8", "1\n\"A,\"\nB\n\"A,\"\n5\n"},
+		{"Format array", query + "&format=array", "text/plain", http.StatusOK, "application/vnd.fizzbuzz.array+json", `["1","A,","B","A,","5"]` + "\n"},
+		{"Format NDJSON", query + "&format=ndjson", "", http.StatusOK, "application/x-ndjson", "\"1\"\n\"A,\"\n\"B\"\n\"A,\"\n\"5\"\n"},
+		{"Format XML", query + "&format=xml", "", http.StatusOK, "application/xml", xml.Header + "<items><item>1</item><item>A,</item><item>B</item><item>A,</item><item>5</item></items>\n"},
+		{"Format CBOR", query + "&format=cbor", "", http.StatusOK, "application/cbor", "\x85\x611\x62A,\x61B\x62A,\x615"},
+		{"Format MessagePack", query + "&format=msgpack", "", http.StatusOK, "application/msgpack", "\x95\xa11\xa2A,\xa1B\xa2A,\xa15"},
+		{"Format Bad Request", query + "&format=yaml", "", http.StatusBadRequest, "", `{"error":true,"response":"format parameter must be one of json, array, text, csv, ndjson, xml, cbor, msgpack, value yaml was given"}` + "\n"},
+		{"Not Acceptable", query, "image/png", http.StatusNotAcceptable, "", `{"error":true,"response":"Accept header must accept a format among json, array, text, csv, ndjson, xml, cbor, msgpack, value image/png was given"}` + "\n"},
+		{"Invalid request", "limit=0&int1=2&int2=3&format=csv", "", http.StatusBadRequest, "", `{"error":true,"response":"limit parameter must be \u003e= 1, value 0 was given"}` + "\n"},
+	}
+	// Run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := http.NewRequest("GET", "/render?"+tt.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.accept != "" {
+				request.Header.Set("Accept", tt.accept)
+			}
+			recorder := httptest.NewRecorder()
+			renderHandler(deps).ServeHTTP(recorder, request)
+			if recorder.Code != tt.codeWanted {
+				t.Errorf("handler returned status code %v, want %v", recorder.Code, tt.codeWanted)
+			}
+			if got := recorder.Header().Get("Content-Type"); tt.contentTypeWant != "" && got != tt.contentTypeWant {
+				t.Errorf("handler returned Content-Type %s, want %s", got, tt.contentTypeWant)
+			}
+			if got := recorder.Body.String(); got != tt.bodyWanted {
+				t.Errorf("handler returned body %q, want %q", got, tt.bodyWanted)
+			}
+		})
+	}
+}
+
+func Test_renderStream(t *testing.T) {
+	// Prepare test server
+	renderer := render.NewRenderer()
+	deps := &dependencies{renderer: renderer}
+	server := httptest.NewServer(createRouter(deps))
+	defer server.Close()
+	// Check that streamed items are sent in chunks, and are the same as the items written at once
+	for _, format := range []string{"json", "ndjson", "xml", "cbor"} {
+		query := "/render?limit=50000&int1=3&int2=5&str1=fizz&str2=buzz&format=" + format
+		response, err := http.Get(server.URL + query + "&stream=true")
+		if err != nil {
+			t.Fatal(err)
+		}
+		streamed, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.StatusCode != http.StatusOK || len(response.TransferEncoding) != 1 || response.TransferEncoding[0] != "chunked" {
+			t.Errorf("%s stream returned status code %d and transfer encoding %v, want a chunked response", format, response.StatusCode, response.TransferEncoding)
+		}
+		if got := response.Trailer.Get("X-Render-Items"); got != "50000" || response.Trailer.Get("X-Render-Truncated") != "false" {
+			t.Errorf("%s stream returned trailers %v, want 50000 items not truncated", format, response.Trailer)
+		}
+		response, err = http.Get(server.URL + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		written, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if format == "cbor" {
+			// Streamed CBOR arrays are of indefinite length
+			streamed = streamed[1 : len(streamed)-1]
+			written = written[3:]
+		}
+		if !bytes.Equal(streamed, written) {
+			t.Errorf("%s stream returned a body of %d bytes, want the %d bytes written at once", format, len(streamed), len(written))
+		}
+	}
+	// Check that a render stopped before its end is reported as truncated
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	request, err := http.NewRequest("GET", "/render?limit=1000&int1=3&int2=5&format=text&stream=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	renderHandler(deps).ServeHTTP(recorder, request.WithContext(ctx))
+	trailer := recorder.Result().Trailer
+	if lines := strings.Count(recorder.Body.String(), "\n"); trailer.Get("X-Render-Truncated") != "true" || trailer.Get("X-Render-Items") != fmt.Sprint(lines) || lines == 1000 {
+		t.Errorf("handler returned trailers %v and %d items, want fewer items than the limit, truncated", trailer, lines)
+	}
+	// Check the invalid streams
+	for query, want := range map[string]apiResponse{
+		"limit=20&int1=3&int2=5&stream=maybe":               {true, "stream parameter must be true or false, value maybe was given"},
+		"limit=20&int1=3&int2=5&stream=true&format=msgpack": {true, "stream parameter is not supported by the msgpack format, value true was given"},
+		"limit=0&int1=3&int2=5&stream=true":                 {true, "limit parameter must be \u003e= 1, value 0 was given"},
+	} {
+		request, err := http.NewRequest("GET", "/render?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		validateHandler(t, renderHandler(deps), request, http.StatusBadRequest, want)
+	}
+}
+
+func Test_renderCache(t *testing.T) {
+	// Prepare test server
+	renderer := render.NewRenderer()
+	server := httptest.NewServer(createRouter(&dependencies{renderer: renderer}))
+	defer server.Close()
+	// Prepare tests data, the ETag of the first render replaces ETAG in the If-None-Match headers of the next ones
+	const query = "/render?limit=2&int1=3&int2=5&str1=A&str2=B"
+	tests := []struct {
+		name               string
+		path               string
+		ifNoneMatch        string
+		codeWanted         int
+		etagWanted         string
+		cacheControlWanted string
+	}{
+		{"Render", query, "", http.StatusOK, "strong", "public, max-age=31536000, immutable"},
+		{"Not modified", query, "ETAG", http.StatusNotModified, "strong", "public, max-age=31536000, immutable"},
+		{"Equivalent request", "/render?limit=2&int1=4&int2=6", "ETAG", http.StatusNotModified, "strong", "public, max-age=31536000, immutable"},
+		{"Weak comparison", query, `"other", W/ETAG`, http.StatusNotModified, "strong", "public, max-age=31536000, immutable"},
+		{"Any", query, "*", http.StatusNotModified, "strong", "public, max-age=31536000, immutable"},
+		{"Other request", "/render?limit=3&int1=3&int2=5&str1=A&str2=B", "ETAG", http.StatusOK, "strong", "public, max-age=31536000, immutable"},
+		{"Other format", query + "&format=array", "ETAG", http.StatusOK, "strong", "public, max-age=31536000, immutable"},
+		{"Other version", "/v2" + query, "ETAG", http.StatusOK, "weak", "public, max-age=31536000, immutable"},
+		{"Stream", query + "&stream=true", "ETAG", http.StatusOK, "", ""},
+		{"Invalid request", "/render?limit=0&int1=3&int2=5", "*", http.StatusBadRequest, "", ""},
+		{"Statistics", "/statistics", "", http.StatusOK, "", "public, max-age=5"},
+		{"Statistics error", "/statistics?top=0", "", http.StatusBadRequest, "", ""},
+		{"Statistic not found", "/v2/statistics/request?limit=9&int1=3&int2=5", "", http.StatusNotFound, "", ""},
+	}
+	// Run tests
+	etag := ""
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := http.NewRequest("GET", server.URL+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.ifNoneMatch != "" {
+				request.Header.Set("If-None-Match", strings.Replace(tt.ifNoneMatch, "ETAG", etag, -1))
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+			if response.StatusCode != tt.codeWanted {
+				t.Errorf("server returned status code %v, want %v", response.StatusCode, tt.codeWanted)
+			}
+			got := response.Header.Get("ETag")
+			if etag == "" {
+				etag = got
+			}
+			switch {
+			case tt.etagWanted == "" && got != "",
+				tt.etagWanted == "strong" && (!strings.HasPrefix(got, `"`) || tt.codeWanted == http.StatusNotModified && got != etag),
+				tt.etagWanted == "weak" && !strings.HasPrefix(got, `W/"`):
+				t.Errorf("server returned ETag %s, want %s", got, tt.etagWanted)
+			}
+			if got := response.Header.Get("Cache-Control"); got != tt.cacheControlWanted {
+				t.Errorf("server returned Cache-Control %s, want %s", got, tt.cacheControlWanted)
+			}
+		})
+	}
+	// Revalidated renders are recorded as successful renderings: the render and its 3 revalidations, then the renders in other shapes
+	if got := renderer.GetStatistic(render.NewRequest(2, 3, 5, "A", "B")); got == nil || got.Total != 7 || got.Outcomes[render.OutcomeSuccess].Total != 7 {
+		t.Errorf("renderer recorded statistic %+v, want 7 successful renderings", got)
+	}
+	if got := renderer.GetStatistic(render.NewRequest(2, 4, 6, "", "")); got == nil || got.Total != 1 {
+		t.Errorf("renderer recorded statistic %+v for the equivalent request, want 1 rendering", got)
+	}
+	// Renders of authenticated clients are not cached by shared caches
+	authenticator := auth.NewAuthenticator()
+	authenticator.AddAPIKey("a-key", &auth.Identity{Subject: "a", Roles: []auth.Role{auth.RoleRenderer}, Method: auth.MethodAPIKey})
+	authenticated := httptest.NewServer(createRouter(&dependencies{renderer: render.NewRenderer(), authenticator: authenticator}))
+	defer authenticated.Close()
+	request, err := http.NewRequest("GET", authenticated.URL+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("X-API-Key", "a-key")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if got := response.Header.Get("Cache-Control"); got != "private, max-age=31536000, immutable" || response.Header.Get("ETag") != etag {
+		t.Errorf("server returned Cache-Control %s and ETag %s, want a private cache and the ETag %s", got, response.Header.Get("ETag"), etag)
+	}
+}
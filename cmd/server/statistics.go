@@ -0,0 +1,596 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jpraynaud/fizzbuzz-server/pkg/render"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// statisticsMaxAge is the duration the statistics may be cached, short as they change with each render
+	statisticsMaxAge = 5 * time.Second
+	// statisticsTopMax is the maximum number of top requests returned by the statistics endpoint
+	statisticsTopMax = 1000
+	// statisticsAggregateTop is the default number of top groups returned by the statistics aggregate endpoint
+	statisticsAggregateTop = 10
+	// statisticsPageSize is the default number of statistics of a page of the statistics requests endpoint
+	statisticsPageSize = 100
+	// statisticsPageSizeMax is the maximum number of statistics of a page of the statistics requests endpoint
+	statisticsPageSizeMax = 1000
+	// statisticsStreamBuffer is the number of changes buffered for a subscriber of the statistics stream endpoint, before it is dropped
+	statisticsStreamBuffer = 256
+	// statisticsStreamKeepAlive is the interval between keep-alive comments of the statistics stream endpoint
+	statisticsStreamKeepAlive = 15 * time.Second
+	// statisticsStreamDuration is the duration of a statistics stream, shorter than the server write timeout (clients reconnect afterwards)
+	statisticsStreamDuration = 50 * time.Second
+	// statisticsStreamRetry is the reconnection delay advised to the clients of the statistics stream endpoint
+	statisticsStreamRetry = time.Second
+	// statisticsTimeSeriesWindow is the default window of the statistics time series endpoint
+	statisticsTimeSeriesWindow = time.Hour
+)
+
+// statisticsView returns the statistics view selected by the view parameter (raw or canonical)
+func statisticsView(recorder render.StatisticRecorder, view string) (render.StatisticRecorder, error) {
+	switch view {
+	case "", "raw":
+		return recorder, nil
+	case "canonical":
+		if canonicalRecorder, ok := recorder.(render.CanonicalStatisticRecorder); ok {
+			return canonicalRecorder.CanonicalStatistics(), nil
+		}
+	}
+	return nil, &render.ParameterError{Parameter: "view", Reason: "must be raw or canonical", Value: view}
+}
+
+// parseOutcome parses the outcome parameter of statistics, empty when all outcomes are selected
+func parseOutcome(value string) (render.Outcome, error) {
+	if value == "" {
+		return "", nil
+	}
+	outcome, err := render.ParseOutcome(value)
+	if err != nil {
+		return "", &render.ParameterError{Parameter: "outcome", Reason: "must be success, invalid, cancelled or error", Value: value}
+	}
+	return outcome, nil
+}
+
+// outcomeStatistics returns the statistics of the renderings of an outcome of a recorder (all outcomes if empty), if supported
+func outcomeStatistics(recorder render.StatisticRecorder, outcome render.Outcome) (render.StatisticRecorder, error) {
+	if outcome == "" {
+		return recorder, nil
+	}
+	outcomeRecorder, ok := recorder.(render.OutcomeStatisticRecorder)
+	if !ok {
+		return nil, errors.New("statistics by outcome are not supported")
+	}
+	return outcomeRecorder.OutcomeStatistics(outcome), nil
+}
+
+// parseTop parses the top parameter of statistics, an integer between 1 and statisticsTopMax
+func parseTop(value string) (int, error) {
+	top, err := strconv.Atoi(value)
+	if err != nil || top < 1 || top > statisticsTopMax {
+		return 0, &render.ParameterError{Parameter: "top", Reason: fmt.Sprintf("must be an integer between 1 and %d", statisticsTopMax), Value: value}
+	}
+	return top, nil
+}
+
+// parseGroupBy parses the group_by parameter of aggregated statistics, a comma separated list of distinct request parameters
+func parseGroupBy(value string) ([]render.Dimension, error) {
+	groupBy, grouped := make([]render.Dimension, 0), make(map[render.Dimension]bool)
+	for _, name := range strings.Split(value, ",") {
+		dimension, err := render.ParseDimension(name)
+		if err != nil || grouped[dimension] {
+			return nil, &render.ParameterError{Parameter: "group_by", Reason: "must be a comma separated list of distinct parameters among limit, int1, int2, str1 and str2", Value: value}
+		}
+		groupBy, grouped[dimension] = append(groupBy, dimension), true
+	}
+	return groupBy, nil
+}
+
+// parseSort parses the sort parameter of browsed statistics (total or last_seen), total by default
+func parseSort(value string) (render.Order, error) {
+	if value == "" {
+		return render.OrderTotal, nil
+	}
+	order, err := render.ParseOrder(value)
+	if err != nil {
+		return "", &render.ParameterError{Parameter: "sort", Reason: "must be total or last_seen", Value: value}
+	}
+	return order, nil
+}
+
+// parseFilters parses the filters of browsed statistics: a request parameter given a value (e.g. int1=3) filters by equality,
+// and each filter parameter is a comparison of a request parameter with a value (e.g. filter=limit>1000)
+func parseFilters(vars url.Values) ([]*render.Filter, error) {
+	filters := make([]*render.Filter, 0)
+	for _, dimension := range render.Dimensions {
+		for _, value := range vars[string(dimension)] {
+			filter, err := render.NewFilter(dimension, render.OperatorEqual, value)
+			if err != nil {
+				return nil, &render.ParameterError{Parameter: string(dimension), Reason: "must be an integer", Value: value}
+			}
+			filters = append(filters, filter)
+		}
+	}
+	for _, expression := range vars["filter"] {
+		filter, err := render.ParseFilter(expression)
+		if err != nil {
+			return nil, &render.ParameterError{Parameter: "filter", Reason: "must compare limit, int1 or int2 to an integer with =, !=, <, <=, > or >=, or str1 or str2 to a string with = or !=", Value: expression}
+		}
+		filters = append(filters, filter)
+	}
+	return filters, nil
+}
+
+// parsePageSize parses the page_size parameter of browsed statistics, an integer between 1 and statisticsPageSizeMax
+func parsePageSize(value string) (int, error) {
+	size, err := strconv.Atoi(value)
+	if err != nil || size < 1 || size > statisticsPageSizeMax {
+		return 0, &render.ParameterError{Parameter: "page_size", Reason: fmt.Sprintf("must be an integer between 1 and %d", statisticsPageSizeMax), Value: value}
+	}
+	return size, nil
+}
+
+// parseFormat parses the format parameter of exported or imported statistics (json or csv), json by default
+func parseFormat(value string) (string, error) {
+	switch value {
+	case "", "json":
+		return "json", nil
+	case "csv":
+		return value, nil
+	}
+	return "", &render.ParameterError{Parameter: "format", Reason: "must be json or csv", Value: value}
+}
+
+// parseThreshold parses the threshold parameter of the statistics stream, a positive integer
+func parseThreshold(value string) (int, error) {
+	threshold, err := strconv.Atoi(value)
+	if err != nil || threshold < 1 {
+		return 0, &render.ParameterError{Parameter: "threshold", Reason: "must be an integer >= 1", Value: value}
+	}
+	return threshold, nil
+}
+
+// writeEvent writes a server-sent event with its data encoded in JSON, and flushes it to the client
+func writeEvent(w http.ResponseWriter, event string, data interface{}) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, encoded); err != nil {
+		return err
+	}
+	w.(http.Flusher).Flush()
+	return nil
+}
+
+// parseWindow parses the window parameter of time bucketed statistics, a duration of whole minutes up to render.StatisticsWindowMax
+func parseWindow(value string) (time.Duration, error) {
+	window, err := time.ParseDuration(value)
+	if err != nil || window < time.Minute || window > render.StatisticsWindowMax || window%time.Minute != 0 {
+		return 0, &render.ParameterError{Parameter: "window", Reason: fmt.Sprintf("must be a duration of whole minutes between 1m and %s (e.g. 5m, 1h, 24h)", render.StatisticsWindowMax), Value: value}
+	}
+	return window, nil
+}
+
+// statisticsMode returns the mode of the statistics of a recorder (exact or approximate)
+func statisticsMode(recorder render.StatisticRecorder) string {
+	if approximateRecorder, ok := recorder.(render.ApproximateStatisticRecorder); ok && approximateRecorder.Approximate() {
+		return "approximate"
+	}
+	return "exact"
+}
+
+// windowedStatistics returns the time bucketed statistics of a recorder, if supported
+func windowedStatistics(recorder render.StatisticRecorder) (render.WindowedStatisticRecorder, error) {
+	windowedRecorder, ok := recorder.(render.WindowedStatisticRecorder)
+	if !ok {
+		return nil, errors.New("time bucketed statistics are not supported")
+	}
+	return windowedRecorder, nil
+}
+
+// Handles rendering statistics
+func statisticsHandler(renderer render.Renderer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Prepare input parameters
+		vars := r.URL.Query()
+		recorder, err := statisticsView(renderer.Statistics(), vars.Get("view"))
+		if err != nil {
+			apiFailure(w, r, http.StatusBadRequest, err)
+			return
+		}
+		outcome, err := parseOutcome(vars.Get("outcome"))
+		if err != nil {
+			apiFailure(w, r, http.StatusBadRequest, err)
+			return
+		}
+		top := 0
+		if vars.Get("top") != "" {
+			if top, err = parseTop(vars.Get("top")); err != nil {
+				apiFailure(w, r, http.StatusBadRequest, err)
+				return
+			}
+		}
+		var window time.Duration
+		if vars.Get("window") != "" {
+			if window, err = parseWindow(vars.Get("window")); err != nil {
+				apiFailure(w, r, http.StatusBadRequest, err)
+				return
+			}
+		}
+
+		if recorder, err = outcomeStatistics(recorder, outcome); err != nil {
+			apiFailure(w, r, http.StatusNotImplemented, err)
+			return
+		}
+
+		// Get statistics
+		var response interface{}
+		switch {
+		case window == 0 && top == 0:
+			response = recorder.GetTopStatistic()
+		case window == 0:
+			response = recorder.GetTopStatistics(top)
+		default:
+			windowedRecorder, err := windowedStatistics(recorder)
+			if err != nil {
+				apiFailure(w, r, http.StatusNotImplemented, err)
+				return
+			}
+			if top > 0 {
+				response = windowedRecorder.GetWindowTopStatistics(window, top)
+			} else if topStatistics := windowedRecorder.GetWindowTopStatistics(window, 1); len(topStatistics) > 0 {
+				topStatistics[0].Rank = 0
+				response = topStatistics[0]
+			}
+		}
+
+		// Write response
+		w.Header().Set("X-Statistics-Mode", statisticsMode(recorder))
+		writeResponse(w, r, response)
+	}
+}
+
+// Handles per minute rendering statistics of a request
+func timeSeriesHandler(renderer render.Renderer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Prepare input parameters
+		vars := r.URL.Query()
+		request, err := parseRequest(vars)
+		if err != nil {
+			apiFailure(w, r, http.StatusBadRequest, err)
+			return
+		}
+		recorder, err := statisticsView(renderer.Statistics(), vars.Get("view"))
+		if err != nil {
+			apiFailure(w, r, http.StatusBadRequest, err)
+			return
+		}
+		outcome, err := parseOutcome(vars.Get("outcome"))
+		if err != nil {
+			apiFailure(w, r, http.StatusBadRequest, err)
+			return
+		}
+		window := statisticsTimeSeriesWindow
+		if vars.Get("window") != "" {
+			if window, err = parseWindow(vars.Get("window")); err != nil {
+				apiFailure(w, r, http.StatusBadRequest, err)
+				return
+			}
+		}
+		if recorder, err = outcomeStatistics(recorder, outcome); err != nil {
+			apiFailure(w, r, http.StatusNotImplemented, err)
+			return
+		}
+		windowedRecorder, err := windowedStatistics(recorder)
+		if err != nil {
+			apiFailure(w, r, http.StatusNotImplemented, err)
+			return
+		}
+
+		// Write response
+		writeResponse(w, r, windowedRecorder.GetTimeSeries(request, window))
+	}
+}
+
+// Handles rendering statistics aggregated by request parameters
+func aggregateHandler(renderer render.Renderer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Prepare input parameters
+		vars := r.URL.Query()
+		recorder, err := statisticsView(renderer.Statistics(), vars.Get("view"))
+		if err != nil {
+			apiFailure(w, r, http.StatusBadRequest, err)
+			return
+		}
+		outcome, err := parseOutcome(vars.Get("outcome"))
+		if err != nil {
+			apiFailure(w, r, http.StatusBadRequest, err)
+			return
+		}
+		groupBy, err := parseGroupBy(vars.Get("group_by"))
+		if err != nil {
+			apiFailure(w, r, http.StatusBadRequest, err)
+			return
+		}
+		top := statisticsAggregateTop
+		if vars.Get("top") != "" {
+			if top, err = parseTop(vars.Get("top")); err != nil {
+				apiFailure(w, r, http.StatusBadRequest, err)
+				return
+			}
+		}
+		if recorder, err = outcomeStatistics(recorder, outcome); err != nil {
+			apiFailure(w, r, http.StatusNotImplemented, err)
+			return
+		}
+		rangeRecorder, ok := recorder.(render.RangeStatisticRecorder)
+		if !ok {
+			apiError(w, r, http.StatusNotImplemented, "aggregated statistics are not supported")
+			return
+		}
+
+		// Write response
+		writeResponse(w, r, render.Aggregate(rangeRecorder, groupBy, top))
+	}
+}
+
+// Handles paginated rendering statistics of the requests, sorted and filtered
+func requestsHandler(renderer render.Renderer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Prepare input parameters
+		vars := r.URL.Query()
+		recorder, err := statisticsView(renderer.Statistics(), vars.Get("view"))
+		if err != nil {
+			apiFailure(w, r, http.StatusBadRequest, err)
+			return
+		}
+		outcome, err := parseOutcome(vars.Get("outcome"))
+		if err != nil {
+			apiFailure(w, r, http.StatusBadRequest, err)
+			return
+		}
+		order, err := parseSort(vars.Get("sort"))
+		if err != nil {
+			apiFailure(w, r, http.StatusBadRequest, err)
+			return
+		}
+		filters, err := parseFilters(vars)
+		if err != nil {
+			apiFailure(w, r, http.StatusBadRequest, err)
+			return
+		}
+		size := statisticsPageSize
+		if vars.Get("page_size") != "" {
+			if size, err = parsePageSize(vars.Get("page_size")); err != nil {
+				apiFailure(w, r, http.StatusBadRequest, err)
+				return
+			}
+		}
+		if recorder, err = outcomeStatistics(recorder, outcome); err != nil {
+			apiFailure(w, r, http.StatusNotImplemented, err)
+			return
+		}
+		rangeRecorder, ok := recorder.(render.RangeStatisticRecorder)
+		if !ok {
+			apiError(w, r, http.StatusNotImplemented, "browsing statistics is not supported")
+			return
+		}
+
+		// Browse statistics
+		page, err := render.Browse(rangeRecorder, order, filters, vars.Get("cursor"), size)
+		if err != nil {
+			apiFailure(w, r, http.StatusBadRequest, &render.ParameterError{Parameter: "cursor", Reason: fmt.Sprintf("must be the next_cursor of a page sorted by %s", order), Value: vars.Get("cursor")})
+			return
+		}
+
+		// Write response
+		w.Header().Set("X-Statistics-Mode", statisticsMode(recorder))
+		writeResponse(w, r, page)
+	}
+}
+
+// Handles rendering statistics of a request
+func requestHandler(renderer render.Renderer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Prepare input parameters
+		vars := r.URL.Query()
+		request, err := parseRequest(vars)
+		if err != nil {
+			apiFailure(w, r, http.StatusBadRequest, err)
+			return
+		}
+		recorder, err := statisticsView(renderer.Statistics(), vars.Get("view"))
+		if err != nil {
+			apiFailure(w, r, http.StatusBadRequest, err)
+			return
+		}
+		outcome, err := parseOutcome(vars.Get("outcome"))
+		if err != nil {
+			apiFailure(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if recorder, err = outcomeStatistics(recorder, outcome); err != nil {
+			apiFailure(w, r, http.StatusNotImplemented, err)
+			return
+		}
+
+		// Get statistic
+		statistic := recorder.GetStatistic(request)
+		if statistic == nil {
+			apiError(w, r, http.StatusNotFound, "no rendering of the request was recorded")
+			return
+		}
+
+		// Write response
+		w.Header().Set("X-Statistics-Mode", statisticsMode(recorder))
+		writeResponse(w, r, statistic)
+	}
+}
+
+// Handles the export of all the rendering statistics, as a JSON or CSV file
+func exportHandler(renderer render.Renderer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Prepare input parameters
+		vars := r.URL.Query()
+		recorder, err := statisticsView(renderer.Statistics(), vars.Get("view"))
+		if err != nil {
+			apiFailure(w, r, http.StatusBadRequest, err)
+			return
+		}
+		outcome, err := parseOutcome(vars.Get("outcome"))
+		if err != nil {
+			apiFailure(w, r, http.StatusBadRequest, err)
+			return
+		}
+		format, err := parseFormat(vars.Get("format"))
+		if err != nil {
+			apiFailure(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if recorder, err = outcomeStatistics(recorder, outcome); err != nil {
+			apiFailure(w, r, http.StatusNotImplemented, err)
+			return
+		}
+		rangeRecorder, ok := recorder.(render.RangeStatisticRecorder)
+		if !ok {
+			apiError(w, r, http.StatusNotImplemented, "statistics export is not supported")
+			return
+		}
+
+		// Write export
+		export := render.NewExport(rangeRecorder, time.Now())
+		w.Header().Set("X-Statistics-Mode", statisticsMode(recorder))
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="statistics-%s.%s"`, export.Time.Format("20060102T150405Z"), format))
+		if format == "csv" {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			if err := export.WriteCSV(w); err != nil {
+				log.Errorf("Statistics export failed: %v", err)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(export)
+	}
+}
+
+// Handles the federation state of the node, that its peers pull and merge
+func federationHandler(renderer render.Renderer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		federatedRecorder, ok := renderer.Statistics().(render.FederatedStatisticRecorder)
+		if !ok {
+			apiError(w, r, http.StatusNotImplemented, "statistics federation is not enabled")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(federatedRecorder.FederationState())
+	}
+}
+
+// Handles the live stream of the changes of the rendering statistics, as server-sent events
+// A top event is sent on connection and whenever the top request changes, a threshold event whenever the total of a request
+// reaches the threshold parameter, and a reset event when the statistics are reset
+// A subscriber that does not keep up with the changes is sent a dropped event and disconnected
+func streamHandler(renderer render.Renderer, closing <-chan struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Prepare input parameters
+		vars := r.URL.Query()
+		recorder, err := statisticsView(renderer.Statistics(), vars.Get("view"))
+		if err != nil {
+			apiFailure(w, r, http.StatusBadRequest, err)
+			return
+		}
+		outcome, err := parseOutcome(vars.Get("outcome"))
+		if err != nil {
+			apiFailure(w, r, http.StatusBadRequest, err)
+			return
+		}
+		threshold := 0
+		if vars.Get("threshold") != "" {
+			if threshold, err = parseThreshold(vars.Get("threshold")); err != nil {
+				apiFailure(w, r, http.StatusBadRequest, err)
+				return
+			}
+		}
+		if recorder, err = outcomeStatistics(recorder, outcome); err != nil {
+			apiFailure(w, r, http.StatusNotImplemented, err)
+			return
+		}
+		notifyingRecorder, ok := recorder.(render.NotifyingStatisticRecorder)
+		if _, flushes := w.(http.Flusher); !ok || !flushes {
+			apiError(w, r, http.StatusNotImplemented, "statistics stream is not supported")
+			return
+		}
+
+		// Subscribe to the changes, then send the current top request
+		subscription := notifyingRecorder.Subscribe(statisticsStreamBuffer)
+		defer subscription.Cancel()
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.Header().Set("X-Statistics-Mode", statisticsMode(recorder))
+		fmt.Fprintf(w, "retry: %d\n\n", statisticsStreamRetry/time.Millisecond)
+		if err := writeEvent(w, "top", recorder.GetTopStatistic()); err != nil {
+			return
+		}
+
+		// Send events until the client disconnects, the stream ends or the server shuts down
+		keepAlive := time.NewTicker(statisticsStreamKeepAlive)
+		defer keepAlive.Stop()
+		end := time.NewTimer(statisticsStreamDuration)
+		defer end.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-end.C:
+				return
+			case <-closing:
+				return
+			case <-keepAlive.C:
+				if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+				w.(http.Flusher).Flush()
+			case change, ok := <-subscription.Changes:
+				if !ok {
+					if subscription.Dropped() {
+						log.Warnf("%s - %s - statistics stream subscriber dropped", r.Method, r.RequestURI)
+						writeEvent(w, "dropped", "the subscriber did not keep up with the changes of the statistics")
+					}
+					return
+				}
+				if err := writeChangeEvents(w, change, threshold); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// writeChangeEvents writes the server-sent events of a change of the statistics, given the threshold of the stream (none if 0)
+func writeChangeEvents(w http.ResponseWriter, change *render.StatisticChange, threshold int) error {
+	if change.Reset {
+		return writeEvent(w, "reset", nil)
+	}
+	statistic := render.NewRequestStatistic(&change.Request, change.Total)
+	if change.TopChanged {
+		if err := writeEvent(w, "top", statistic); err != nil {
+			return err
+		}
+	}
+	if threshold > 0 && change.Previous < threshold && change.Total >= threshold {
+		return writeEvent(w, "threshold", statistic)
+	}
+	return nil
+}
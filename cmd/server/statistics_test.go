@@ -0,0 +1,578 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jpraynaud/fizzbuzz-server/pkg/render"
+	"github.com/jpraynaud/fizzbuzz-server/pkg/resp"
+	"github.com/jpraynaud/fizzbuzz-server/pkg/resp/resptest"
+)
+
+func Test_statisticsHandler(t *testing.T) {
+	// Create new renderer
+	renderer := render.NewRenderer()
+	deps := &dependencies{renderer: renderer}
+	// Prepare tests data
+	type args struct {
+		handler           http.HandlerFunc
+		method            string
+		path              string
+		query             string
+		codeWanted        int
+		apiResponseWanted apiResponse
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{"Render OK", args{renderHandler(deps), "GET", "/render", "limit=20&int1=3&int2=5&str1=A&str2=B", http.StatusOK, apiResponse{false, "1,2,A,4,B,A,7,8,A,B,11,A,13,14,AB,16,17,A,19,B"}}},
+		{"Render OK", args{renderHandler(deps), "GET", "/render", "limit=20&int1=3&int2=5&str1=AA&str2=BBB", http.StatusOK, apiResponse{false, "1,2,AA,4,BBB,AA,7,8,AA,BBB,11,AA,13,14,AABBB,16,17,AA,19,BBB"}}},
+		{"Render OK", args{renderHandler(deps), "GET", "/render", "limit=20&int1=3&int2=5&str1=A&str2=B", http.StatusOK, apiResponse{false, "1,2,A,4,B,A,7,8,A,B,11,A,13,14,AB,16,17,A,19,B"}}},
+		{"Statistics OK", args{statisticsHandler(renderer), "GET", "/statistics", "", http.StatusOK, apiResponse{false, render.RequestStatistic{Request: render.Request{Limit: 20, Int1: 3, Int2: 5, Str1: "A", Str2: "B"}, Total: 2, Outcomes: succeeded(2)}}}},
+		{"Render OK", args{renderHandler(deps), "GET", "/render", "limit=20&int1=3&int2=5&str1=AA&str2=BBB", http.StatusOK, apiResponse{false, "1,2,AA,4,BBB,AA,7,8,AA,BBB,11,AA,13,14,AABBB,16,17,AA,19,BBB"}}},
+		{"Render OK", args{renderHandler(deps), "GET", "/render", "limit=20&int1=3&int2=5&str1=AA&str2=BBB", http.StatusOK, apiResponse{false, "1,2,AA,4,BBB,AA,7,8,AA,BBB,11,AA,13,14,AABBB,16,17,AA,19,BBB"}}},
+		{"Statistics OK", args{statisticsHandler(renderer), "GET", "/statistics", "", http.StatusOK, apiResponse{false, render.RequestStatistic{Request: render.Request{Limit: 20, Int1: 3, Int2: 5, Str1: "AA", Str2: "BBB"}, Total: 3, Outcomes: succeeded(3)}}}},
+		{"Render OK", args{renderHandler(deps), "GET", "/render", "limit=5&int1=3&int2=3&str1=A&str2=B", http.StatusOK, apiResponse{false, "1,2,AB,4,5"}}},
+		{"Render OK", args{renderHandler(deps), "GET", "/render", "limit=5&int1=3&int2=30&str1=AB&str2=C", http.StatusOK, apiResponse{false, "1,2,AB,4,5"}}},
+		{"Render OK", args{renderHandler(deps), "GET", "/render", "limit=5&int1=30&int2=3&str1=C&str2=AB", http.StatusOK, apiResponse{false, "1,2,AB,4,5"}}},
+		{"Render OK", args{renderHandler(deps), "GET", "/render", "limit=5&int1=3&int2=10&str1=AB&str2=", http.StatusOK, apiResponse{false, "1,2,AB,4,5"}}},
+		{"Statistics OK", args{statisticsHandler(renderer), "GET", "/statistics", "view=raw", http.StatusOK, apiResponse{false, render.RequestStatistic{Request: render.Request{Limit: 20, Int1: 3, Int2: 5, Str1: "AA", Str2: "BBB"}, Total: 3, Outcomes: succeeded(3)}}}},
+		{"Statistics OK", args{statisticsHandler(renderer), "GET", "/statistics", "view=canonical", http.StatusOK, apiResponse{false, render.RequestStatistic{Request: render.Request{Limit: 5, Int1: 3, Int2: 3, Str1: "AB", Str2: ""}, Total: 4, Outcomes: succeeded(4)}}}},
+		{"Statistics Bad Request", args{statisticsHandler(renderer), "GET", "/statistics", "view=Z", http.StatusBadRequest, apiResponse{true, "view parameter must be raw or canonical, value Z was given"}}},
+		{"Statistics OK", args{statisticsHandler(renderer), "GET", "/statistics", "top=2", http.StatusOK, apiResponse{false, []render.RequestStatistic{
+			{Request: render.Request{Limit: 20, Int1: 3, Int2: 5, Str1: "AA", Str2: "BBB"}, Total: 3, Rank: 1, Outcomes: succeeded(3)},
+			{Request: render.Request{Limit: 20, Int1: 3, Int2: 5, Str1: "A", Str2: "B"}, Total: 2, Rank: 2, Outcomes: succeeded(2)},
+		}}}},
+		{"Statistics OK", args{statisticsHandler(renderer), "GET", "/statistics", "top=2&view=canonical", http.StatusOK, apiResponse{false, []render.RequestStatistic{
+			{Request: render.Request{Limit: 5, Int1: 3, Int2: 3, Str1: "AB", Str2: ""}, Total: 4, Rank: 1, Outcomes: succeeded(4)},
+			{Request: render.Request{Limit: 20, Int1: 3, Int2: 5, Str1: "AA", Str2: "BBB"}, Total: 3, Rank: 2, Outcomes: succeeded(3)},
+		}}}},
+		{"Statistics Bad Request", args{statisticsHandler(renderer), "GET", "/statistics", "top=0", http.StatusBadRequest, apiResponse{true, "top parameter must be an integer between 1 and 1000, value 0 was given"}}},
+		{"Statistics Bad Request", args{statisticsHandler(renderer), "GET", "/statistics", "top=Z", http.StatusBadRequest, apiResponse{true, "top parameter must be an integer between 1 and 1000, value Z was given"}}},
+		{"Statistics OK", args{statisticsHandler(renderer), "GET", "/statistics", "window=5m", http.StatusOK, apiResponse{false, render.RequestStatistic{Request: render.Request{Limit: 20, Int1: 3, Int2: 5, Str1: "AA", Str2: "BBB"}, Total: 3}}}},
+		{"Statistics OK", args{statisticsHandler(renderer), "GET", "/statistics", "window=24h&top=1&view=canonical", http.StatusOK, apiResponse{false, []render.RequestStatistic{
+			{Request: render.Request{Limit: 5, Int1: 3, Int2: 3, Str1: "AB", Str2: ""}, Total: 4, Rank: 1},
+		}}}},
+		{"Statistics Bad Request", args{statisticsHandler(renderer), "GET", "/statistics", "window=48h", http.StatusBadRequest, apiResponse{true, "window parameter must be a duration of whole minutes between 1m and 24h0m0s (e.g. 5m, 1h, 24h), value 48h was given"}}},
+		{"Statistics Bad Request", args{statisticsHandler(renderer), "GET", "/statistics", "window=90s", http.StatusBadRequest, apiResponse{true, "window parameter must be a duration of whole minutes between 1m and 24h0m0s (e.g. 5m, 1h, 24h), value 90s was given"}}},
+		{"Render Bad Request", args{renderHandler(deps), "GET", "/render", "limit=0&int1=3&int2=5&str1=A&str2=B", http.StatusBadRequest, apiResponse{true, "limit parameter must be >= 1, value 0 was given"}}},
+		{"Render Bad Request", args{renderHandler(deps), "GET", "/render", "limit=0&int1=3&int2=5&str1=A&str2=B", http.StatusBadRequest, apiResponse{true, "limit parameter must be >= 1, value 0 was given"}}},
+		{"Render Bad Request", args{renderHandler(deps), "GET", "/render", "limit=0&int1=3&int2=5&str1=A&str2=B", http.StatusBadRequest, apiResponse{true, "limit parameter must be >= 1, value 0 was given"}}},
+		{"Render Bad Request", args{renderHandler(deps), "GET", "/render", "limit=0&int1=3&int2=5&str1=A&str2=B", http.StatusBadRequest, apiResponse{true, "limit parameter must be >= 1, value 0 was given"}}},
+		{"Statistics OK", args{statisticsHandler(renderer), "GET", "/statistics", "", http.StatusOK, apiResponse{false, render.RequestStatistic{Request: render.Request{Limit: 0, Int1: 3, Int2: 5, Str1: "A", Str2: "B"}, Total: 4, Outcomes: map[render.Outcome]*render.OutcomeStatistic{render.OutcomeInvalid: {Total: 4}}}}}},
+		{"Statistics OK", args{statisticsHandler(renderer), "GET", "/statistics", "outcome=success", http.StatusOK, apiResponse{false, render.RequestStatistic{Request: render.Request{Limit: 20, Int1: 3, Int2: 5, Str1: "AA", Str2: "BBB"}, Total: 3}}}},
+		{"Statistics OK", args{statisticsHandler(renderer), "GET", "/statistics", "outcome=invalid&top=1", http.StatusOK, apiResponse{false, []render.RequestStatistic{
+			{Request: render.Request{Limit: 0, Int1: 3, Int2: 5, Str1: "A", Str2: "B"}, Total: 4, Rank: 1},
+		}}}},
+		{"Statistics OK", args{statisticsHandler(renderer), "GET", "/statistics", "outcome=success&view=canonical&window=5m", http.StatusOK, apiResponse{false, render.RequestStatistic{Request: render.Request{Limit: 5, Int1: 3, Int2: 3, Str1: "AB", Str2: ""}, Total: 4}}}},
+		{"Statistics Bad Request", args{statisticsHandler(renderer), "GET", "/statistics", "outcome=Z", http.StatusBadRequest, apiResponse{true, "outcome parameter must be success, invalid, cancelled or error, value Z was given"}}},
+		{"Time Series Bad Request", args{timeSeriesHandler(renderer), "GET", "/statistics/timeseries", "limit=Z", http.StatusBadRequest, apiResponse{true, "limit parameter must be an integer, value Z was given"}}},
+		{"Time Series Bad Request", args{timeSeriesHandler(renderer), "GET", "/statistics/timeseries", "limit=20&int1=3&int2=5&str1=A&str2=B&window=Z", http.StatusBadRequest, apiResponse{true, "window parameter must be a duration of whole minutes between 1m and 24h0m0s (e.g. 5m, 1h, 24h), value Z was given"}}},
+	}
+	// Reset statistics
+	renderer.ResetStatistics()
+	// Run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Create request
+			request, err := http.NewRequest(tt.args.method, tt.args.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.args.query != "" {
+				mappedQuery, err := url.ParseQuery(tt.args.query)
+				if err != nil {
+					t.Fatal(err)
+				}
+				request.URL.RawQuery = mappedQuery.Encode()
+			}
+			// Validate handler
+			validateHandler(t, tt.args.handler, request, tt.args.codeWanted, tt.args.apiResponseWanted)
+		})
+	}
+}
+
+func Test_statisticsHandlerRedis(t *testing.T) {
+	// Create new renderer with redis statistics
+	redisServer := resptest.NewServer()
+	defer redisServer.Close()
+	renderer := render.NewRendererWithStatistics(render.NewRedisStatistics(resp.NewClient(redisServer.Addr, time.Second, 1), "test:"))
+	renderer.RecordStatistic(render.NewRequest(20, 3, 5, "A", "B"))
+	tests := []struct {
+		name              string
+		query             string
+		codeWanted        int
+		apiResponseWanted apiResponse
+	}{
+		{"Statistics OK", "", http.StatusOK, apiResponse{false, render.RequestStatistic{Request: render.Request{Limit: 20, Int1: 3, Int2: 5, Str1: "A", Str2: "B"}, Total: 1}}},
+		{"Statistics Not Implemented", "window=5m", http.StatusNotImplemented, apiResponse{true, "time bucketed statistics are not supported"}},
+		{"Statistics Not Implemented", "outcome=success", http.StatusNotImplemented, apiResponse{true, "statistics by outcome are not supported"}},
+	}
+	// Run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := http.NewRequest("GET", "/statistics?"+tt.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			validateHandler(t, statisticsHandler(renderer), request, tt.codeWanted, tt.apiResponseWanted)
+		})
+	}
+}
+
+func Test_statisticsHandlerApproximate(t *testing.T) {
+	// Create new renderers with exact and approximate statistics
+	request := render.NewRequest(20, 3, 5, "A", "B")
+	exactRenderer := render.NewRenderer()
+	exactRenderer.RecordStatistic(request)
+	approximateRenderer := render.NewRendererWithStatistics(render.NewApproximateStatistics(0.01, 0.01, 10))
+	approximateRenderer.RecordStatistic(request)
+	tests := []struct {
+		name              string
+		renderer          render.Renderer
+		modeWanted        string
+		apiResponseWanted apiResponse
+	}{
+		{"Statistics Exact", exactRenderer, "exact", apiResponse{false, render.RequestStatistic{Request: *request, Total: 1, Outcomes: succeeded(1)}}},
+		{"Statistics Approximate", approximateRenderer, "approximate", apiResponse{false, render.RequestStatistic{Request: *request, Total: 1, Approximate: true}}},
+	}
+	// Run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpRequest, err := http.NewRequest("GET", "/statistics", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			validateHandler(t, statisticsHandler(tt.renderer), httpRequest, http.StatusOK, tt.apiResponseWanted)
+			recorder := httptest.NewRecorder()
+			statisticsHandler(tt.renderer).ServeHTTP(recorder, httpRequest)
+			if got := recorder.Header().Get("X-Statistics-Mode"); got != tt.modeWanted {
+				t.Errorf("handler returned statistics mode %v, want %v", got, tt.modeWanted)
+			}
+		})
+	}
+}
+
+func Test_aggregateHandler(t *testing.T) {
+	// Create new renderers and record requests
+	renderer := render.NewRenderer()
+	renderer.RecordStatistic(render.NewRequest(20, 3, 5, "A", "B"))
+	renderer.RecordStatistic(render.NewRequest(30, 3, 5, "C", "D"))
+	renderer.RecordStatistic(render.NewRequest(10, 2, 5, "A", "D"))
+	approximateRenderer := render.NewRendererWithStatistics(render.NewApproximateStatistics(0.01, 0.01, 10))
+	limit := &render.LimitDistribution{Min: 10, P50: 20, P90: 30, P99: 30, Max: 30, Histogram: []*render.LimitBucket{{From: 10, To: 99, Total: 3}}}
+	tests := []struct {
+		name              string
+		renderer          render.Renderer
+		query             string
+		codeWanted        int
+		apiResponseWanted apiResponse
+	}{
+		{"Aggregate OK", renderer, "group_by=int1,int2", http.StatusOK, apiResponse{false, render.Aggregation{
+			GroupBy: []render.Dimension{render.DimensionInt1, render.DimensionInt2}, Total: 3, Requests: 3, Limit: limit,
+			Groups: []*render.GroupStatistic{
+				{Group: map[render.Dimension]interface{}{render.DimensionInt1: 3, render.DimensionInt2: 5}, Total: 2, Requests: 2, Rank: 1},
+				{Group: map[render.Dimension]interface{}{render.DimensionInt1: 2, render.DimensionInt2: 5}, Total: 1, Requests: 1, Rank: 2},
+			},
+		}}},
+		{"Aggregate OK", renderer, "group_by=str1&top=1", http.StatusOK, apiResponse{false, render.Aggregation{
+			GroupBy: []render.Dimension{render.DimensionStr1}, Total: 3, Requests: 3, Limit: limit,
+			Groups: []*render.GroupStatistic{
+				{Group: map[render.Dimension]interface{}{render.DimensionStr1: "A"}, Total: 2, Requests: 2, Rank: 1},
+			},
+		}}},
+		{"Aggregate Bad Request", renderer, "", http.StatusBadRequest, apiResponse{true, "group_by parameter must be a comma separated list of distinct parameters among limit, int1, int2, str1 and str2, value  was given"}},
+		{"Aggregate Bad Request", renderer, "group_by=int1,int1", http.StatusBadRequest, apiResponse{true, "group_by parameter must be a comma separated list of distinct parameters among limit, int1, int2, str1 and str2, value int1,int1 was given"}},
+		{"Aggregate Bad Request", renderer, "group_by=int3", http.StatusBadRequest, apiResponse{true, "group_by parameter must be a comma separated list of distinct parameters among limit, int1, int2, str1 and str2, value int3 was given"}},
+		{"Aggregate Bad Request", renderer, "group_by=int1&top=Z", http.StatusBadRequest, apiResponse{true, "top parameter must be an integer between 1 and 1000, value Z was given"}},
+		{"Aggregate Not Implemented", approximateRenderer, "group_by=int1", http.StatusNotImplemented, apiResponse{true, "aggregated statistics are not supported"}},
+	}
+	// Run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := http.NewRequest("GET", "/statistics/aggregate?"+tt.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			validateHandler(t, aggregateHandler(tt.renderer), request, tt.codeWanted, tt.apiResponseWanted)
+		})
+	}
+}
+
+func Test_requestsHandler(t *testing.T) {
+	// Create new renderers and record requests
+	renderer := render.NewRenderer()
+	for _, request := range []*render.Request{
+		render.NewRequest(20, 3, 5, "A", "B"),
+		render.NewRequest(30, 3, 5, "C", "D"),
+		render.NewRequest(10, 2, 5, "A", "D"),
+		render.NewRequest(20, 3, 5, "A", "B"),
+	} {
+		renderer.RecordStatistic(request)
+	}
+	approximateRenderer := render.NewRendererWithStatistics(render.NewApproximateStatistics(0.01, 0.01, 10))
+	statistics := []*render.RequestStatistic{
+		{Request: render.Request{Limit: 20, Int1: 3, Int2: 5, Str1: "A", Str2: "B"}, Total: 2},
+		{Request: render.Request{Limit: 10, Int1: 2, Int2: 5, Str1: "A", Str2: "D"}, Total: 1},
+		{Request: render.Request{Limit: 30, Int1: 3, Int2: 5, Str1: "C", Str2: "D"}, Total: 1},
+	}
+	tests := []struct {
+		name              string
+		renderer          render.Renderer
+		query             string
+		codeWanted        int
+		apiResponseWanted apiResponse
+	}{
+		{"Requests OK", renderer, "", http.StatusOK, apiResponse{false, render.Page{Statistics: statistics}}},
+		{"Requests OK", renderer, "sort=total&int1=3", http.StatusOK, apiResponse{false, render.Page{Statistics: []*render.RequestStatistic{statistics[0], statistics[2]}}}},
+		{"Requests OK", renderer, "filter=limit>10&filter=str2!=B", http.StatusOK, apiResponse{false, render.Page{Statistics: statistics[2:]}}},
+		{"Requests OK", renderer, "view=canonical&outcome=success&str1=C", http.StatusOK, apiResponse{false, render.Page{Statistics: statistics[2:]}}},
+		{"Requests OK", renderer, "outcome=error", http.StatusOK, apiResponse{false, render.Page{Statistics: []*render.RequestStatistic{}}}},
+		{"Requests Bad Request", renderer, "sort=rank", http.StatusBadRequest, apiResponse{true, "sort parameter must be total or last_seen, value rank was given"}},
+		{"Requests Bad Request", renderer, "int1=Z", http.StatusBadRequest, apiResponse{true, "int1 parameter must be an integer, value Z was given"}},
+		{"Requests Bad Request", renderer, "filter=str1>A", http.StatusBadRequest, apiResponse{true, "filter parameter must compare limit, int1 or int2 to an integer with =, !=, <, <=, > or >=, or str1 or str2 to a string with = or !=, value str1>A was given"}},
+		{"Requests Bad Request", renderer, "page_size=1001", http.StatusBadRequest, apiResponse{true, "page_size parameter must be an integer between 1 and 1000, value 1001 was given"}},
+		{"Requests Bad Request", renderer, "cursor=Z", http.StatusBadRequest, apiResponse{true, "cursor parameter must be the next_cursor of a page sorted by total, value Z was given"}},
+		{"Requests Not Implemented", approximateRenderer, "", http.StatusNotImplemented, apiResponse{true, "browsing statistics is not supported"}},
+	}
+	// Run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := http.NewRequest("GET", "/statistics/requests?"+tt.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			validateHandler(t, requestsHandler(tt.renderer), request, tt.codeWanted, tt.apiResponseWanted)
+		})
+	}
+	// Check that pages follow each other until the last one
+	got := make([]*render.RequestStatistic, 0)
+	query := url.Values{"page_size": {"2"}}
+	for pages := 1; ; pages++ {
+		recorder := httptest.NewRecorder()
+		request, err := http.NewRequest("GET", "/statistics/requests?"+query.Encode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		requestsHandler(renderer).ServeHTTP(recorder, request)
+		var page struct {
+			Response render.Page `json:"response"`
+		}
+		if err := json.NewDecoder(recorder.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, page.Response.Statistics...)
+		if page.Response.NextCursor == "" {
+			break
+		}
+		if pages == len(statistics) {
+			t.Fatalf("handler returned more pages than statistics")
+		}
+		query.Set("cursor", page.Response.NextCursor)
+	}
+	for _, statistic := range got {
+		statistic.FirstSeen, statistic.LastSeen = nil, nil
+	}
+	if !reflect.DeepEqual(got, statistics) {
+		t.Errorf("handler returned pages of statistics %v, want %v", got, statistics)
+	}
+}
+
+func Test_requestHandler(t *testing.T) {
+	// Create new renderer and record requests
+	renderer := render.NewRenderer()
+	renderer.RecordStatistic(render.NewRequest(20, 3, 5, "A", "B"))
+	renderer.RecordStatistic(render.NewRequest(20, 3, 5, "A", "B"))
+	renderer.RecordStatistic(render.NewRequest(5, 3, 30, "AB", "C"))
+	tests := []struct {
+		name              string
+		query             string
+		codeWanted        int
+		apiResponseWanted apiResponse
+	}{
+		{"Request OK", "limit=20&int1=3&int2=5&str1=A&str2=B", http.StatusOK, apiResponse{false, render.RequestStatistic{Request: render.Request{Limit: 20, Int1: 3, Int2: 5, Str1: "A", Str2: "B"}, Total: 2, Outcomes: succeeded(2)}}},
+		{"Request OK", "limit=20&int1=3&int2=5&str1=A&str2=B&outcome=success", http.StatusOK, apiResponse{false, render.RequestStatistic{Request: render.Request{Limit: 20, Int1: 3, Int2: 5, Str1: "A", Str2: "B"}, Total: 2}}},
+		{"Request OK", "limit=5&int1=3&int2=3&str1=AB&view=canonical", http.StatusOK, apiResponse{false, render.RequestStatistic{Request: render.Request{Limit: 5, Int1: 3, Int2: 3, Str1: "AB", Str2: ""}, Total: 1, Outcomes: succeeded(1)}}},
+		{"Request Not Found", "limit=20&int1=3&int2=5&str1=A&str2=C", http.StatusNotFound, apiResponse{true, "no rendering of the request was recorded"}},
+		{"Request Not Found", "limit=20&int1=3&int2=5&str1=A&str2=B&outcome=invalid", http.StatusNotFound, apiResponse{true, "no rendering of the request was recorded"}},
+		{"Request Bad Request", "limit=Z&int1=3&int2=5", http.StatusBadRequest, apiResponse{true, "limit parameter must be an integer, value Z was given"}},
+		{"Request Bad Request", "limit=20&int1=3&int2=5&view=Z", http.StatusBadRequest, apiResponse{true, "view parameter must be raw or canonical, value Z was given"}},
+	}
+	// Run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := http.NewRequest("GET", "/statistics/request?"+tt.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			validateHandler(t, requestHandler(renderer), request, tt.codeWanted, tt.apiResponseWanted)
+		})
+	}
+}
+
+func Test_exportHandler(t *testing.T) {
+	// Create new renderers and record requests
+	renderer := render.NewRenderer()
+	renderer.RecordStatistic(render.NewRequest(20, 3, 5, "A", "B"))
+	renderer.RecordStatistic(render.NewRequest(20, 3, 5, "A", "B"))
+	renderer.RecordStatistic(render.NewRequest(10, 2, 7, "C", "D"))
+	approximateRenderer := render.NewRendererWithStatistics(render.NewApproximateStatistics(0.01, 0.01, 10))
+	tests := []struct {
+		name        string
+		renderer    render.Renderer
+		query       string
+		codeWanted  int
+		typeWanted  string
+		bodyWanted  string
+		rowsWanted  int
+		totalWanted int
+	}{
+		{"Export JSON", renderer, "", http.StatusOK, "application/json", "", 2, 3},
+		{"Export JSON", renderer, "format=json&view=canonical&outcome=success", http.StatusOK, "application/json", "", 2, 3},
+		{"Export CSV", renderer, "format=csv", http.StatusOK, "text/csv; charset=utf-8", "limit,int1,int2,str1,str2,total,first_seen,last_seen,latency_count,latency_mean_ms,latency_max_ms\n20,3,5,A,B,2,", 2, 3},
+		{"Export Bad Request", renderer, "format=xml", http.StatusBadRequest, "", `{"error":true,"response":"format parameter must be json or csv, value xml was given"}`, 0, 0},
+		{"Export Not Implemented", approximateRenderer, "", http.StatusNotImplemented, "", `{"error":true,"response":"statistics export is not supported"}`, 0, 0},
+	}
+	// Run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			request, err := http.NewRequest("GET", "/statistics/export?"+tt.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			exportHandler(tt.renderer).ServeHTTP(recorder, request)
+			if recorder.Code != tt.codeWanted {
+				t.Fatalf("handler returned status code %v, want %v", recorder.Code, tt.codeWanted)
+			}
+			if tt.typeWanted != "" && recorder.Header().Get("Content-Type") != tt.typeWanted {
+				t.Errorf("handler returned content type %q, want %q", recorder.Header().Get("Content-Type"), tt.typeWanted)
+			}
+			if !strings.HasPrefix(recorder.Body.String(), tt.bodyWanted) {
+				t.Errorf("handler returned body %q, want a body starting with %q", recorder.Body.String(), tt.bodyWanted)
+			}
+			if tt.codeWanted != http.StatusOK {
+				return
+			}
+			// Check that the export reads back
+			export := &render.Export{}
+			if tt.typeWanted == "application/json" {
+				err = json.NewDecoder(recorder.Body).Decode(export)
+			} else {
+				export, err = render.ReadExportCSV(recorder.Body)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			total := 0
+			for _, statistic := range export.Statistics {
+				total += statistic.Total
+			}
+			if len(export.Statistics) != tt.rowsWanted || total != tt.totalWanted {
+				t.Errorf("handler exported %v statistics with a total of %v, want %v and %v", len(export.Statistics), total, tt.rowsWanted, tt.totalWanted)
+			}
+		})
+	}
+}
+
+func Test_streamHandler(t *testing.T) {
+	// Create new renderer, record a request and start a test server
+	renderer := render.NewRenderer()
+	request, otherRequest := render.NewRequest(20, 3, 5, "A", "B"), render.NewRequest(10, 2, 7, "C", "D")
+	renderer.RecordStatistic(request)
+	closing := make(chan struct{})
+	server := httptest.NewServer(streamHandler(renderer, closing))
+	defer server.Close()
+	// Connect to the stream
+	response, err := http.Get(server.URL + "?threshold=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if got := response.Header.Get("Content-Type"); response.StatusCode != http.StatusOK || got != "text/event-stream" {
+		t.Fatalf("handler returned status code %v and content type %q, want %v and %q", response.StatusCode, got, http.StatusOK, "text/event-stream")
+	}
+	events := bufio.NewReader(response.Body)
+	// readEvent reads the next event of the stream, and returns its name and data
+	readEvent := func() (string, string) {
+		var event, data string
+		for {
+			line, err := events.ReadString('\n')
+			if err != nil {
+				t.Fatalf("stream ended before an event: %v", err)
+			}
+			switch line = strings.TrimSuffix(line, "\n"); {
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				data = strings.TrimPrefix(line, "data: ")
+			case line == "" && event != "":
+				return event, data
+			}
+		}
+	}
+	// Check the events of the changes, once subscribed (when the first event is sent)
+	tests := []struct {
+		event string
+		data  interface{}
+	}{
+		{"top", render.RequestStatistic{Request: *request, Total: 1, Outcomes: succeeded(1)}},
+		{"top", render.RequestStatistic{Request: *otherRequest, Total: 1}},
+		{"threshold", render.RequestStatistic{Request: *otherRequest, Total: 2}},
+		{"reset", nil},
+	}
+	for i, tt := range tests {
+		event, data := readEvent()
+		if i == 0 {
+			renderer.RecordStatistic(otherRequest)
+			renderer.RecordStatistic(otherRequest)
+			renderer.ResetStatistics()
+		}
+		want, err := json.Marshal(tt.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event != tt.event || normalizeBody(t, []byte(data)) != normalizeBody(t, want) {
+			t.Errorf("stream sent event %s with data %s, want %s with data %s", event, data, tt.event, want)
+		}
+	}
+	// Check that the stream ends when the server shuts down
+	close(closing)
+	if _, err := ioutil.ReadAll(events); err != nil {
+		t.Errorf("stream ended with %v, want the end of the stream", err)
+	}
+}
+
+func Test_streamHandlerErrors(t *testing.T) {
+	redisRenderer := render.NewRendererWithStatistics(render.NewRedisStatistics(nil, ""))
+	tests := []struct {
+		name              string
+		renderer          render.Renderer
+		query             string
+		codeWanted        int
+		apiResponseWanted apiResponse
+	}{
+		{"Stream Bad Request", render.NewRenderer(), "threshold=0", http.StatusBadRequest, apiResponse{true, "threshold parameter must be an integer >= 1, value 0 was given"}},
+		{"Stream Bad Request", render.NewRenderer(), "view=Z", http.StatusBadRequest, apiResponse{true, "view parameter must be raw or canonical, value Z was given"}},
+		{"Stream Not Implemented", redisRenderer, "", http.StatusNotImplemented, apiResponse{true, "statistics stream is not supported"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := http.NewRequest("GET", "/statistics/stream?"+tt.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			validateHandler(t, streamHandler(tt.renderer, nil), request, tt.codeWanted, tt.apiResponseWanted)
+		})
+	}
+}
+
+func Test_federationHandler(t *testing.T) {
+	// Start three federated servers, and render requests on each of them
+	nodes := make([]*render.FederatedStatistics, 0, 3)
+	servers := make([]*httptest.Server, 0, 3)
+	for _, name := range []string{"a", "b", "c"} {
+		node := render.NewFederatedStatistics(name, render.NewStatistics())
+		server := httptest.NewServer(createRouter(&dependencies{renderer: render.NewRendererWithStatistics(node)}))
+		defer server.Close()
+		nodes, servers = append(nodes, node), append(servers, server)
+	}
+	for i, query := range []string{"limit=20&int1=3&int2=5&str1=A&str2=B", "limit=20&int1=3&int2=5&str1=A&str2=B", "limit=10&int1=2&int2=7&str1=C&str2=D"} {
+		for _, server := range servers[i:] {
+			response, err := http.Get(server.URL + "/render?" + query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+		}
+	}
+	// Pull the peers of each node, then check that every node returns the cluster-wide statistics
+	for i, node := range nodes {
+		for j, server := range servers {
+			if i != j {
+				if err := node.Pull(context.Background(), server.Client(), server.URL); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	want := apiResponse{false, []*render.RequestStatistic{
+		{Request: *render.NewRequest(20, 3, 5, "A", "B"), Total: 5, Rank: 1, Outcomes: succeeded(2)},
+		{Request: *render.NewRequest(10, 2, 7, "C", "D"), Total: 1, Rank: 2},
+	}}
+	for i, node := range nodes {
+		want.Response.([]*render.RequestStatistic)[0].Outcomes = succeeded([]int{1, 2, 2}[i])
+		if i == 2 {
+			want.Response.([]*render.RequestStatistic)[1].Outcomes = succeeded(1)
+		}
+		request, err := http.NewRequest("GET", "/statistics?top=10", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		validateHandler(t, statisticsHandler(render.NewRendererWithStatistics(node)), request, http.StatusOK, want)
+	}
+	// Check that the federation state gives the counts of each node, and is not served unless federated
+	response, err := http.Get(servers[0].URL + render.FederationPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	state := &render.FederationState{}
+	if err := json.NewDecoder(response.Body).Decode(state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Node != "a" || len(state.Incarnations) != 3 || len(state.Counters) != 2 || !reflect.DeepEqual(state.Counters[1].Counts, render.GCounter{"a": 1, "b": 2, "c": 2}) {
+		t.Errorf("federation state = %+v, want the counts of the three nodes", state)
+	}
+	request, err := http.NewRequest("GET", render.FederationPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validateHandler(t, federationHandler(render.NewRenderer()), request, http.StatusNotImplemented, apiResponse{true, "statistics federation is not enabled"})
+}
+
+func Test_timeSeriesHandler(t *testing.T) {
+	// Create new renderer and record a request
+	renderer := render.NewRenderer()
+	request := render.NewRequest(20, 3, 5, "A", "B")
+	renderer.RecordStatistic(request)
+	renderer.RecordStatistic(request)
+	// Request time series
+	recorder := httptest.NewRecorder()
+	httpRequest, err := http.NewRequest("GET", "/statistics/timeseries?limit=20&int1=3&int2=5&str1=A&str2=B&window=5m", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeSeriesHandler(renderer).ServeHTTP(recorder, httpRequest)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("handler returned status code %v, want %v", recorder.Code, http.StatusOK)
+	}
+	// Check time series
+	var got struct {
+		Error    bool              `json:"error"`
+		Response render.TimeSeries `json:"response"`
+	}
+	if err := json.NewDecoder(recorder.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Response.Request != *request || len(got.Response.Series) != 5 {
+		t.Fatalf("handler returned time series %+v, want 5 minutes of %+v", got.Response, request)
+	}
+	total := 0
+	for _, timeStatistic := range got.Response.Series {
+		total += timeStatistic.Total
+	}
+	if total != 2 {
+		t.Errorf("handler returned time series total %v, want %v", total, 2)
+	}
+}
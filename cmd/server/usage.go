@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jpraynaud/fizzbuzz-server/pkg/auth"
+	"github.com/jpraynaud/fizzbuzz-server/pkg/render"
+	"github.com/jpraynaud/fizzbuzz-server/pkg/resp"
+	"github.com/jpraynaud/fizzbuzz-server/pkg/usage"
+	log "github.com/sirupsen/logrus"
+)
+
+// parseQuotas parses the quotas of each client, comma separated resources per period and their quota (e.g. requests/day=10000,items/month=100000000)
+func parseQuotas(value string) (usage.Quotas, error) {
+	quotas := usage.Quotas{}
+	if value == "" {
+		return quotas, nil
+	}
+	for _, quota := range strings.Split(value, ",") {
+		i := strings.Index(quota, "=")
+		if i < 0 {
+			return quotas, fmt.Errorf("quotas must be comma separated quotas such as requests/day=10000, value %s was given", value)
+		}
+		limit, err := strconv.ParseInt(strings.TrimSpace(quota[i+1:]), 10, 64)
+		if err != nil || limit < 1 {
+			return quotas, fmt.Errorf("quota %s must be an integer >= 1, value %s was given", strings.TrimSpace(quota[:i]), quota[i+1:])
+		}
+		switch strings.TrimSpace(quota[:i]) {
+		case "requests/day":
+			quotas.Daily.Requests = limit
+		case "items/day":
+			quotas.Daily.Items = limit
+		case "requests/month":
+			quotas.Monthly.Requests = limit
+		case "items/month":
+			quotas.Monthly.Items = limit
+		default:
+			return quotas, fmt.Errorf("quota must be requests/day, items/day, requests/month or items/month, value %s was given", strings.TrimSpace(quota[:i]))
+		}
+	}
+	return quotas, nil
+}
+
+// usageSetup creates the meter of the usage of the authenticated clients, nil if authentication is disabled, and returns the function that closes it
+// The usage is stored as the statistics are: in the data directory with the file backend, in the Redis server with the redis backend, else in memory
+func usageSetup(ctx context.Context, authenticator *auth.Authenticator) (*usage.Meter, func() error, error) {
+	parsed, err := parseQuotas(quotas)
+	if err != nil {
+		return nil, nil, err
+	}
+	if authenticator == nil {
+		if quotas != "" {
+			return nil, nil, errors.New("quotas require authentication (apikeys, jwtsecret or jwtpublickey)")
+		}
+		return nil, func() error { return nil }, nil
+	}
+	var store usage.Store
+	closeStore := func() error { return nil }
+	switch statisticsBackendName() {
+	case "file":
+		fileStore, err := usage.OpenFileStore(dataDirectory)
+		if err != nil {
+			return nil, nil, err
+		}
+		go fileStore.Run(ctx, statisticsSnapshotInterval)
+		store, closeStore = fileStore, fileStore.Close
+	case "redis":
+		client := resp.NewClient(redisAddr, redisTimeout, redisPoolSize)
+		store, closeStore = usage.NewRedisStore(client, redisKeyPrefix), client.Close
+	default:
+		memoryStore := usage.NewMemoryStore()
+		go memoryStore.Run(ctx, statisticsSnapshotInterval)
+		store = memoryStore
+	}
+	log.WithFields(log.Fields{
+		"daily":   fmt.Sprintf("%d requests, %d items", parsed.Daily.Requests, parsed.Daily.Items),
+		"monthly": fmt.Sprintf("%d requests, %d items", parsed.Monthly.Requests, parsed.Monthly.Items),
+	}).Info("Usage metering enabled")
+	return usage.NewMeter(store, parsed), closeStore, nil
+}
+
+// usageResponseWriter records the status code written to a response, so that the requests rejected as invalid are refunded
+type usageResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the first status code written, and writes it
+func (w *usageResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Flush flushes the response, so that streamed responses are still flushed
+func (w *usageResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// usageMiddleware meters each request of the authenticated clients, anonymous clients are not metered
+// Requests rejected with a 400 error (invalid parameters) are refunded, so that they do not consume the quota of their client
+func usageMiddleware(meter *usage.Meter) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			taken, now := usage.Usage{Requests: 1}, time.Now()
+			if !takeUsage(w, r, meter, taken, now) {
+				return
+			}
+			usageWriter := &usageResponseWriter{ResponseWriter: w}
+			next.ServeHTTP(usageWriter, r)
+			if identity := auth.FromContext(r.Context()); identity != nil && usageWriter.status == http.StatusBadRequest {
+				if err := meter.Refund(identity.Subject, taken, now); err != nil {
+					log.Errorf("%s - %s - usage refund failed: %v", r.Method, r.RequestURI, err)
+				}
+			}
+		})
+	}
+}
+
+// takeUsage adds a usage at a time to the usage of the authenticated client of a request, and writes a 429 error along with its Retry-After header
+// (the seconds until the end of the period) if it would exceed a quota
+// Failures of the usage store are only logged, as they must not prevent rendering
+func takeUsage(w http.ResponseWriter, r *http.Request, meter *usage.Meter, taken usage.Usage, now time.Time) bool {
+	identity := auth.FromContext(r.Context())
+	if meter == nil || identity == nil {
+		return true
+	}
+	err := meter.Take(identity.Subject, taken, now)
+	quotaError, ok := err.(*usage.QuotaError)
+	if !ok {
+		if err != nil {
+			log.Errorf("%s - %s - usage metering failed: %v", r.Method, r.RequestURI, err)
+		}
+		return true
+	}
+	retryAfter := strconv.Itoa(int(math.Ceil(quotaError.RetryAfter.Seconds())))
+	w.Header().Set("Retry-After", retryAfter)
+	apiError(w, r, http.StatusTooManyRequests, fmt.Sprintf("%s, retry after %s seconds", quotaError.Error(), retryAfter))
+	return false
+}
+
+// takeUsageItems adds the items of a valid render (its limit) to the usage of its authenticated client, if metered
+func takeUsageItems(w http.ResponseWriter, r *http.Request, meter *usage.Meter, request *render.Request) bool {
+	if request.Validate() != nil {
+		return true
+	}
+	return takeUsage(w, r, meter, usage.Usage{Items: int64(request.Limit)}, time.Now())
+}
+
+// parseDate parses the date parameter of the usage, a day (e.g. 2026-10-18), today by default
+func parseDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Now(), nil
+	}
+	date, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, &render.ParameterError{Parameter: "date", Reason: "must be a day such as 2026-10-18", Value: value}
+	}
+	return date, nil
+}
+
+// Handles the daily and monthly usage of the authenticated client, or of the clients of the month for the clients with the admin role
+func usageHandler(meter *usage.Meter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if meter == nil {
+			apiError(w, r, http.StatusNotImplemented, "usage metering is not enabled, it requires authentication")
+			return
+		}
+		identity := auth.FromContext(r.Context())
+		if identity == nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			apiFailure(w, r, http.StatusUnauthorized, auth.ErrNoCredentials)
+			return
+		}
+		vars := r.URL.Query()
+		date, err := parseDate(vars.Get("date"))
+		if err != nil {
+			apiFailure(w, r, http.StatusBadRequest, err)
+			return
+		}
+		client := vars.Get("client")
+		if client != "" && client != identity.Subject && !identity.HasRole(auth.RoleAdmin) {
+			apiError(w, r, http.StatusForbidden, fmt.Sprintf("client %s must have the %s role to read the usage of other clients", identity.Subject, auth.RoleAdmin))
+			return
+		}
+
+		// Get usage
+		reports := make([]*usage.Report, 0, 1)
+		if client == "" && identity.HasRole(auth.RoleAdmin) {
+			reports, err = meter.Reports(date)
+		} else {
+			if client == "" {
+				client = identity.Subject
+			}
+			var report *usage.Report
+			if report, err = meter.Report(client, date); err == nil {
+				reports = append(reports, report)
+			}
+		}
+		if err != nil {
+			apiFailure(w, r, http.StatusInternalServerError, fmt.Errorf("usage reading failed: %v", err))
+			return
+		}
+
+		// Write response
+		writeResponse(w, r, reports)
+	}
+}
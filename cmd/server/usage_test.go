@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jpraynaud/fizzbuzz-server/pkg/auth"
+	"github.com/jpraynaud/fizzbuzz-server/pkg/render"
+	"github.com/jpraynaud/fizzbuzz-server/pkg/usage"
+)
+
+func Test_usageSetup(t *testing.T) {
+	directory, err := ioutil.TempDir("", "usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	tests := []struct {
+		name          string
+		authenticated bool
+		quotas        string
+		datadir       string
+		want          usage.Quotas
+		wantNil       bool
+		wantErr       string
+	}{
+		{"Disabled", false, "", "", usage.Quotas{}, true, ""},
+		{"Quotas without authentication", false, "requests/day=10", "", usage.Quotas{}, true, "quotas require authentication (apikeys, jwtsecret or jwtpublickey)"},
+		{"Unlimited", true, "", "", usage.Quotas{}, false, ""},
+		{"Quotas", true, "requests/day=10, items/day=1000,requests/month=100,items/month=10000", "", usage.Quotas{Daily: usage.Usage{Requests: 10, Items: 1000}, Monthly: usage.Usage{Requests: 100, Items: 10000}}, false, ""},
+		{"File", true, "items/month=10000", directory, usage.Quotas{Monthly: usage.Usage{Items: 10000}}, false, ""},
+		{"Invalid quota", true, "requests/day=0", "", usage.Quotas{}, true, "quota requests/day must be an integer >= 1, value 0 was given"},
+		{"Unknown quota", true, "requests/week=10", "", usage.Quotas{}, true, "quota must be requests/day, items/day, requests/month or items/month, value requests/week was given"},
+		{"Malformed quotas", true, "10", "", usage.Quotas{}, true, "quotas must be comma separated quotas such as requests/day=10000, value 10 was given"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quotas, dataDirectory = tt.quotas, tt.datadir
+			defer func() {
+				quotas, dataDirectory = "", ""
+			}()
+			var authenticator *auth.Authenticator
+			if tt.authenticated {
+				authenticator = auth.NewAuthenticator()
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			meter, closeUsage, err := usageSetup(ctx, authenticator)
+			if gotErr := ""; err != nil || tt.wantErr != "" {
+				if err != nil {
+					gotErr = err.Error()
+				}
+				if gotErr != tt.wantErr {
+					t.Fatalf("usageSetup() error = %s, want %s", gotErr, tt.wantErr)
+				}
+				return
+			}
+			defer closeUsage()
+			if (meter == nil) != tt.wantNil || (meter != nil && meter.Quotas() != tt.want) {
+				t.Errorf("usageSetup() = %+v, want nil %v and quotas %+v", meter, tt.wantNil, tt.want)
+			}
+		})
+	}
+	if _, err := os.Stat(directory + "/usage.snapshot.json"); err != nil {
+		t.Errorf("usage snapshot is not written in the data directory: %v", err)
+	}
+}
+
+func Test_usageMiddleware(t *testing.T) {
+	// Prepare test server, a client may send 4 requests a day and have 100 items rendered a month
+	adminToken = "secret"
+	authenticator := auth.NewAuthenticator()
+	authenticator.AddAPIKey("a-key", &auth.Identity{Subject: "a", Roles: []auth.Role{auth.RoleReader, auth.RoleRenderer}, Method: auth.MethodAPIKey})
+	authenticator.AddAPIKey("b-key", &auth.Identity{Subject: "b", Roles: []auth.Role{auth.RoleRenderer}, Method: auth.MethodAPIKey})
+	authenticator.SetAdminToken(adminToken)
+	usageMeter := usage.NewMeter(usage.NewMemoryStore(), usage.Quotas{Daily: usage.Usage{Requests: 4}, Monthly: usage.Usage{Items: 100}})
+	defer func() {
+		adminToken = ""
+	}()
+	server := httptest.NewServer(createRouter(&dependencies{renderer: render.NewRenderer(), authenticator: authenticator, usageMeter: usageMeter}))
+	defer server.Close()
+	// Prepare tests data
+	tests := []struct {
+		name          string
+		path          string
+		apiKey        string
+		authorization string
+		codeWanted    int
+		messageWanted string
+	}{
+		{"Render", "/render?limit=60&int1=3&int2=5", "a-key", "", http.StatusOK, ""},
+		{"Items quota exceeded", "/v2/render?limit=60&int1=3&int2=5", "a-key", "", http.StatusTooManyRequests, "monthly items quota of 100 exceeded, retry after"},
+		{"Invalid render", "/render?limit=0&int1=3&int2=5", "a-key", "", http.StatusBadRequest, "limit parameter must be >= 1, value 0 was given"},
+		{"Own usage", "/usage", "a-key", "", http.StatusOK, ""},
+		{"Own usage", "/usage", "a-key", "", http.StatusOK, ""},
+		{"Requests quota exceeded", "/usage", "a-key", "", http.StatusTooManyRequests, "daily requests quota of 4 exceeded, retry after"},
+		{"Other client", "/render?limit=100&int1=3&int2=5", "b-key", "", http.StatusOK, ""},
+		{"Usage of another client", "/usage?client=a", "b-key", "", http.StatusForbidden, "client b must have the admin role to read the usage of other clients"},
+		{"Invalid date", "/usage?date=today", "b-key", "", http.StatusBadRequest, "date parameter must be a day such as 2026-10-18, value today was given"},
+		{"Anonymous", "/usage", "", "", http.StatusUnauthorized, "an API key (X-API-Key header) or a bearer token must be given"},
+	}
+	// Run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := http.NewRequest("GET", server.URL+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.apiKey != "" {
+				request.Header.Set("X-API-Key", tt.apiKey)
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+			if response.StatusCode != tt.codeWanted {
+				t.Errorf("server returned status code %v, want %v", response.StatusCode, tt.codeWanted)
+			}
+			if retryAfter := response.Header.Get("Retry-After"); (retryAfter != "") != (tt.codeWanted == http.StatusTooManyRequests) {
+				t.Errorf("server returned Retry-After %s with status code %v", retryAfter, response.StatusCode)
+			}
+			if tt.messageWanted == "" {
+				return
+			}
+			body := make(map[string]interface{})
+			if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			message, _ := body["response"].(string)
+			if detail, ok := body["error"].(map[string]interface{}); ok {
+				message, _ = detail["message"].(string)
+			}
+			if !strings.HasPrefix(message, tt.messageWanted) {
+				t.Errorf("server returned message %s, want %s", message, tt.messageWanted)
+			}
+		})
+	}
+	// Administrators get the usage of every client, rejected items and invalid requests are not counted
+	request, err := http.NewRequest("GET", server.URL+"/v2/usage", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Authorization", "Bearer secret")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	document := struct {
+		Data []*usage.Report `json:"data"`
+	}{}
+	if err := json.NewDecoder(response.Body).Decode(&document); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]usage.Usage)
+	for _, report := range document.Data {
+		got[report.Client] = report.Day.Usage
+	}
+	want := map[string]usage.Usage{"a": {Requests: 4, Items: 60}, "b": {Requests: 2, Items: 100}, "admin": {Requests: 1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("server returned usage %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,293 @@
+// Package auth authenticates the clients of the server, by static API keys or by JSON Web Tokens (JWT) signed with HMAC (HS256)
+// or RSA (RS256) keys, and gives their identity and their roles
+package auth
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Role represents what a client is allowed to do
+type Role string
+
+// Roles of the clients
+const (
+	// RoleReader is the role of the clients that read statistics
+	RoleReader Role = "reader"
+	// RoleRenderer is the role of the clients that render requests
+	RoleRenderer Role = "renderer"
+	// RoleAdmin is the role of the clients that administrate statistics, it includes the other roles
+	RoleAdmin Role = "admin"
+)
+
+// Roles lists the roles of the clients
+var Roles = []Role{RoleReader, RoleRenderer, RoleAdmin}
+
+// ParseRole returns the role of a name
+func ParseRole(name string) (Role, error) {
+	for _, role := range Roles {
+		if string(role) == name {
+			return role, nil
+		}
+	}
+	return "", fmt.Errorf("role must be reader, renderer or admin, value %s was given", name)
+}
+
+// Methods of authentication of the clients
+const (
+	// MethodAPIKey authenticates a client by an API key, in the X-API-Key header or as a bearer token
+	MethodAPIKey = "apikey"
+	// MethodJWT authenticates a client by a JSON Web Token, as a bearer token
+	MethodJWT = "jwt"
+	// MethodAdminToken authenticates the administrator by the admin token of the server, as a bearer token
+	MethodAdminToken = "admintoken"
+)
+
+// jwtLeeway is the clock skew tolerated when checking the expiration and not before times of JSON Web Tokens
+const jwtLeeway = 30 * time.Second
+
+// Identity represents an authenticated client: its subject (e.g. the owner of an API key), its roles and how it was authenticated
+type Identity struct {
+	Subject string `json:"subject"`
+	Roles   []Role `json:"roles"`
+	Method  string `json:"method"`
+}
+
+// HasRole reports whether the client has a role, the admin role includes the other roles
+func (i *Identity) HasRole(role Role) bool {
+	for _, granted := range i.Roles {
+		if granted == role || granted == RoleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// identityKey is the key of the Identity in a context
+type identityKey struct{}
+
+// NewContext returns a copy of a context that carries an identity
+func NewContext(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// FromContext returns the identity carried by a context, nil if there is none (anonymous clients)
+func FromContext(ctx context.Context) *Identity {
+	identity, _ := ctx.Value(identityKey{}).(*Identity)
+	return identity
+}
+
+// ErrNoCredentials is returned when the authentication of a client requires credentials that it did not give
+var ErrNoCredentials = errors.New("an API key (X-API-Key header) or a bearer token must be given")
+
+// Authenticator represents the credentials known by the server: the API keys (stored as SHA-256 hashes), the keys that verify
+// the signatures of JSON Web Tokens, and the admin token
+type Authenticator struct {
+	keys       map[[sha256.Size]byte]*Identity
+	hmacKey    []byte
+	rsaKey     *rsa.PublicKey
+	adminToken string
+}
+
+// NewAuthenticator is the Authenticator factory, that creates an authenticator without credentials
+func NewAuthenticator() *Authenticator {
+	return &Authenticator{
+		keys: make(map[[sha256.Size]byte]*Identity),
+	}
+}
+
+// AddAPIKey adds an API key and the identity of its client
+func (a *Authenticator) AddAPIKey(key string, identity *Identity) {
+	a.keys[sha256.Sum256([]byte(key))] = identity
+}
+
+// LoadAPIKeys loads API keys from a reader, one per line: the key (or sha256: followed by the hexadecimal SHA-256 hash of the key),
+// the subject of its client and its comma separated roles, separated by spaces (e.g. 3f9a... partner-a reader,renderer)
+// Empty lines and lines starting with # are ignored
+func (a *Authenticator) LoadAPIKeys(reader io.Reader) error {
+	scanner := bufio.NewScanner(reader)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 3 {
+			return fmt.Errorf("API keys line %d must hold a key, a subject and roles", line)
+		}
+		identity := &Identity{Subject: fields[1], Roles: make([]Role, 0), Method: MethodAPIKey}
+		for _, name := range strings.Split(fields[2], ",") {
+			role, err := ParseRole(name)
+			if err != nil {
+				return fmt.Errorf("API keys line %d: %v", line, err)
+			}
+			identity.Roles = append(identity.Roles, role)
+		}
+		if !strings.HasPrefix(fields[0], "sha256:") {
+			a.AddAPIKey(fields[0], identity)
+			continue
+		}
+		hash, err := hex.DecodeString(strings.TrimPrefix(fields[0], "sha256:"))
+		if err != nil || len(hash) != sha256.Size {
+			return fmt.Errorf("API keys line %d: a key hash must be sha256: followed by 64 hexadecimal digits", line)
+		}
+		var sum [sha256.Size]byte
+		copy(sum[:], hash)
+		a.keys[sum] = identity
+	}
+	return scanner.Err()
+}
+
+// SetHMACKey sets the secret that verifies the JSON Web Tokens signed with HS256
+func (a *Authenticator) SetHMACKey(secret []byte) {
+	a.hmacKey = secret
+}
+
+// SetRSAKey sets the public key (PEM encoded, PKIX or PKCS #1) that verifies the JSON Web Tokens signed with RS256
+func (a *Authenticator) SetRSAKey(encoded []byte) error {
+	block, _ := pem.Decode(encoded)
+	if block == nil {
+		return errors.New("RSA public key must be PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		a.rsaKey = key
+		return nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("RSA public key is invalid: %v", err)
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("RSA public key is not an RSA key")
+	}
+	a.rsaKey = rsaKey
+	return nil
+}
+
+// SetAdminToken sets the admin token, that authenticates the administrator with the admin role
+func (a *Authenticator) SetAdminToken(token string) {
+	a.adminToken = token
+}
+
+// Authenticate returns the identity of the client of a request at a time, nil if it gave no credentials (anonymous client)
+// The credentials are an API key in the X-API-Key header, or a bearer token in the Authorization header: the admin token,
+// a JSON Web Token or an API key
+func (a *Authenticator) Authenticate(r *http.Request, now time.Time) (*Identity, error) {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		if identity, ok := a.keys[sha256.Sum256([]byte(key))]; ok {
+			return identity, nil
+		}
+		return nil, errors.New("API key is invalid")
+	}
+	authorization := r.Header.Get("Authorization")
+	if authorization == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return nil, errors.New("Authorization header must hold a bearer token")
+	}
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	if a.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.adminToken)) == 1 {
+		return &Identity{Subject: "admin", Roles: []Role{RoleAdmin}, Method: MethodAdminToken}, nil
+	}
+	if identity, ok := a.keys[sha256.Sum256([]byte(token))]; ok {
+		return identity, nil
+	}
+	if strings.Count(token, ".") == 2 && (a.hmacKey != nil || a.rsaKey != nil) {
+		return a.verifyJWT(token, now)
+	}
+	return nil, errors.New("bearer token is invalid")
+}
+
+// jwtHeader represents the header of a JSON Web Token
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+}
+
+// jwtClaims represents the claims of a JSON Web Token used by the authenticator, the times are in seconds since the epoch
+type jwtClaims struct {
+	Subject   string   `json:"sub"`
+	Roles     []string `json:"roles"`
+	ExpiresAt *float64 `json:"exp"`
+	NotBefore *float64 `json:"nbf"`
+}
+
+// verifyJWT verifies the signature and the times of a JSON Web Token at a time, and returns the identity of its claims
+// Its algorithm must be HS256 or RS256 and its key known, its subject and expiration time are required, unknown roles are ignored
+func (a *Authenticator) verifyJWT(token string, now time.Time) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	header, claims := &jwtHeader{}, &jwtClaims{}
+	if err := decodeJWTPart(parts[0], header); err != nil {
+		return nil, fmt.Errorf("bearer token header is invalid: %v", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("bearer token signature is invalid")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	switch {
+	case header.Algorithm == "HS256" && a.hmacKey != nil:
+		mac := hmac.New(sha256.New, a.hmacKey)
+		mac.Write(signed)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return nil, errors.New("bearer token signature is invalid")
+		}
+	case header.Algorithm == "RS256" && a.rsaKey != nil:
+		digest := sha256.Sum256(signed)
+		if rsa.VerifyPKCS1v15(a.rsaKey, crypto.SHA256, digest[:], signature) != nil {
+			return nil, errors.New("bearer token signature is invalid")
+		}
+	default:
+		return nil, fmt.Errorf("bearer token algorithm is not supported, value %s was given", header.Algorithm)
+	}
+	if err := decodeJWTPart(parts[1], claims); err != nil {
+		return nil, fmt.Errorf("bearer token claims are invalid: %v", err)
+	}
+	switch {
+	case claims.Subject == "":
+		return nil, errors.New("bearer token must have a subject (sub claim)")
+	case claims.ExpiresAt == nil:
+		return nil, errors.New("bearer token must have an expiration time (exp claim)")
+	case now.Add(-jwtLeeway).After(jwtTime(*claims.ExpiresAt)):
+		return nil, errors.New("bearer token has expired")
+	case claims.NotBefore != nil && now.Add(jwtLeeway).Before(jwtTime(*claims.NotBefore)):
+		return nil, errors.New("bearer token is not valid yet")
+	}
+	identity := &Identity{Subject: claims.Subject, Roles: make([]Role, 0, len(claims.Roles)), Method: MethodJWT}
+	for _, name := range claims.Roles {
+		if role, err := ParseRole(name); err == nil {
+			identity.Roles = append(identity.Roles, role)
+		}
+	}
+	return identity, nil
+}
+
+// decodeJWTPart decodes a part of a JSON Web Token, a base64url encoded JSON object
+func decodeJWTPart(part string, value interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(decoded, value)
+}
+
+// jwtTime returns the time of a number of seconds since the epoch
+func jwtTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
@@ -0,0 +1,191 @@
+package auth_test
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jpraynaud/fizzbuzz-server/pkg/auth"
+)
+
+// signJWT is a helper that returns a JSON Web Token of claims signed with an algorithm and a key (a secret for HS256, an RSA private key for RS256)
+func signJWT(t *testing.T, algorithm string, key interface{}, claims map[string]interface{}) string {
+	encode := func(value interface{}) string {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(encoded)
+	}
+	signed := encode(map[string]string{"alg": algorithm, "typ": "JWT"}) + "." + encode(claims)
+	var signature []byte
+	switch algorithm {
+	case "HS256":
+		mac := hmac.New(sha256.New, key.([]byte))
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case "RS256":
+		digest := sha256.Sum256([]byte(signed))
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestParseRole(t *testing.T) {
+	if role, err := auth.ParseRole("renderer"); role != auth.RoleRenderer || err != nil {
+		t.Errorf("ParseRole() = %s, %v, want renderer", role, err)
+	}
+	if _, err := auth.ParseRole("writer"); err == nil || err.Error() != "role must be reader, renderer or admin, value writer was given" {
+		t.Errorf("ParseRole() error = %v, want an invalid role error", err)
+	}
+	identity := &auth.Identity{Subject: "a", Roles: []auth.Role{auth.RoleReader}}
+	if !identity.HasRole(auth.RoleReader) || identity.HasRole(auth.RoleRenderer) {
+		t.Errorf("HasRole() of a reader is wrong")
+	}
+	if admin := (&auth.Identity{Subject: "b", Roles: []auth.Role{auth.RoleAdmin}}); !admin.HasRole(auth.RoleRenderer) {
+		t.Errorf("HasRole() of an admin = false, want true for every role")
+	}
+}
+
+func TestAuthenticator_LoadAPIKeys(t *testing.T) {
+	hash := sha256.Sum256([]byte("hashed-key"))
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"Valid", "# key subject roles\n\nplain-key partner-a reader,renderer\nsha256:" + hex.EncodeToString(hash[:]) + " partner-b admin\n", ""},
+		{"Missing roles", "plain-key partner-a\n", "API keys line 1 must hold a key, a subject and roles"},
+		{"Unknown role", "\nplain-key partner-a reader,writer\n", "API keys line 2: role must be reader, renderer or admin, value writer was given"},
+		{"Invalid hash", "sha256:abc partner-a reader\n", "API keys line 1: a key hash must be sha256: followed by 64 hexadecimal digits"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authenticator := auth.NewAuthenticator()
+			err := authenticator.LoadAPIKeys(strings.NewReader(tt.content))
+			if got := ""; err != nil {
+				if got = err.Error(); got != tt.wantErr {
+					t.Errorf("LoadAPIKeys() error = %s, want %s", got, tt.wantErr)
+				}
+				return
+			}
+			if tt.wantErr != "" {
+				t.Fatalf("LoadAPIKeys() error = nil, want %s", tt.wantErr)
+			}
+			for key, want := range map[string]*auth.Identity{
+				"plain-key":  {Subject: "partner-a", Roles: []auth.Role{auth.RoleReader, auth.RoleRenderer}, Method: auth.MethodAPIKey},
+				"hashed-key": {Subject: "partner-b", Roles: []auth.Role{auth.RoleAdmin}, Method: auth.MethodAPIKey},
+			} {
+				request := httptest.NewRequest("GET", "/", nil)
+				request.Header.Set("X-API-Key", key)
+				if got, err := authenticator.Authenticate(request, time.Now()); err != nil || !reflect.DeepEqual(got, want) {
+					t.Errorf("Authenticate() with key %s = %+v, %v, want %+v", key, got, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthenticator_Authenticate(t *testing.T) {
+	// Prepare the authenticator
+	secret := []byte("secret")
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator := auth.NewAuthenticator()
+	authenticator.AddAPIKey("key", &auth.Identity{Subject: "partner", Roles: []auth.Role{auth.RoleReader}, Method: auth.MethodAPIKey})
+	authenticator.SetHMACKey(secret)
+	if err := authenticator.SetRSAKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey})); err != nil {
+		t.Fatal(err)
+	}
+	if err := authenticator.SetRSAKey([]byte("not a key")); err == nil {
+		t.Errorf("SetRSAKey() error = nil, want a PEM error")
+	}
+	authenticator.SetAdminToken("admin-token")
+	// Prepare tests data
+	now := time.Date(2026, time.October, 1, 0, 0, 0, 0, time.UTC)
+	claims := func(more map[string]interface{}) map[string]interface{} {
+		claims := map[string]interface{}{"sub": "service", "exp": now.Add(time.Hour).Unix(), "roles": []string{"renderer", "unknown"}}
+		for name, value := range more {
+			claims[name] = value
+		}
+		return claims
+	}
+	jwtIdentity := &auth.Identity{Subject: "service", Roles: []auth.Role{auth.RoleRenderer}, Method: auth.MethodJWT}
+	tests := []struct {
+		name          string
+		apiKey        string
+		authorization string
+		want          *auth.Identity
+		wantErr       string
+	}{
+		{"Anonymous", "", "", nil, ""},
+		{"API key", "key", "", &auth.Identity{Subject: "partner", Roles: []auth.Role{auth.RoleReader}, Method: auth.MethodAPIKey}, ""},
+		{"API key bearer", "", "Bearer key", &auth.Identity{Subject: "partner", Roles: []auth.Role{auth.RoleReader}, Method: auth.MethodAPIKey}, ""},
+		{"Invalid API key", "guess", "", nil, "API key is invalid"},
+		{"Admin token", "", "Bearer admin-token", &auth.Identity{Subject: "admin", Roles: []auth.Role{auth.RoleAdmin}, Method: auth.MethodAdminToken}, ""},
+		{"Not bearer", "", "Basic a2V5", nil, "Authorization header must hold a bearer token"},
+		{"Invalid bearer", "", "Bearer guess", nil, "bearer token is invalid"},
+		{"HS256", "", "Bearer " + signJWT(t, "HS256", secret, claims(nil)), jwtIdentity, ""},
+		{"RS256", "", "Bearer " + signJWT(t, "RS256", privateKey, claims(nil)), jwtIdentity, ""},
+		{"Wrong secret", "", "Bearer " + signJWT(t, "HS256", []byte("guess"), claims(nil)), nil, "bearer token signature is invalid"},
+		{"Unsupported algorithm", "", "Bearer " + signJWT(t, "none", nil, claims(nil)), nil, "bearer token algorithm is not supported, value none was given"},
+		{"Expired", "", "Bearer " + signJWT(t, "HS256", secret, claims(map[string]interface{}{"exp": now.Add(-time.Minute).Unix()})), nil, "bearer token has expired"},
+		{"Expired within leeway", "", "Bearer " + signJWT(t, "HS256", secret, claims(map[string]interface{}{"exp": now.Add(-10 * time.Second).Unix()})), jwtIdentity, ""},
+		{"Not valid yet", "", "Bearer " + signJWT(t, "HS256", secret, claims(map[string]interface{}{"nbf": now.Add(time.Minute).Unix()})), nil, "bearer token is not valid yet"},
+		{"No expiration", "", "Bearer " + signJWT(t, "HS256", secret, claims(map[string]interface{}{"exp": nil})), nil, "bearer token must have an expiration time (exp claim)"},
+		{"No subject", "", "Bearer " + signJWT(t, "HS256", secret, claims(map[string]interface{}{"sub": ""})), nil, "bearer token must have a subject (sub claim)"},
+	}
+	// Run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", "/", nil)
+			if tt.apiKey != "" {
+				request.Header.Set("X-API-Key", tt.apiKey)
+			}
+			if tt.authorization != "" {
+				request.Header.Set("Authorization", tt.authorization)
+			}
+			got, err := authenticator.Authenticate(request, now)
+			if gotErr := ""; err != nil || tt.wantErr != "" {
+				if err != nil {
+					gotErr = err.Error()
+				}
+				if gotErr != tt.wantErr {
+					t.Errorf("Authenticate() error = %s, want %s", gotErr, tt.wantErr)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Authenticate() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+	// The identity is carried by the context of a request
+	request := httptest.NewRequest("GET", "/", nil)
+	if auth.FromContext(request.Context()) != nil {
+		t.Errorf("FromContext() of an anonymous request is not nil")
+	}
+	if got := auth.FromContext(auth.NewContext(request.Context(), jwtIdentity)); got != jwtIdentity {
+		t.Errorf("FromContext() = %+v, want %+v", got, jwtIdentity)
+	}
+}
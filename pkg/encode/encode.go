@@ -0,0 +1,417 @@
+// Package encode implements the encodings of rendered FizzBuzz items (text, CSV, NDJSON, XML, JSON, CBOR, MessagePack...),
+// registered by name and media type so that an encoding can be selected by a format parameter or negotiated with an Accept header
+package encode
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Encoder represents the interface of an encoding of rendered items
+type Encoder interface {
+	Encode(w io.Writer, items []string) error
+}
+
+// EncoderFunc is an adapter that allows the use of an ordinary function as an Encoder
+type EncoderFunc func(w io.Writer, items []string) error
+
+// Encode calls f(w, items)
+func (f EncoderFunc) Encode(w io.Writer, items []string) error {
+	return f(w, items)
+}
+
+// Format represents an encoding registered under a name (e.g. csv) and a media type (e.g. text/csv)
+type Format struct {
+	Name      string
+	MediaType string
+	Encoder
+}
+
+// ContentType returns the value of the Content-Type header of the format, text media types are UTF-8 encoded
+func (f *Format) ContentType() string {
+	if strings.HasPrefix(f.MediaType, "text/") {
+		return f.MediaType + "; charset=utf-8"
+	}
+	return f.MediaType
+}
+
+// Registry represents a set of formats, the first registered one is the default format
+type Registry struct {
+	formats []*Format
+}
+
+// NewRegistry is the Registry factory, that creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		formats: make([]*Format, 0),
+	}
+}
+
+// RegisterBuiltins registers the built-in formats in a registry: array, text, csv, ndjson, xml, cbor and msgpack
+// All of them but msgpack (whose arrays start with their length) are StreamEncoders
+func RegisterBuiltins(registry *Registry) {
+	registry.Register("array", "application/vnd.fizzbuzz.array+json", arrayStream)
+	registry.Register("text", "text/plain", textStream)
+	registry.Register("csv", "text/csv", csvStream)
+	registry.Register("ndjson", "application/x-ndjson", ndjsonStream)
+	registry.Register("xml", "application/xml", xmlStream)
+	registry.Register("cbor", "application/cbor", cborEncoder{})
+	registry.Register("msgpack", "application/msgpack", EncoderFunc(EncodeMessagePack))
+}
+
+// Register registers a format, replacing the format previously registered under the same name
+func (r *Registry) Register(name, mediaType string, encoder Encoder) {
+	format := &Format{Name: name, MediaType: mediaType, Encoder: encoder}
+	for i, registered := range r.formats {
+		if registered.Name == name {
+			r.formats[i] = format
+			return
+		}
+	}
+	r.formats = append(r.formats, format)
+}
+
+// Names returns the names of the registered formats, in registration order
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.formats))
+	for _, format := range r.formats {
+		names = append(names, format.Name)
+	}
+	return names
+}
+
+// Lookup returns the format registered under a name, nil if there is none
+func (r *Registry) Lookup(name string) *Format {
+	for _, format := range r.formats {
+		if format.Name == name {
+			return format
+		}
+	}
+	return nil
+}
+
+// Negotiate returns the format that best matches the media ranges of an Accept header (see RFC 7231 section 5.3.2),
+// the default format if the header is empty, and nil if no format is acceptable
+// Media ranges are tried by descending quality, then by descending specificity, then in header order
+func (r *Registry) Negotiate(accept string) *Format {
+	if len(r.formats) == 0 {
+		return nil
+	}
+	if strings.TrimSpace(accept) == "" {
+		return r.formats[0]
+	}
+	ranges := parseAccept(accept)
+	for _, accepted := range ranges {
+		if accepted.quality == 0 {
+			break
+		}
+		for _, format := range r.formats {
+			if accepted.match(format.MediaType) && !excluded(ranges, format.MediaType) {
+				return format
+			}
+		}
+	}
+	return nil
+}
+
+// Accepts reports whether an Accept header explicitly accepts a media type, i.e. lists it with a quality above 0 (wildcards aside)
+func Accepts(accept, mediaType string) bool {
+	for _, accepted := range parseAccept(accept) {
+		if accepted.specificity == 2 && accepted.mediaType == mediaType {
+			return accepted.quality > 0
+		}
+	}
+	return false
+}
+
+// mediaRange represents a media range of an Accept header (e.g. text/csv, text/* or */*) along with its quality
+type mediaRange struct {
+	mediaType   string
+	quality     float64
+	specificity int
+}
+
+// parseAccept parses the media ranges of an Accept header sorted by descending quality then specificity, invalid ones are skipped
+func parseAccept(accept string) []mediaRange {
+	ranges := make([]mediaRange, 0)
+	for _, value := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(value)
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil || quality < 0 || quality > 1 {
+				continue
+			}
+		}
+		specificity := 2
+		switch {
+		case mediaType == "*/*":
+			specificity = 0
+		case strings.HasSuffix(mediaType, "/*"):
+			specificity = 1
+		}
+		ranges = append(ranges, mediaRange{mediaType, quality, specificity})
+	}
+	sort.SliceStable(ranges, func(i, j int) bool {
+		if ranges[i].quality != ranges[j].quality {
+			return ranges[i].quality > ranges[j].quality
+		}
+		return ranges[i].specificity > ranges[j].specificity
+	})
+	return ranges
+}
+
+// match reports whether a media type belongs to the media range
+func (mr *mediaRange) match(mediaType string) bool {
+	switch mr.specificity {
+	case 0:
+		return true
+	case 1:
+		return strings.HasPrefix(mediaType, strings.TrimSuffix(mr.mediaType, "*"))
+	}
+	return mr.mediaType == mediaType
+}
+
+// excluded reports whether a media type is explicitly excluded by a media range of quality 0 (e.g. text/csv;q=0)
+func excluded(ranges []mediaRange, mediaType string) bool {
+	for _, mediaRange := range ranges {
+		if mediaRange.quality == 0 && mediaRange.specificity == 2 && mediaRange.mediaType == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// ItemWriter represents a writer that encodes items one by one, Close writes the end of the encoding (without closing the underlying writer)
+type ItemWriter interface {
+	WriteItem(item string) error
+	Close() error
+}
+
+// StreamEncoder represents the interface of an Encoder that can also encode items one by one, as they are rendered
+type StreamEncoder interface {
+	Encoder
+	NewItemWriter(w io.Writer) ItemWriter
+}
+
+// streamBufferSize is the size of the buffer of an item writer, the underlying writer receives its writes in chunks of this size
+const streamBufferSize = 32 << 10
+
+// Stream represents an encoding of items made of a header, the items with a separator between them, and a footer
+type Stream struct {
+	Header    string
+	Separator string
+	Footer    string
+	Item      func(w *bufio.Writer, item string) error
+}
+
+// Encode encodes the items at once
+func (s *Stream) Encode(w io.Writer, items []string) error {
+	writer := s.NewItemWriter(w)
+	for _, item := range items {
+		if err := writer.WriteItem(item); err != nil {
+			return err
+		}
+	}
+	return writer.Close()
+}
+
+// NewItemWriter returns an ItemWriter that encodes items one by one, the header is written along with the first item
+func (s *Stream) NewItemWriter(w io.Writer) ItemWriter {
+	return &streamWriter{
+		stream: s,
+		writer: bufio.NewWriterSize(w, streamBufferSize),
+	}
+}
+
+// streamWriter represents the ItemWriter of a Stream
+type streamWriter struct {
+	stream  *Stream
+	writer  *bufio.Writer
+	started bool
+}
+
+// WriteItem encodes an item
+func (sw *streamWriter) WriteItem(item string) error {
+	if !sw.started {
+		sw.started = true
+		sw.writer.WriteString(sw.stream.Header)
+	} else {
+		sw.writer.WriteString(sw.stream.Separator)
+	}
+	return sw.stream.Item(sw.writer, item)
+}
+
+// Close writes the end of the encoding, and flushes it
+func (sw *streamWriter) Close() error {
+	if !sw.started {
+		sw.started = true
+		sw.writer.WriteString(sw.stream.Header)
+	}
+	sw.writer.WriteString(sw.stream.Footer)
+	return sw.writer.Flush()
+}
+
+var (
+	// arrayStream encodes the items as a JSON array of strings
+	arrayStream = &Stream{Header: "[", Separator: ",", Footer: "]\n", Item: WriteJSONString}
+	// textStream encodes the items as plain text, one item per line
+	textStream = &Stream{Item: func(w *bufio.Writer, item string) error {
+		w.WriteString(item)
+		return w.WriteByte('\n')
+	}}
+	// csvStream encodes the items as CSV, one item per record
+	csvStream = &Stream{Item: func(w *bufio.Writer, item string) error {
+		writer := csv.NewWriter(w)
+		writer.Write([]string{item})
+		writer.Flush()
+		return writer.Error()
+	}}
+	// ndjsonStream encodes the items as newline delimited JSON, one JSON string per line
+	ndjsonStream = &Stream{Item: func(w *bufio.Writer, item string) error {
+		WriteJSONString(w, item)
+		return w.WriteByte('\n')
+	}}
+	// xmlStream encodes the items as an XML document, an items element holding an item element per item
+	xmlStream = &Stream{Header: xml.Header + "<items>", Footer: "</items>\n", Item: func(w *bufio.Writer, item string) error {
+		w.WriteString("<item>")
+		if err := xml.EscapeText(w, []byte(item)); err != nil {
+			return err
+		}
+		_, err := w.WriteString("</item>")
+		return err
+	}}
+	// cborStream encodes the items as a CBOR array of indefinite length
+	cborStream = &Stream{Header: "\x9f", Footer: "\xff", Item: writeCBORString}
+)
+
+// WriteJSONString writes an item as a JSON string, it suits the Item of a Stream of JSON strings
+func WriteJSONString(w *bufio.Writer, item string) error {
+	value, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(value)
+	return err
+}
+
+// EncodeArray encodes the items as a JSON array of strings
+func EncodeArray(w io.Writer, items []string) error {
+	return arrayStream.Encode(w, items)
+}
+
+// EncodeText encodes the items as plain text, one item per line
+func EncodeText(w io.Writer, items []string) error {
+	return textStream.Encode(w, items)
+}
+
+// EncodeCSV encodes the items as CSV, one item per record (items holding commas, quotes or line breaks are quoted)
+func EncodeCSV(w io.Writer, items []string) error {
+	return csvStream.Encode(w, items)
+}
+
+// EncodeNDJSON encodes the items as newline delimited JSON, one JSON string per line
+func EncodeNDJSON(w io.Writer, items []string) error {
+	return ndjsonStream.Encode(w, items)
+}
+
+// EncodeXML encodes the items as an XML document, an items element holding an item element per item
+func EncodeXML(w io.Writer, items []string) error {
+	return xmlStream.Encode(w, items)
+}
+
+// EncodeCBOR encodes the items as a CBOR array of text strings (see RFC 8949)
+func EncodeCBOR(w io.Writer, items []string) error {
+	writer := bufio.NewWriter(w)
+	writeCBORHead(writer, 4, uint64(len(items)))
+	for _, item := range items {
+		writeCBORString(writer, item)
+	}
+	return writer.Flush()
+}
+
+// cborEncoder encodes the items as a CBOR array, of definite length when encoded at once and of indefinite length when streamed
+type cborEncoder struct{}
+
+// Encode encodes the items at once
+func (cborEncoder) Encode(w io.Writer, items []string) error {
+	return EncodeCBOR(w, items)
+}
+
+// NewItemWriter returns an ItemWriter that encodes items one by one
+func (cborEncoder) NewItemWriter(w io.Writer) ItemWriter {
+	return cborStream.NewItemWriter(w)
+}
+
+// writeCBORString writes an item as a CBOR text string
+func writeCBORString(w *bufio.Writer, item string) error {
+	writeCBORHead(w, 3, uint64(len(item)))
+	_, err := w.WriteString(item)
+	return err
+}
+
+// writeCBORHead writes the head of a CBOR data item: its major type and its argument (a length for strings and arrays)
+func writeCBORHead(writer *bufio.Writer, majorType byte, argument uint64) {
+	majorType <<= 5
+	switch {
+	case argument < 24:
+		writer.WriteByte(majorType | byte(argument))
+	case argument <= 0xff:
+		writer.Write([]byte{majorType | 24, byte(argument)})
+	case argument <= 0xffff:
+		writer.Write([]byte{majorType | 25, byte(argument >> 8), byte(argument)})
+	case argument <= 0xffffffff:
+		writer.Write([]byte{majorType | 26, byte(argument >> 24), byte(argument >> 16), byte(argument >> 8), byte(argument)})
+	default:
+		writer.WriteByte(majorType | 27)
+		for shift := uint(56); ; shift -= 8 {
+			writer.WriteByte(byte(argument >> shift))
+			if shift == 0 {
+				break
+			}
+		}
+	}
+}
+
+// EncodeMessagePack encodes the items as a MessagePack array of strings
+func EncodeMessagePack(w io.Writer, items []string) error {
+	writer := bufio.NewWriter(w)
+	length := len(items)
+	switch {
+	case length < 16:
+		writer.WriteByte(0x90 | byte(length))
+	case length <= 0xffff:
+		writer.Write([]byte{0xdc, byte(length >> 8), byte(length)})
+	case uint64(length) <= 0xffffffff:
+		writer.Write([]byte{0xdd, byte(length >> 24), byte(length >> 16), byte(length >> 8), byte(length)})
+	default:
+		return fmt.Errorf("msgpack: %d items exceed the maximum length of an array", length)
+	}
+	for _, item := range items {
+		length := len(item)
+		switch {
+		case length < 32:
+			writer.WriteByte(0xa0 | byte(length))
+		case length <= 0xff:
+			writer.Write([]byte{0xd9, byte(length)})
+		case length <= 0xffff:
+			writer.Write([]byte{0xda, byte(length >> 8), byte(length)})
+		case uint64(length) <= 0xffffffff:
+			writer.Write([]byte{0xdb, byte(length >> 24), byte(length >> 16), byte(length >> 8), byte(length)})
+		default:
+			return fmt.Errorf("msgpack: item of %d bytes exceeds the maximum length of a string", length)
+		}
+		writer.WriteString(item)
+	}
+	return writer.Flush()
+}
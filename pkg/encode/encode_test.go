@@ -0,0 +1,193 @@
+package encode_test
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/jpraynaud/fizzbuzz-server/pkg/encode"
+)
+
+func TestEncoders(t *testing.T) {
+	// Prepare tests data, items holding separators of the formats
+	items := []string{"1", "A,B", "x<\"y\">", "世界"}
+	tests := []struct {
+		name    string
+		encoder encode.EncoderFunc
+		want    string
+	}{
+		{"Array", encode.EncodeArray, `["1","A,B","x\u003c\"y\"\u003e","世界"]` + "\n"},
+		{"Text", encode.EncodeText, "1\nA,B\nx<\"y\">\n世界\n"},
+		{"CSV", encode.EncodeCSV, "1\n\"A,B\"\n\"x<\"\"y\"\">\"\n世界\n"},
+		{"NDJSON", encode.EncodeNDJSON, "\"1\"\n\"A,B\"\n\"x\\u003c\\\"y\\\"\\u003e\"\n\"世界\"\n"},
+		{"XML", encode.EncodeXML, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<items><item>1</item><item>A,B</item><item>x&lt;&#34;y&#34;&gt;</item><item>世界</item></items>\n"},
+		{"CBOR", encode.EncodeCBOR, "\x84\x611\x63A,B\x66x<\"y\">\x66世界"},
+		{"MessagePack", encode.EncodeMessagePack, "\x94\xa11\xa3A,B\xa6x<\"y\">\xa6世界"},
+	}
+	// Run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buffer := &bytes.Buffer{}
+			if err := tt.encoder(buffer, items); err != nil {
+				t.Fatal(err)
+			}
+			if got := buffer.String(); got != tt.want {
+				t.Errorf("Encode() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncoders_Lengths(t *testing.T) {
+	// Check the heads of long arrays and strings
+	long := strings.Repeat("A", 300)
+	items := make([]string, 20)
+	for i := range items {
+		items[i] = long
+	}
+	tests := []struct {
+		name       string
+		encoder    encode.EncoderFunc
+		arrayHead  string
+		stringHead string
+	}{
+		{"CBOR", encode.EncodeCBOR, "\x94", "\x79\x01\x2c"},
+		{"MessagePack", encode.EncodeMessagePack, "\xdc\x00\x14", "\xda\x01\x2c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buffer := &bytes.Buffer{}
+			if err := tt.encoder(buffer, items); err != nil {
+				t.Fatal(err)
+			}
+			want := tt.arrayHead + strings.Repeat(tt.stringHead+long, len(items))
+			if got := buffer.String(); got != want {
+				t.Errorf("Encode() = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	// Register a default format, then the built-in ones
+	registry := encode.NewRegistry()
+	if got := registry.Negotiate(""); got != nil {
+		t.Errorf("Negotiate() = %+v on an empty registry, want nil", got)
+	}
+	registry.Register("json", "application/json", encode.EncoderFunc(func(w io.Writer, items []string) error {
+		_, err := io.WriteString(w, strings.Join(items, ","))
+		return err
+	}))
+	encode.RegisterBuiltins(registry)
+	if got := strings.Join(registry.Names(), ","); got != "json,array,text,csv,ndjson,xml,cbor,msgpack" {
+		t.Errorf("Names() = %s, want the default format first", got)
+	}
+	if got := registry.Lookup("csv"); got == nil || got.ContentType() != "text/csv; charset=utf-8" {
+		t.Errorf("Lookup(csv) = %+v, want the csv format", got)
+	}
+	if got := registry.Lookup("yaml"); got != nil {
+		t.Errorf("Lookup(yaml) = %+v, want nil", got)
+	}
+	// Check the negotiated formats
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", "json"},
+		{"*/*", "json"},
+		{"text/*", "text"},
+		{"application/xml, text/csv", "xml"},
+		{"application/xml;q=0.5, text/csv", "csv"},
+		{"text/*;q=0.5, text/csv;q=0.5", "csv"},
+		{"text/*, text/plain;q=0", "csv"},
+		{"application/msgpack;q=0.1, image/png", "msgpack"},
+		{"text/html, */*;q=0.8", "json"},
+		{"image/png", ""},
+		{"text/csv;q=0, invalid, application/cbor;q=2", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			got := ""
+			if format := registry.Negotiate(tt.accept); format != nil {
+				got = format.Name
+			}
+			if got != tt.want {
+				t.Errorf("Negotiate(%s) = %s, want %s", tt.accept, got, tt.want)
+			}
+		})
+	}
+	// Check that registering an existing name replaces its format
+	registry.Register("text", "text/markdown", encode.EncoderFunc(encode.EncodeText))
+	if got := registry.Negotiate("text/markdown"); got == nil || got.Name != "text" || len(registry.Names()) != 8 {
+		t.Errorf("Negotiate(text/markdown) = %+v, want the replaced text format", got)
+	}
+}
+
+func TestStreamEncoders(t *testing.T) {
+	// Check that the streamable formats encode items one by one as they encode them at once
+	registry := encode.NewRegistry()
+	encode.RegisterBuiltins(registry)
+	items := []string{"1", "A,B", "x<\"y\">", "世界"}
+	for _, name := range registry.Names() {
+		format := registry.Lookup(name)
+		encoder, ok := format.Encoder.(encode.StreamEncoder)
+		if name == "msgpack" {
+			if ok {
+				t.Errorf("%s format is a StreamEncoder, want it not to be", name)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%s format is not a StreamEncoder", name)
+			continue
+		}
+		for _, items := range [][]string{items, {}} {
+			want := &bytes.Buffer{}
+			if err := format.Encode(want, items); err != nil {
+				t.Fatal(err)
+			}
+			got := &bytes.Buffer{}
+			writer := encoder.NewItemWriter(got)
+			for _, item := range items {
+				if err := writer.WriteItem(item); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if name == "cbor" {
+				// Streamed CBOR arrays are of indefinite length
+				want.Reset()
+				want.WriteString("\x9f")
+				for _, item := range items {
+					want.WriteString(string(rune(0x60+len(item))) + item)
+				}
+				want.WriteString("\xff")
+			}
+			if got.String() != want.String() {
+				t.Errorf("%s format streamed %q, want %q", name, got, want)
+			}
+		}
+	}
+}
+
+func TestAccepts(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"application/*", false},
+		{"application/problem+json", true},
+		{"application/json, application/problem+json;q=0.5", true},
+		{"application/problem+json;q=0", false},
+	}
+	for _, tt := range tests {
+		if got := encode.Accepts(tt.accept, "application/problem+json"); got != tt.want {
+			t.Errorf("Accepts(%s) = %v, want %v", tt.accept, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,529 @@
+// Package openapi generates OpenAPI 3 documents describing HTTP APIs, whose schemas are reflected from Go types (by their JSON tags),
+// and validates incoming requests against the operations they describe
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version is the version of the OpenAPI specification of the documents
+const Version = "3.0.3"
+
+// bodyMaxBytes is the default maximum size of the bodies validated, larger bodies are not validated
+const bodyMaxBytes = 1 << 20
+
+// Document represents an OpenAPI document, whose paths are keyed by path template then by lower case method
+type Document struct {
+	OpenAPI    string                           `json:"openapi"`
+	Info       Info                             `json:"info"`
+	Paths      map[string]map[string]*Operation `json:"paths"`
+	Components Components                       `json:"components"`
+	// MaxBodyBytes is the maximum size of the bodies validated, larger bodies are passed through without validation
+	MaxBodyBytes int64 `json:"-"`
+	types        map[string]reflect.Type
+}
+
+// Info represents the metadata of the API described by a document
+type Info struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+// Components represents the reusable schemas of a document, referenced by name, and its security schemes
+type Components struct {
+	Schemas         map[string]*Schema         `json:"schemas,omitempty"`
+	SecuritySchemes map[string]*SecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+// SecurityScheme represents a way the operations of a document are authenticated (e.g. an HTTP bearer token, or an API key in a header)
+type SecurityScheme struct {
+	Type        string `json:"type"`
+	Scheme      string `json:"scheme,omitempty"`
+	In          string `json:"in,omitempty"`
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// Operation represents an operation of a path, with its parameters, its request body and its responses keyed by status code (or default)
+type Operation struct {
+	OperationID string                `json:"operationId,omitempty"`
+	Summary     string                `json:"summary,omitempty"`
+	Tags        []string              `json:"tags,omitempty"`
+	Deprecated  bool                  `json:"deprecated,omitempty"`
+	Parameters  []*Parameter          `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]*Response  `json:"responses"`
+	Security    []map[string][]string `json:"security,omitempty"`
+}
+
+// Parameter represents a parameter of an operation, located in the query of the requests
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+// RequestBody represents the body of the requests of an operation, keyed by media type
+type RequestBody struct {
+	Required bool                  `json:"required,omitempty"`
+	Content  map[string]*MediaType `json:"content"`
+}
+
+// Response represents a response of an operation, keyed by media type
+type Response struct {
+	Description string                `json:"description"`
+	Content     map[string]*MediaType `json:"content,omitempty"`
+}
+
+// MediaType represents the schema of a body of a media type
+type MediaType struct {
+	Schema *Schema `json:"schema,omitempty"`
+}
+
+// Schema represents the schema of a value, either a reference to a schema of the components or an inline schema (OneOf several schemas)
+// AdditionalProperties is either false, when the properties of an object are all known, or the *Schema of their values
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	OneOf                []*Schema          `json:"oneOf,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties interface{}        `json:"additionalProperties,omitempty"`
+}
+
+// Bound returns a bound of a schema (its Minimum or Maximum)
+func Bound(value float64) *float64 {
+	return &value
+}
+
+// NewDocument is the Document factory, that creates a document without paths
+func NewDocument(title, description, version string) *Document {
+	return &Document{
+		OpenAPI: Version,
+		Info: Info{
+			Title:       title,
+			Description: description,
+			Version:     version,
+		},
+		Paths: make(map[string]map[string]*Operation),
+		Components: Components{
+			Schemas: make(map[string]*Schema),
+		},
+		MaxBodyBytes: bodyMaxBytes,
+		types:        make(map[string]reflect.Type),
+	}
+}
+
+// AddOperation adds the operation of a method on a path template (e.g. /v2/render), it replaces the previous one if any
+func (d *Document) AddOperation(path, method string, operation *Operation) {
+	if d.Paths[path] == nil {
+		d.Paths[path] = make(map[string]*Operation)
+	}
+	d.Paths[path][strings.ToLower(method)] = operation
+}
+
+// Operation returns the operation of a method on a path template, nil if there is none
+func (d *Document) Operation(path, method string) *Operation {
+	return d.Paths[path][strings.ToLower(method)]
+}
+
+// AddSecurityScheme adds a security scheme, that operations reference by name
+func (d *Document) AddSecurityScheme(name string, scheme *SecurityScheme) {
+	if d.Components.SecuritySchemes == nil {
+		d.Components.SecuritySchemes = make(map[string]*SecurityScheme)
+	}
+	d.Components.SecuritySchemes[name] = scheme
+}
+
+// timeType is the type of the times, encoded as RFC 3339 strings
+var timeType = reflect.TypeOf(time.Time{})
+
+// Schema returns the schema of the JSON encoding of the type of a value, the schemas of named struct types are added to the components
+// and referenced by their name (capitalized), the other types are described inline
+// The fields of a struct are its properties, named by their JSON tag, and required unless omitempty
+// Their openapi tag holds comma separated options: optional (not required despite no omitempty), minimum=N and maximum=N
+func (d *Document) Schema(value interface{}) *Schema {
+	return d.schemaOf(reflect.TypeOf(value))
+}
+
+// schemaOf returns the schema of the JSON encoding of a type
+func (d *Document) schemaOf(t reflect.Type) *Schema {
+	if t == nil {
+		return &Schema{}
+	}
+	if t == timeType {
+		return &Schema{Type: "string", Format: "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return d.schemaOf(t.Elem())
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &Schema{Type: "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		return &Schema{Type: "array", Items: d.schemaOf(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: d.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return d.structSchema(t)
+		}
+		name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+		if d.types[name] != t {
+			// The component is added before its properties, so that recursive types reference it
+			d.types[name] = t
+			d.Components.Schemas[name] = &Schema{}
+			*d.Components.Schemas[name] = *d.structSchema(t)
+		}
+		return &Schema{Ref: "#/components/schemas/" + name}
+	}
+	return &Schema{}
+}
+
+// structSchema returns the inline schema of a struct type, whose untagged embedded structs are flattened
+func (d *Document) structSchema(t reflect.Type) *Schema {
+	schema := &Schema{Type: "object", Properties: make(map[string]*Schema), AdditionalProperties: false}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" || (field.PkgPath != "" && !field.Anonymous) {
+			continue
+		}
+		options := strings.Split(tag, ",")
+		name := options[0]
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				flattened := d.structSchema(embedded)
+				for property, propertySchema := range flattened.Properties {
+					schema.Properties[property] = propertySchema
+				}
+				schema.Required = append(schema.Required, flattened.Required...)
+				continue
+			}
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		property := d.schemaOf(field.Type)
+		required := true
+		for _, option := range options[1:] {
+			if option == "omitempty" {
+				required = false
+			}
+		}
+		for _, option := range strings.Split(field.Tag.Get("openapi"), ",") {
+			key, value := option, ""
+			if i := strings.Index(option, "="); i >= 0 {
+				key, value = option[:i], option[i+1:]
+			}
+			bound, _ := strconv.ParseFloat(value, 64)
+			switch key {
+			case "optional":
+				required = false
+			case "minimum":
+				property.Minimum = Bound(bound)
+			case "maximum":
+				property.Maximum = Bound(bound)
+			}
+		}
+		schema.Properties[name] = property
+		if required {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+	sort.Strings(schema.Required)
+	return schema
+}
+
+// QueryParameters returns the query parameters of the fields of a flat struct (e.g. a request sent in a query), in the order of the fields
+// Their names, schemas and whether they are required follow the rules of Document.Schema
+func QueryParameters(value interface{}) []*Parameter {
+	t := reflect.Indirect(reflect.ValueOf(value)).Type()
+	schema := NewDocument("", "", "").structSchema(t)
+	required := make(map[string]bool)
+	for _, name := range schema.Required {
+		required[name] = true
+	}
+	parameters := make([]*Parameter, 0, len(schema.Properties))
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if property, ok := schema.Properties[name]; ok {
+			parameters = append(parameters, &Parameter{Name: name, In: "query", Required: required[name], Schema: property})
+		}
+	}
+	return parameters
+}
+
+// resolve returns the schema referenced by a schema, or the schema itself if it is inline
+func (d *Document) resolve(schema *Schema) *Schema {
+	if schema != nil && schema.Ref != "" {
+		if resolved := d.Components.Schemas[strings.TrimPrefix(schema.Ref, "#/components/schemas/")]; resolved != nil {
+			return resolved
+		}
+	}
+	return schema
+}
+
+// ValidationError represents a request that does not comply with its operation: a query parameter or a property of its JSON body
+// (In is query or body), why it is invalid and its value
+type ValidationError struct {
+	In     string
+	Name   string
+	Reason string
+	Value  string
+}
+
+// Error returns the message of the error
+func (e *ValidationError) Error() string {
+	if e.In == "body" {
+		return fmt.Sprintf("body property %s %s, value %s was given", e.Name, e.Reason, e.Value)
+	}
+	return fmt.Sprintf("%s parameter %s, value %s was given", e.Name, e.Reason, e.Value)
+}
+
+// ValidateRequest validates a request against the operation of its method on a path template, if any, and returns a *ValidationError
+// when it does not comply: its query parameters, then its JSON body
+// Empty query parameters are considered missing, malformed JSON bodies and bodies larger than MaxBodyBytes are not validated
+// The body is read, then restored for the handlers
+func (d *Document) ValidateRequest(r *http.Request, path string) error {
+	operation := d.Operation(path, r.Method)
+	if operation == nil {
+		return nil
+	}
+	query := r.URL.Query()
+	for _, parameter := range operation.Parameters {
+		if parameter.In != "query" {
+			continue
+		}
+		values := query[parameter.Name]
+		if len(values) == 0 || (len(values) == 1 && values[0] == "") {
+			if parameter.Required {
+				return &ValidationError{In: "query", Name: parameter.Name, Reason: "is required"}
+			}
+			continue
+		}
+		schema := d.resolve(parameter.Schema)
+		if schema.Type == "array" {
+			schema = d.resolve(schema.Items)
+		}
+		for _, value := range values {
+			if reason := d.validateValue(schema, value); reason != "" {
+				return &ValidationError{In: "query", Name: parameter.Name, Reason: reason, Value: value}
+			}
+		}
+	}
+	return d.validateBody(r, operation)
+}
+
+// validateValue validates the value of a query parameter against its schema, and returns the reason why it is invalid (empty if valid)
+func (d *Document) validateValue(schema *Schema, value string) string {
+	switch schema.Type {
+	case "integer":
+		integer, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || !inBounds(schema, float64(integer)) {
+			return boundsReason(schema)
+		}
+	case "number":
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil || !inBounds(schema, number) {
+			return boundsReason(schema)
+		}
+	case "boolean":
+		if _, err := strconv.ParseBool(value); err != nil {
+			return "must be true or false"
+		}
+	case "string":
+		return enumReason(schema, value)
+	}
+	return ""
+}
+
+// inBounds reports whether a number is within the bounds of a schema
+func inBounds(schema *Schema, number float64) bool {
+	return (schema.Minimum == nil || number >= *schema.Minimum) && (schema.Maximum == nil || number <= *schema.Maximum)
+}
+
+// boundsReason returns the reason why a number (or an integer) is invalid, given the type and the bounds of its schema
+func boundsReason(schema *Schema) string {
+	kind := "a number"
+	if schema.Type == "integer" {
+		kind = "an integer"
+	}
+	switch {
+	case schema.Minimum != nil && schema.Maximum != nil:
+		return fmt.Sprintf("must be %s between %g and %g", kind, *schema.Minimum, *schema.Maximum)
+	case schema.Minimum != nil:
+		return fmt.Sprintf("must be %s >= %g", kind, *schema.Minimum)
+	case schema.Maximum != nil:
+		return fmt.Sprintf("must be %s <= %g", kind, *schema.Maximum)
+	}
+	return "must be " + kind
+}
+
+// enumReason returns the reason why a string is not among the values of its schema, empty if it is or if any string is valid
+func enumReason(schema *Schema, value string) string {
+	if len(schema.Enum) == 0 {
+		return ""
+	}
+	for _, valid := range schema.Enum {
+		if value == valid {
+			return ""
+		}
+	}
+	return "must be one of " + strings.Join(schema.Enum, ", ")
+}
+
+// bodyReadCloser restores a body that was read: the bytes read, then the rest of the body
+type bodyReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// validateBody validates the JSON body of a request against the schema of its operation, if any
+func (d *Document) validateBody(r *http.Request, operation *Operation) error {
+	if operation.RequestBody == nil || r.Body == nil {
+		return nil
+	}
+	mediaType := "application/json"
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, _ = mime.ParseMediaType(contentType)
+	}
+	content := operation.RequestBody.Content[mediaType]
+	if mediaType != "application/json" || content == nil || content.Schema == nil {
+		return nil
+	}
+	read, err := ioutil.ReadAll(io.LimitReader(r.Body, d.MaxBodyBytes+1))
+	r.Body = &bodyReadCloser{Reader: io.MultiReader(bytes.NewReader(read), r.Body), Closer: r.Body}
+	if err != nil || int64(len(read)) > d.MaxBodyBytes {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(read))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil
+	}
+	return d.validateJSON(content.Schema, value, "")
+}
+
+// validateJSON validates a decoded JSON value against its schema, name is the path of the value in the body (empty for the body itself)
+func (d *Document) validateJSON(schema *Schema, value interface{}, name string) error {
+	schema = d.resolve(schema)
+	invalid := func(reason string) error {
+		encoded, _ := json.Marshal(value)
+		if name == "" {
+			return &ValidationError{In: "body", Name: "(root)", Reason: reason, Value: string(encoded)}
+		}
+		return &ValidationError{In: "body", Name: name, Reason: reason, Value: string(encoded)}
+	}
+	switch schema.Type {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return invalid("must be an object")
+		}
+		for _, required := range schema.Required {
+			if _, ok := object[required]; !ok {
+				return &ValidationError{In: "body", Name: joinName(name, required), Reason: "is required"}
+			}
+		}
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			property := schema.Properties[key]
+			if property == nil {
+				additional, ok := schema.AdditionalProperties.(*Schema)
+				if !ok {
+					if schema.AdditionalProperties == false {
+						encoded, _ := json.Marshal(object[key])
+						return &ValidationError{In: "body", Name: joinName(name, key), Reason: "is not allowed", Value: string(encoded)}
+					}
+					continue
+				}
+				property = additional
+			}
+			if err := d.validateJSON(property, object[key], joinName(name, key)); err != nil {
+				return err
+			}
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return invalid("must be an array")
+		}
+		for i, item := range array {
+			if err := d.validateJSON(schema.Items, item, fmt.Sprintf("%s[%d]", name, i)); err != nil {
+				return err
+			}
+		}
+	case "integer", "number":
+		number, ok := value.(json.Number)
+		if !ok {
+			return invalid(boundsReason(schema))
+		}
+		if reason := d.validateValue(schema, number.String()); reason != "" {
+			return invalid(reason)
+		}
+	case "string":
+		text, ok := value.(string)
+		if !ok {
+			return invalid("must be a string")
+		}
+		if reason := enumReason(schema, text); reason != "" {
+			return invalid(reason)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return invalid("must be true or false")
+		}
+	}
+	return nil
+}
+
+// joinName returns the path of a property of a value in a body
+func joinName(name, property string) string {
+	if name == "" {
+		return property
+	}
+	return name + "." + property
+}
@@ -0,0 +1,146 @@
+package openapi_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jpraynaud/fizzbuzz-server/pkg/openapi"
+)
+
+type embedded struct {
+	Embedded string `json:"embedded"`
+}
+
+type item struct {
+	embedded
+	Name     string            `json:"name" openapi:"optional"`
+	Count    int               `json:"count" openapi:"minimum=1,maximum=10"`
+	Tags     []string          `json:"tags,omitempty"`
+	Labels   map[string]*item  `json:"labels,omitempty"`
+	Seen     *time.Time        `json:"seen,omitempty"`
+	Data     []byte            `json:"data,omitempty"`
+	Any      interface{}       `json:"any"`
+	Ignored  string            `json:"-"`
+	internal string            // unexported fields are not encoded
+	Values   map[string]uint64 `json:"values,omitempty"`
+}
+
+func TestDocument_Schema(t *testing.T) {
+	document := openapi.NewDocument("Test", "", "1")
+	if got := document.Schema([]*item{}); got.Type != "array" || got.Items.Ref != "#/components/schemas/Item" {
+		t.Fatalf("Schema() = %+v, want an array of Item references", got)
+	}
+	encoded, err := json.Marshal(document.Components.Schemas["Item"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"type":"object","properties":{` +
+		`"any":{},` +
+		`"count":{"type":"integer","minimum":1,"maximum":10},` +
+		`"data":{"type":"string","format":"byte"},` +
+		`"embedded":{"type":"string"},` +
+		`"labels":{"type":"object","additionalProperties":{"$ref":"#/components/schemas/Item"}},` +
+		`"name":{"type":"string"},` +
+		`"seen":{"type":"string","format":"date-time"},` +
+		`"tags":{"type":"array","items":{"type":"string"}},` +
+		`"values":{"type":"object","additionalProperties":{"type":"integer","format":"int64"}}},` +
+		`"required":["any","count","embedded"],"additionalProperties":false}`
+	if string(encoded) != want {
+		t.Errorf("Item schema = %s, want %s", encoded, want)
+	}
+	if len(document.Components.Schemas) != 1 {
+		t.Errorf("Components.Schemas = %+v, want Item only", document.Components.Schemas)
+	}
+}
+
+func TestQueryParameters(t *testing.T) {
+	parameters := openapi.QueryParameters(struct {
+		Limit int    `json:"limit" openapi:"minimum=1"`
+		Name  string `json:"name,omitempty"`
+	}{})
+	if len(parameters) != 2 {
+		t.Fatalf("QueryParameters() = %+v, want 2 parameters", parameters)
+	}
+	if got := parameters[0]; got.Name != "limit" || got.In != "query" || !got.Required || got.Schema.Type != "integer" || *got.Schema.Minimum != 1 {
+		t.Errorf("QueryParameters()[0] = %+v, want the required limit >= 1", got)
+	}
+	if got := parameters[1]; got.Name != "name" || got.Required || got.Schema.Type != "string" {
+		t.Errorf("QueryParameters()[1] = %+v, want the optional name", got)
+	}
+}
+
+func TestDocument_ValidateRequest(t *testing.T) {
+	// Prepare the document
+	document := openapi.NewDocument("Test", "", "1")
+	document.MaxBodyBytes = 128
+	parameters := append(openapi.QueryParameters(struct {
+		Limit int    `json:"limit" openapi:"minimum=1"`
+		Name  string `json:"name" openapi:"optional"`
+	}{}), &openapi.Parameter{Name: "mode", In: "query", Schema: &openapi.Schema{Type: "string", Enum: []string{"a", "b"}}},
+		&openapi.Parameter{Name: "ratio", In: "query", Schema: &openapi.Schema{Type: "number", Maximum: openapi.Bound(1)}},
+		&openapi.Parameter{Name: "flag", In: "query", Schema: &openapi.Schema{Type: "boolean"}},
+		&openapi.Parameter{Name: "ids", In: "query", Schema: &openapi.Schema{Type: "array", Items: &openapi.Schema{Type: "integer"}}})
+	document.AddOperation("/items", http.MethodGet, &openapi.Operation{Parameters: parameters})
+	document.AddOperation("/items", http.MethodPost, &openapi.Operation{RequestBody: &openapi.RequestBody{
+		Content: map[string]*openapi.MediaType{"application/json": {Schema: document.Schema(item{})}},
+	}})
+	// Prepare tests data
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		contentType string
+		body        string
+		wantErr     string
+	}{
+		{"Valid", "GET", "/items?limit=1&name=x&mode=a&ratio=0.5&flag=true&ids=1&ids=2", "", "", ""},
+		{"Missing", "GET", "/items?name=x", "", "", "limit parameter is required, value  was given"},
+		{"Empty", "GET", "/items?limit=", "", "", "limit parameter is required, value  was given"},
+		{"Integer", "GET", "/items?limit=1.5", "", "", "limit parameter must be an integer >= 1, value 1.5 was given"},
+		{"Minimum", "GET", "/items?limit=0", "", "", "limit parameter must be an integer >= 1, value 0 was given"},
+		{"Enum", "GET", "/items?limit=1&mode=c", "", "", "mode parameter must be one of a, b, value c was given"},
+		{"Maximum", "GET", "/items?limit=1&ratio=2", "", "", "ratio parameter must be a number <= 1, value 2 was given"},
+		{"Boolean", "GET", "/items?limit=1&flag=yes", "", "", "flag parameter must be true or false, value yes was given"},
+		{"Array", "GET", "/items?limit=1&ids=1&ids=x", "", "", "ids parameter must be an integer, value x was given"},
+		{"Not described", "GET", "/other?limit=x", "", "", ""},
+		{"Valid body", "POST", "/items", "application/json", `{"embedded":"","count":1,"any":null}`, ""},
+		{"Body required", "POST", "/items", "", `{"count":1,"any":null}`, "body property embedded is required, value  was given"},
+		{"Body bounds", "POST", "/items", "application/json; charset=utf-8", `{"embedded":"","count":11,"any":null}`, "body property count must be an integer between 1 and 10, value 11 was given"},
+		{"Body nested", "POST", "/items", "", `{"embedded":"","count":1,"any":1,"labels":{"a":{"embedded":1,"count":1,"any":1}}}`, "body property labels.a.embedded must be a string, value 1 was given"},
+		{"Body unknown", "POST", "/items", "", `{"embedded":"","count":1,"any":1,"other":true}`, "body property other is not allowed, value true was given"},
+		{"Body items", "POST", "/items", "", `{"embedded":"","count":1,"any":1,"tags":["a",2]}`, "body property tags[1] must be a string, value 2 was given"},
+		{"Body root", "POST", "/items", "", `[]`, "body property (root) must be an object, value [] was given"},
+		{"Body malformed", "POST", "/items", "", `{"count":`, ""},
+		{"Body other media type", "POST", "/items", "text/csv", `count`, ""},
+		{"Body too large", "POST", "/items", "", `{"tags":["` + strings.Repeat("a", 128) + `"]}`, ""},
+	}
+	// Run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				request.Header.Set("Content-Type", tt.contentType)
+			}
+			got := ""
+			if err := document.ValidateRequest(request, request.URL.Path); err != nil {
+				if _, ok := err.(*openapi.ValidationError); !ok {
+					t.Errorf("ValidateRequest() error is a %T, want a *openapi.ValidationError", err)
+				}
+				got = err.Error()
+			}
+			if got != tt.wantErr {
+				t.Errorf("ValidateRequest() error = %s, want %s", got, tt.wantErr)
+			}
+			// Check that the body is restored for the handlers
+			body, err := ioutil.ReadAll(request.Body)
+			if err != nil || string(body) != tt.body {
+				t.Errorf("body = %s, want %s restored", body, tt.body)
+			}
+		})
+	}
+}
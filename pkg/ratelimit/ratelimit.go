@@ -0,0 +1,124 @@
+// Package ratelimit implements the token bucket rate limiting of clients identified by a key (e.g. their IP address or their API key)
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limiter represents the token buckets of the clients, each of them refilled at Rate tokens per second up to Burst tokens
+// A client starts with a full bucket. It is safe for concurrent use
+type Limiter struct {
+	rate    float64
+	burst   int
+	mutex   sync.Mutex
+	buckets map[string]*bucket
+}
+
+// bucket represents the tokens of a client at the time they were last updated
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Result represents the outcome of a take of tokens: whether it is allowed, the budget of the client (Limit, the burst)
+// and its tokens Remaining after the take, the delay after which the take would be allowed (0 if allowed),
+// and the delay after which the bucket is full again
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration
+	Reset      time.Duration
+}
+
+// NewLimiter is the Limiter factory, rate is in tokens per second and burst is the capacity of the buckets
+func NewLimiter(rate float64, burst int) *Limiter {
+	return &Limiter{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Rate returns the number of tokens per second that refill the buckets
+func (l *Limiter) Rate() float64 {
+	return l.rate
+}
+
+// Burst returns the capacity of the buckets, a take of more tokens is never allowed
+func (l *Limiter) Burst() int {
+	return l.burst
+}
+
+// refill returns the tokens of a bucket at a time
+func (l *Limiter) refill(b *bucket, now time.Time) float64 {
+	elapsed := now.Sub(b.updated).Seconds()
+	if elapsed <= 0 {
+		return b.tokens
+	}
+	return math.Min(float64(l.burst), b.tokens+elapsed*l.rate)
+}
+
+// Take takes tokens from the bucket of a client at a time, if it holds enough of them, otherwise the bucket is left unchanged
+func (l *Limiter) Take(key string, tokens int, now time.Time) Result {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.burst), updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens, b.updated = l.refill(b, now), now
+	result := Result{Allowed: b.tokens >= float64(tokens), Limit: l.burst}
+	if result.Allowed {
+		b.tokens -= float64(tokens)
+	} else if tokens <= l.burst {
+		result.RetryAfter = l.duration(float64(tokens) - b.tokens)
+	}
+	result.Remaining = int(math.Floor(b.tokens))
+	result.Reset = l.duration(float64(l.burst) - b.tokens)
+	return result
+}
+
+// duration returns the duration in which a number of tokens are refilled
+func (l *Limiter) duration(tokens float64) time.Duration {
+	return time.Duration(math.Ceil(tokens / l.rate * float64(time.Second)))
+}
+
+// Prune removes the buckets that are full at a time, as they are the same as the buckets of new clients, and returns their number
+func (l *Limiter) Prune(now time.Time) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	pruned := 0
+	for key, b := range l.buckets {
+		if l.refill(b, now) >= float64(l.burst) {
+			delete(l.buckets, key)
+			pruned++
+		}
+	}
+	return pruned
+}
+
+// Len returns the number of buckets of the limiter
+func (l *Limiter) Len() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return len(l.buckets)
+}
+
+// Run prunes the buckets periodically until the context is done
+func (l *Limiter) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.Prune(now)
+		}
+	}
+}
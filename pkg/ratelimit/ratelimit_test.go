@@ -0,0 +1,88 @@
+package ratelimit_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jpraynaud/fizzbuzz-server/pkg/ratelimit"
+)
+
+func TestLimiter_Take(t *testing.T) {
+	// A bucket of 4 tokens refilled at 2 tokens per second
+	limiter := ratelimit.NewLimiter(2, 4)
+	start := time.Date(2026, time.October, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		key     string
+		tokens  int
+		elapsed time.Duration
+		want    ratelimit.Result
+	}{
+		{"Full bucket", "a", 1, 0, ratelimit.Result{Allowed: true, Limit: 4, Remaining: 3, Reset: 500 * time.Millisecond}},
+		{"Several tokens", "a", 3, 0, ratelimit.Result{Allowed: true, Limit: 4, Remaining: 0, Reset: 2 * time.Second}},
+		{"Empty bucket", "a", 1, 0, ratelimit.Result{Allowed: false, Limit: 4, Remaining: 0, RetryAfter: 500 * time.Millisecond, Reset: 2 * time.Second}},
+		{"Other client", "b", 4, 0, ratelimit.Result{Allowed: true, Limit: 4, Remaining: 0, Reset: 2 * time.Second}},
+		{"Partially refilled", "a", 2, 750 * time.Millisecond, ratelimit.Result{Allowed: false, Limit: 4, Remaining: 1, RetryAfter: 250 * time.Millisecond, Reset: 1250 * time.Millisecond}},
+		{"Refilled", "a", 2, time.Second, ratelimit.Result{Allowed: true, Limit: 4, Remaining: 0, Reset: 2 * time.Second}},
+		{"Capped refill", "b", 0, time.Hour, ratelimit.Result{Allowed: true, Limit: 4, Remaining: 4}},
+		{"Above burst", "b", 5, time.Hour, ratelimit.Result{Allowed: false, Limit: 4, Remaining: 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := limiter.Take(tt.key, tt.tokens, start.Add(tt.elapsed)); got != tt.want {
+				t.Errorf("Take() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimiter_Prune(t *testing.T) {
+	limiter := ratelimit.NewLimiter(1, 10)
+	now := time.Now()
+	limiter.Take("a", 10, now)
+	limiter.Take("b", 10, now.Add(5*time.Second))
+	if got := limiter.Prune(now.Add(10 * time.Second)); got != 1 || limiter.Len() != 1 {
+		t.Errorf("Prune() = %d with %d buckets left, want 1 and 1", got, limiter.Len())
+	}
+	// The bucket of a pruned client is full again
+	if got := limiter.Take("a", 10, now.Add(10*time.Second)); !got.Allowed {
+		t.Errorf("Take() = %+v after Prune(), want allowed", got)
+	}
+	// Run prunes until the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		limiter.Run(ctx, time.Millisecond)
+		close(done)
+	}()
+	cancel()
+	<-done
+}
+
+func TestLimiter_Concurrent(t *testing.T) {
+	// A bucket that is not refilled during the test allows exactly its burst
+	limiter := ratelimit.NewLimiter(0.001, 100)
+	now := time.Now()
+	allowed := make(chan bool, 1000)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 1000; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			allowed <- limiter.Take("a", 1, now).Allowed
+		}()
+	}
+	wg.Wait()
+	close(allowed)
+	total := 0
+	for ok := range allowed {
+		if ok {
+			total++
+		}
+	}
+	if total != 100 {
+		t.Errorf("%d takes allowed, want 100", total)
+	}
+}
@@ -0,0 +1,123 @@
+package render
+
+import (
+	"errors"
+	"sort"
+)
+
+// ErrNegativeTotal is returned when an adjustment would bring the total of a request below 0
+var ErrNegativeTotal = errors.New("the adjustment would bring the total of the request below 0")
+
+// AdminStatisticRecorder represents the interface of a StatisticRecorder whose statistics can be managed request by request:
+// - DeleteStatistics deletes the statistics of the requests that match all the filters, and returns them ranked
+// - DeleteStatistic deletes the statistic of a request, and returns it (nil if the request was not recorded)
+// - AdjustStatistic adds delta hits to the total of a request (removes them if negative), and returns its statistic (nil once its total is 0)
+// Added hits are not broken down by outcome nor bucketed by minute, removed hits are removed from its outcomes in proportion
+type AdminStatisticRecorder interface {
+	DeleteStatistics(filters []*Filter) ([]*RequestStatistic, error)
+	DeleteStatistic(request *Request) (*RequestStatistic, error)
+	AdjustStatistic(request *Request, delta int) (*RequestStatistic, error)
+}
+
+// DeleteStatistics deletes the statistics of the requests that match all the filters, and returns them ranked
+// When the statistics are persisted, the deletions are also appended to the log of the persister
+func (s *Statistics) DeleteStatistics(filters []*Filter) ([]*RequestStatistic, error) {
+	if s.persister != nil {
+		s.persister.mutex.Lock()
+		defer s.persister.mutex.Unlock()
+	}
+	deleted := make([]*RequestStatistic, 0)
+	for _, seen := range s.seenRequests() {
+		if matchFilters(&seen.request, filters) {
+			if statistic := s.delete(&seen.request); statistic != nil {
+				deleted = append(deleted, statistic)
+			}
+		}
+	}
+	if len(deleted) > 0 {
+		s.refreshCanonical(s.now())
+		s.refreshTop()
+	}
+	sort.Slice(deleted, func(i, j int) bool {
+		return deleted[i].RanksBefore(deleted[j])
+	})
+	for i, statistic := range deleted {
+		statistic.Rank = i + 1
+	}
+	return deleted, nil
+}
+
+// DeleteStatistic deletes the statistic of a request, and returns it (nil if the request was not recorded)
+// When the statistics are persisted, the deletion is also appended to the log of the persister
+func (s *Statistics) DeleteStatistic(request *Request) (*RequestStatistic, error) {
+	if s.persister != nil {
+		s.persister.mutex.Lock()
+		defer s.persister.mutex.Unlock()
+	}
+	statistic := s.delete(request)
+	if statistic != nil {
+		s.refreshCanonical(s.now())
+		s.refreshTop()
+	}
+	return statistic, nil
+}
+
+// delete deletes the statistic of a request and returns it, nil if the request was not recorded
+// The caller must hold the mutex of the persister, and refresh the canonical requests and the top request
+func (s *Statistics) delete(request *Request) *RequestStatistic {
+	statistic := s.GetStatistic(request)
+	if statistic == nil {
+		return nil
+	}
+	factor := 0.0
+	s.persist(&persistedRecord{Request: request, Factor: &factor, Time: s.now()})
+	s.scale(request, factor)
+	return statistic
+}
+
+// AdjustStatistic adds delta hits to the total of a request (removes them if negative), and returns its statistic (nil once its total is 0)
+// When the statistics are persisted, the adjustment is also appended to the log of the persister
+func (s *Statistics) AdjustStatistic(request *Request, delta int) (*RequestStatistic, error) {
+	if s.persister != nil {
+		s.persister.mutex.Lock()
+		defer s.persister.mutex.Unlock()
+	}
+	switch {
+	case delta > 0:
+		statistic := NewRequestStatistic(request, delta)
+		s.persist(&persistedRecord{Statistic: statistic, Time: s.now()})
+		s.merge(statistic)
+	case delta < 0:
+		key := s.key(request)
+		shard := s.shard(&key)
+		shard.Lock()
+		total := shard.totals[key]
+		shard.Unlock()
+		if total+delta < 0 {
+			return nil, ErrNegativeTotal
+		}
+		s.persist(&persistedRecord{Request: request, Delta: delta, Time: s.now()})
+		if _, evicted := s.removeHits(request, -delta); evicted {
+			s.refreshCanonical(s.now())
+		}
+		s.refreshTop()
+	}
+	return s.GetStatistic(request), nil
+}
+
+// removeHits removes hits from the total of a request, and from its totals by outcome in proportion (see Statistics.lower)
+func (s *Statistics) removeHits(request *Request, hits int) (int, bool) {
+	return s.lower(request, func(total int) int {
+		return total - hits
+	})
+}
+
+// matchFilters reports whether a request matches all the filters
+func matchFilters(request *Request, filters []*Filter) bool {
+	for _, filter := range filters {
+		if !filter.Match(request) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,132 @@
+package render
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStatistics_DeleteStatistics(t *testing.T) {
+	// Record requests, two of which have the same canonical form
+	now := time.Date(2019, 10, 1, 12, 0, 30, 0, time.UTC)
+	statistics := NewStatistics()
+	setClock(statistics, &now)
+	first, second, third := NewRequest(5, 3, 3, "A", "B"), NewRequest(5, 3, 30, "AB", "C"), NewRequest(20, 3, 5, "A", "B")
+	for i, request := range []*Request{first, second, second, third, third, third} {
+		statistics.RecordOutcome(request, OutcomeSuccess, time.Duration(i)*time.Millisecond)
+	}
+	// Check that only the requests matching all filters are deleted, and returned ranked
+	filters := []*Filter{mustFilter(t, "int1=3"), mustFilter(t, "limit<10")}
+	deleted, err := statistics.DeleteStatistics(filters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 2 || deleted[0].Request != *second || deleted[0].Total != 2 || deleted[0].Rank != 1 || deleted[1].Request != *first {
+		t.Errorf("Statistics.DeleteStatistics() = %v, want the second and the first requests", deleted)
+	}
+	if got := statistics.GetTopStatistics(10); len(got) != 1 || got[0].Request != *third {
+		t.Errorf("Statistics.GetTopStatistics() = %v, want the third request only", got)
+	}
+	if got := statistics.CanonicalStatistics().GetStatistic(first); got != nil {
+		t.Errorf("Statistics.CanonicalStatistics().GetStatistic() = %+v, want nil", got)
+	}
+	if deleted, err := statistics.DeleteStatistics(filters); err != nil || len(deleted) != 0 {
+		t.Errorf("Statistics.DeleteStatistics() = %v, %v, want no statistic", deleted, err)
+	}
+}
+
+func TestStatistics_DeleteStatistic(t *testing.T) {
+	// Record requests with the same canonical form, seen at different times
+	now := time.Date(2019, 10, 1, 12, 0, 30, 0, time.UTC)
+	later := now.Add(time.Hour)
+	statistics := NewStatistics()
+	setClock(statistics, &now)
+	first, second := NewRequest(5, 3, 3, "A", "B"), NewRequest(5, 3, 30, "AB", "C")
+	statistics.RecordOutcome(first, OutcomeError, 3*time.Millisecond)
+	now = later
+	statistics.RecordOutcome(second, OutcomeSuccess, time.Millisecond)
+	statistics.RecordOutcome(second, OutcomeSuccess, time.Millisecond)
+	// Check that the deleted statistic is returned, and that the canonical statistic only keeps the other request
+	deleted, err := statistics.DeleteStatistic(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted == nil || deleted.Request != *first || deleted.Total != 1 {
+		t.Errorf("Statistics.DeleteStatistic() = %+v, want the first request", deleted)
+	}
+	want := &RequestStatistic{
+		Request:   first.Canonical(),
+		Total:     2,
+		Outcomes:  map[Outcome]*OutcomeStatistic{OutcomeSuccess: {Total: 2, Latency: &LatencyStatistic{Count: 2, Mean: 1, Max: 1}, FirstSeen: &later, LastSeen: &later}},
+		Latency:   &LatencyStatistic{Count: 2, Mean: 1, Max: 1},
+		FirstSeen: &later,
+		LastSeen:  &later,
+	}
+	if got := statistics.CanonicalStatistics().GetStatistic(first); !reflect.DeepEqual(got, want) {
+		t.Errorf("Statistics.CanonicalStatistics().GetStatistic() = %+v, want %+v", got, want)
+	}
+	if deleted, err := statistics.DeleteStatistic(first); deleted != nil || err != nil {
+		t.Errorf("Statistics.DeleteStatistic() = %+v, %v, want nil", deleted, err)
+	}
+}
+
+func TestStatistics_AdjustStatistic(t *testing.T) {
+	// Record a request with outcomes
+	statistics := NewStatistics()
+	request, other := NewRequest(20, 3, 5, "A", "B"), NewRequest(10, 2, 7, "C", "D")
+	for i := 0; i < 2; i++ {
+		statistics.RecordOutcome(request, OutcomeSuccess, time.Millisecond)
+		statistics.RecordOutcome(request, OutcomeError, time.Millisecond)
+	}
+	statistics.RecordStatistic(other)
+	statistics.RecordStatistic(other)
+	statistics.RecordStatistic(other)
+	tests := []struct {
+		name         string
+		request      *Request
+		delta        int
+		wantTotal    int
+		wantOutcomes int
+		wantTop      *Request
+		wantErr      error
+	}{
+		{"Add hits", request, 6, 10, 4, request, nil},
+		{"Remove hits", request, -7, 3, 0, other, nil},
+		{"Remove too many hits", request, -4, 3, 0, other, ErrNegativeTotal},
+		{"Add hits to a new request", NewRequest(1, 2, 3, "E", "F"), 1, 1, 0, other, nil},
+		{"Remove all hits", request, -3, 0, 0, other, nil},
+	}
+	for _, tt := range tests {
+		got, err := statistics.AdjustStatistic(tt.request, tt.delta)
+		if err != tt.wantErr {
+			t.Errorf("%s: Statistics.AdjustStatistic() error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+		if err == nil && ((got == nil) != (tt.wantTotal == 0) || (got != nil && got.Total != tt.wantTotal)) {
+			t.Errorf("%s: Statistics.AdjustStatistic() = %+v, want total %d", tt.name, got, tt.wantTotal)
+		}
+		outcomes := 0
+		if got := statistics.GetStatistic(tt.request); got != nil {
+			for _, outcomeStatistic := range got.Outcomes {
+				outcomes += outcomeStatistic.Total
+			}
+		}
+		if outcomes != tt.wantOutcomes {
+			t.Errorf("%s: totals by outcome = %d, want %d", tt.name, outcomes, tt.wantOutcomes)
+		}
+		if got := statistics.GetTopStatistic(); got.Request != *tt.wantTop {
+			t.Errorf("%s: Statistics.GetTopStatistic() = %+v, want %v", tt.name, got, tt.wantTop)
+		}
+		if got, want := statistics.CanonicalStatistics().GetStatistic(tt.request), statistics.GetStatistic(tt.request); (got == nil) != (want == nil) || (got != nil && got.Total != want.Total) {
+			t.Errorf("%s: Statistics.CanonicalStatistics().GetStatistic() = %+v, want %+v", tt.name, got, want)
+		}
+	}
+}
+
+// mustFilter parses a filter expression, or fails the test
+func mustFilter(t *testing.T, expression string) *Filter {
+	filter, err := ParseFilter(expression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filter
+}
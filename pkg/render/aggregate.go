@@ -0,0 +1,201 @@
+package render
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Dimension represents a request parameter by which statistics can be aggregated
+type Dimension string
+
+// Dimensions of the requests, in Request order
+const (
+	DimensionLimit Dimension = "limit"
+	DimensionInt1  Dimension = "int1"
+	DimensionInt2  Dimension = "int2"
+	DimensionStr1  Dimension = "str1"
+	DimensionStr2  Dimension = "str2"
+)
+
+// Dimensions lists the dimensions of the requests, in Request order
+var Dimensions = []Dimension{DimensionLimit, DimensionInt1, DimensionInt2, DimensionStr1, DimensionStr2}
+
+// ParseDimension returns the dimension of a request parameter name
+func ParseDimension(name string) (Dimension, error) {
+	for _, dimension := range Dimensions {
+		if string(dimension) == name {
+			return dimension, nil
+		}
+	}
+	return "", fmt.Errorf("unknown dimension %s", name)
+}
+
+// value returns the value of the dimension of a request
+func (d Dimension) value(request *Request) interface{} {
+	switch d {
+	case DimensionLimit:
+		return request.Limit
+	case DimensionInt1:
+		return request.Int1
+	case DimensionInt2:
+		return request.Int2
+	case DimensionStr1:
+		return request.Str1
+	}
+	return request.Str2
+}
+
+// project copies the dimension of a request to another one
+func (d Dimension) project(from, to *Request) {
+	switch d {
+	case DimensionLimit:
+		to.Limit = from.Limit
+	case DimensionInt1:
+		to.Int1 = from.Int1
+	case DimensionInt2:
+		to.Int2 = from.Int2
+	case DimensionStr1:
+		to.Str1 = from.Str1
+	case DimensionStr2:
+		to.Str2 = from.Str2
+	}
+}
+
+// GroupStatistic represents the rendering statistics of the requests that share the same values of the aggregated dimensions
+// Group maps each aggregated dimension to its value, Requests is the number of distinct requests of the group
+type GroupStatistic struct {
+	Group    map[Dimension]interface{} `json:"group"`
+	Total    int                       `json:"total"`
+	Requests int                       `json:"requests"`
+	Rank     int                       `json:"rank"`
+}
+
+// LimitBucket represents the hits of the requests whose limit is between From and To (inclusive)
+type LimitBucket struct {
+	From  int `json:"from"`
+	To    int `json:"to"`
+	Total int `json:"total"`
+}
+
+// newLimitBucket returns the empty bucket of a limit, invalid limits (lower than 1) share the bucket starting at the lowest one
+func newLimitBucket(limit int) *LimitBucket {
+	const maxInt = int(^uint(0) >> 1)
+	if limit < 1 {
+		return &LimitBucket{From: limit, To: 0}
+	}
+	bucket := &LimitBucket{From: 1, To: 9}
+	for limit > bucket.To {
+		if bucket.To > (maxInt-9)/10 {
+			bucket.From, bucket.To = bucket.To+1, maxInt
+			break
+		}
+		bucket.From, bucket.To = bucket.To+1, bucket.To*10+9
+	}
+	return bucket
+}
+
+// LimitDistribution represents the distribution of the limit parameter over the hits of the requests
+// Percentiles are computed with the nearest-rank method, the histogram has a bucket per power of ten (empty buckets are omitted)
+type LimitDistribution struct {
+	Min       int            `json:"min"`
+	P50       int            `json:"p50"`
+	P90       int            `json:"p90"`
+	P99       int            `json:"p99"`
+	Max       int            `json:"max"`
+	Histogram []*LimitBucket `json:"histogram"`
+}
+
+// Aggregation represents rendering statistics aggregated by some dimensions
+// Groups are the k top groups, ranked by descending Total then ascending values of the dimensions (in Request order)
+// Limit is the distribution of the limit parameter over all the hits, nil when no request has been recorded
+type Aggregation struct {
+	GroupBy  []Dimension        `json:"group_by"`
+	Total    int                `json:"total"`
+	Requests int                `json:"requests"`
+	Groups   []*GroupStatistic  `json:"groups"`
+	Limit    *LimitDistribution `json:"limit,omitempty"`
+}
+
+// Aggregate aggregates the statistics of a recorder by some dimensions, and returns the k top groups
+func Aggregate(recorder RangeStatisticRecorder, groupBy []Dimension, k int) *Aggregation {
+	aggregation := &Aggregation{GroupBy: groupBy}
+	groups := make(map[Request]*RequestStatistic)
+	requests := make(map[Request]int)
+	limits := make(map[int]int)
+	recorder.RangeStatistics(func(statistic *RequestStatistic) bool {
+		aggregation.Total += statistic.Total
+		aggregation.Requests++
+		limits[statistic.Limit] += statistic.Total
+		key := Request{}
+		for _, dimension := range groupBy {
+			dimension.project(&statistic.Request, &key)
+		}
+		if group, ok := groups[key]; ok {
+			group.Total += statistic.Total
+		} else {
+			groups[key] = NewRequestStatistic(&key, statistic.Total)
+		}
+		requests[key]++
+		return true
+	})
+	// Rank the groups as requests, since the dimensions that are not aggregated are zero
+	top := make(statisticHeap, 0, k)
+	for _, group := range groups {
+		top.offer(group, k)
+	}
+	aggregation.Groups = make([]*GroupStatistic, 0, top.Len())
+	for _, group := range top.ranked() {
+		values := make(map[Dimension]interface{}, len(groupBy))
+		for _, dimension := range groupBy {
+			values[dimension] = dimension.value(&group.Request)
+		}
+		aggregation.Groups = append(aggregation.Groups, &GroupStatistic{
+			Group:    values,
+			Total:    group.Total,
+			Requests: requests[group.Request],
+			Rank:     group.Rank,
+		})
+	}
+	aggregation.Limit = newLimitDistribution(limits, aggregation.Total)
+	return aggregation
+}
+
+// newLimitDistribution returns the distribution of the limit parameter given the hits of each limit, and their total
+func newLimitDistribution(limits map[int]int, total int) *LimitDistribution {
+	if total == 0 {
+		return nil
+	}
+	values := make([]int, 0, len(limits))
+	for limit := range limits {
+		values = append(values, limit)
+	}
+	sort.Ints(values)
+	distribution := &LimitDistribution{
+		Min:       values[0],
+		Max:       values[len(values)-1],
+		Histogram: []*LimitBucket{},
+	}
+	percentiles := []struct {
+		percentile *int
+		rank       int
+	}{
+		{&distribution.P50, int(math.Ceil(0.50 * float64(total)))},
+		{&distribution.P90, int(math.Ceil(0.90 * float64(total)))},
+		{&distribution.P99, int(math.Ceil(0.99 * float64(total)))},
+	}
+	hits, next := 0, 0
+	var bucket *LimitBucket
+	for _, limit := range values {
+		hits += limits[limit]
+		for ; next < len(percentiles) && hits >= percentiles[next].rank; next++ {
+			*percentiles[next].percentile = limit
+		}
+		if bucket == nil || limit > bucket.To {
+			bucket = newLimitBucket(limit)
+			distribution.Histogram = append(distribution.Histogram, bucket)
+		}
+		bucket.Total += limits[limit]
+	}
+	return distribution
+}
@@ -0,0 +1,88 @@
+package render
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAggregate(t *testing.T) {
+	// Record requests
+	statistics := NewStatistics()
+	records := []struct {
+		request *Request
+		times   int
+	}{
+		{NewRequest(10, 3, 5, "A", "B"), 5},
+		{NewRequest(100, 3, 5, "C", "D"), 3},
+		{NewRequest(15, 2, 7, "A", "B"), 4},
+		{NewRequest(1000, 2, 7, "C", "B"), 4},
+		{NewRequest(5, 4, 6, "A", "E"), 1},
+	}
+	for _, record := range records {
+		for i := 0; i < record.times; i++ {
+			statistics.RecordStatistic(record.request)
+		}
+	}
+	// Prepare tests data
+	limit := &LimitDistribution{
+		Min: 5, P50: 15, P90: 1000, P99: 1000, Max: 1000,
+		Histogram: []*LimitBucket{{1, 9, 1}, {10, 99, 9}, {100, 999, 3}, {1000, 9999, 4}},
+	}
+	tests := []struct {
+		name    string
+		groupBy []Dimension
+		k       int
+		want    *Aggregation
+	}{
+		{"Int1 and Int2", []Dimension{DimensionInt1, DimensionInt2}, 2, &Aggregation{
+			GroupBy: []Dimension{DimensionInt1, DimensionInt2}, Total: 17, Requests: 5, Limit: limit,
+			Groups: []*GroupStatistic{
+				{Group: map[Dimension]interface{}{DimensionInt1: 2, DimensionInt2: 7}, Total: 8, Requests: 2, Rank: 1},
+				{Group: map[Dimension]interface{}{DimensionInt1: 3, DimensionInt2: 5}, Total: 8, Requests: 2, Rank: 2},
+			},
+		}},
+		{"Str1", []Dimension{DimensionStr1}, 10, &Aggregation{
+			GroupBy: []Dimension{DimensionStr1}, Total: 17, Requests: 5, Limit: limit,
+			Groups: []*GroupStatistic{
+				{Group: map[Dimension]interface{}{DimensionStr1: "A"}, Total: 10, Requests: 3, Rank: 1},
+				{Group: map[Dimension]interface{}{DimensionStr1: "C"}, Total: 7, Requests: 2, Rank: 2},
+			},
+		}},
+	}
+	// Run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Aggregate(statistics, tt.groupBy, tt.k); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Aggregate() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+	// Check that empty statistics give an empty aggregation
+	statistics.ResetStatistics()
+	want := &Aggregation{GroupBy: []Dimension{DimensionLimit}, Groups: []*GroupStatistic{}}
+	if got := Aggregate(statistics, []Dimension{DimensionLimit}, 10); !reflect.DeepEqual(got, want) {
+		t.Errorf("Aggregate() = %+v, want %+v", got, want)
+	}
+}
+
+func Test_newLimitBucket(t *testing.T) {
+	const maxInt = int(^uint(0) >> 1)
+	tests := []struct {
+		limit int
+		want  LimitBucket
+	}{
+		{-3, LimitBucket{From: -3, To: 0}},
+		{1, LimitBucket{From: 1, To: 9}},
+		{10, LimitBucket{From: 10, To: 99}},
+		{12345, LimitBucket{From: 10000, To: 99999}},
+	}
+	for _, tt := range tests {
+		if got := newLimitBucket(tt.limit); *got != tt.want {
+			t.Errorf("newLimitBucket(%v) = %+v, want %+v", tt.limit, got, tt.want)
+		}
+	}
+	// Check that the last bucket does not overflow
+	if got := newLimitBucket(maxInt); got.From <= maxInt/10 || got.To != maxInt {
+		t.Errorf("newLimitBucket(%v) = %+v, want a bucket ending at %v", maxInt, got, maxInt)
+	}
+}
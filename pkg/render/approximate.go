@@ -0,0 +1,230 @@
+package render
+
+import (
+	"container/heap"
+	"math"
+	"sync"
+)
+
+// ApproximateStatistics represents approximate statistics of requests rendering, that use a fixed amount of memory
+// whatever the number of distinct requests recorded (N is the number of records below)
+// The total of a request is estimated by a count-min sketch of depth rows of width counters:
+// - the estimate never underestimates the exact total
+// - the estimate overestimates the exact total by at most e/width*N, with a probability of at least 1-exp(-depth)
+// The top requests are tracked by the Space-Saving algorithm with capacity counters:
+// - any request whose exact total is greater than N/capacity is tracked
+// - the counter of a tracked request overestimates its exact total by at most its error, itself at most N/capacity
+// The total of a request is the minimum of both estimates, and its MaxError is the minimum of both bounds
+type ApproximateStatistics struct {
+	mutex         sync.Mutex
+	width, depth  int
+	sketch        []int
+	records       int
+	capacity      int
+	counters      map[Request]*heavyHitter
+	heavyHitters  heavyHitterHeap
+	canonical     *ApproximateStatistics
+	canonicalKeys bool
+}
+
+// heavyHitter represents a Space-Saving counter of a request
+type heavyHitter struct {
+	request Request
+	count   int
+	error   int
+	index   int
+}
+
+// heavyHitterHeap is a heap of Space-Saving counters where the root is the counter that ranks last
+type heavyHitterHeap []*heavyHitter
+
+func (h heavyHitterHeap) Len() int { return len(h) }
+func (h heavyHitterHeap) Less(i, j int) bool {
+	if h[i].count != h[j].count {
+		return h[i].count < h[j].count
+	}
+	return h[j].request.Less(&h[i].request)
+}
+func (h heavyHitterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+func (h *heavyHitterHeap) Push(x interface{}) {
+	hitter := x.(*heavyHitter)
+	hitter.index = len(*h)
+	*h = append(*h, hitter)
+}
+func (h *heavyHitterHeap) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// NewApproximateStatistics is the ApproximateStatistics factory
+// epsilon and delta set the error bound of the count-min sketch (at most epsilon*N, with a probability of at least 1-delta)
+// capacity is the number of Space-Saving counters
+func NewApproximateStatistics(epsilon, delta float64, capacity int) *ApproximateStatistics {
+	statistics := newApproximateStatistics(epsilon, delta, capacity, false)
+	statistics.canonical = newApproximateStatistics(epsilon, delta, capacity, true)
+	return statistics
+}
+
+// newApproximateStatistics creates empty ApproximateStatistics, keyed by canonical requests if canonicalKeys is set
+func newApproximateStatistics(epsilon, delta float64, capacity int, canonicalKeys bool) *ApproximateStatistics {
+	width := int(math.Ceil(math.E / epsilon))
+	depth := int(math.Ceil(math.Log(1 / delta)))
+	if depth < 1 {
+		depth = 1
+	}
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &ApproximateStatistics{
+		width:         width,
+		depth:         depth,
+		sketch:        make([]int, width*depth),
+		capacity:      capacity,
+		counters:      make(map[Request]*heavyHitter, capacity),
+		heavyHitters:  make(heavyHitterHeap, 0, capacity),
+		canonicalKeys: canonicalKeys,
+	}
+}
+
+// key returns the key under which the statistics of a request are recorded
+func (as *ApproximateStatistics) key(request *Request) Request {
+	if as.canonicalKeys {
+		return request.Canonical()
+	}
+	return *request
+}
+
+// cell returns the index of the sketch counter of a key in a row (by double hashing)
+func (as *ApproximateStatistics) cell(hash uint64, row int) int {
+	h1, h2 := hash&0xffffffff, hash>>32|1
+	return row*as.width + int((h1+uint64(row)*h2)%uint64(as.width))
+}
+
+// sketchBound returns the error bound of the count-min sketch
+func (as *ApproximateStatistics) sketchBound() int {
+	return int(math.Ceil(math.E / float64(as.width) * float64(as.records)))
+}
+
+// statistic returns the estimated statistic of a key, the caller must hold the mutex
+func (as *ApproximateStatistics) statistic(key *Request) *RequestStatistic {
+	hash := key.hash()
+	total := math.MaxInt64
+	for row := 0; row < as.depth; row++ {
+		if count := as.sketch[as.cell(hash, row)]; count < total {
+			total = count
+		}
+	}
+	maxError := as.sketchBound()
+	if hitter, ok := as.counters[*key]; ok {
+		if hitter.count < total {
+			total = hitter.count
+		}
+		if hitter.error < maxError {
+			maxError = hitter.error
+		}
+	}
+	if maxError > total {
+		maxError = total
+	}
+	statistic := NewRequestStatistic(key, total)
+	statistic.Approximate, statistic.MaxError = true, maxError
+	return statistic
+}
+
+// RecordStatistic records rendering statistics
+func (as *ApproximateStatistics) RecordStatistic(request *Request) {
+	key := as.key(request)
+	hash := key.hash()
+	as.mutex.Lock()
+	as.records++
+	for row := 0; row < as.depth; row++ {
+		as.sketch[as.cell(hash, row)]++
+	}
+	switch hitter, ok := as.counters[key]; {
+	case ok:
+		hitter.count++
+		heap.Fix(&as.heavyHitters, hitter.index)
+	case len(as.heavyHitters) < as.capacity:
+		hitter = &heavyHitter{request: key, count: 1}
+		as.counters[key] = hitter
+		heap.Push(&as.heavyHitters, hitter)
+	default:
+		hitter = as.heavyHitters[0]
+		delete(as.counters, hitter.request)
+		hitter.request, hitter.error = key, hitter.count
+		hitter.count++
+		as.counters[key] = hitter
+		heap.Fix(&as.heavyHitters, 0)
+	}
+	as.mutex.Unlock()
+	if as.canonical != nil {
+		as.canonical.RecordStatistic(request)
+	}
+}
+
+// GetStatistic returns estimated rendering statistics of a request
+func (as *ApproximateStatistics) GetStatistic(request *Request) *RequestStatistic {
+	key := as.key(request)
+	as.mutex.Lock()
+	defer as.mutex.Unlock()
+	statistic := as.statistic(&key)
+	if statistic.Total == 0 {
+		return nil
+	}
+	return statistic
+}
+
+// GetTopStatistic returns estimated rendering statistics of the top request
+func (as *ApproximateStatistics) GetTopStatistic() *RequestStatistic {
+	top := as.GetTopStatistics(1)
+	if len(top) == 0 {
+		return nil
+	}
+	top[0].Rank = 0
+	return top[0]
+}
+
+// GetTopStatistics returns estimated rendering statistics of the k top tracked requests, ranked (see RequestStatistic.RanksBefore)
+func (as *ApproximateStatistics) GetTopStatistics(k int) []*RequestStatistic {
+	if k < 1 {
+		return []*RequestStatistic{}
+	}
+	top := make(statisticHeap, 0, k)
+	as.mutex.Lock()
+	for _, hitter := range as.heavyHitters {
+		top.offer(as.statistic(&hitter.request), k)
+	}
+	as.mutex.Unlock()
+	return top.ranked()
+}
+
+// CanonicalStatistics returns the estimated rendering statistics grouped by canonical requests
+func (as *ApproximateStatistics) CanonicalStatistics() StatisticRecorder {
+	if as.canonical == nil {
+		return as
+	}
+	return as.canonical
+}
+
+// Approximate reports that the statistics are approximate
+func (as *ApproximateStatistics) Approximate() bool {
+	return true
+}
+
+// ResetStatistics resets all statistics currently recorded
+func (as *ApproximateStatistics) ResetStatistics() {
+	as.mutex.Lock()
+	as.sketch = make([]int, as.width*as.depth)
+	as.records = 0
+	as.counters = make(map[Request]*heavyHitter, as.capacity)
+	as.heavyHitters = make(heavyHitterHeap, 0, as.capacity)
+	as.mutex.Unlock()
+	if as.canonical != nil {
+		as.canonical.ResetStatistics()
+	}
+}
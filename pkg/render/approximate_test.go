@@ -0,0 +1,74 @@
+package render
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestApproximateStatistics(t *testing.T) {
+	// Record a few heavy requests (above N/capacity) among many distinct requests recorded once
+	statistics := NewApproximateStatistics(0.001, 0.001, 200)
+	heavy := make(map[Request]int)
+	for i := 1; i <= 10; i++ {
+		request := NewRequest(100, 3, 5, "Heavy"+strconv.Itoa(i), "B")
+		heavy[*request] = 1000 * i
+		for j := 0; j < 1000*i; j++ {
+			statistics.RecordStatistic(request)
+		}
+	}
+	for i := 0; i < 100000; i++ {
+		statistics.RecordStatistic(NewRequest(100, 3, 5, "Light"+strconv.Itoa(i), "B"))
+	}
+	// Check that memory is bounded
+	if got := len(statistics.counters); got != 200 {
+		t.Errorf("ApproximateStatistics counters = %v, want %v", got, 200)
+	}
+	// Check that the heavy requests are ranked first, with estimates within their error bounds
+	top := statistics.GetTopStatistics(10)
+	if len(top) != 10 {
+		t.Fatalf("ApproximateStatistics.GetTopStatistics() returned %v statistics, want %v", len(top), 10)
+	}
+	for i, statistic := range top {
+		exact, ok := heavy[statistic.Request]
+		if !ok {
+			t.Fatalf("ApproximateStatistics.GetTopStatistics() ranked %v, want a heavy request", statistic.Request)
+		}
+		if want := 10000 - 1000*i; exact != want {
+			t.Errorf("ApproximateStatistics.GetTopStatistics() ranked %v at %v, want total %v", statistic.Request, statistic.Rank, want)
+		}
+		if !statistic.Approximate || statistic.Total < exact || statistic.Total > exact+statistic.MaxError {
+			t.Errorf("ApproximateStatistics.GetTopStatistics() = %+v, want an estimate of %v", statistic, exact)
+		}
+	}
+	if got := statistics.GetTopStatistic(); got.Request != top[0].Request || got.Rank != 0 {
+		t.Errorf("ApproximateStatistics.GetTopStatistic() = %+v, want %+v", got, top[0].Request)
+	}
+	// Check the estimate of a light request
+	statistic := statistics.GetStatistic(NewRequest(100, 3, 5, "Light0", "B"))
+	if statistic == nil || statistic.Total < 1 || statistic.Total > 1+statistic.MaxError || statistic.MaxError > 156 {
+		t.Errorf("ApproximateStatistics.GetStatistic() = %+v, want an estimate of 1 with an error of at most 156", statistic)
+	}
+}
+
+func TestApproximateStatistics_CanonicalStatistics(t *testing.T) {
+	// Record equivalent requests
+	statistics := NewApproximateStatistics(0.01, 0.01, 10)
+	statistics.RecordStatistic(NewRequest(5, 3, 3, "A", "B"))
+	statistics.RecordStatistic(NewRequest(5, 3, 30, "AB", "C"))
+	// Check raw and canonical statistics
+	if got := statistics.GetTopStatistic(); got.Total != 1 {
+		t.Errorf("ApproximateStatistics.GetTopStatistic() = %v, want %v", got.Total, 1)
+	}
+	canonical := statistics.CanonicalStatistics()
+	if got := canonical.GetStatistic(NewRequest(5, 3, 3, "AB", "")); got == nil || got.Total != 2 {
+		t.Errorf("ApproximateStatistics.CanonicalStatistics().GetStatistic() = %+v, want a total of %v", got, 2)
+	}
+	// Check that reset empties both views
+	statistics.ResetStatistics()
+	if got := statistics.GetTopStatistic(); got != nil {
+		t.Errorf("ApproximateStatistics.GetTopStatistic() = %+v, want nil", got)
+	}
+	if got := canonical.GetTopStatistics(10); len(got) != 0 {
+		t.Errorf("ApproximateStatistics.CanonicalStatistics().GetTopStatistics() = %+v, want none", got)
+	}
+}
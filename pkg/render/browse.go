@@ -0,0 +1,257 @@
+package render
+
+import (
+	"container/heap"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Order represents an order in which statistics are browsed
+type Order string
+
+// Orders of the browsed statistics
+const (
+	// OrderTotal sorts statistics by descending Total
+	OrderTotal Order = "total"
+	// OrderLastSeen sorts statistics by descending LastSeen, statistics whose seen times are not tracked come last
+	OrderLastSeen Order = "last_seen"
+)
+
+// Orders lists the orders of the browsed statistics
+var Orders = []Order{OrderTotal, OrderLastSeen}
+
+// ParseOrder returns the order of a name
+func ParseOrder(name string) (Order, error) {
+	for _, order := range Orders {
+		if string(order) == name {
+			return order, nil
+		}
+	}
+	return "", fmt.Errorf("unknown order %s", name)
+}
+
+// before reports whether a statistic comes before another one in the order, ties are broken by ascending Request order (see Request.Less)
+func (o Order) before(statistic, other *RequestStatistic) bool {
+	switch o {
+	case OrderTotal:
+		if statistic.Total != other.Total {
+			return statistic.Total > other.Total
+		}
+	case OrderLastSeen:
+		lastSeen, otherLastSeen := timeOf(statistic.LastSeen), timeOf(other.LastSeen)
+		if !lastSeen.Equal(otherLastSeen) {
+			return lastSeen.After(otherLastSeen)
+		}
+	}
+	return statistic.Request.Less(&other.Request)
+}
+
+// Operator represents a comparison operator of a filter
+type Operator string
+
+// Operators of the filters, strings only support equality operators
+const (
+	OperatorEqual          Operator = "="
+	OperatorNotEqual       Operator = "!="
+	OperatorLess           Operator = "<"
+	OperatorLessOrEqual    Operator = "<="
+	OperatorGreater        Operator = ">"
+	OperatorGreaterOrEqual Operator = ">="
+)
+
+// Filter represents a condition on a dimension of the requests, such as int1=3 or limit>1000
+type Filter struct {
+	Dimension Dimension
+	Operator  Operator
+	Value     string
+	number    int
+}
+
+// NewFilter is the Filter factory
+func NewFilter(dimension Dimension, operator Operator, value string) (*Filter, error) {
+	filter := &Filter{Dimension: dimension, Operator: operator, Value: value}
+	switch dimension {
+	case DimensionStr1, DimensionStr2:
+		if operator != OperatorEqual && operator != OperatorNotEqual {
+			return nil, fmt.Errorf("operator %s is not supported by %s", operator, dimension)
+		}
+	default:
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be compared to an integer, value %s was given", dimension, value)
+		}
+		filter.number = number
+	}
+	return filter, nil
+}
+
+// ParseFilter returns the filter of an expression made of a dimension, an operator and a value (e.g. int1=3, limit>1000, str1!=A)
+func ParseFilter(expression string) (*Filter, error) {
+	i := strings.IndexAny(expression, "=!<>")
+	if i < 0 {
+		return nil, fmt.Errorf("filter %s has no operator", expression)
+	}
+	name, operator := expression[:i], Operator(expression[i:i+1])
+	if strings.HasPrefix(expression[i+1:], "=") {
+		operator = Operator(expression[i : i+2])
+	}
+	switch operator {
+	case OperatorEqual, OperatorNotEqual, OperatorLess, OperatorLessOrEqual, OperatorGreater, OperatorGreaterOrEqual:
+	default:
+		return nil, fmt.Errorf("filter %s has an unknown operator", expression)
+	}
+	dimension, err := ParseDimension(name)
+	if err != nil {
+		return nil, err
+	}
+	return NewFilter(dimension, operator, expression[i+len(operator):])
+}
+
+// String returns the expression of the filter
+func (f *Filter) String() string {
+	return string(f.Dimension) + string(f.Operator) + f.Value
+}
+
+// Match reports whether a request satisfies the filter
+func (f *Filter) Match(request *Request) bool {
+	switch value := f.Dimension.value(request).(type) {
+	case string:
+		return (value == f.Value) == (f.Operator == OperatorEqual)
+	case int:
+		switch f.Operator {
+		case OperatorEqual:
+			return value == f.number
+		case OperatorNotEqual:
+			return value != f.number
+		case OperatorLess:
+			return value < f.number
+		case OperatorLessOrEqual:
+			return value <= f.number
+		case OperatorGreater:
+			return value > f.number
+		case OperatorGreaterOrEqual:
+			return value >= f.number
+		}
+	}
+	return false
+}
+
+// ErrInvalidCursor is returned when browsing statistics from a cursor that was not returned for the same order
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// cursor represents the position of the last statistic of a page, in an order
+type cursor struct {
+	Order    Order      `json:"order"`
+	Request  Request    `json:"request"`
+	Total    int        `json:"total,omitempty"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+}
+
+// newCursor returns the cursor of the position of a statistic in an order, that only keeps the sort key of the order
+func newCursor(order Order, statistic *RequestStatistic) *cursor {
+	c := &cursor{Order: order, Request: statistic.Request}
+	switch order {
+	case OrderTotal:
+		c.Total = statistic.Total
+	case OrderLastSeen:
+		c.LastSeen = statistic.LastSeen
+	}
+	return c
+}
+
+// encode returns the opaque form of the cursor
+func (c *cursor) encode() string {
+	encoded, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// decodeCursor returns the position of an opaque cursor of an order
+func decodeCursor(encoded string, order Order) (*RequestStatistic, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	c := &cursor{}
+	if err := json.Unmarshal(decoded, c); err != nil || c.Order != order {
+		return nil, ErrInvalidCursor
+	}
+	return &RequestStatistic{Request: c.Request, Total: c.Total, LastSeen: c.LastSeen}, nil
+}
+
+// Page represents a page of browsed statistics
+// NextCursor gives the position of the next page, empty on the last page
+type Page struct {
+	Statistics []*RequestStatistic `json:"statistics"`
+	NextCursor string              `json:"next_cursor,omitempty"`
+}
+
+// browseHeap is a heap of statistics where the root is the statistic that comes last in an order
+type browseHeap struct {
+	statistics []*RequestStatistic
+	order      Order
+}
+
+func (h browseHeap) Len() int           { return len(h.statistics) }
+func (h browseHeap) Less(i, j int) bool { return h.order.before(h.statistics[j], h.statistics[i]) }
+func (h browseHeap) Swap(i, j int) {
+	h.statistics[i], h.statistics[j] = h.statistics[j], h.statistics[i]
+}
+func (h *browseHeap) Push(x interface{}) { h.statistics = append(h.statistics, x.(*RequestStatistic)) }
+func (h *browseHeap) Pop() interface{} {
+	last := h.statistics[len(h.statistics)-1]
+	h.statistics = h.statistics[:len(h.statistics)-1]
+	return last
+}
+
+// Browse returns a page of at most size statistics of a recorder whose requests match all filters, sorted in an order
+// The page starts after the position of a cursor returned by a previous page, or at the first statistic if the cursor is empty
+func Browse(recorder RangeStatisticRecorder, order Order, filters []*Filter, encodedCursor string, size int) (*Page, error) {
+	if size < 1 {
+		return nil, fmt.Errorf("page size must be positive, value %d was given", size)
+	}
+	var after *RequestStatistic
+	if encodedCursor != "" {
+		var err error
+		if after, err = decodeCursor(encodedCursor, order); err != nil {
+			return nil, err
+		}
+	}
+	// Keep the size+1 first statistics, the extra one tells whether there is a next page
+	top := &browseHeap{order: order}
+	recorder.RangeStatistics(func(statistic *RequestStatistic) bool {
+		if after != nil && !order.before(after, statistic) {
+			return true
+		}
+		for _, filter := range filters {
+			if !filter.Match(&statistic.Request) {
+				return true
+			}
+		}
+		switch {
+		case top.Len() < size+1:
+			heap.Push(top, statistic)
+		case order.before(statistic, top.statistics[0]):
+			top.statistics[0] = statistic
+			heap.Fix(top, 0)
+		}
+		return true
+	})
+	statistics := top.statistics
+	sort.Slice(statistics, func(i, j int) bool {
+		return order.before(statistics[i], statistics[j])
+	})
+	page := &Page{Statistics: make([]*RequestStatistic, 0, size)}
+	if len(statistics) > size {
+		statistics = statistics[:size]
+		last := statistics[size-1]
+		page.NextCursor = newCursor(order, last).encode()
+	}
+	page.Statistics = append(page.Statistics, statistics...)
+	return page, nil
+}
@@ -0,0 +1,117 @@
+package render
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       *Filter
+		wantErr    bool
+	}{
+		{"int1=3", &Filter{Dimension: DimensionInt1, Operator: OperatorEqual, Value: "3", number: 3}, false},
+		{"limit>1000", &Filter{Dimension: DimensionLimit, Operator: OperatorGreater, Value: "1000", number: 1000}, false},
+		{"int2<=-5", &Filter{Dimension: DimensionInt2, Operator: OperatorLessOrEqual, Value: "-5", number: -5}, false},
+		{"str1!=A=B", &Filter{Dimension: DimensionStr1, Operator: OperatorNotEqual, Value: "A=B"}, false},
+		{"str2=", &Filter{Dimension: DimensionStr2, Operator: OperatorEqual, Value: ""}, false},
+		{"int1", nil, true},
+		{"int1!3", nil, true},
+		{"int1=>3", nil, true},
+		{"int3=3", nil, true},
+		{"limit>Z", nil, true},
+		{"str1>A", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseFilter(tt.expression)
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseFilter(%q) = %+v, %v, want %+v", tt.expression, got, err, tt.want)
+		}
+		if err == nil && got.String() != tt.expression {
+			t.Errorf("ParseFilter(%q).String() = %q, want %q", tt.expression, got.String(), tt.expression)
+		}
+	}
+}
+
+func TestBrowse(t *testing.T) {
+	// Record requests, a minute apart
+	now := time.Date(2019, 10, 1, 12, 0, 30, 0, time.UTC)
+	statistics := NewStatistics()
+	setClock(statistics, &now)
+	records := []struct {
+		request *Request
+		times   int
+	}{
+		{NewRequest(10, 3, 5, "A", "B"), 5},
+		{NewRequest(100, 3, 5, "C", "D"), 3},
+		{NewRequest(15, 2, 7, "A", "B"), 4},
+		{NewRequest(1000, 2, 7, "C", "B"), 4},
+		{NewRequest(5, 3, 6, "A", "E"), 1},
+	}
+	for _, record := range records {
+		for i := 0; i < record.times; i++ {
+			statistics.RecordStatistic(record.request)
+		}
+		now = now.Add(time.Minute)
+	}
+	// browseAll browses all the pages of statistics, and returns the totals of their requests
+	browseAll := func(order Order, filters []*Filter, size int) []int {
+		totals := make([]int, 0)
+		cursor := ""
+		for pages := 0; pages <= len(records); pages++ {
+			page, err := Browse(statistics, order, filters, cursor, size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page.Statistics) > size || (page.NextCursor != "" && len(page.Statistics) != size) {
+				t.Fatalf("Browse() returned a page of %v statistics with cursor %q, want at most %v", len(page.Statistics), page.NextCursor, size)
+			}
+			for _, statistic := range page.Statistics {
+				totals = append(totals, statistic.Total)
+			}
+			if cursor = page.NextCursor; cursor == "" {
+				return totals
+			}
+		}
+		t.Fatalf("Browse() returned more pages than statistics")
+		return nil
+	}
+	// Check orders, filters and pagination
+	int1, _ := ParseFilter("int1=3")
+	limit, _ := ParseFilter("limit>=15")
+	tests := []struct {
+		name    string
+		order   Order
+		filters []*Filter
+		want    []int
+	}{
+		{"Total", OrderTotal, nil, []int{5, 4, 4, 3, 1}},
+		{"Last seen", OrderLastSeen, nil, []int{1, 4, 4, 3, 5}},
+		{"Total int1=3", OrderTotal, []*Filter{int1}, []int{5, 3, 1}},
+		{"Last seen int1=3 and limit>=15", OrderLastSeen, []*Filter{int1, limit}, []int{3}},
+	}
+	for _, tt := range tests {
+		for size := 1; size <= len(records)+1; size++ {
+			if got := browseAll(tt.order, tt.filters, size); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s: Browse() with pages of %v = %v, want %v", tt.name, size, got, tt.want)
+			}
+		}
+	}
+	// Check that statistics come with their seen times, and that tied totals are sorted by request
+	page, _ := Browse(statistics, OrderTotal, nil, "", 3)
+	if got, want := page.Statistics[1].Request, *NewRequest(15, 2, 7, "A", "B"); got != want {
+		t.Errorf("Browse() ranked %v second, want %v", got, want)
+	}
+	if first, last := page.Statistics[0].FirstSeen, page.Statistics[0].LastSeen; first == nil || last == nil || !first.Equal(time.Date(2019, 10, 1, 12, 0, 30, 0, time.UTC)) || !last.Equal(*first) {
+		t.Errorf("Browse() returned seen times %v and %v, want the time of the first records", first, last)
+	}
+	// Check that cursors are bound to their order
+	if _, err := Browse(statistics, OrderLastSeen, nil, page.NextCursor, 3); err != ErrInvalidCursor {
+		t.Errorf("Browse() with a cursor of another order returned %v, want %v", err, ErrInvalidCursor)
+	}
+	if _, err := Browse(statistics, OrderTotal, nil, "Z", 3); err != ErrInvalidCursor {
+		t.Errorf("Browse() with an invalid cursor returned %v, want %v", err, ErrInvalidCursor)
+	}
+}
@@ -0,0 +1,177 @@
+package render
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportCSVHeader is the header of the CSV form of an export
+var exportCSVHeader = []string{"limit", "int1", "int2", "str1", "str2", "total", "first_seen", "last_seen", "latency_count", "latency_mean_ms", "latency_max_ms"}
+
+// Export represents a dump of all the statistics of a recorder, taken at Time
+// Statistics are sorted by rank (see RequestStatistic.RanksBefore), without their Rank set
+type Export struct {
+	Time       time.Time           `json:"time"`
+	Statistics []*RequestStatistic `json:"statistics"`
+}
+
+// NewExport is the Export factory, it dumps the statistics of a recorder at a time
+func NewExport(recorder RangeStatisticRecorder, now time.Time) *Export {
+	export := &Export{Time: now.UTC(), Statistics: make([]*RequestStatistic, 0)}
+	recorder.RangeStatistics(func(statistic *RequestStatistic) bool {
+		export.Statistics = append(export.Statistics, statistic)
+		return true
+	})
+	sort.Slice(export.Statistics, func(i, j int) bool {
+		return export.Statistics[i].RanksBefore(export.Statistics[j])
+	})
+	return export
+}
+
+// Validate checks that the statistics of the export can be imported: totals are positive, and cover their latency count and the totals of their outcomes
+func (e *Export) Validate() error {
+	for i, statistic := range e.Statistics {
+		if statistic == nil || statistic.Total < 1 {
+			return fmt.Errorf("statistic %d must have a total >= 1", i+1)
+		}
+		if latency := statistic.Latency; latency != nil && (latency.Count < 0 || latency.Count > statistic.Total) {
+			return fmt.Errorf("statistic %d must have a latency count between 0 and its total", i+1)
+		}
+		total := 0
+		for outcome, outcomeStatistic := range statistic.Outcomes {
+			if _, err := ParseOutcome(string(outcome)); err != nil {
+				return fmt.Errorf("statistic %d has an %v", i+1, err)
+			}
+			if outcomeStatistic == nil || outcomeStatistic.Total < 1 {
+				return fmt.Errorf("statistic %d must have a total >= 1 for outcome %s", i+1, outcome)
+			}
+			total += outcomeStatistic.Total
+		}
+		if total > statistic.Total {
+			return fmt.Errorf("statistic %d must have a total >= the sum of the totals of its outcomes", i+1)
+		}
+	}
+	return nil
+}
+
+// WriteCSV writes the statistics of the export as CSV, with a header
+// Each row gives a request, its total, and its seen times and latencies (empty when unknown), it is not broken down by outcome
+func (e *Export) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(exportCSVHeader); err != nil {
+		return err
+	}
+	for _, statistic := range e.Statistics {
+		row := []string{
+			strconv.Itoa(statistic.Limit),
+			strconv.Itoa(statistic.Int1),
+			strconv.Itoa(statistic.Int2),
+			statistic.Str1,
+			statistic.Str2,
+			strconv.Itoa(statistic.Total),
+			formatCSVTime(statistic.FirstSeen),
+			formatCSVTime(statistic.LastSeen),
+			"", "", "",
+		}
+		if latency := statistic.Latency; latency != nil {
+			row[8] = strconv.Itoa(latency.Count)
+			row[9] = strconv.FormatFloat(latency.Mean, 'f', -1, 64)
+			row[10] = strconv.FormatFloat(latency.Max, 'f', -1, 64)
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// ReadExportCSV reads an export written by Export.WriteCSV, its Time is unknown
+func ReadExportCSV(r io.Reader) (*Export, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = len(exportCSVHeader)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("CSV header must be %s: %v", strings.Join(exportCSVHeader, ","), err)
+	}
+	for i, column := range exportCSVHeader {
+		if header[i] != column {
+			return nil, fmt.Errorf("CSV header must be %s, column %s was given", strings.Join(exportCSVHeader, ","), header[i])
+		}
+	}
+	export := &Export{Statistics: make([]*RequestStatistic, 0)}
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return export, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		statistic, err := parseCSVStatistic(row)
+		if err != nil {
+			return nil, fmt.Errorf("CSV row %d: %v", len(export.Statistics)+1, err)
+		}
+		export.Statistics = append(export.Statistics, statistic)
+	}
+}
+
+// parseCSVStatistic parses the statistic of a row of the CSV form of an export
+func parseCSVStatistic(row []string) (*RequestStatistic, error) {
+	integers := make([]int, 0, 4)
+	for _, i := range []int{0, 1, 2, 5} {
+		integer, err := strconv.Atoi(row[i])
+		if err != nil {
+			return nil, fmt.Errorf("%s must be an integer, value %s was given", exportCSVHeader[i], row[i])
+		}
+		integers = append(integers, integer)
+	}
+	statistic := NewRequestStatistic(NewRequest(integers[0], integers[1], integers[2], row[3], row[4]), integers[3])
+	var err error
+	if statistic.FirstSeen, err = parseCSVTime(row[6]); err != nil {
+		return nil, fmt.Errorf("first_seen must be an RFC 3339 time, value %s was given", row[6])
+	}
+	if statistic.LastSeen, err = parseCSVTime(row[7]); err != nil {
+		return nil, fmt.Errorf("last_seen must be an RFC 3339 time, value %s was given", row[7])
+	}
+	if row[8] != "" {
+		latency := &LatencyStatistic{}
+		if latency.Count, err = strconv.Atoi(row[8]); err != nil {
+			return nil, fmt.Errorf("latency_count must be an integer, value %s was given", row[8])
+		}
+		if latency.Mean, err = strconv.ParseFloat(row[9], 64); err != nil {
+			return nil, fmt.Errorf("latency_mean_ms must be a number, value %s was given", row[9])
+		}
+		if latency.Max, err = strconv.ParseFloat(row[10], 64); err != nil {
+			return nil, fmt.Errorf("latency_max_ms must be a number, value %s was given", row[10])
+		}
+		statistic.Latency = latency
+	}
+	return statistic, nil
+}
+
+// formatCSVTime formats a time of the CSV form of an export, empty if unknown
+func formatCSVTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+// parseCSVTime parses a time of the CSV form of an export, nil if empty
+func parseCSVTime(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return nil, err
+	}
+	t = t.UTC()
+	return &t, nil
+}
@@ -0,0 +1,139 @@
+package render
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExport(t *testing.T) {
+	// Record requests, with outcomes and latencies
+	now := time.Date(2019, 10, 1, 12, 0, 30, 0, time.UTC)
+	start := now
+	statistics := NewStatistics()
+	setClock(statistics, &now)
+	statistics.RecordOutcome(NewRequest(20, 3, 5, "A", "B"), OutcomeSuccess, 2*time.Millisecond)
+	statistics.RecordOutcome(NewRequest(20, 3, 5, "A", "B"), OutcomeCancelled, 500*time.Microsecond)
+	now = now.Add(time.Minute)
+	statistics.RecordStatistic(NewRequest(10, 2, 7, "喂", "a,\"b\""))
+	statistics.RecordStatistic(NewRequest(20, 3, 5, "A", "B"))
+	// Check the export
+	export := NewExport(statistics, now)
+	want := &Export{
+		Time: now,
+		Statistics: []*RequestStatistic{
+			{Request: *NewRequest(20, 3, 5, "A", "B"), Total: 3, Latency: &LatencyStatistic{Count: 2, Mean: 1.25, Max: 2}, FirstSeen: &start, LastSeen: &now},
+			{Request: *NewRequest(10, 2, 7, "喂", "a,\"b\""), Total: 1, FirstSeen: &now, LastSeen: &now},
+		},
+	}
+	if !reflect.DeepEqual(export, want) {
+		t.Errorf("NewExport() = %+v, want %+v", export, want)
+	}
+	// Check that the CSV form reads back as the export, but its time
+	buffer := &bytes.Buffer{}
+	if err := export.WriteCSV(buffer); err != nil {
+		t.Fatal(err)
+	}
+	wantCSV := "limit,int1,int2,str1,str2,total,first_seen,last_seen,latency_count,latency_mean_ms,latency_max_ms\n" +
+		"20,3,5,A,B,3,2019-10-01T12:00:30Z,2019-10-01T12:01:30Z,2,1.25,2\n" +
+		"10,2,7,喂,\"a,\"\"b\"\"\",1,2019-10-01T12:01:30Z,2019-10-01T12:01:30Z,,,\n"
+	if got := buffer.String(); got != wantCSV {
+		t.Errorf("Export.WriteCSV() = %q, want %q", got, wantCSV)
+	}
+	got, err := ReadExportCSV(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want.Time = time.Time{}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadExportCSV() = %+v, want %+v", got, want)
+	}
+	// Check invalid CSV forms
+	for _, invalid := range []string{
+		"",
+		"limit,int1,int2,str1,str2,total\n",
+		"limit,int1,int2,str1,str2,count,first_seen,last_seen,latency_count,latency_mean_ms,latency_max_ms\n",
+		"limit,int1,int2,str1,str2,total,first_seen,last_seen,latency_count,latency_mean_ms,latency_max_ms\nZ,3,5,A,B,1,,,,,\n",
+		"limit,int1,int2,str1,str2,total,first_seen,last_seen,latency_count,latency_mean_ms,latency_max_ms\n20,3,5,A,B,1,yesterday,,,,\n",
+		"limit,int1,int2,str1,str2,total,first_seen,last_seen,latency_count,latency_mean_ms,latency_max_ms\n20,3,5,A,B,1,,,1,Z,1\n",
+	} {
+		if got, err := ReadExportCSV(strings.NewReader(invalid)); err == nil {
+			t.Errorf("ReadExportCSV(%q) = %+v, want an error", invalid, got)
+		}
+	}
+}
+
+func TestExport_Validate(t *testing.T) {
+	request := *NewRequest(20, 3, 5, "A", "B")
+	tests := []struct {
+		name      string
+		statistic *RequestStatistic
+		wantErr   bool
+	}{
+		{"Valid", &RequestStatistic{Request: request, Total: 3, Outcomes: map[Outcome]*OutcomeStatistic{OutcomeSuccess: {Total: 2}}}, false},
+		{"Nil", nil, true},
+		{"Total < 1", &RequestStatistic{Request: request, Total: 0}, true},
+		{"Latency count > total", &RequestStatistic{Request: request, Total: 1, Latency: &LatencyStatistic{Count: 2}}, true},
+		{"Unknown outcome", &RequestStatistic{Request: request, Total: 3, Outcomes: map[Outcome]*OutcomeStatistic{"lost": {Total: 1}}}, true},
+		{"Outcome total < 1", &RequestStatistic{Request: request, Total: 3, Outcomes: map[Outcome]*OutcomeStatistic{OutcomeError: {Total: 0}}}, true},
+		{"Outcome totals > total", &RequestStatistic{Request: request, Total: 3, Outcomes: map[Outcome]*OutcomeStatistic{OutcomeSuccess: {Total: 2}, OutcomeError: {Total: 2}}}, true},
+	}
+	for _, tt := range tests {
+		export := &Export{Statistics: []*RequestStatistic{tt.statistic}}
+		if err := export.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: Export.Validate() = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestStatistics_ImportStatistics(t *testing.T) {
+	// Record a request, then import statistics of equivalent requests
+	now := time.Date(2019, 10, 1, 12, 0, 30, 0, time.UTC)
+	earlier := now.Add(-time.Hour)
+	statistics := NewStatistics()
+	setClock(statistics, &now)
+	request, equivalentRequest := NewRequest(5, 3, 3, "A", "B"), NewRequest(5, 3, 30, "AB", "C")
+	statistics.RecordStatistic(request)
+	imported := []*RequestStatistic{
+		{Request: *request, Total: 3, FirstSeen: &earlier, LastSeen: &earlier, Outcomes: map[Outcome]*OutcomeStatistic{
+			OutcomeInvalid: {Total: 2, Latency: &LatencyStatistic{Count: 2, Mean: 1, Max: 1}, FirstSeen: &earlier, LastSeen: &earlier},
+		}},
+		{Request: *equivalentRequest, Total: 4, Latency: &LatencyStatistic{Count: 1, Mean: 3, Max: 3}},
+	}
+	if err := statistics.ImportStatistics(imported, false); err != nil {
+		t.Fatal(err)
+	}
+	// Check merged statistics, hits that are not broken down by outcome are only counted by the statistics of all outcomes
+	want := &RequestStatistic{
+		Request: *request,
+		Total:   4,
+		Outcomes: map[Outcome]*OutcomeStatistic{
+			OutcomeSuccess: {Total: 1, FirstSeen: &now, LastSeen: &now},
+			OutcomeInvalid: {Total: 2, Latency: &LatencyStatistic{Count: 2, Mean: 1, Max: 1}, FirstSeen: &earlier, LastSeen: &earlier},
+		},
+		Latency:   &LatencyStatistic{Count: 2, Mean: 1, Max: 1},
+		FirstSeen: &earlier,
+		LastSeen:  &now,
+	}
+	if got := statistics.GetStatistic(request); !reflect.DeepEqual(got, want) {
+		t.Errorf("Statistics.GetStatistic() = %+v, want %+v", got, want)
+	}
+	if got := statistics.CanonicalStatistics().GetTopStatistic(); got.Request != request.Canonical() || got.Total != 8 {
+		t.Errorf("Statistics.CanonicalStatistics().GetTopStatistic() = %+v, want total 8", got)
+	}
+	if got := statistics.GetWindowTopStatistics(time.Minute, 10); len(got) != 1 || got[0].Total != 1 {
+		t.Errorf("Statistics.GetWindowTopStatistics() = %v, want only the recorded hit", got)
+	}
+	// Check that replacing imports reset the statistics first
+	if err := statistics.ImportStatistics(imported[1:], true); err != nil {
+		t.Fatal(err)
+	}
+	if got := statistics.GetStatistic(request); got != nil {
+		t.Errorf("Statistics.GetStatistic() = %+v, want nil", got)
+	}
+	if got := statistics.GetTopStatistic(); got.Request != *equivalentRequest || got.Total != 4 {
+		t.Errorf("Statistics.GetTopStatistic() = %+v, want total 4", got)
+	}
+}
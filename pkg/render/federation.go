@@ -0,0 +1,282 @@
+package render
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// FederationPath is the path under which a node serves its federation state to its peers
+const FederationPath = "/statistics/federation"
+
+// GCounter represents a grow-only counter replicated across nodes: the count of each node, only incremented by the node itself
+type GCounter map[string]int
+
+// Value returns the value of the counter, the sum of the counts of the nodes
+func (c GCounter) Value() int {
+	value := 0
+	for _, count := range c {
+		value += count
+	}
+	return value
+}
+
+// FederatedCounter represents the G-counter of the hits of a request
+type FederatedCounter struct {
+	Request Request  `json:"request"`
+	Counts  GCounter `json:"counts"`
+}
+
+// FederationState represents the statistics known by a node of a federation, in a mergeable form
+// Incarnations gives the incarnation of each known node: a node starts a new incarnation when its counts restart from zero,
+// the counts of a node are only merged with the counts of the same incarnation, and replaced by the counts of a newer one
+type FederationState struct {
+	Node         string              `json:"node"`
+	Incarnations map[string]int64    `json:"incarnations"`
+	Counters     []*FederatedCounter `json:"counters"`
+}
+
+// FederatedStatisticRecorder represents the interface of a StatisticRecorder federated with peers
+type FederatedStatisticRecorder interface {
+	FederationState() *FederationState
+}
+
+// nodeCounts represents the counts of the requests of a node of a federation, during an incarnation
+type nodeCounts struct {
+	incarnation int64
+	counts      map[Request]int
+}
+
+// FederatedStatistics represents statistics of requests rendering federated across the nodes of a cluster
+// The hits recorded by the node are its own counts, kept in local statistics (that may be persisted)
+// The counts of the other nodes are pulled from peers and merged, and the statistics report the cluster-wide view
+// Hits pulled from peers are only counted in totals, not by outcome nor by minute, and have no details
+type FederatedStatistics struct {
+	*Statistics
+	node        string
+	local       *Statistics
+	mutex       sync.RWMutex
+	incarnation int64
+	remote      map[string]*nodeCounts
+	credential  string
+}
+
+// NewFederatedStatistics is the FederatedStatistics factory, local holds the hits recorded by the node (and must no longer be used directly)
+func NewFederatedStatistics(node string, local *Statistics) *FederatedStatistics {
+	fs := &FederatedStatistics{
+		Statistics:  NewStatistics(),
+		node:        node,
+		local:       local,
+		incarnation: time.Now().UnixNano(),
+		remote:      make(map[string]*nodeCounts),
+	}
+	fs.Statistics.restore(local.snapshot(0))
+	return fs
+}
+
+// Node returns the name of the node in the federation
+func (fs *FederatedStatistics) Node() string {
+	return fs.node
+}
+
+// RecordStatistic records rendering statistics, as a success whose latency is unknown
+func (fs *FederatedStatistics) RecordStatistic(request *Request) {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	fs.local.RecordStatistic(request)
+	fs.Statistics.RecordStatistic(request)
+}
+
+// RecordOutcome records rendering statistics, along with the outcome and the latency of the rendering
+func (fs *FederatedStatistics) RecordOutcome(request *Request, outcome Outcome, latency time.Duration) {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	fs.local.RecordOutcome(request, outcome, latency)
+	fs.Statistics.RecordOutcome(request, outcome, latency)
+}
+
+// ImportStatistics imports statistics as hits recorded by the node, replacing them resets the counts of the node only
+func (fs *FederatedStatistics) ImportStatistics(statistics []*RequestStatistic, replace bool) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if err := fs.local.ImportStatistics(statistics, replace); err != nil {
+		return err
+	}
+	if replace {
+		fs.incarnation = time.Now().UnixNano()
+		fs.rebuild()
+		return nil
+	}
+	return fs.Statistics.ImportStatistics(statistics, false)
+}
+
+// ResetStatistics resets the hits recorded by the node, which starts a new incarnation so that its peers reset its counts too
+// The counts of the other nodes are kept: resetting the statistics of the cluster requires resetting every node
+func (fs *FederatedStatistics) ResetStatistics() {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.local.ResetStatistics()
+	fs.incarnation = time.Now().UnixNano()
+	fs.rebuild()
+}
+
+// ErrFederatedLowering is returned when the totals of federated statistics would be lowered, as the counts of a node can only grow on its peers
+var ErrFederatedLowering = errors.New("lowering totals is not supported by federated statistics")
+
+// ApplyRetention is not supported by federated statistics, see ErrFederatedLowering
+func (fs *FederatedStatistics) ApplyRetention(policy *RetentionPolicy) (*RetentionResult, error) {
+	return nil, ErrFederatedLowering
+}
+
+// DeleteStatistics is not supported by federated statistics, see ErrFederatedLowering
+func (fs *FederatedStatistics) DeleteStatistics(filters []*Filter) ([]*RequestStatistic, error) {
+	return nil, ErrFederatedLowering
+}
+
+// DeleteStatistic is not supported by federated statistics, see ErrFederatedLowering
+func (fs *FederatedStatistics) DeleteStatistic(request *Request) (*RequestStatistic, error) {
+	return nil, ErrFederatedLowering
+}
+
+// AdjustStatistic is not supported by federated statistics, see ErrFederatedLowering
+func (fs *FederatedStatistics) AdjustStatistic(request *Request, delta int) (*RequestStatistic, error) {
+	return nil, ErrFederatedLowering
+}
+
+// rebuild rebuilds the cluster-wide statistics from the local statistics and the counts of the other nodes
+// The caller must hold the mutex
+func (fs *FederatedStatistics) rebuild() {
+	fs.Statistics.reset()
+	fs.Statistics.restore(fs.local.snapshot(0))
+	for _, known := range fs.remote {
+		for request, count := range known.counts {
+			request := request
+			fs.Statistics.add(&request, count, 0, "", requestDetails{})
+		}
+	}
+}
+
+// FederationState returns the statistics known by the node, in a mergeable form sorted by request
+func (fs *FederatedStatistics) FederationState() *FederationState {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	state := &FederationState{
+		Node:         fs.node,
+		Incarnations: map[string]int64{fs.node: fs.incarnation},
+		Counters:     make([]*FederatedCounter, 0),
+	}
+	counters := make(map[Request]*FederatedCounter)
+	counter := func(request Request) *FederatedCounter {
+		if counter, ok := counters[request]; ok {
+			return counter
+		}
+		counter := &FederatedCounter{Request: request, Counts: make(GCounter)}
+		counters[request] = counter
+		state.Counters = append(state.Counters, counter)
+		return counter
+	}
+	fs.local.RangeStatistics(func(statistic *RequestStatistic) bool {
+		counter(statistic.Request).Counts[fs.node] = statistic.Total
+		return true
+	})
+	for node, known := range fs.remote {
+		state.Incarnations[node] = known.incarnation
+		for request, count := range known.counts {
+			counter(request).Counts[node] = count
+		}
+	}
+	sort.Slice(state.Counters, func(i, j int) bool {
+		return state.Counters[i].Request.Less(&state.Counters[j].Request)
+	})
+	return state
+}
+
+// Merge merges the statistics known by another node into the cluster-wide statistics
+// The counts of the node itself are ignored, as the node is the only one that increments them
+func (fs *FederatedStatistics) Merge(state *FederationState) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	rebuild := false
+	for node, incarnation := range state.Incarnations {
+		if node == fs.node {
+			continue
+		}
+		if known := fs.remote[node]; known == nil || incarnation > known.incarnation {
+			rebuild = rebuild || known != nil
+			fs.remote[node] = &nodeCounts{incarnation: incarnation, counts: make(map[Request]int)}
+		}
+	}
+	for _, counter := range state.Counters {
+		for node, count := range counter.Counts {
+			known := fs.remote[node]
+			if node == fs.node || known == nil || state.Incarnations[node] != known.incarnation || count <= known.counts[counter.Request] {
+				continue
+			}
+			delta := count - known.counts[counter.Request]
+			known.counts[counter.Request] = count
+			if !rebuild {
+				fs.Statistics.add(&counter.Request, delta, 0, "", requestDetails{})
+			}
+		}
+	}
+	if rebuild {
+		fs.rebuild()
+	}
+}
+
+// SetCredential sets the credential (API key or bearer token) sent to the peers that authenticate their clients, before Run
+func (fs *FederatedStatistics) SetCredential(credential string) {
+	fs.credential = credential
+}
+
+// Pull pulls the federation state of a peer, given its base URL, and merges it
+// The credential of the node, if any, is sent as a bearer token
+func (fs *FederatedStatistics) Pull(ctx context.Context, client *http.Client, peer string) error {
+	request, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(peer, "/")+FederationPath, nil)
+	if err != nil {
+		return err
+	}
+	if fs.credential != "" {
+		request.Header.Set("Authorization", "Bearer "+fs.credential)
+	}
+	response, err := client.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer %s returned status code %d", peer, response.StatusCode)
+	}
+	state := &FederationState{}
+	if err := json.NewDecoder(response.Body).Decode(state); err != nil {
+		return fmt.Errorf("peer %s returned an invalid federation state: %v", peer, err)
+	}
+	fs.Merge(state)
+	return nil
+}
+
+// Run pulls the federation state of the peers periodically until the context is done, failures are only logged
+func (fs *FederatedStatistics) Run(ctx context.Context, client *http.Client, peers []string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, peer := range peers {
+			if err := fs.Pull(ctx, client, peer); err != nil && ctx.Err() == nil {
+				log.Errorf("Statistics federation pull failed: %v", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package render
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFederatedStatistics(t *testing.T) {
+	// Record requests on three nodes, one of which had recorded hits before being federated
+	first, second := NewRequest(5, 3, 3, "A", "B"), NewRequest(5, 3, 30, "AB", "C")
+	local := NewStatistics()
+	local.RecordStatistic(first)
+	a := NewFederatedStatistics("a", local)
+	b := NewFederatedStatistics("b", NewStatistics())
+	c := NewFederatedStatistics("c", NewStatistics())
+	a.RecordStatistic(first)
+	b.RecordOutcome(first, OutcomeError, 0)
+	b.RecordStatistic(second)
+	c.RecordStatistic(second)
+	// Check the totals of each node once every node merged the state of every other node, twice as merges are idempotent
+	nodes := []*FederatedStatistics{a, b, c}
+	exchange := func() {
+		for _, node := range nodes {
+			for _, peer := range nodes {
+				if peer != node {
+					node.Merge(peer.FederationState())
+				}
+			}
+		}
+	}
+	checkTotals := func(step string, firstTotal, secondTotal int) {
+		for _, node := range nodes {
+			if got := node.GetStatistic(first); got == nil || got.Total != firstTotal {
+				t.Errorf("%s: node %s GetStatistic(first) = %+v, want total %d", step, node.Node(), got, firstTotal)
+			}
+			if got := node.GetStatistic(second); got == nil || got.Total != secondTotal {
+				t.Errorf("%s: node %s GetStatistic(second) = %+v, want total %d", step, node.Node(), got, secondTotal)
+			}
+			if got := node.CanonicalStatistics().GetTopStatistic(); got.Total != firstTotal+secondTotal {
+				t.Errorf("%s: node %s canonical GetTopStatistic() = %+v, want total %d", step, node.Node(), got, firstTotal+secondTotal)
+			}
+		}
+	}
+	exchange()
+	exchange()
+	checkTotals("Merged", 3, 2)
+	for _, got := range b.FederationState().Counters {
+		if got.Request == *first && (len(got.Counts) != 2 || got.Counts["a"] != 2 || got.Counts.Value() != 3) {
+			t.Errorf("FederationState() counter = %+v, want the counts of nodes a and b", got)
+		}
+	}
+	// Check that states are merged transitively, and that stale states are ignored
+	stale := c.FederationState()
+	c.RecordStatistic(second)
+	a.Merge(c.FederationState())
+	b.Merge(a.FederationState())
+	b.Merge(stale)
+	if got := b.GetStatistic(second); got.Total != 3 {
+		t.Errorf("GetStatistic() = %+v, want total 3 once merged through another node", got)
+	}
+	// Check that a reset starts a new incarnation of the node, whose counts replace the previous ones
+	a.ResetStatistics()
+	a.RecordStatistic(second)
+	exchange()
+	checkTotals("Reset", 1, 4)
+	if got := a.OutcomeStatistics(OutcomeSuccess).GetTopStatistic(); got.Request != *second || got.Total != 1 {
+		t.Errorf("OutcomeStatistics().GetTopStatistic() = %+v, want the hit recorded by the node only", got)
+	}
+}
+
+func TestFederatedStatistics_Pull(t *testing.T) {
+	// Serve the federation state of a node
+	peer := NewFederatedStatistics("peer", NewStatistics())
+	peer.RecordStatistic(NewRequest(20, 3, 5, "A", "B"))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case FederationPath:
+			json.NewEncoder(w).Encode(peer.FederationState())
+		case "/invalid" + FederationPath:
+			w.Write([]byte("{"))
+		case "/authenticated" + FederationPath:
+			if r.Header.Get("Authorization") != "Bearer peer-key" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(w).Encode(peer.FederationState())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	// Check that the state is pulled and merged, and that pull failures are reported
+	node := NewFederatedStatistics("node", NewStatistics())
+	if err := node.Pull(context.Background(), server.Client(), server.URL+"/"); err != nil {
+		t.Fatal(err)
+	}
+	if got := node.GetTopStatistic(); got == nil || got.Total != 1 {
+		t.Errorf("GetTopStatistic() = %+v, want total 1", got)
+	}
+	for _, peer := range []string{server.URL + "/missing", server.URL + "/invalid", server.URL + "/authenticated", "http://%"} {
+		if err := node.Pull(context.Background(), server.Client(), peer); err == nil {
+			t.Errorf("Pull(%s) = nil, want an error", peer)
+		}
+	}
+	// Check that the credential of the node is sent to the peer
+	node.SetCredential("peer-key")
+	if err := node.Pull(context.Background(), server.Client(), server.URL+"/authenticated"); err != nil {
+		t.Errorf("Pull() = %v, want the credential to be sent", err)
+	}
+}
@@ -0,0 +1,98 @@
+package render
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// StatisticChange represents a change of statistics: hits of a request were recorded, that brought its total from Previous to Total
+// TopChanged is set when the request became the top request (see StatisticRecorder.GetTopStatistic)
+// Reset is set when all statistics were reset instead, the other fields are then empty
+type StatisticChange struct {
+	Request
+	Previous   int
+	Total      int
+	TopChanged bool
+	Reset      bool
+}
+
+// NotifyingStatisticRecorder represents the interface of a StatisticRecorder that notifies the changes of its statistics
+// Subscribe returns a subscription to the changes, buffered up to buffer changes
+type NotifyingStatisticRecorder interface {
+	Subscribe(buffer int) *Subscription
+}
+
+// Subscription represents a subscription to the changes of statistics
+// Changes receives the changes, in the order they were recorded for each request
+// A subscriber that does not keep up is dropped when its buffer is full: Changes is then closed and Dropped reports it
+type Subscription struct {
+	Changes  <-chan *StatisticChange
+	changes  chan *StatisticChange
+	notifier *notifier
+	dropped  int32
+}
+
+// Cancel cancels the subscription, Changes is closed
+func (s *Subscription) Cancel() {
+	s.notifier.unsubscribe(s)
+}
+
+// Dropped reports whether the subscription was dropped because its buffer was full
+func (s *Subscription) Dropped() bool {
+	return atomic.LoadInt32(&s.dropped) == 1
+}
+
+// notifier broadcasts the changes of statistics to their subscriptions, its zero value has no subscription
+type notifier struct {
+	mutex         sync.RWMutex
+	subscriptions map[*Subscription]struct{}
+	count         int32
+}
+
+// subscribe adds a subscription with a buffer of changes
+func (n *notifier) subscribe(buffer int) *Subscription {
+	changes := make(chan *StatisticChange, buffer)
+	subscription := &Subscription{Changes: changes, changes: changes, notifier: n}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.subscriptions == nil {
+		n.subscriptions = make(map[*Subscription]struct{})
+	}
+	n.subscriptions[subscription] = struct{}{}
+	atomic.StoreInt32(&n.count, int32(len(n.subscriptions)))
+	return subscription
+}
+
+// unsubscribe removes a subscription and closes its changes, if it was not removed yet
+func (n *notifier) unsubscribe(subscription *Subscription) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if _, ok := n.subscriptions[subscription]; ok {
+		delete(n.subscriptions, subscription)
+		close(subscription.changes)
+		atomic.StoreInt32(&n.count, int32(len(n.subscriptions)))
+	}
+}
+
+// active reports whether there are subscriptions, so that changes are only built when they are notified
+func (n *notifier) active() bool {
+	return atomic.LoadInt32(&n.count) > 0
+}
+
+// notify sends a change to the subscriptions without blocking, the subscriptions whose buffer is full are dropped
+func (n *notifier) notify(change *StatisticChange) {
+	var dropped []*Subscription
+	n.mutex.RLock()
+	for subscription := range n.subscriptions {
+		select {
+		case subscription.changes <- change:
+		default:
+			dropped = append(dropped, subscription)
+		}
+	}
+	n.mutex.RUnlock()
+	for _, subscription := range dropped {
+		atomic.StoreInt32(&subscription.dropped, 1)
+		n.unsubscribe(subscription)
+	}
+}
@@ -0,0 +1,71 @@
+package render
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStatistics_Subscribe(t *testing.T) {
+	// Subscribe to raw and canonical statistics, then record requests
+	statistics := NewStatistics()
+	subscription := statistics.Subscribe(10)
+	canonical := statistics.CanonicalStatistics().(NotifyingStatisticRecorder).Subscribe(10)
+	first, second := NewRequest(5, 3, 3, "A", "B"), NewRequest(5, 3, 30, "AB", "C")
+	statistics.RecordStatistic(first)
+	statistics.RecordStatistic(second)
+	statistics.RecordStatistic(second)
+	statistics.ResetStatistics()
+	// Check the changes of each subscription
+	checkChanges := func(name string, subscription *Subscription, want []*StatisticChange) {
+		for _, wantChange := range want {
+			if got := <-subscription.Changes; !reflect.DeepEqual(got, wantChange) {
+				t.Errorf("%s Subscription.Changes received %+v, want %+v", name, got, wantChange)
+			}
+		}
+		select {
+		case got := <-subscription.Changes:
+			t.Errorf("%s Subscription.Changes received %+v, want no more change", name, got)
+		default:
+		}
+	}
+	checkChanges("Raw", subscription, []*StatisticChange{
+		{Request: *first, Previous: 0, Total: 1, TopChanged: true},
+		{Request: *second, Previous: 0, Total: 1},
+		{Request: *second, Previous: 1, Total: 2, TopChanged: true},
+		{Reset: true},
+	})
+	checkChanges("Canonical", canonical, []*StatisticChange{
+		{Request: first.Canonical(), Previous: 0, Total: 1, TopChanged: true},
+		{Request: first.Canonical(), Previous: 1, Total: 2},
+		{Request: first.Canonical(), Previous: 2, Total: 3},
+		{Reset: true},
+	})
+	// Check that cancelled subscriptions are closed and no longer notified
+	subscription.Cancel()
+	subscription.Cancel()
+	statistics.RecordStatistic(first)
+	if change, ok := <-subscription.Changes; ok || subscription.Dropped() {
+		t.Errorf("cancelled Subscription.Changes received %+v, want it closed and not dropped", change)
+	}
+}
+
+func TestStatistics_SubscribeSlowConsumer(t *testing.T) {
+	// Subscribe with a small buffer, and record more changes than it holds
+	statistics := NewStatistics()
+	slow, fast := statistics.Subscribe(2), statistics.Subscribe(10)
+	for i := 0; i < 3; i++ {
+		statistics.RecordStatistic(NewRequest(20, 3, 5, "A", "B"))
+	}
+	// Check that the slow subscription is dropped once its buffer is full, but not the other one
+	received := 0
+	for range slow.Changes {
+		received++
+	}
+	if received != 2 || !slow.Dropped() {
+		t.Errorf("slow Subscription received %v changes and dropped %v, want 2 changes and dropped", received, slow.Dropped())
+	}
+	if got := len(fast.Changes); got != 3 || fast.Dropped() {
+		t.Errorf("fast Subscription buffered %v changes and dropped %v, want 3 changes and not dropped", got, fast.Dropped())
+	}
+	fast.Cancel()
+}
@@ -0,0 +1,118 @@
+package render
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Outcome represents how the rendering of a request ended
+type Outcome string
+
+// Outcomes of a rendering
+const (
+	// OutcomeSuccess is the outcome of a request whose items were all rendered
+	OutcomeSuccess Outcome = "success"
+	// OutcomeInvalid is the outcome of a request that failed validation (see Request.Validate)
+	OutcomeInvalid Outcome = "invalid"
+	// OutcomeCancelled is the outcome of a request whose rendering was cancelled by its context
+	OutcomeCancelled Outcome = "cancelled"
+	// OutcomeError is the outcome of a request whose rendering failed unexpectedly
+	OutcomeError Outcome = "error"
+)
+
+// Outcomes lists the outcomes of a rendering
+var Outcomes = []Outcome{OutcomeSuccess, OutcomeInvalid, OutcomeCancelled, OutcomeError}
+
+// ParseOutcome returns the outcome of a name
+func ParseOutcome(name string) (Outcome, error) {
+	for _, outcome := range Outcomes {
+		if string(outcome) == name {
+			return outcome, nil
+		}
+	}
+	return "", fmt.Errorf("unknown outcome %s", name)
+}
+
+// LatencyStatistic represents the rendering latencies of a request, in milliseconds
+// Count is the number of renderings whose latency was recorded (see OutcomeStatisticRecorder)
+type LatencyStatistic struct {
+	Count int     `json:"count"`
+	Mean  float64 `json:"mean_ms"`
+	Max   float64 `json:"max_ms"`
+}
+
+// OutcomeStatistic represents the rendering statistics of a request for an outcome
+type OutcomeStatistic struct {
+	Total     int               `json:"total"`
+	Latency   *LatencyStatistic `json:"latency,omitempty"`
+	FirstSeen *time.Time        `json:"first_seen,omitempty"`
+	LastSeen  *time.Time        `json:"last_seen,omitempty"`
+}
+
+// latencyTotals represents the recorded latencies of a request
+type latencyTotals struct {
+	count int
+	sum   time.Duration
+	max   time.Duration
+}
+
+// newLatencyTotals returns the totals of a single latency, or empty totals if the latency is unknown
+func newLatencyTotals(latency *time.Duration) latencyTotals {
+	if latency == nil {
+		return latencyTotals{}
+	}
+	return latencyTotals{count: 1, sum: *latency, max: *latency}
+}
+
+// add adds other latencies to the totals
+func (lt *latencyTotals) add(other latencyTotals) {
+	lt.count += other.count
+	lt.sum += other.sum
+	if other.max > lt.max {
+		lt.max = other.max
+	}
+}
+
+// minus returns the totals without other latencies, their maximum is kept
+func (lt latencyTotals) minus(other latencyTotals) latencyTotals {
+	lt.count -= other.count
+	lt.sum -= other.sum
+	if lt.count <= 0 {
+		return latencyTotals{}
+	}
+	return lt
+}
+
+// scale returns the totals scaled by numerator/denominator (rounded down), their maximum is kept
+func (lt latencyTotals) scale(numerator, denominator int) latencyTotals {
+	count := lt.count * numerator / denominator
+	if count <= 0 {
+		return latencyTotals{}
+	}
+	return latencyTotals{count: count, sum: time.Duration(float64(lt.sum) * float64(numerator) / float64(denominator)), max: lt.max}
+}
+
+// statistic returns the statistic of the latencies, nil if none was recorded
+func (lt latencyTotals) statistic() *LatencyStatistic {
+	if lt.count == 0 {
+		return nil
+	}
+	return &LatencyStatistic{
+		Count: lt.count,
+		Mean:  float64(lt.sum) / float64(lt.count) / float64(time.Millisecond),
+		Max:   float64(lt.max) / float64(time.Millisecond),
+	}
+}
+
+// latencyTotalsOf returns the totals of the latencies of a statistic, the reverse of latencyTotals.statistic
+func latencyTotalsOf(statistic *LatencyStatistic) latencyTotals {
+	if statistic == nil {
+		return latencyTotals{}
+	}
+	return latencyTotals{
+		count: statistic.Count,
+		sum:   time.Duration(math.Round(statistic.Mean * float64(time.Millisecond) * float64(statistic.Count))),
+		max:   time.Duration(math.Round(statistic.Max * float64(time.Millisecond))),
+	}
+}
@@ -0,0 +1,487 @@
+package render
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// persistedSnapshotFile is the name of the snapshot file in the data directory
+	persistedSnapshotFile = "statistics.snapshot.json"
+	// persistedLogPrefix is the prefix of the log files in the data directory, followed by their generation
+	persistedLogPrefix = "statistics.log."
+	// persistedVersion is the version of the snapshot format
+	persistedVersion = 1
+)
+
+// errPersisterClosed is returned when a closed persister is used
+var errPersisterClosed = errors.New("statistics persister is closed")
+
+// persistedRecord represents a record appended to the log: hits of a request (with their outcome and latency if known),
+// hits removed from a request (a negative delta, see Statistics.AdjustStatistic), an imported statistic (see Statistics.ImportStatistics),
+// a reset of all statistics, or the scaling of the totals of a request (of all requests if none) by a factor (see Statistics.ApplyRetention)
+// Decayed is the time the totals last decayed, set when the decay starts and when the totals of all requests decay
+type persistedRecord struct {
+	Request   *Request          `json:"request,omitempty"`
+	Delta     int               `json:"delta,omitempty"`
+	Outcome   Outcome           `json:"outcome,omitempty"`
+	Latency   *time.Duration    `json:"latency,omitempty"`
+	Statistic *RequestStatistic `json:"statistic,omitempty"`
+	Reset     bool              `json:"reset,omitempty"`
+	Factor    *float64          `json:"factor,omitempty"`
+	Decayed   *time.Time        `json:"decayed,omitempty"`
+	Time      time.Time         `json:"time"`
+}
+
+// persistedMinute represents the statistics of the requests recorded during the minute starting at Time
+type persistedMinute struct {
+	Time       time.Time           `json:"time"`
+	Statistics []*RequestStatistic `json:"statistics"`
+}
+
+// persistedSnapshot represents a snapshot of statistics, that covers the logs of the generations prior to Generation
+// Decayed is the time the totals last decayed, if they ever did (see RetentionPolicy.HalfLife)
+type persistedSnapshot struct {
+	Version    int                 `json:"version"`
+	Generation int64               `json:"generation"`
+	Time       time.Time           `json:"time"`
+	Statistics []*RequestStatistic `json:"statistics"`
+	Minutes    []*persistedMinute  `json:"minutes"`
+	Decayed    *time.Time          `json:"decayed,omitempty"`
+}
+
+// Persister persists Statistics in a data directory, so that they survive restarts
+// The statistics are saved in periodic snapshots, and what is recorded between snapshots is appended to a log:
+// - each snapshot starts a new generation of the log, the logs of the previous generations are removed once the snapshot is written
+// - a snapshot is written to a temporary file that is atomically renamed, so that a crash never leaves a partial snapshot
+// - on recovery the snapshot is loaded, then the logs of its generation and of the later ones are replayed (truncated records are skipped)
+// Records are written to the log as they happen, and the log is synced to disk on each snapshot
+type Persister struct {
+	statistics    *Statistics
+	directory     string
+	mutex         sync.RWMutex
+	logMutex      sync.Mutex
+	snapshotMutex sync.Mutex
+	logFile       *os.File
+	generation    int64
+}
+
+// OpenPersister opens the data directory (created if missing), recovers the statistics persisted in it and persists the statistics from now on
+// The statistics must be empty and not in use yet
+func OpenPersister(directory string, statistics *Statistics) (*Persister, error) {
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, fmt.Errorf("statistics data directory creation failed: %v", err)
+	}
+	p := &Persister{
+		statistics: statistics,
+		directory:  directory,
+	}
+	generation, err := p.recover()
+	if err != nil {
+		return nil, err
+	}
+	p.generation = generation + 1
+	if err := p.writeSnapshot(statistics.snapshot(p.generation)); err != nil {
+		return nil, err
+	}
+	if err := p.removeLogs(p.generation); err != nil {
+		return nil, err
+	}
+	if p.logFile, err = p.createLog(p.generation); err != nil {
+		return nil, err
+	}
+	statistics.persister = p
+	log.WithFields(log.Fields{
+		"directory":  directory,
+		"generation": p.generation,
+	}).Info("Statistics recovered")
+	return p, nil
+}
+
+// Run writes snapshots periodically until the context is done
+func (p *Persister) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := p.Snapshot(); err != nil {
+				log.Errorf("Statistics snapshot failed: %v", err)
+			}
+		}
+	}
+}
+
+// Snapshot writes a snapshot of the statistics and starts a new generation of the log
+func (p *Persister) Snapshot() error {
+	p.snapshotMutex.Lock()
+	defer p.snapshotMutex.Unlock()
+	p.mutex.Lock()
+	previousLogFile := p.logFile
+	if previousLogFile == nil {
+		p.mutex.Unlock()
+		return errPersisterClosed
+	}
+	logFile, err := p.createLog(p.generation + 1)
+	if err != nil {
+		p.mutex.Unlock()
+		return err
+	}
+	p.logFile, p.generation = logFile, p.generation+1
+	snapshot := p.statistics.snapshot(p.generation)
+	p.mutex.Unlock()
+	if err := closeFile(previousLogFile); err != nil {
+		return fmt.Errorf("statistics log closing failed: %v", err)
+	}
+	if err := p.writeSnapshot(snapshot); err != nil {
+		return err
+	}
+	return p.removeLogs(snapshot.Generation)
+}
+
+// Close writes a final snapshot and closes the log, the statistics are no longer persisted afterwards
+func (p *Persister) Close() error {
+	err := p.Snapshot()
+	p.mutex.Lock()
+	logFile := p.logFile
+	p.logFile = nil
+	p.mutex.Unlock()
+	if logFile != nil {
+		if closeErr := closeFile(logFile); closeErr != nil && err == nil {
+			err = fmt.Errorf("statistics log closing failed: %v", closeErr)
+		}
+	}
+	return err
+}
+
+// append appends a record to the log, failures are only logged as they must not prevent rendering
+// The caller must hold the mutex (for reading at least)
+func (p *Persister) append(record *persistedRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Errorf("Statistics record encoding failed: %v", err)
+		return
+	}
+	p.logMutex.Lock()
+	defer p.logMutex.Unlock()
+	if p.logFile == nil {
+		return
+	}
+	if _, err := p.logFile.Write(append(line, '\n')); err != nil {
+		log.Errorf("Statistics record writing failed: %v", err)
+	}
+}
+
+// recover restores the statistics from the snapshot and the logs, and returns the last generation found
+func (p *Persister) recover() (int64, error) {
+	generation := int64(0)
+	snapshot, err := p.readSnapshot()
+	if err != nil {
+		return 0, err
+	}
+	if snapshot != nil {
+		p.statistics.restore(snapshot)
+		generation = snapshot.Generation
+	}
+	generations, err := p.logGenerations()
+	if err != nil {
+		return 0, err
+	}
+	for _, logGeneration := range generations {
+		if logGeneration < generation {
+			continue
+		}
+		if err := p.replayLog(logGeneration); err != nil {
+			return 0, err
+		}
+		generation = logGeneration
+	}
+	// Requests evicted by retention are only accounted for by canonical requests and the top request once they are found again
+	p.statistics.refreshCanonical(p.statistics.now())
+	p.statistics.refreshTop()
+	return generation, nil
+}
+
+// readSnapshot reads the snapshot file, if any
+func (p *Persister) readSnapshot() (*persistedSnapshot, error) {
+	data, err := ioutil.ReadFile(filepath.Join(p.directory, persistedSnapshotFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("statistics snapshot reading failed: %v", err)
+	}
+	snapshot := &persistedSnapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return nil, fmt.Errorf("statistics snapshot decoding failed: %v", err)
+	}
+	if snapshot.Version != persistedVersion {
+		return nil, fmt.Errorf("statistics snapshot version must be %d, version %d was found", persistedVersion, snapshot.Version)
+	}
+	return snapshot, nil
+}
+
+// writeSnapshot atomically replaces the snapshot file
+func (p *Persister) writeSnapshot(snapshot *persistedSnapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("statistics snapshot encoding failed: %v", err)
+	}
+	path := filepath.Join(p.directory, persistedSnapshotFile)
+	file, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("statistics snapshot writing failed: %v", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("statistics snapshot writing failed: %v", err)
+	}
+	if err := closeFile(file); err != nil {
+		return fmt.Errorf("statistics snapshot writing failed: %v", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("statistics snapshot writing failed: %v", err)
+	}
+	return p.syncDirectory()
+}
+
+// syncDirectory syncs the data directory, so that file creations, renames and removals are durable
+func (p *Persister) syncDirectory() error {
+	directory, err := os.Open(p.directory)
+	if err != nil {
+		return fmt.Errorf("statistics data directory syncing failed: %v", err)
+	}
+	defer directory.Close()
+	if err := directory.Sync(); err != nil {
+		log.Debugf("Statistics data directory syncing failed: %v", err)
+	}
+	return nil
+}
+
+// logPath returns the path of the log of a generation
+func (p *Persister) logPath(generation int64) string {
+	return filepath.Join(p.directory, fmt.Sprintf("%s%020d", persistedLogPrefix, generation))
+}
+
+// createLog creates the log of a generation
+func (p *Persister) createLog(generation int64) (*os.File, error) {
+	logFile, err := os.OpenFile(p.logPath(generation), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("statistics log creation failed: %v", err)
+	}
+	return logFile, nil
+}
+
+// logGenerations returns the generations of the logs in the data directory, in ascending order
+func (p *Persister) logGenerations() ([]int64, error) {
+	files, err := ioutil.ReadDir(p.directory)
+	if err != nil {
+		return nil, fmt.Errorf("statistics data directory reading failed: %v", err)
+	}
+	generations := make([]int64, 0)
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), persistedLogPrefix) {
+			continue
+		}
+		generation, err := strconv.ParseInt(strings.TrimPrefix(file.Name(), persistedLogPrefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		generations = append(generations, generation)
+	}
+	sort.Slice(generations, func(i, j int) bool {
+		return generations[i] < generations[j]
+	})
+	return generations, nil
+}
+
+// removeLogs removes the logs of the generations prior to a generation
+func (p *Persister) removeLogs(generation int64) error {
+	generations, err := p.logGenerations()
+	if err != nil {
+		return err
+	}
+	for _, logGeneration := range generations {
+		if logGeneration >= generation {
+			break
+		}
+		if err := os.Remove(p.logPath(logGeneration)); err != nil {
+			return fmt.Errorf("statistics log removal failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// replayLog replays the records of the log of a generation
+func (p *Persister) replayLog(generation int64) error {
+	logFile, err := os.Open(p.logPath(generation))
+	if err != nil {
+		return fmt.Errorf("statistics log reading failed: %v", err)
+	}
+	defer logFile.Close()
+	reader := bufio.NewReader(logFile)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Warnf("Statistics log %d ends with a truncated record, it is skipped", generation)
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("statistics log reading failed: %v", err)
+		}
+		record := &persistedRecord{}
+		if err := json.Unmarshal(line, record); err != nil {
+			log.Warnf("Statistics log %d contains an invalid record, it is skipped: %v", generation, err)
+			continue
+		}
+		p.statistics.replay(record)
+	}
+}
+
+// closeFile syncs and closes a file
+func closeFile(file *os.File) error {
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// snapshot returns a snapshot of the statistics (of their raw requests, canonical ones are derived from them)
+// The totals and details of the requests are broken down by outcome, so that the statistics of each outcome are derived from them too
+func (s *Statistics) snapshot(generation int64) *persistedSnapshot {
+	now := s.now()
+	to := unixMinute(now)
+	from := to - statisticsMinutes + 1
+	snapshot := &persistedSnapshot{
+		Version:    persistedVersion,
+		Generation: generation,
+		Time:       now,
+		Statistics: make([]*RequestStatistic, 0),
+		Minutes:    make([]*persistedMinute, 0),
+	}
+	s.retentionMutex.Lock()
+	if !s.decayed.IsZero() {
+		decayed := s.decayed
+		snapshot.Decayed = &decayed
+	}
+	s.retentionMutex.Unlock()
+	statistics := make(map[Request]*RequestStatistic)
+	minutes := make(map[int64]*persistedMinute)
+	minuteStatistics := make(map[int64]map[Request]*RequestStatistic)
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.Lock()
+		for request, total := range shard.totals {
+			statistic := NewRequestStatistic(&request, total)
+			details := shard.details[request]
+			details.setTo(statistic)
+			statistics[request] = statistic
+			snapshot.Statistics = append(snapshot.Statistics, statistic)
+		}
+		for minute := from; minute <= to; minute++ {
+			for request, total := range shard.minuteTotals(minute) {
+				minuteSnapshot, ok := minutes[minute]
+				if !ok {
+					minuteSnapshot = &persistedMinute{Time: time.Unix(minute*60, 0).UTC()}
+					minutes[minute] = minuteSnapshot
+					minuteStatistics[minute] = make(map[Request]*RequestStatistic)
+					snapshot.Minutes = append(snapshot.Minutes, minuteSnapshot)
+				}
+				statistic := NewRequestStatistic(&request, total)
+				minuteStatistics[minute][request] = statistic
+				minuteSnapshot.Statistics = append(minuteSnapshot.Statistics, statistic)
+			}
+		}
+		shard.Unlock()
+	}
+	for outcome, outcomeStatistics := range s.outcomes {
+		for i := range outcomeStatistics.shards {
+			shard := &outcomeStatistics.shards[i]
+			shard.Lock()
+			for request, total := range shard.totals {
+				if statistic, ok := statistics[request]; ok {
+					details := shard.details[request]
+					statistic.addOutcome(outcome, details.outcomeStatistic(total))
+				}
+			}
+			for minute := from; minute <= to; minute++ {
+				for request, total := range shard.minuteTotals(minute) {
+					if statistic, ok := minuteStatistics[minute][request]; ok {
+						statistic.addOutcome(outcome, &OutcomeStatistic{Total: total})
+					}
+				}
+			}
+			shard.Unlock()
+		}
+	}
+	sort.Slice(snapshot.Minutes, func(i, j int) bool {
+		return snapshot.Minutes[i].Time.Before(snapshot.Minutes[j].Time)
+	})
+	return snapshot
+}
+
+// restore adds the statistics of a snapshot
+// The hits that are not broken down by outcome (recorded before outcomes were) are only added to the statistics of all outcomes
+func (s *Statistics) restore(snapshot *persistedSnapshot) {
+	if snapshot.Decayed != nil {
+		s.decayed = *snapshot.Decayed
+	}
+	for _, statistic := range snapshot.Statistics {
+		s.merge(statistic)
+	}
+	for _, minuteSnapshot := range snapshot.Minutes {
+		minute := unixMinute(minuteSnapshot.Time)
+		for _, statistic := range minuteSnapshot.Statistics {
+			total := statistic.Total
+			for _, outcome := range Outcomes {
+				if outcomeStatistic := statistic.Outcomes[outcome]; outcomeStatistic != nil {
+					s.addMinute(&statistic.Request, outcomeStatistic.Total, minute, outcome)
+					total -= outcomeStatistic.Total
+				}
+			}
+			if total != 0 {
+				s.addMinute(&statistic.Request, total, minute, "")
+			}
+		}
+	}
+}
+
+// replay applies a record of the log
+func (s *Statistics) replay(record *persistedRecord) {
+	if record.Decayed != nil {
+		s.decayed = *record.Decayed
+	}
+	switch {
+	case record.Reset:
+		s.reset()
+	case record.Statistic != nil:
+		s.merge(record.Statistic)
+	case record.Factor != nil && record.Request != nil:
+		s.scale(record.Request, *record.Factor)
+	case record.Factor != nil:
+		s.scaleAll(*record.Factor)
+	case record.Request != nil && record.Delta < 0:
+		s.removeHits(record.Request, -record.Delta)
+	case record.Request != nil:
+		s.add(record.Request, record.Delta, unixMinute(record.Time), record.Outcome, newRequestDetails(record.Latency, record.Time))
+	}
+}
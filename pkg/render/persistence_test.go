@@ -0,0 +1,240 @@
+package render
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// openTestPersister opens a persister of new statistics with a fake clock in a data directory
+func openTestPersister(t *testing.T, directory string, now *time.Time) (*Statistics, *Persister) {
+	statistics := NewStatistics()
+	setClock(statistics, now)
+	persister, err := OpenPersister(directory, statistics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return statistics, persister
+}
+
+// checkRecovered checks that recovered statistics match the original ones
+func checkRecovered(t *testing.T, got, want *Statistics) {
+	if got, want := got.GetTopStatistics(100), want.GetTopStatistics(100); !reflect.DeepEqual(got, want) {
+		t.Errorf("recovered Statistics.GetTopStatistics() = %v, want %v", got, want)
+	}
+	if got, want := got.GetTopStatistic(), want.GetTopStatistic(); !reflect.DeepEqual(got, want) {
+		t.Errorf("recovered Statistics.GetTopStatistic() = %v, want %v", got, want)
+	}
+	if got, want := got.CanonicalStatistics().GetTopStatistics(100), want.CanonicalStatistics().GetTopStatistics(100); !reflect.DeepEqual(got, want) {
+		t.Errorf("recovered Statistics.CanonicalStatistics().GetTopStatistics() = %v, want %v", got, want)
+	}
+	if got, want := got.GetWindowTopStatistics(time.Hour, 100), want.GetWindowTopStatistics(time.Hour, 100); !reflect.DeepEqual(got, want) {
+		t.Errorf("recovered Statistics.GetWindowTopStatistics() = %v, want %v", got, want)
+	}
+	for _, outcome := range Outcomes {
+		got, want := got.OutcomeStatistics(outcome).(*Statistics), want.OutcomeStatistics(outcome).(*Statistics)
+		if got, want := got.GetTopStatistics(100), want.GetTopStatistics(100); !reflect.DeepEqual(got, want) {
+			t.Errorf("recovered Statistics.OutcomeStatistics(%v).GetTopStatistics() = %v, want %v", outcome, got, want)
+		}
+		if got, want := got.GetWindowTopStatistics(time.Hour, 100), want.GetWindowTopStatistics(time.Hour, 100); !reflect.DeepEqual(got, want) {
+			t.Errorf("recovered Statistics.OutcomeStatistics(%v).GetWindowTopStatistics() = %v, want %v", outcome, got, want)
+		}
+	}
+}
+
+func TestPersister(t *testing.T) {
+	// Prepare tests data
+	requests := []*Request{
+		NewRequest(20, 3, 5, "A", "B"),
+		NewRequest(20, 3, 3, "A", "B"),
+		NewRequest(20, 3, 3, "AB", ""),
+		NewRequest(30, 2, 7, "喂", "世界"),
+	}
+	tests := []struct {
+		name  string
+		crash bool
+	}{
+		{"Recovery after close", false},
+		{"Recovery after crash", true},
+	}
+	// Run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			directory, err := ioutil.TempDir("", "statistics")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(directory)
+			now := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+			// Record statistics, with snapshots, a reset, an import, a retention and adjustments in between
+			statistics, persister := openTestPersister(t, directory, &now)
+			for i := 0; i < 10; i++ {
+				statistics.RecordStatistic(requests[0])
+			}
+			statistics.ResetStatistics()
+			for i, request := range requests {
+				for j := 0; j <= i; j++ {
+					if j%2 == 1 {
+						statistics.RecordOutcome(request, OutcomeCancelled, time.Duration(j)*time.Millisecond+123*time.Nanosecond)
+						continue
+					}
+					statistics.RecordStatistic(request)
+				}
+				now = now.Add(time.Minute)
+				if i == 1 {
+					if err := persister.Snapshot(); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			imported := []*RequestStatistic{{Request: *requests[3], Total: 5, Outcomes: map[Outcome]*OutcomeStatistic{OutcomeError: {Total: 2}}}}
+			if err := statistics.ImportStatistics(imported, false); err != nil {
+				t.Fatal(err)
+			}
+			statistics.RecordStatistic(requests[0])
+			if _, err := statistics.ApplyRetention(&RetentionPolicy{MaxRequests: 3}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := statistics.AdjustStatistic(requests[3], -2); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := statistics.DeleteStatistic(requests[2]); err != nil {
+				t.Fatal(err)
+			}
+			if tt.crash {
+				// Simulate a truncated record at the end of the log
+				logFile, err := os.OpenFile(persister.logPath(persister.generation), os.O_WRONLY|os.O_APPEND, 0600)
+				if err != nil {
+					t.Fatal(err)
+				}
+				logFile.WriteString(`{"request":{"limit":20,"int1":3`)
+				logFile.Close()
+			} else if err := persister.Close(); err != nil {
+				t.Fatal(err)
+			}
+			// Recover statistics and check them
+			recovered, recoveredPersister := openTestPersister(t, directory, &now)
+			defer recoveredPersister.Close()
+			checkRecovered(t, recovered, statistics)
+			if got := recovered.GetStatistic(requests[0]); got == nil || got.Total != 2 {
+				t.Errorf("recovered Statistics.GetStatistic() = %v, want total 2", got)
+			}
+			// Check that recovered statistics are persisted too
+			recovered.RecordStatistic(requests[0])
+			statistics.RecordStatistic(requests[0])
+			if err := recoveredPersister.Close(); err != nil {
+				t.Fatal(err)
+			}
+			recoveredTwice, recoveredTwicePersister := openTestPersister(t, directory, &now)
+			defer recoveredTwicePersister.Close()
+			checkRecovered(t, recoveredTwice, statistics)
+		})
+	}
+}
+
+func TestPersister_Generations(t *testing.T) {
+	// Open persister
+	directory, err := ioutil.TempDir("", "statistics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	now := time.Now()
+	statistics, persister := openTestPersister(t, directory, &now)
+	// Check that only the log of the current generation is kept after snapshots
+	for i := 0; i < 3; i++ {
+		statistics.RecordStatistic(NewRequest(20, 3, 5, "A", "B"))
+		if err := persister.Snapshot(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := filepath.Glob(filepath.Join(directory, persistedLogPrefix+"*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{persister.logPath(persister.generation)}; !reflect.DeepEqual(files, want) {
+		t.Errorf("log files = %v, want %v", files, want)
+	}
+	// Check that closed persister can not snapshot anymore
+	if err := persister.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := persister.Snapshot(); err != errPersisterClosed {
+		t.Errorf("Persister.Snapshot() error = %v, want %v", err, errPersisterClosed)
+	}
+}
+
+func TestPersister_Concurrent(t *testing.T) {
+	// Open persister
+	directory, err := ioutil.TempDir("", "statistics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	now := time.Now()
+	statistics, persister := openTestPersister(t, directory, &now)
+	// Record statistics while taking snapshots
+	const calls = 1000
+	var wg sync.WaitGroup
+	wg.Add(calls + 1)
+	for i := 0; i < calls; i++ {
+		go func(i int) {
+			defer wg.Done()
+			statistics.RecordStatistic(NewRequest(20+i%10, 3, 5, "A", "B"))
+		}(i)
+	}
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			if err := persister.Snapshot(); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	wg.Wait()
+	// Check that recovered statistics are exact
+	recovered, recoveredPersister := openTestPersister(t, directory, &now)
+	defer recoveredPersister.Close()
+	checkRecovered(t, recovered, statistics)
+}
+
+func TestPersister_Decay(t *testing.T) {
+	// Open persister
+	directory, err := ioutil.TempDir("", "statistics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	now := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	statistics, _ := openTestPersister(t, directory, &now)
+	request, policy := NewRequest(20, 3, 5, "A", "B"), &RetentionPolicy{HalfLife: time.Hour}
+	for i := 0; i < 4; i++ {
+		statistics.RecordStatistic(request)
+	}
+	// Start the decay, then crash: the start of the decay is recovered from the log
+	if _, err := statistics.ApplyRetention(policy); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(40 * time.Minute)
+	recovered, persister := openTestPersister(t, directory, &now)
+	if got, err := recovered.ApplyRetention(policy); err != nil || got.Decayed != 0 {
+		t.Errorf("Statistics.ApplyRetention() = %+v, %v within the half-life, want no decay", got, err)
+	}
+	// Restart across the half-life: the start of the decay is recovered from the snapshot, and the totals decay
+	if err := persister.Close(); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(40 * time.Minute)
+	reopened, reopenedPersister := openTestPersister(t, directory, &now)
+	defer reopenedPersister.Close()
+	if got, err := reopened.ApplyRetention(policy); err != nil || got.Decayed != 2 {
+		t.Errorf("Statistics.ApplyRetention() = %+v, %v after the half-life, want 2 hits decayed", got, err)
+	}
+	if got := reopened.GetStatistic(request); got == nil || got.Total != 2 {
+		t.Errorf("Statistics.GetStatistic() = %v after the half-life, want a total of 2", got)
+	}
+}
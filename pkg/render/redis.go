@@ -0,0 +1,219 @@
+package render
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/jpraynaud/fizzbuzz-server/pkg/resp"
+	log "github.com/sirupsen/logrus"
+)
+
+// RedisStatistics represents statistics of requests rendering stored in a Redis server (or any server that speaks RESP)
+// Several servers that share the same Redis server (and key prefix) share the same global statistics
+// The total of a request is the score of its JSON encoding in a sorted set, ties are broken as for Statistics (see RequestStatistic.RanksBefore)
+// Failures of the Redis server are logged and the statistics are then reported as empty, as they must not prevent rendering
+type RedisStatistics struct {
+	client        *resp.Client
+	key           string
+	canonical     *RedisStatistics
+	canonicalKeys bool
+}
+
+// NewRedisStatistics is the RedisStatistics factory, its keys are prefixed by prefix
+func NewRedisStatistics(client *resp.Client, prefix string) *RedisStatistics {
+	return &RedisStatistics{
+		client: client,
+		key:    prefix + "statistics",
+		canonical: &RedisStatistics{
+			client:        client,
+			key:           prefix + "statistics:canonical",
+			canonicalKeys: true,
+		},
+	}
+}
+
+// member returns the member of the sorted set of a request
+func (rs *RedisStatistics) member(request *Request) string {
+	key := *request
+	if rs.canonicalKeys {
+		key = request.Canonical()
+	}
+	member, _ := json.Marshal(&key)
+	return string(member)
+}
+
+// statistic decodes the statistic of a member of the sorted set and its score
+func (rs *RedisStatistics) statistic(member, score []byte) (*RequestStatistic, error) {
+	request := &Request{}
+	if err := json.Unmarshal(member, request); err != nil {
+		return nil, err
+	}
+	total, err := resp.Float64(score)
+	if err != nil {
+		return nil, err
+	}
+	return NewRequestStatistic(request, int(total)), nil
+}
+
+// RecordStatistic records rendering statistics
+func (rs *RedisStatistics) RecordStatistic(request *Request) {
+	commands := [][]string{{"ZINCRBY", rs.key, "1", rs.member(request)}}
+	if rs.canonical != nil {
+		commands = append(commands, []string{"ZINCRBY", rs.canonical.key, "1", rs.canonical.member(request)})
+	}
+	replies, err := rs.client.Pipeline(commands)
+	if err == nil {
+		for _, reply := range replies {
+			if replyErr, ok := reply.(resp.Error); ok {
+				err = replyErr
+			}
+		}
+	}
+	if err != nil {
+		log.Errorf("Redis statistics recording failed: %v", err)
+	}
+}
+
+// GetStatistic returns rendering statistics of a request
+func (rs *RedisStatistics) GetStatistic(request *Request) *RequestStatistic {
+	member := rs.member(request)
+	reply, err := rs.client.Do("ZSCORE", rs.key, member)
+	if err != nil {
+		log.Errorf("Redis statistics reading failed: %v", err)
+		return nil
+	}
+	if score, _ := reply.([]byte); score != nil {
+		statistic, err := rs.statistic([]byte(member), score)
+		if err != nil {
+			log.Errorf("Redis statistics decoding failed: %v", err)
+			return nil
+		}
+		return statistic
+	}
+	return nil
+}
+
+// GetTopStatistic returns rendering statistics of the top request
+func (rs *RedisStatistics) GetTopStatistic() *RequestStatistic {
+	top := rs.GetTopStatistics(1)
+	if len(top) == 0 {
+		return nil
+	}
+	top[0].Rank = 0
+	return top[0]
+}
+
+// GetTopStatistics returns rendering statistics of the k top requests, ranked (see RequestStatistic.RanksBefore)
+// The k members with the highest scores are completed with the members tied with the last one, before ranking
+func (rs *RedisStatistics) GetTopStatistics(k int) []*RequestStatistic {
+	if k < 1 {
+		return []*RequestStatistic{}
+	}
+	reply, err := rs.client.Do("ZREVRANGE", rs.key, "0", strconv.Itoa(k-1), "WITHSCORES")
+	if err != nil {
+		log.Errorf("Redis statistics reading failed: %v", err)
+		return []*RequestStatistic{}
+	}
+	items, _ := reply.([]interface{})
+	if len(items) == 2*k {
+		score, _ := items[len(items)-1].([]byte)
+		reply, err := rs.client.Do("ZRANGEBYSCORE", rs.key, string(score), string(score), "WITHSCORES")
+		if err != nil {
+			log.Errorf("Redis statistics reading failed: %v", err)
+			return []*RequestStatistic{}
+		}
+		tied, _ := reply.([]interface{})
+		items = append(items, tied...)
+	}
+	top := make(statisticHeap, 0, k)
+	offered := make(map[string]bool)
+	for i := 0; i+1 < len(items); i += 2 {
+		member, _ := items[i].([]byte)
+		score, _ := items[i+1].([]byte)
+		if offered[string(member)] {
+			continue
+		}
+		offered[string(member)] = true
+		statistic, err := rs.statistic(member, score)
+		if err != nil {
+			log.Errorf("Redis statistics decoding failed: %v", err)
+			continue
+		}
+		top.offer(statistic, k)
+	}
+	return top.ranked()
+}
+
+// RangeStatistics calls f for each recorded statistic, in ascending score order, until f returns false
+func (rs *RedisStatistics) RangeStatistics(f func(statistic *RequestStatistic) bool) {
+	reply, err := rs.client.Do("ZRANGE", rs.key, "0", "-1", "WITHSCORES")
+	if err != nil {
+		log.Errorf("Redis statistics reading failed: %v", err)
+		return
+	}
+	items, _ := reply.([]interface{})
+	for i := 0; i+1 < len(items); i += 2 {
+		member, _ := items[i].([]byte)
+		score, _ := items[i+1].([]byte)
+		statistic, err := rs.statistic(member, score)
+		if err != nil {
+			log.Errorf("Redis statistics decoding failed: %v", err)
+			continue
+		}
+		if !f(statistic) {
+			return
+		}
+	}
+}
+
+// CanonicalStatistics returns the rendering statistics grouped by canonical requests
+func (rs *RedisStatistics) CanonicalStatistics() StatisticRecorder {
+	if rs.canonical == nil {
+		return rs
+	}
+	return rs.canonical
+}
+
+// ImportStatistics adds the totals of statistics to the recorded ones, that are reset beforehand when replace is set
+// The details of the statistics are not stored by this backend, they are dropped
+func (rs *RedisStatistics) ImportStatistics(statistics []*RequestStatistic, replace bool) error {
+	commands := make([][]string, 0, 2*len(statistics)+1)
+	if replace {
+		command := []string{"DEL", rs.key}
+		if rs.canonical != nil {
+			command = append(command, rs.canonical.key)
+		}
+		commands = append(commands, command)
+	}
+	for _, statistic := range statistics {
+		total := strconv.Itoa(statistic.Total)
+		commands = append(commands, []string{"ZINCRBY", rs.key, total, rs.member(&statistic.Request)})
+		if rs.canonical != nil {
+			commands = append(commands, []string{"ZINCRBY", rs.canonical.key, total, rs.canonical.member(&statistic.Request)})
+		}
+	}
+	replies, err := rs.client.Pipeline(commands)
+	if err == nil {
+		for _, reply := range replies {
+			if replyErr, ok := reply.(resp.Error); ok {
+				err = replyErr
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("redis statistics import failed: %v", err)
+	}
+	return nil
+}
+
+// ResetStatistics resets all statistics currently recorded
+func (rs *RedisStatistics) ResetStatistics() {
+	args := []string{"DEL", rs.key}
+	if rs.canonical != nil {
+		args = append(args, rs.canonical.key)
+	}
+	if _, err := rs.client.Do(args...); err != nil {
+		log.Errorf("Redis statistics reset failed: %v", err)
+	}
+}
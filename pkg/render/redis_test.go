@@ -0,0 +1,113 @@
+package render
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jpraynaud/fizzbuzz-server/pkg/resp"
+	"github.com/jpraynaud/fizzbuzz-server/pkg/resp/resptest"
+)
+
+func TestRedisStatistics(t *testing.T) {
+	// Start fake server and create statistics of two replicas sharing it
+	server := resptest.NewServer()
+	defer server.Close()
+	client := resp.NewClient(server.Addr, time.Second, 4)
+	defer client.Close()
+	replica1, replica2 := NewRedisStatistics(client, "test:"), NewRedisStatistics(client, "test:")
+	// Record statistics concurrently on both replicas
+	requests := []*Request{
+		NewRequest(20, 3, 5, "A", "C"),
+		NewRequest(20, 3, 5, "A", "B"),
+		NewRequest(20, 3, 3, "A", "B"),
+		NewRequest(20, 3, 30, "AB", "C"),
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		for j, request := range requests {
+			if j == 0 && i%2 == 0 {
+				continue
+			}
+			wg.Add(1)
+			go func(i int, request *Request) {
+				defer wg.Done()
+				if i%2 == 0 {
+					replica1.RecordStatistic(request)
+				} else {
+					replica2.RecordStatistic(request)
+				}
+			}(i, request)
+		}
+	}
+	wg.Wait()
+	// Check global statistics
+	if got := replica1.GetStatistic(requests[1]); got == nil || got.Total != 100 {
+		t.Errorf("RedisStatistics.GetStatistic() = %v, want total 100", got)
+	}
+	if got := replica2.GetStatistic(NewRequest(1, 1, 1, "", "")); got != nil {
+		t.Errorf("RedisStatistics.GetStatistic() = %v, want nil", got)
+	}
+	want := []*RequestStatistic{
+		{Request: *requests[2], Total: 100, Rank: 1},
+		{Request: *requests[1], Total: 100, Rank: 2},
+		{Request: *requests[3], Total: 100, Rank: 3},
+	}
+	if got := replica2.GetTopStatistics(3); !reflect.DeepEqual(got, want) {
+		t.Errorf("RedisStatistics.GetTopStatistics() = %v, want %v", got, want)
+	}
+	if got := replica2.GetTopStatistic(); !reflect.DeepEqual(got, NewRequestStatistic(requests[2], 100)) {
+		t.Errorf("RedisStatistics.GetTopStatistic() = %v, want %v", got, NewRequestStatistic(requests[2], 100))
+	}
+	// Check that all statistics are ranged over
+	ranged := 0
+	replica1.RangeStatistics(func(statistic *RequestStatistic) bool {
+		ranged += statistic.Total
+		return true
+	})
+	if ranged != 350 {
+		t.Errorf("RedisStatistics.RangeStatistics() ranged over %v hits, want %v", ranged, 350)
+	}
+	// Check canonical statistics
+	canonical := replica1.CanonicalStatistics()
+	if got := canonical.GetTopStatistic(); got == nil || got.Request != requests[2].Canonical() || got.Total != 200 {
+		t.Errorf("RedisStatistics.CanonicalStatistics().GetTopStatistic() = %v, want total 200", got)
+	}
+	// Check imports
+	if err := replica1.ImportStatistics([]*RequestStatistic{{Request: *requests[0], Total: 70}}, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := replica2.GetTopStatistic(); got == nil || got.Request != *requests[0] || got.Total != 120 {
+		t.Errorf("RedisStatistics.GetTopStatistic() = %v, want total 120", got)
+	}
+	if err := replica2.ImportStatistics([]*RequestStatistic{{Request: *requests[3], Total: 3}}, true); err != nil {
+		t.Fatal(err)
+	}
+	if got := replica1.CanonicalStatistics().GetTopStatistics(3); len(got) != 1 || got[0].Request != requests[3].Canonical() || got[0].Total != 3 {
+		t.Errorf("RedisStatistics.CanonicalStatistics().GetTopStatistics() = %v, want a total of 3", got)
+	}
+	// Check reset
+	replica1.ResetStatistics()
+	if got := replica2.GetTopStatistics(3); len(got) != 0 {
+		t.Errorf("RedisStatistics.GetTopStatistics() = %v, want none", got)
+	}
+	if got := canonical.GetTopStatistic(); got != nil {
+		t.Errorf("RedisStatistics.CanonicalStatistics().GetTopStatistic() = %v, want nil", got)
+	}
+}
+
+func TestRedisStatistics_ServerFailure(t *testing.T) {
+	// Start and stop fake server
+	server := resptest.NewServer()
+	server.Close()
+	statistics := NewRedisStatistics(resp.NewClient(server.Addr, time.Second, 4), "test:")
+	// Check that failures are reported as empty statistics
+	statistics.RecordStatistic(NewRequest(20, 3, 5, "A", "B"))
+	if got := statistics.GetTopStatistic(); got != nil {
+		t.Errorf("RedisStatistics.GetTopStatistic() = %v, want nil", got)
+	}
+	if got := statistics.GetTopStatistics(3); len(got) != 0 {
+		t.Errorf("RedisStatistics.GetTopStatistics() = %v, want none", got)
+	}
+}
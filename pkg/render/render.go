@@ -5,20 +5,25 @@ import (
 	"context"
 	"fmt"
 	"strconv"
-	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// AlgorithmVersion is the version of the FizzBuzz algorithm, to be incremented whenever the items rendered for a request change
+// It is part of the entity tags of the renders, so that the renders cached by the clients are invalidated along with it
+const AlgorithmVersion = 1
+
 // Request represents a request that will be rendered according to the FizzBuzz algorithm (see README for details)
 // Limit is the number of items that will be rendered (starting from 1 to Limit)
 // Int1 (or Int2) represents the multiple of the item numbers that will display Str1 (or Str2) instead of their respective item number
+// The openapi tags hold the constraints checked by Validate, Str1 and Str2 are optional (empty by default)
 type Request struct {
-	Limit int    `json:"limit"`
-	Int1  int    `json:"int1"`
-	Int2  int    `json:"int2"`
-	Str1  string `json:"str1"`
-	Str2  string `json:"str2"`
+	Limit int    `json:"limit" openapi:"minimum=1"`
+	Int1  int    `json:"int1" openapi:"minimum=1"`
+	Int2  int    `json:"int2" openapi:"minimum=1"`
+	Str1  string `json:"str1" openapi:"optional"`
+	Str2  string `json:"str2" openapi:"optional"`
 }
 
 // NewRequest is the Request factory
@@ -32,19 +37,105 @@ func NewRequest(limit, int1, int2 int, str1, str2 string) *Request {
 	}
 }
 
+// ParameterError represents an invalid parameter of a request, whose message reads "<Parameter> parameter <Reason>, value <Value> was given"
+type ParameterError struct {
+	Parameter string
+	Reason    string
+	Value     string
+}
+
+// Error returns the message of the error
+func (e *ParameterError) Error() string {
+	return fmt.Sprintf("%s parameter %s, value %s was given", e.Parameter, e.Reason, e.Value)
+}
+
 // Validate checks that the request is valid and can be rendered by the FizzBuzz algorithm (see README for details)
-// i.e. Limit/Int1/Int2 must be >= 1
+// i.e. Limit/Int1/Int2 must be >= 1, a *ParameterError is returned otherwise
 func (r *Request) Validate() error {
-	var err error
 	switch {
 	case r.Limit < 1:
-		err = fmt.Errorf("limit parameter must be >= 1, value %d was given", r.Limit)
+		return &ParameterError{Parameter: "limit", Reason: "must be >= 1", Value: strconv.Itoa(r.Limit)}
 	case r.Int1 < 1:
-		err = fmt.Errorf("int1 parameter must be >= 1, value %d was given", r.Int1)
+		return &ParameterError{Parameter: "int1", Reason: "must be >= 1", Value: strconv.Itoa(r.Int1)}
 	case r.Int2 < 1:
-		err = fmt.Errorf("int2 parameter must be >= 1, value %d was given", r.Int2)
+		return &ParameterError{Parameter: "int2", Reason: "must be >= 1", Value: strconv.Itoa(r.Int2)}
+	}
+	return nil
+}
+
+// Canonical returns the canonical form of the request, i.e. the simplest request that renders exactly the same items
+// Equivalent requests share the same canonical form, which makes it suitable as a grouping key (statistics, caches...)
+// The normalization rules applied to a valid request are:
+// - Int1 and Int2 both greater than Limit never replace any item, they are set to Limit+1 and Str1/Str2 are emptied
+// - Int1 (or Int2) that never replaces an item on its own (greater than Limit, or multiple of the other one with an empty string) is dropped
+// - Int1 equal to Int2 always pairs Str1 with Str2, they are merged into Str1
+// - a dropped Int2 is represented by Int2 equal to Int1 and an empty Str2
+// - Int1 greater than Int2 is swapped with Int2 (along with Str1 and Str2) when Str1Str2 and Str2Str1 are identical, or when lcm(Int1, Int2) is greater than Limit (Str1Str2 is then never rendered)
+// Invalid requests are returned unchanged
+func (r *Request) Canonical() Request {
+	canonical := *r
+	if canonical.Validate() != nil {
+		return canonical
+	}
+	switch {
+	case canonical.Int1 > canonical.Limit && canonical.Int2 > canonical.Limit:
+		canonical.Int1, canonical.Str1 = canonical.Limit+1, ""
+		canonical.Int2, canonical.Str2 = canonical.Limit+1, ""
+	case canonical.Int1 > canonical.Limit || (canonical.Str1 == "" && canonical.Int1%canonical.Int2 == 0):
+		canonical.Int1, canonical.Str1 = canonical.Int2, canonical.Str2
+		canonical.Str2 = ""
+	case canonical.Int2 > canonical.Limit || (canonical.Str2 == "" && canonical.Int2%canonical.Int1 == 0):
+		canonical.Int2, canonical.Str2 = canonical.Int1, ""
+	case canonical.Int1 == canonical.Int2:
+		canonical.Str1, canonical.Str2 = canonical.Str1+canonical.Str2, ""
+	// lcm(Int1, Int2) > Limit is checked as Int1/gcd(Int1, Int2) > Limit/Int2 to avoid overflows
+	case canonical.Int1 > canonical.Int2 && (canonical.Str1+canonical.Str2 == canonical.Str2+canonical.Str1 || canonical.Int1/gcd(canonical.Int1, canonical.Int2) > canonical.Limit/canonical.Int2):
+		canonical.Int1, canonical.Int2 = canonical.Int2, canonical.Int1
+		canonical.Str1, canonical.Str2 = canonical.Str2, canonical.Str1
+	}
+	return canonical
+}
+
+// gcd returns the greatest common divisor of two positive integers
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
 	}
-	return err
+	return a
+}
+
+// Less reports whether the request is ordered before the other one
+// Requests are ordered by Limit, then Int1, Int2, Str1 and Str2 (strings are compared bytewise)
+func (r *Request) Less(other *Request) bool {
+	switch {
+	case r.Limit != other.Limit:
+		return r.Limit < other.Limit
+	case r.Int1 != other.Int1:
+		return r.Int1 < other.Int1
+	case r.Int2 != other.Int2:
+		return r.Int2 < other.Int2
+	case r.Str1 != other.Str1:
+		return r.Str1 < other.Str1
+	}
+	return r.Str2 < other.Str2
+}
+
+// hash returns the 64-bit FNV-1a hash of the request parameters
+func (r *Request) hash() uint64 {
+	const offset, prime = 14695981039346656037, 1099511628211
+	hash := uint64(offset)
+	for _, value := range [...]int{r.Limit, r.Int1, r.Int2} {
+		for i := uint(0); i < 64; i += 8 {
+			hash = (hash ^ uint64(byte(value>>i))) * prime
+		}
+	}
+	for _, value := range [...]string{r.Str1, r.Str2} {
+		for i := 0; i < len(value); i++ {
+			hash = (hash ^ uint64(value[i])) * prime
+		}
+		hash = (hash ^ 0xff) * prime
+	}
+	return hash
 }
 
 // Response represents a response that will be returned when a request is rendered
@@ -62,36 +153,68 @@ func NewResponse() *Response {
 }
 
 // Renderer represents the interface to render the FizzBuzz Algorithm (see README for details)
+// Statistics returns the StatisticRecorder in which renderings are recorded, so that its optional capabilities can be used
 type Renderer interface {
 	Render(ctx context.Context, request *Request) *Response
+	Statistics() StatisticRecorder
 	StatisticRecorder
 }
 
 // Default renderer implementation
 type renderer struct {
-	*Statistics
+	StatisticRecorder
 }
 
-// NewRenderer is the Renderer factory
+// NewRenderer is the Renderer factory, that records in-memory Statistics
 func NewRenderer() Renderer {
+	return NewRendererWithStatistics(NewStatistics())
+}
+
+// NewRendererWithStatistics is the Renderer factory that records in the given StatisticRecorder
+func NewRendererWithStatistics(statistics StatisticRecorder) Renderer {
 	return &renderer{
-		Statistics: NewStatistics(),
+		StatisticRecorder: statistics,
+	}
+}
+
+// Statistics returns the StatisticRecorder in which renderings are recorded
+func (rr *renderer) Statistics() StatisticRecorder {
+	return rr.StatisticRecorder
+}
+
+// recordOutcome records the rendering of a request with its outcome and latency, if supported by the StatisticRecorder
+// Otherwise only successful renderings are recorded, so that invalid or cancelled requests can not take the top spot
+func (rr *renderer) recordOutcome(request *Request, outcome Outcome, started time.Time) {
+	if outcomeRecorder, ok := rr.StatisticRecorder.(OutcomeStatisticRecorder); ok {
+		outcomeRecorder.RecordOutcome(request, outcome, time.Since(started))
+		return
+	}
+	if outcome == OutcomeSuccess {
+		rr.RecordStatistic(request)
 	}
 }
 
 // Render renders the response associated with the request according to the FizzBuzz algorithm (see README for details)
+// The rendering is recorded once it ends, before the items are closed, along with its outcome
 func (rr *renderer) Render(ctx context.Context, request *Request) *Response {
-	defer rr.RecordStatistic(request)
+	started := time.Now()
 	response := NewResponse()
 	if err := request.Validate(); err != nil {
 		defer close(response.Items)
+		rr.recordOutcome(request, OutcomeInvalid, started)
 		response.Error = err
 		return response
 	}
 	log.Debugf("Request rendering started %+v", request)
 	go func() {
+		outcome := OutcomeSuccess
 		defer func() {
+			if err := recover(); err != nil {
+				log.Errorf("Request rendering failed %+v: %v", request, err)
+				outcome = OutcomeError
+			}
 			log.Debugf("Request rendering done %+v", request)
+			rr.recordOutcome(request, outcome, started)
 			close(response.Items)
 		}()
 		for i := 1; i <= request.Limit; i++ {
@@ -110,79 +233,10 @@ func (rr *renderer) Render(ctx context.Context, request *Request) *Response {
 			case response.Items <- item:
 			case <-ctx.Done():
 				log.Debugf("Request rendering cancelled %+v", request)
+				outcome = OutcomeCancelled
 				return
 			}
 		}
 	}()
 	return response
 }
-
-// RequestStatistic represents the rendering statistics of a request
-type RequestStatistic struct {
-	Request `json:"request"`
-	Total   int `json:"total"`
-}
-
-// NewRequestStatistic is the RequestStatistic factory
-func NewRequestStatistic(request *Request, total int) *RequestStatistic {
-	return &RequestStatistic{
-		Request: *request,
-		Total:   total,
-	}
-}
-
-// StatisticRecorder represents the interface for statistics recording of requests rendering
-type StatisticRecorder interface {
-	RecordStatistic(request *Request)
-	GetStatistic(request *Request) *RequestStatistic
-	GetTopStatistic() *RequestStatistic
-	ResetStatistics()
-}
-
-// Statistics represents statistics of requests rendering
-type Statistics struct {
-	Totals     sync.Map
-	TopRequest Request
-}
-
-// NewStatistics is the Statistics factory
-func NewStatistics() *Statistics {
-	return &Statistics{
-		Totals: sync.Map{},
-	}
-}
-
-// RecordStatistic records rendering statistics
-func (s *Statistics) RecordStatistic(request *Request) {
-	total, _ := s.Totals.Load(*request)
-	totalI, _ := total.(int)
-	totalI++
-	totalTop, _ := s.Totals.Load(s.TopRequest)
-	totalTopI, _ := totalTop.(int)
-	s.Totals.Store(*request, totalI)
-	if totalI > totalTopI {
-		s.TopRequest = *request
-	}
-}
-
-// GetStatistic returns rendering statistics of a request
-func (s *Statistics) GetStatistic(request *Request) *RequestStatistic {
-	total, _ := s.Totals.Load(*request)
-	totalI, _ := total.(int)
-	if totalI == 0 {
-		return nil
-	}
-	return NewRequestStatistic(request, totalI)
-}
-
-// GetTopStatistic returns rendering statistics of the top request
-func (s *Statistics) GetTopStatistic() *RequestStatistic {
-	topRequest := s.TopRequest
-	return s.GetStatistic(&topRequest)
-}
-
-// ResetStatistics resets all statistics currently recorded
-func (s *Statistics) ResetStatistics() {
-	s.Totals = sync.Map{}
-	s.TopRequest = Request{}
-}
@@ -41,13 +41,109 @@ func TestRequest_Validate(t *testing.T) {
 			// Create request
 			request := NewRequest(tt.fields.Limit, tt.fields.Int1, tt.fields.Int2, tt.fields.Str1, tt.fields.Str2)
 			// Check request validation matches the one wanted
-			if err := request.Validate(); (err != nil) != tt.wantErr {
+			err := request.Validate()
+			if (err != nil) != tt.wantErr {
 				t.Errorf("Request.Validate() error = %v, wantErr %v", err, tt.wantErr)
 			}
+			if _, ok := err.(*ParameterError); tt.wantErr && !ok {
+				t.Errorf("Request.Validate() error = %T, want *ParameterError", err)
+			}
+		})
+	}
+}
+
+func TestRequest_Canonical(t *testing.T) {
+	// Prepare tests data
+	type fields struct {
+		Limit int
+		Int1  int
+		Int2  int
+		Str1  string
+		Str2  string
+	}
+	tests := []struct {
+		name   string
+		fields fields
+		want   fields
+	}{
+		{"Invalid request", fields{0, 3, 5, "A", "B"}, fields{0, 3, 5, "A", "B"}},
+		{"Standard case", fields{20, 3, 5, "A", "B"}, fields{20, 3, 5, "A", "B"}},
+		{"Int2 > Int1", fields{20, 5, 3, "A", "B"}, fields{20, 5, 3, "A", "B"}},
+		{"Limit < Int1", fields{10, 30, 3, "A", "B"}, fields{10, 3, 3, "B", ""}},
+		{"Limit < Int2", fields{10, 3, 30, "B", "A"}, fields{10, 3, 3, "B", ""}},
+		{"Limit < Int1 and Limit < Int2", fields{10, 30, 50, "A", "B"}, fields{10, 11, 11, "", ""}},
+		{"Int1 == Int2", fields{10, 3, 3, "A", "B"}, fields{10, 3, 3, "AB", ""}},
+		{"Str1 == Str2", fields{20, 5, 3, "A", "A"}, fields{20, 3, 5, "A", "A"}},
+		{"Str1 is empty", fields{20, 5, 3, "", "B"}, fields{20, 3, 5, "B", ""}},
+		{"Str1 is empty and Int1 multiple of Int2", fields{20, 6, 3, "", "B"}, fields{20, 3, 3, "B", ""}},
+		{"Str2 is empty and Int2 multiple of Int1", fields{20, 3, 9, "A", ""}, fields{20, 3, 3, "A", ""}},
+		{"Str1Str2 == Str2Str1", fields{20, 5, 3, "AA", "A"}, fields{20, 3, 5, "A", "AA"}},
+		{"Limit < lcm(Int1, Int2)", fields{5, 4, 3, "A", "B"}, fields{5, 3, 4, "B", "A"}},
+		{"Limit >= lcm(Int1, Int2)", fields{12, 4, 3, "A", "B"}, fields{12, 4, 3, "A", "B"}},
+	}
+	// Create renderer
+	renderer := NewRenderer()
+	// Run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Create request and its canonical form
+			request := NewRequest(tt.fields.Limit, tt.fields.Int1, tt.fields.Int2, tt.fields.Str1, tt.fields.Str2)
+			want := NewRequest(tt.want.Limit, tt.want.Int1, tt.want.Int2, tt.want.Str1, tt.want.Str2)
+			got := request.Canonical()
+			if !reflect.DeepEqual(got, *want) {
+				t.Errorf("Request.Canonical() = %v, want %v", got, *want)
+			}
+			// Check that canonical form is stable
+			if gotTwice := got.Canonical(); !reflect.DeepEqual(gotTwice, got) {
+				t.Errorf("Request.Canonical() twice = %v, want %v", gotTwice, got)
+			}
+			// Check that canonical form renders the same items
+			if request.Validate() == nil {
+				gotItems, wantItems := make([]string, 0), make([]string, 0)
+				for item := range renderer.Render(context.TODO(), &got).Items {
+					gotItems = append(gotItems, item)
+				}
+				for item := range renderer.Render(context.TODO(), request).Items {
+					wantItems = append(wantItems, item)
+				}
+				if !reflect.DeepEqual(gotItems, wantItems) {
+					t.Errorf("Renderer.Render() of canonical request = %v, want %v", gotItems, wantItems)
+				}
+			}
 		})
 	}
 }
 
+func TestRequest_CanonicalEquivalence(t *testing.T) {
+	// Render every small request and group the requests by rendered items
+	renderer := NewRendererWithStatistics(&plainStatistics{NewStatistics()})
+	strs := []string{"", "A", "B", "AB"}
+	for limit := 1; limit <= 8; limit++ {
+		canonicals := make(map[string]Request)
+		for int1 := 1; int1 <= limit+2; int1++ {
+			for int2 := 1; int2 <= limit+2; int2++ {
+				for _, str1 := range strs {
+					for _, str2 := range strs {
+						request := NewRequest(limit, int1, int2, str1, str2)
+						items := make([]string, 0, limit)
+						for item := range renderer.Render(context.TODO(), request).Items {
+							items = append(items, item)
+						}
+						// Check that requests rendering the same items share the same canonical form
+						key := strings.Join(items, ",")
+						canonical, found := canonicals[key]
+						if !found {
+							canonicals[key] = request.Canonical()
+						} else if got := request.Canonical(); !reflect.DeepEqual(got, canonical) {
+							t.Errorf("Request.Canonical() of %v = %v, want %v", *request, got, canonical)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
 func TestRenderer_Render(t *testing.T) {
 	// Prepare tests data
 	type fields struct {
@@ -101,6 +197,73 @@ func TestRenderer_Render(t *testing.T) {
 	}
 }
 
+func TestRenderer_RenderOutcome(t *testing.T) {
+	// Render requests with each outcome (the cancelled rendering has enough items left to observe the cancellation)
+	renderer := NewRenderer()
+	request, invalidRequest, cancelledRequest := NewRequest(20, 3, 5, "A", "B"), NewRequest(0, 3, 5, "A", "B"), NewRequest(1000, 3, 5, "A", "B")
+	for range renderer.Render(context.TODO(), request).Items {
+	}
+	for range renderer.Render(context.TODO(), invalidRequest).Items {
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	response := renderer.Render(ctx, cancelledRequest)
+	<-response.Items
+	cancel()
+	for range response.Items {
+	}
+	// Check that outcomes are recorded once the items are closed, along with their latencies
+	tests := []struct {
+		request *Request
+		outcome Outcome
+	}{
+		{request, OutcomeSuccess},
+		{invalidRequest, OutcomeInvalid},
+		{cancelledRequest, OutcomeCancelled},
+	}
+	for _, tt := range tests {
+		statistic := renderer.GetStatistic(tt.request)
+		if statistic == nil || statistic.Total != 1 || statistic.Latency == nil || statistic.Latency.Count != 1 {
+			t.Fatalf("Renderer.GetStatistic() = %+v, want a total of 1 with its latency", statistic)
+		}
+		if got := statistic.Outcomes; len(got) != 1 || got[tt.outcome] == nil || got[tt.outcome].Total != 1 {
+			t.Errorf("Renderer.GetStatistic() outcomes = %+v, want a total of 1 %v", got, tt.outcome)
+		}
+	}
+}
+
+// plainStatistics represents a StatisticRecorder without outcome support, as the redis and approximate backends
+type plainStatistics struct {
+	StatisticRecorder
+}
+
+func TestRenderer_RenderWithoutOutcomes(t *testing.T) {
+	// Render a valid, an invalid and a cancelled request with a StatisticRecorder that does not record outcomes
+	renderer := NewRendererWithStatistics(&plainStatistics{NewStatistics()})
+	request, invalidRequest, cancelledRequest := NewRequest(20, 3, 5, "A", "B"), NewRequest(0, 3, 5, "A", "B"), NewRequest(1000, 3, 5, "A", "B")
+	for range renderer.Render(context.TODO(), request).Items {
+	}
+	for range renderer.Render(context.TODO(), invalidRequest).Items {
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	response := renderer.Render(ctx, cancelledRequest)
+	<-response.Items
+	cancel()
+	for range response.Items {
+	}
+	// Check that only the successful rendering is counted
+	if got := renderer.GetStatistic(request); got == nil || got.Total != 1 {
+		t.Errorf("Renderer.GetStatistic() = %+v, want a total of 1", got)
+	}
+	for _, request := range []*Request{invalidRequest, cancelledRequest} {
+		if got := renderer.GetStatistic(request); got != nil {
+			t.Errorf("Renderer.GetStatistic(%+v) = %+v, want nil", request, got)
+		}
+	}
+	if got := renderer.GetTopStatistic(); got == nil || got.Request != *request {
+		t.Errorf("Renderer.GetTopStatistic() = %+v, want the successful request", got)
+	}
+}
+
 func BenchmarkRenderer_Render(b *testing.B) {
 	// Create renderer
 	renderer := NewRenderer()
@@ -130,70 +293,3 @@ func ExampleRenderer_Render() {
 	fmt.Print(strings.Join(items, ","))
 	// Output: 1,2,fizz,4,buzz,fizz,7,8,fizz,buzz,11,fizz,13,14,fizzbuzz,16,17,fizz,19,buzz
 }
-
-func TestStatistics(t *testing.T) {
-	// Prepare tests data
-	type fields struct {
-		Limit int
-		Int1  int
-		Int2  int
-		Str1  string
-		Str2  string
-	}
-	tests := []struct {
-		name               string
-		fieldsTodo         fields
-		iterationsTodo     int
-		iterationsWant     int
-		fieldsMostUsedWant fields
-	}{
-		{"Step 1", fields{10, 3, 5, "A", "B"}, 1, 1, fields{10, 3, 5, "A", "B"}},
-		{"Step 2", fields{20, 3, 5, "A", "B"}, 2, 2, fields{20, 3, 5, "A", "B"}},
-		{"Step 3", fields{20, 3, 5, "A", "B"}, 10, 12, fields{20, 3, 5, "A", "B"}},
-		{"Step 4", fields{20, 3, 5, "A", "B"}, 30, 42, fields{20, 3, 5, "A", "B"}},
-		{"Step 5", fields{30, 3, 5, "A", "B"}, 100, 100, fields{30, 3, 5, "A", "B"}},
-	}
-	// Get & reset statistics
-	statistics := NewStatistics()
-	// Run tests
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			// Create request
-			request := NewRequest(tt.fieldsTodo.Limit, tt.fieldsTodo.Int1, tt.fieldsTodo.Int2, tt.fieldsTodo.Str1, tt.fieldsTodo.Str2)
-			// Records request multiple times
-			for i := 0; i < tt.iterationsTodo; i++ {
-				statistics.RecordStatistic(request)
-			}
-			// Check that total renderings recorded matches the total wanted
-			requestStatistic := statistics.GetStatistic(request)
-			if got := requestStatistic.Total; got != tt.iterationsWant {
-				t.Errorf("StatisticRecorder.RecordStatistic() = %v, want %v", got, tt.iterationsWant)
-			}
-			// Check that the most used request matches the most used request wanted
-			topRequestWant := NewRequest(tt.fieldsMostUsedWant.Limit, tt.fieldsMostUsedWant.Int1, tt.fieldsMostUsedWant.Int2, tt.fieldsMostUsedWant.Str1, tt.fieldsMostUsedWant.Str2)
-			topRequestStatistic := statistics.GetTopStatistic()
-			if got := topRequestStatistic.Request; !reflect.DeepEqual(got, *topRequestWant) {
-				t.Errorf("Renderer.Render() = %v, want %v", got, topRequestWant)
-			}
-		})
-	}
-}
-
-func BenchmarkRenderer_GetTopStatistic(b *testing.B) {
-	// Create renderer
-	renderer := NewRenderer()
-	// Create request
-	request := NewRequest(100, 3, 5, "fizz", "buzz")
-	// record statistics
-	for i := 0; i < 1000; i++ {
-		// Create request
-		renderer.Render(context.TODO(), request)
-	}
-	// Reset timer
-	b.ResetTimer()
-	// Run benchmark
-	for i := 0; i < b.N; i++ {
-		// Create request
-		renderer.GetTopStatistic()
-	}
-}
@@ -0,0 +1,334 @@
+package render
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RetentionPolicy represents how long the statistics of requests are retained, each rule is disabled when zero:
+// - requests that were not seen for MaxAge are evicted
+// - only the MaxRequests most recently seen requests are kept, the least recently seen ones are evicted
+// - totals decay over time, they are halved every HalfLife (rounded down) and requests are evicted once their total is 0
+type RetentionPolicy struct {
+	MaxAge      time.Duration
+	MaxRequests int
+	HalfLife    time.Duration
+}
+
+// Enabled reports whether any rule of the policy is enabled
+func (rp *RetentionPolicy) Enabled() bool {
+	return rp.MaxAge > 0 || rp.MaxRequests > 0 || rp.HalfLife > 0
+}
+
+// RetentionResult represents the outcome of applying a retention policy: the number of requests evicted and of hits removed by decay
+type RetentionResult struct {
+	Evicted int `json:"evicted"`
+	Decayed int `json:"decayed"`
+}
+
+// RetentionStatisticRecorder represents the interface of a StatisticRecorder whose statistics can be retained by a policy
+type RetentionStatisticRecorder interface {
+	ApplyRetention(policy *RetentionPolicy) (*RetentionResult, error)
+}
+
+// RunRetention applies a retention policy periodically until the context is done, failures are only logged
+func RunRetention(ctx context.Context, recorder RetentionStatisticRecorder, policy *RetentionPolicy, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			result, err := recorder.ApplyRetention(policy)
+			if err != nil {
+				log.Errorf("Statistics retention failed: %v", err)
+				continue
+			}
+			if result.Evicted > 0 || result.Decayed > 0 {
+				log.WithFields(log.Fields{
+					"evicted": result.Evicted,
+					"decayed": result.Decayed,
+				}).Info("Statistics retention applied")
+			}
+		}
+	}
+}
+
+// ApplyRetention applies a retention policy to the statistics: totals decay first, then requests are evicted by age and by count
+// Requests whose last seen time is unknown (imported without it) are never evicted by age, and are the first ones evicted by count
+// Time bucketed statistics are left untouched, as they expire on their own
+// When the statistics are persisted, the decays and evictions are also appended to the log of the persister
+func (s *Statistics) ApplyRetention(policy *RetentionPolicy) (*RetentionResult, error) {
+	if s.persister != nil {
+		s.persister.mutex.Lock()
+		defer s.persister.mutex.Unlock()
+	}
+	s.retentionMutex.Lock()
+	defer s.retentionMutex.Unlock()
+	now := s.now()
+	result := &RetentionResult{}
+	if policy.HalfLife > 0 {
+		// The time the totals last decayed is persisted, so that restarts do not delay the decay
+		if s.decayed.IsZero() {
+			s.decayed = now
+			s.persist(&persistedRecord{Decayed: &now, Time: now})
+		}
+		if halvings := now.Sub(s.decayed) / policy.HalfLife; halvings > 0 {
+			s.decayed = s.decayed.Add(halvings * policy.HalfLife)
+			factor, decayed := math.Pow(0.5, float64(halvings)), s.decayed
+			s.persist(&persistedRecord{Factor: &factor, Decayed: &decayed, Time: now})
+			for _, seen := range s.seenRequests() {
+				removed, evicted := s.scale(&seen.request, factor)
+				result.Decayed += removed
+				if evicted {
+					result.Evicted++
+				}
+			}
+		}
+	}
+	if policy.MaxAge > 0 || policy.MaxRequests > 0 {
+		seenRequests := s.seenRequests()
+		sort.Slice(seenRequests, func(i, j int) bool {
+			if !seenRequests[i].lastSeen.Equal(seenRequests[j].lastSeen) {
+				return seenRequests[i].lastSeen.Before(seenRequests[j].lastSeen)
+			}
+			return seenRequests[j].request.Less(&seenRequests[i].request)
+		})
+		factor := 0.0
+		for i, seen := range seenRequests {
+			expired := policy.MaxAge > 0 && !seen.lastSeen.IsZero() && now.Sub(seen.lastSeen) > policy.MaxAge
+			if !expired && (policy.MaxRequests <= 0 || len(seenRequests)-i <= policy.MaxRequests) {
+				continue
+			}
+			s.persist(&persistedRecord{Request: &seen.request, Factor: &factor, Time: now})
+			s.scale(&seen.request, factor)
+			result.Evicted++
+		}
+	}
+	if result.Evicted > 0 {
+		s.refreshCanonical(now)
+	}
+	if result.Evicted > 0 || result.Decayed > 0 {
+		s.refreshTop()
+	}
+	return result, nil
+}
+
+// persist appends a record to the log of the persister, if the statistics are persisted
+// The caller must hold the mutex of the persister
+func (s *Statistics) persist(record *persistedRecord) {
+	if s.persister != nil {
+		s.persister.append(record)
+	}
+}
+
+// seenRequest represents a recorded request, with the last time it was seen (zero if unknown)
+type seenRequest struct {
+	request  Request
+	lastSeen time.Time
+}
+
+// seenRequests returns the recorded requests, in no particular order
+func (s *Statistics) seenRequests() []seenRequest {
+	seenRequests := make([]seenRequest, 0)
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.Lock()
+		for request := range shard.totals {
+			seenRequests = append(seenRequests, seenRequest{request: request, lastSeen: shard.details[request].lastSeen})
+		}
+		shard.Unlock()
+	}
+	return seenRequests
+}
+
+// scaleAll scales the totals of all the recorded requests by a factor (see Statistics.scale)
+func (s *Statistics) scaleAll(factor float64) {
+	for _, seen := range s.seenRequests() {
+		s.scale(&seen.request, factor)
+	}
+}
+
+// scale scales the total of a request by a factor between 0 and 1 (rounded down), see Statistics.lower
+func (s *Statistics) scale(request *Request, factor float64) (int, bool) {
+	return s.lower(request, func(total int) int {
+		return int(float64(total) * factor)
+	})
+}
+
+// lower lowers the total of a request to the total returned by lowered, and its totals by outcome in proportion (rounded down)
+// The latencies of the request are then those of its outcomes, plus those of its hits not broken down by outcome lowered in proportion
+// The hits removed are also removed from its canonical request, and the request is evicted once its total is 0
+// It returns the number of hits removed, and whether the request was evicted
+// The top request is not updated, see Statistics.refreshTop
+func (s *Statistics) lower(request *Request, lowered func(total int) int) (int, bool) {
+	key := s.key(request)
+	shard := s.shard(&key)
+	shard.Lock()
+	total := shard.totals[key]
+	shard.Unlock()
+	remaining := lowered(total)
+	if total == 0 || remaining >= total {
+		return 0, false
+	}
+	if remaining < 0 {
+		remaining = 0
+	}
+	var outcomesBefore, outcomesAfter latencyTotals
+	for outcome, outcomeStatistics := range s.outcomes {
+		outcomeTotal, outcomeRemaining, before, after := outcomeStatistics.shard(&key).lower(key, func(outcomeTotal int) int {
+			return outcomeTotal * remaining / total
+		}, nil)
+		outcomesBefore.add(before)
+		outcomesAfter.add(after)
+		if outcomeRemaining != outcomeTotal && s.canonical != nil {
+			s.canonical.outcomes[outcome].subtract(request, outcomeTotal-outcomeRemaining, before.minus(after))
+		}
+	}
+	removed := total - remaining
+	total, remaining, before, after := shard.lower(key, func(total int) int {
+		return total - removed
+	}, func(latency latencyTotals, total, remaining int) latencyTotals {
+		if s.outcomes == nil {
+			return latency.scale(remaining, total)
+		}
+		lowered := latency.minus(outcomesBefore).scale(remaining, total)
+		lowered.add(outcomesAfter)
+		lowered.max = latency.max
+		return lowered
+	})
+	if s.canonical != nil && remaining != total {
+		s.canonical.subtract(request, total-remaining, before.minus(after))
+	}
+	return total - remaining, remaining == 0
+}
+
+// subtract subtracts hits and their latencies from the total of a request, which is evicted once its total is 0
+func (s *Statistics) subtract(request *Request, delta int, latency latencyTotals) {
+	key := s.key(request)
+	shard := s.shard(&key)
+	shard.Lock()
+	defer shard.Unlock()
+	total := shard.totals[key] - delta
+	if total <= 0 {
+		delete(shard.totals, key)
+		delete(shard.details, key)
+		return
+	}
+	shard.totals[key] = total
+	details := shard.details[key]
+	details.latency.count -= latency.count
+	details.latency.sum -= latency.sum
+	if details.latency.count <= 0 {
+		details.latency = latencyTotals{}
+	}
+	shard.details[key] = details
+}
+
+// lower lowers the total of a key to the total returned by lowered, and its latencies by latency (in proportion if nil)
+// The key is evicted once its total is 0. It returns the previous and the new totals and latencies of the key
+func (ss *statisticsShard) lower(key Request, lowered func(total int) int, latency func(latency latencyTotals, total, remaining int) latencyTotals) (int, int, latencyTotals, latencyTotals) {
+	ss.Lock()
+	defer ss.Unlock()
+	total, ok := ss.totals[key]
+	if !ok {
+		return 0, 0, latencyTotals{}, latencyTotals{}
+	}
+	remaining := lowered(total)
+	details := ss.details[key]
+	if remaining >= total {
+		return total, total, details.latency, details.latency
+	}
+	if remaining <= 0 {
+		delete(ss.totals, key)
+		delete(ss.details, key)
+		return total, 0, details.latency, latencyTotals{}
+	}
+	before := details.latency
+	if latency != nil {
+		details.latency = latency(before, total, remaining)
+	} else {
+		details.latency = before.scale(remaining, total)
+	}
+	ss.totals[key], ss.details[key] = remaining, details
+	return total, remaining, before, details.latency
+}
+
+// refreshCanonical finds the seen times and the maximum latencies of the canonical requests again once requests were evicted,
+// as those of the evicted requests can not be subtracted
+// The last seen times after since are kept, as they come from hits recorded meanwhile
+func (s *Statistics) refreshCanonical(since time.Time) {
+	if s.canonical == nil {
+		return
+	}
+	refresh := func(raw, canonical *Statistics) {
+		canonicalDetails := make(map[Request]requestDetails)
+		for i := range raw.shards {
+			shard := &raw.shards[i]
+			shard.Lock()
+			for request, details := range shard.details {
+				key := canonical.key(&request)
+				keyDetails := canonicalDetails[key]
+				keyDetails.add(requestDetails{latency: latencyTotals{max: details.latency.max}, firstSeen: details.firstSeen, lastSeen: details.lastSeen})
+				canonicalDetails[key] = keyDetails
+			}
+			shard.Unlock()
+		}
+		for i := range canonical.shards {
+			shard := &canonical.shards[i]
+			shard.Lock()
+			for key, details := range shard.details {
+				refreshed := canonicalDetails[key]
+				details.firstSeen, details.latency.max = refreshed.firstSeen, refreshed.latency.max
+				if !details.lastSeen.After(since) {
+					details.lastSeen = refreshed.lastSeen
+				}
+				shard.details[key] = details
+			}
+			shard.Unlock()
+		}
+	}
+	refresh(s, s.canonical)
+	for outcome, outcomeStatistics := range s.outcomes {
+		refresh(outcomeStatistics, s.canonical.outcomes[outcome])
+	}
+}
+
+// refreshTop finds the top request again once totals were lowered, as recording only tracks a top request whose total grows
+// A change of the top request is notified, as well as the one of the nested statistics
+func (s *Statistics) refreshTop() {
+	for i := range s.shards {
+		s.shards[i].Lock()
+	}
+	topRequest, topTotal := Request{}, 0
+	for i := range s.shards {
+		for request, total := range s.shards[i].totals {
+			if total > topTotal || (total == topTotal && request.Less(&topRequest)) {
+				topRequest, topTotal = request, total
+			}
+		}
+	}
+	s.topMutex.Lock()
+	changed := topTotal != 0 && topRequest != s.topRequest
+	s.topRequest = topRequest
+	atomic.StoreInt64(&s.topTotal, int64(topTotal))
+	s.topMutex.Unlock()
+	if changed && s.notifier.active() {
+		s.notifier.notify(&StatisticChange{Request: topRequest, Previous: topTotal, Total: topTotal, TopChanged: true})
+	}
+	for i := range s.shards {
+		s.shards[i].Unlock()
+	}
+	for _, outcomeStatistics := range s.outcomes {
+		outcomeStatistics.refreshTop()
+	}
+	if s.canonical != nil {
+		s.canonical.refreshTop()
+	}
+}
@@ -0,0 +1,74 @@
+package render
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStatistics_ApplyRetention(t *testing.T) {
+	// Record requests seen at different times, two of which have the same canonical form
+	now := time.Date(2019, 10, 1, 12, 0, 30, 0, time.UTC)
+	statistics := NewStatistics()
+	setClock(statistics, &now)
+	oldest, old, recent := NewRequest(20, 3, 5, "A", "B"), NewRequest(5, 3, 3, "A", "B"), NewRequest(5, 3, 30, "AB", "C")
+	for i := 0; i < 6; i++ {
+		statistics.RecordStatistic(oldest)
+	}
+	now = now.Add(24 * time.Hour)
+	for i := 0; i < 4; i++ {
+		statistics.RecordOutcome(old, OutcomeError, time.Millisecond)
+	}
+	now = now.Add(24 * time.Hour)
+	statistics.RecordStatistic(recent)
+	statistics.RecordStatistic(recent)
+	tests := []struct {
+		name       string
+		policy     *RetentionPolicy
+		elapsed    time.Duration
+		want       *RetentionResult
+		wantTotals map[*Request]int
+	}{
+		{"Disabled", &RetentionPolicy{}, time.Hour, &RetentionResult{}, map[*Request]int{oldest: 6, old: 4, recent: 2}},
+		{"Decay starts", &RetentionPolicy{HalfLife: time.Hour}, 0, &RetentionResult{}, map[*Request]int{oldest: 6, old: 4, recent: 2}},
+		{"Decay within half-life", &RetentionPolicy{HalfLife: time.Hour}, 59 * time.Minute, &RetentionResult{}, map[*Request]int{oldest: 6, old: 4, recent: 2}},
+		{"Decay", &RetentionPolicy{HalfLife: time.Hour}, time.Minute, &RetentionResult{Decayed: 6}, map[*Request]int{oldest: 3, old: 2, recent: 1}},
+		{"Max age", &RetentionPolicy{MaxAge: 36 * time.Hour}, 0, &RetentionResult{Evicted: 1}, map[*Request]int{old: 2, recent: 1}},
+		{"Max requests", &RetentionPolicy{MaxRequests: 1}, 0, &RetentionResult{Evicted: 1}, map[*Request]int{recent: 1}},
+		{"Decay evicts", &RetentionPolicy{HalfLife: time.Hour}, time.Hour, &RetentionResult{Evicted: 1, Decayed: 1}, map[*Request]int{}},
+	}
+	for _, tt := range tests {
+		now = now.Add(tt.elapsed)
+		got, err := statistics.ApplyRetention(tt.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Statistics.ApplyRetention() = %+v, want %+v", tt.name, got, tt.want)
+		}
+		// Check the totals, and that canonical totals, totals by outcome and the top request are kept consistent
+		canonicalTotal := 0
+		for _, request := range []*Request{oldest, old, recent} {
+			got := statistics.GetStatistic(request)
+			if total := tt.wantTotals[request]; (got == nil && total != 0) || (got != nil && got.Total != total) {
+				t.Errorf("%s: Statistics.GetStatistic(%v) = %+v, want total %d", tt.name, request, got, total)
+			}
+			if request != oldest {
+				canonicalTotal += tt.wantTotals[request]
+			}
+		}
+		if got := statistics.CanonicalStatistics().GetStatistic(old); (got == nil && canonicalTotal != 0) || (got != nil && got.Total != canonicalTotal) {
+			t.Errorf("%s: Statistics.CanonicalStatistics().GetStatistic() = %+v, want total %d", tt.name, got, canonicalTotal)
+		}
+		if got := statistics.OutcomeStatistics(OutcomeError).GetStatistic(old); (got == nil) != (tt.wantTotals[old] == 0) || (got != nil && (got.Total != tt.wantTotals[old] || got.Latency.Count != got.Total)) {
+			t.Errorf("%s: Statistics.OutcomeStatistics().GetStatistic() = %+v, want total %d", tt.name, got, tt.wantTotals[old])
+		}
+		if top, want := statistics.GetTopStatistic(), statistics.GetTopStatistics(1); (top == nil) != (len(want) == 0) || (top != nil && top.Total != want[0].Total) {
+			t.Errorf("%s: Statistics.GetTopStatistic() = %+v, want %+v", tt.name, top, want)
+		}
+	}
+	// Check that the hits of the last day are still counted by time bucketed statistics
+	if got := statistics.GetWindowTopStatistics(StatisticsWindowMax, 10); len(got) != 1 || got[0].Total != 2 {
+		t.Errorf("Statistics.GetWindowTopStatistics() = %v, want the hits of the recent request", got)
+	}
+}
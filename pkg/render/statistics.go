@@ -0,0 +1,665 @@
+package render
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// statisticsShards is the number of shards of the statistics store
+	statisticsShards = 32
+	// statisticsMinutes is the number of minutes during which time bucketed statistics are kept
+	statisticsMinutes = 24 * 60
+)
+
+// StatisticsWindowMax is the maximum window of time bucketed statistics
+const StatisticsWindowMax = statisticsMinutes * time.Minute
+
+// RequestStatistic represents the rendering statistics of a request
+// Rank is the 1-based position of the request in a ranking of statistics (see GetTopStatistics), 0 when not ranked
+// Approximate is set when Total is an estimate, that overestimates the exact total by at most MaxError
+// Outcomes breaks Total down by outcome and Latency gives the recorded latencies, when supported (see OutcomeStatisticRecorder)
+// FirstSeen and LastSeen are the times of the first and last records of the request, when tracked
+type RequestStatistic struct {
+	Request     `json:"request"`
+	Total       int                           `json:"total"`
+	Rank        int                           `json:"rank,omitempty"`
+	Approximate bool                          `json:"approximate,omitempty"`
+	MaxError    int                           `json:"max_error,omitempty"`
+	Outcomes    map[Outcome]*OutcomeStatistic `json:"outcomes,omitempty"`
+	Latency     *LatencyStatistic             `json:"latency,omitempty"`
+	FirstSeen   *time.Time                    `json:"first_seen,omitempty"`
+	LastSeen    *time.Time                    `json:"last_seen,omitempty"`
+}
+
+// NewRequestStatistic is the RequestStatistic factory
+func NewRequestStatistic(request *Request, total int) *RequestStatistic {
+	return &RequestStatistic{
+		Request: *request,
+		Total:   total,
+	}
+}
+
+// RanksBefore reports whether the statistic ranks before the other one
+// Statistics are ranked by descending Total, ties are broken by ascending Request order (see Request.Less)
+func (rs *RequestStatistic) RanksBefore(other *RequestStatistic) bool {
+	if rs.Total != other.Total {
+		return rs.Total > other.Total
+	}
+	return rs.Request.Less(&other.Request)
+}
+
+// addOutcome sets the statistic of an outcome, in the breakdown of the total by outcome
+func (rs *RequestStatistic) addOutcome(outcome Outcome, statistic *OutcomeStatistic) {
+	if rs.Outcomes == nil {
+		rs.Outcomes = make(map[Outcome]*OutcomeStatistic)
+	}
+	rs.Outcomes[outcome] = statistic
+}
+
+// statisticHeap is a heap of statistics where the root is the statistic that ranks last
+type statisticHeap []*RequestStatistic
+
+func (h statisticHeap) Len() int            { return len(h) }
+func (h statisticHeap) Less(i, j int) bool  { return h[j].RanksBefore(h[i]) }
+func (h statisticHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *statisticHeap) Push(x interface{}) { *h = append(*h, x.(*RequestStatistic)) }
+func (h *statisticHeap) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// offer keeps the statistic in the heap if it ranks among the k first statistics offered so far
+func (h *statisticHeap) offer(statistic *RequestStatistic, k int) {
+	switch {
+	case h.Len() < k:
+		heap.Push(h, statistic)
+	case statistic.RanksBefore((*h)[0]):
+		(*h)[0] = statistic
+		heap.Fix(h, 0)
+	}
+}
+
+// ranked returns the statistics of the heap sorted by rank, with their Rank set
+func (h statisticHeap) ranked() []*RequestStatistic {
+	statistics := []*RequestStatistic(h)
+	sort.Slice(statistics, func(i, j int) bool {
+		return statistics[i].RanksBefore(statistics[j])
+	})
+	for i, statistic := range statistics {
+		statistic.Rank = i + 1
+	}
+	return statistics
+}
+
+// TimeStatistic represents the rendering statistics of a request during the minute starting at Time
+type TimeStatistic struct {
+	Time  time.Time `json:"time"`
+	Total int       `json:"total"`
+}
+
+// TimeSeries represents the per minute rendering statistics of a request
+type TimeSeries struct {
+	Request `json:"request"`
+	Series  []*TimeStatistic `json:"series"`
+}
+
+// StatisticRecorder represents the interface for statistics recording of requests rendering
+type StatisticRecorder interface {
+	RecordStatistic(request *Request)
+	GetStatistic(request *Request) *RequestStatistic
+	GetTopStatistic() *RequestStatistic
+	GetTopStatistics(k int) []*RequestStatistic
+	ResetStatistics()
+}
+
+// CanonicalStatisticRecorder represents the interface of a StatisticRecorder that also groups requests by their canonical form
+type CanonicalStatisticRecorder interface {
+	CanonicalStatistics() StatisticRecorder
+}
+
+// ApproximateStatisticRecorder represents the interface of a StatisticRecorder that may give approximate statistics
+type ApproximateStatisticRecorder interface {
+	Approximate() bool
+}
+
+// OutcomeStatisticRecorder represents the interface of a StatisticRecorder that also records the outcome and latency of renderings
+// RecordStatistic records a success whose latency is unknown, OutcomeStatistics returns the statistics of the renderings of an outcome only
+type OutcomeStatisticRecorder interface {
+	RecordOutcome(request *Request, outcome Outcome, latency time.Duration)
+	OutcomeStatistics(outcome Outcome) StatisticRecorder
+}
+
+// RangeStatisticRecorder represents the interface of a StatisticRecorder that can iterate over all its statistics
+// RangeStatistics calls f for each recorded statistic, in no particular order, until f returns false
+type RangeStatisticRecorder interface {
+	RangeStatistics(f func(statistic *RequestStatistic) bool)
+}
+
+// ImportStatisticRecorder represents the interface of a StatisticRecorder that can import statistics, such as the ones of an Export
+// ImportStatistics adds the totals of the statistics to the recorded ones, that are reset beforehand when replace is set
+type ImportStatisticRecorder interface {
+	ImportStatistics(statistics []*RequestStatistic, replace bool) error
+}
+
+// WindowedStatisticRecorder represents the interface of a StatisticRecorder that also buckets statistics by minute
+// A window covers the current minute and the previous ones, up to StatisticsWindowMax
+type WindowedStatisticRecorder interface {
+	GetWindowTopStatistics(window time.Duration, k int) []*RequestStatistic
+	GetTimeSeries(request *Request, window time.Duration) *TimeSeries
+}
+
+// minuteTotals represents the totals of the requests recorded during a minute (since Unix epoch)
+type minuteTotals struct {
+	minute int64
+	totals map[Request]int
+}
+
+// statisticsShard represents a lock protected partition of the statistics totals
+// The totals of the last minutes are kept in a ring indexed by minute, allocated on the first record of the shard
+type statisticsShard struct {
+	sync.Mutex
+	totals  map[Request]int
+	details map[Request]requestDetails
+	minutes []minuteTotals
+}
+
+// requestDetails represents what is recorded for a request besides its total: its latencies, and when it was first and last seen
+type requestDetails struct {
+	latency   latencyTotals
+	firstSeen time.Time
+	lastSeen  time.Time
+}
+
+// newRequestDetails returns the details of a record at a time, with its latency (nil if unknown)
+// Times are kept in UTC, without monotonic clock reading, so that they are persisted as is
+func newRequestDetails(latency *time.Duration, seen time.Time) requestDetails {
+	seen = seen.UTC()
+	return requestDetails{
+		latency:   newLatencyTotals(latency),
+		firstSeen: seen,
+		lastSeen:  seen,
+	}
+}
+
+// add adds other details to the details, unknown times are ignored
+func (rd *requestDetails) add(other requestDetails) {
+	rd.latency.add(other.latency)
+	if !other.firstSeen.IsZero() && (rd.firstSeen.IsZero() || other.firstSeen.Before(rd.firstSeen)) {
+		rd.firstSeen = other.firstSeen
+	}
+	if other.lastSeen.After(rd.lastSeen) {
+		rd.lastSeen = other.lastSeen
+	}
+}
+
+// seen returns the first and last seen times of the details, nil if unknown
+func (rd *requestDetails) seen() (firstSeen, lastSeen *time.Time) {
+	if rd.firstSeen.IsZero() {
+		return nil, nil
+	}
+	first, last := rd.firstSeen, rd.lastSeen
+	return &first, &last
+}
+
+// setTo sets the details to a statistic
+func (rd *requestDetails) setTo(statistic *RequestStatistic) {
+	statistic.Latency = rd.latency.statistic()
+	statistic.FirstSeen, statistic.LastSeen = rd.seen()
+}
+
+// outcomeStatistic returns the statistic of an outcome, given its total and details
+func (rd *requestDetails) outcomeStatistic(total int) *OutcomeStatistic {
+	statistic := &OutcomeStatistic{Total: total, Latency: rd.latency.statistic()}
+	statistic.FirstSeen, statistic.LastSeen = rd.seen()
+	return statistic
+}
+
+// timeOf returns a time, or the zero time if it is unknown
+func timeOf(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
+
+// minuteTotals returns the totals of a minute if they are still kept in the ring
+func (ss *statisticsShard) minuteTotals(minute int64) map[Request]int {
+	if ss.minutes == nil {
+		return nil
+	}
+	if slot := &ss.minutes[minute%statisticsMinutes]; slot.minute == minute {
+		return slot.totals
+	}
+	return nil
+}
+
+// recordMinute records hits of a request during a minute in the ring, unless a more recent minute already uses its slot
+func (ss *statisticsShard) recordMinute(key Request, delta int, minute int64) {
+	if ss.minutes == nil {
+		ss.minutes = make([]minuteTotals, statisticsMinutes)
+	}
+	slot := &ss.minutes[minute%statisticsMinutes]
+	switch {
+	case slot.minute > minute:
+		return
+	case slot.minute < minute || slot.totals == nil:
+		slot.minute = minute
+		slot.totals = make(map[Request]int)
+	}
+	slot.totals[key] += delta
+}
+
+// Statistics represents statistics of requests rendering
+// Totals are partitioned in shards (selected by a hash of the request) that are locked independently
+// The top request is maintained on each record, while the shard of the recorded request is locked
+// Ties between requests are broken deterministically (see RequestStatistic.RanksBefore)
+// Requests are recorded as is, and grouped by their canonical form in a nested Statistics (see CanonicalStatistics)
+// Each shard also buckets its totals by minute, for the last StatisticsWindowMax (see WindowedStatisticRecorder)
+// Renderings are also recorded in a nested Statistics per outcome, along with their latencies (see OutcomeStatisticRecorder)
+// The first and last times each request is seen are also tracked
+// The changes of the statistics are notified to their subscriptions (see NotifyingStatisticRecorder)
+// Requests can be evicted and totals can decay by a retention policy (see RetentionStatisticRecorder)
+type Statistics struct {
+	topTotal      int64
+	topMutex      sync.Mutex
+	topRequest    Request
+	shards        [statisticsShards]statisticsShard
+	canonical     *Statistics
+	canonicalKeys bool
+	outcomes      map[Outcome]*Statistics
+	now           func() time.Time
+	persister     *Persister
+	notifier      notifier
+	// retentionMutex serializes the applications of retention policies, decayed is the time totals last decayed
+	retentionMutex sync.Mutex
+	decayed        time.Time
+}
+
+// NewStatistics is the Statistics factory
+func NewStatistics() *Statistics {
+	statistics := newStatistics(false).withOutcomes()
+	statistics.canonical = newStatistics(true).withOutcomes()
+	return statistics
+}
+
+// newStatistics creates an empty Statistics, keyed by canonical requests if canonicalKeys is set
+func newStatistics(canonicalKeys bool) *Statistics {
+	statistics := &Statistics{
+		canonicalKeys: canonicalKeys,
+		now:           time.Now,
+	}
+	for i := range statistics.shards {
+		statistics.shards[i].totals = make(map[Request]int)
+		statistics.shards[i].details = make(map[Request]requestDetails)
+	}
+	return statistics
+}
+
+// withOutcomes creates the nested Statistics of each outcome, with the same keys
+func (s *Statistics) withOutcomes() *Statistics {
+	s.outcomes = make(map[Outcome]*Statistics, len(Outcomes))
+	for _, outcome := range Outcomes {
+		s.outcomes[outcome] = newStatistics(s.canonicalKeys)
+	}
+	return s
+}
+
+// key returns the key under which the statistics of a request are recorded
+func (s *Statistics) key(request *Request) Request {
+	if s.canonicalKeys {
+		return request.Canonical()
+	}
+	return *request
+}
+
+// shard returns the shard that holds the statistics of a key
+func (s *Statistics) shard(key *Request) *statisticsShard {
+	return &s.shards[key.hash()%statisticsShards]
+}
+
+// unixMinute returns the minute (since Unix epoch) of a time
+func unixMinute(t time.Time) int64 {
+	return t.Unix() / 60
+}
+
+// RecordStatistic records rendering statistics, as a success whose latency is unknown
+func (s *Statistics) RecordStatistic(request *Request) {
+	s.record(request, OutcomeSuccess, nil)
+}
+
+// RecordOutcome records rendering statistics, along with the outcome and the latency of the rendering
+func (s *Statistics) RecordOutcome(request *Request, outcome Outcome, latency time.Duration) {
+	s.record(request, outcome, &latency)
+}
+
+// record records a rendering with its outcome and latency (nil if unknown)
+// When the statistics are persisted, the record is also appended to the log of the persister
+func (s *Statistics) record(request *Request, outcome Outcome, latency *time.Duration) {
+	if s.persister != nil {
+		s.persister.mutex.RLock()
+		defer s.persister.mutex.RUnlock()
+	}
+	now := s.now()
+	s.add(request, 1, unixMinute(now), outcome, newRequestDetails(latency, now))
+	if s.persister != nil {
+		s.persister.append(&persistedRecord{Request: request, Delta: 1, Outcome: outcome, Latency: latency, Time: now})
+	}
+}
+
+// merge adds the total of a statistic, along with its details and its breakdown by outcome
+// The hits that are not broken down by outcome are only added to the statistics of all outcomes
+func (s *Statistics) merge(statistic *RequestStatistic) {
+	total := statistic.Total
+	for _, outcome := range Outcomes {
+		if outcomeStatistic := statistic.Outcomes[outcome]; outcomeStatistic != nil {
+			s.add(&statistic.Request, outcomeStatistic.Total, 0, outcome, requestDetails{
+				latency:   latencyTotalsOf(outcomeStatistic.Latency),
+				firstSeen: timeOf(outcomeStatistic.FirstSeen),
+				lastSeen:  timeOf(outcomeStatistic.LastSeen),
+			})
+			total -= outcomeStatistic.Total
+		}
+	}
+	if total != 0 {
+		details := requestDetails{firstSeen: timeOf(statistic.FirstSeen), lastSeen: timeOf(statistic.LastSeen)}
+		if len(statistic.Outcomes) == 0 {
+			details.latency = latencyTotalsOf(statistic.Latency)
+		}
+		s.add(&statistic.Request, total, 0, "", details)
+	}
+}
+
+// add adds delta hits (and their details) to the total of a request, as well as to its total during a minute (unless minute is 0)
+// The hits are also added to the statistics of their outcome, unless it is empty
+func (s *Statistics) add(request *Request, delta int, minute int64, outcome Outcome, details requestDetails) {
+	key := s.key(request)
+	shard := s.shard(&key)
+	shard.Lock()
+	total := shard.totals[key] + delta
+	shard.totals[key] = total
+	if minute != 0 {
+		shard.recordMinute(key, delta, minute)
+	}
+	keyDetails := shard.details[key]
+	keyDetails.add(details)
+	shard.details[key] = keyDetails
+	topChanged := false
+	if int64(total) >= atomic.LoadInt64(&s.topTotal) {
+		s.topMutex.Lock()
+		if int64(total) > s.topTotal || (int64(total) == s.topTotal && key.Less(&s.topRequest)) {
+			topChanged = key != s.topRequest || s.topTotal == 0
+			s.topRequest = key
+			atomic.StoreInt64(&s.topTotal, int64(total))
+		}
+		s.topMutex.Unlock()
+	}
+	// Changes are notified while the shard is locked, so that the changes of a request are notified in order
+	if s.notifier.active() {
+		s.notifier.notify(&StatisticChange{Request: key, Previous: total - delta, Total: total, TopChanged: topChanged})
+	}
+	shard.Unlock()
+	if outcomeStatistics := s.outcomes[outcome]; outcomeStatistics != nil {
+		outcomeStatistics.add(request, delta, minute, "", details)
+	}
+	if s.canonical != nil {
+		s.canonical.add(request, delta, minute, outcome, details)
+	}
+}
+
+// addMinute adds delta hits to the total of a request during a minute only
+// The hits are also added to the statistics of their outcome, unless it is empty
+func (s *Statistics) addMinute(request *Request, delta int, minute int64, outcome Outcome) {
+	key := s.key(request)
+	shard := s.shard(&key)
+	shard.Lock()
+	shard.recordMinute(key, delta, minute)
+	shard.Unlock()
+	if outcomeStatistics := s.outcomes[outcome]; outcomeStatistics != nil {
+		outcomeStatistics.addMinute(request, delta, minute, "")
+	}
+	if s.canonical != nil {
+		s.canonical.addMinute(request, delta, minute, outcome)
+	}
+}
+
+// GetStatistic returns rendering statistics of a request
+func (s *Statistics) GetStatistic(request *Request) *RequestStatistic {
+	key := s.key(request)
+	shard := s.shard(&key)
+	shard.Lock()
+	total := shard.totals[key]
+	shard.Unlock()
+	if total == 0 {
+		return nil
+	}
+	return s.detail(NewRequestStatistic(&key, total))
+}
+
+// detail sets the details of a statistic, and breaks its total down by outcome
+func (s *Statistics) detail(statistic *RequestStatistic) *RequestStatistic {
+	shard := s.shard(&statistic.Request)
+	shard.Lock()
+	details := shard.details[statistic.Request]
+	shard.Unlock()
+	details.setTo(statistic)
+	for outcome, outcomeStatistics := range s.outcomes {
+		shard := outcomeStatistics.shard(&statistic.Request)
+		shard.Lock()
+		total, details := shard.totals[statistic.Request], shard.details[statistic.Request]
+		shard.Unlock()
+		if total != 0 {
+			statistic.addOutcome(outcome, details.outcomeStatistic(total))
+		}
+	}
+	return statistic
+}
+
+// GetTopStatistic returns rendering statistics of the top request
+func (s *Statistics) GetTopStatistic() *RequestStatistic {
+	s.topMutex.Lock()
+	topRequest, topTotal := s.topRequest, s.topTotal
+	s.topMutex.Unlock()
+	if topTotal == 0 {
+		return nil
+	}
+	return s.detail(NewRequestStatistic(&topRequest, int(topTotal)))
+}
+
+// GetTopStatistics returns rendering statistics of the k top requests, ranked (see RequestStatistic.RanksBefore)
+// The shards are scanned once, while keeping the k top statistics in a bounded heap
+func (s *Statistics) GetTopStatistics(k int) []*RequestStatistic {
+	if k < 1 {
+		return []*RequestStatistic{}
+	}
+	top := make(statisticHeap, 0, k)
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.Lock()
+		for request, total := range shard.totals {
+			if top.Len() == k && (total < top[0].Total || (total == top[0].Total && top[0].Request.Less(&request))) {
+				continue
+			}
+			top.offer(NewRequestStatistic(&request, total), k)
+		}
+		shard.Unlock()
+	}
+	statistics := top.ranked()
+	for _, statistic := range statistics {
+		s.detail(statistic)
+	}
+	return statistics
+}
+
+// RangeStatistics calls f for each recorded statistic, in no particular order, until f returns false
+// The statistics of a shard are copied before f is called, so that f never runs while a shard is locked
+// Statistics come with their latencies and seen times, but are not broken down by outcome
+func (s *Statistics) RangeStatistics(f func(statistic *RequestStatistic) bool) {
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.Lock()
+		statistics := make([]*RequestStatistic, 0, len(shard.totals))
+		for request, total := range shard.totals {
+			statistic := NewRequestStatistic(&request, total)
+			details := shard.details[request]
+			details.setTo(statistic)
+			statistics = append(statistics, statistic)
+		}
+		shard.Unlock()
+		for _, statistic := range statistics {
+			if !f(statistic) {
+				return
+			}
+		}
+	}
+}
+
+// windowMinutes returns the range of minutes covered by a window ending now
+func (s *Statistics) windowMinutes(window time.Duration) (from, to int64) {
+	if window > StatisticsWindowMax {
+		window = StatisticsWindowMax
+	}
+	to = unixMinute(s.now())
+	from = to - int64((window+time.Minute-1)/time.Minute) + 1
+	return from, to
+}
+
+// GetWindowTopStatistics returns rendering statistics of the k top requests during the window ending now, ranked (see RequestStatistic.RanksBefore)
+// Their totals are not broken down by outcome, as the outcomes are not bucketed by minute
+func (s *Statistics) GetWindowTopStatistics(window time.Duration, k int) []*RequestStatistic {
+	if k < 1 {
+		return []*RequestStatistic{}
+	}
+	from, to := s.windowMinutes(window)
+	top := make(statisticHeap, 0, k)
+	for i := range s.shards {
+		shard := &s.shards[i]
+		windowTotals := make(map[Request]int)
+		shard.Lock()
+		for minute := from; minute <= to; minute++ {
+			for request, total := range shard.minuteTotals(minute) {
+				windowTotals[request] += total
+			}
+		}
+		shard.Unlock()
+		for request, total := range windowTotals {
+			top.offer(NewRequestStatistic(&request, total), k)
+		}
+	}
+	return top.ranked()
+}
+
+// GetTimeSeries returns per minute rendering statistics of a request during the window ending now, in chronological order
+func (s *Statistics) GetTimeSeries(request *Request, window time.Duration) *TimeSeries {
+	key := s.key(request)
+	from, to := s.windowMinutes(window)
+	timeSeries := &TimeSeries{
+		Request: key,
+		Series:  make([]*TimeStatistic, 0, to-from+1),
+	}
+	shard := s.shard(&key)
+	shard.Lock()
+	defer shard.Unlock()
+	for minute := from; minute <= to; minute++ {
+		timeSeries.Series = append(timeSeries.Series, &TimeStatistic{
+			Time:  time.Unix(minute*60, 0).UTC(),
+			Total: shard.minuteTotals(minute)[key],
+		})
+	}
+	return timeSeries
+}
+
+// CanonicalStatistics returns the rendering statistics grouped by canonical requests
+func (s *Statistics) CanonicalStatistics() StatisticRecorder {
+	if s.canonical == nil {
+		return s
+	}
+	return s.canonical
+}
+
+// OutcomeStatistics returns the rendering statistics of an outcome only
+// The statistics of an outcome do not break their totals down by outcome, and they do not support canonical requests
+func (s *Statistics) OutcomeStatistics(outcome Outcome) StatisticRecorder {
+	if outcomeStatistics := s.outcomes[outcome]; outcomeStatistics != nil {
+		return outcomeStatistics
+	}
+	return s
+}
+
+// Approximate reports that the statistics are exact
+func (s *Statistics) Approximate() bool {
+	return false
+}
+
+// ImportStatistics adds the totals of statistics (and their details) to the recorded ones, that are reset beforehand when replace is set
+// Imported hits are not bucketed by minute, so they are not counted by windowed statistics
+// When the statistics are persisted, the import is also appended to the log of the persister
+func (s *Statistics) ImportStatistics(statistics []*RequestStatistic, replace bool) error {
+	if s.persister != nil {
+		s.persister.mutex.Lock()
+		defer s.persister.mutex.Unlock()
+		now := s.now()
+		if replace {
+			s.persister.append(&persistedRecord{Reset: true, Time: now})
+		}
+		for _, statistic := range statistics {
+			s.persister.append(&persistedRecord{Statistic: statistic, Time: now})
+		}
+	}
+	if replace {
+		s.reset()
+	}
+	for _, statistic := range statistics {
+		s.merge(statistic)
+	}
+	return nil
+}
+
+// Subscribe returns a subscription to the changes of the statistics, buffered up to buffer changes
+func (s *Statistics) Subscribe(buffer int) *Subscription {
+	return s.notifier.subscribe(buffer)
+}
+
+// ResetStatistics resets all statistics currently recorded
+// When the statistics are persisted, the reset is also appended to the log of the persister
+func (s *Statistics) ResetStatistics() {
+	if s.persister != nil {
+		s.persister.mutex.Lock()
+		defer s.persister.mutex.Unlock()
+		s.persister.append(&persistedRecord{Reset: true, Time: s.now()})
+	}
+	s.reset()
+}
+
+// reset resets all statistics currently recorded
+func (s *Statistics) reset() {
+	for i := range s.shards {
+		s.shards[i].Lock()
+	}
+	s.topMutex.Lock()
+	for i := range s.shards {
+		s.shards[i].totals = make(map[Request]int)
+		s.shards[i].details = make(map[Request]requestDetails)
+		s.shards[i].minutes = nil
+	}
+	s.topRequest = Request{}
+	atomic.StoreInt64(&s.topTotal, 0)
+	s.topMutex.Unlock()
+	if s.notifier.active() {
+		s.notifier.notify(&StatisticChange{Reset: true})
+	}
+	for i := range s.shards {
+		s.shards[i].Unlock()
+	}
+	for _, outcomeStatistics := range s.outcomes {
+		outcomeStatistics.reset()
+	}
+	if s.canonical != nil {
+		s.canonical.reset()
+	}
+}
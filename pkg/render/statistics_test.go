@@ -0,0 +1,442 @@
+package render
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// setClock sets the clock of statistics (and of its nested statistics) to a fake one
+func setClock(statistics *Statistics, now *time.Time) {
+	statistics.now = func() time.Time { return *now }
+	for _, outcomeStatistics := range statistics.outcomes {
+		outcomeStatistics.now = statistics.now
+	}
+	if statistics.canonical != nil {
+		setClock(statistics.canonical, now)
+	}
+}
+
+// succeeded returns the breakdown by outcome of a total of successes whose latency is unknown, all seen at a time
+func succeeded(total int, seen *time.Time) map[Outcome]*OutcomeStatistic {
+	return map[Outcome]*OutcomeStatistic{OutcomeSuccess: {Total: total, FirstSeen: seen, LastSeen: seen}}
+}
+
+func TestStatistics(t *testing.T) {
+	// Prepare tests data
+	type fields struct {
+		Limit int
+		Int1  int
+		Int2  int
+		Str1  string
+		Str2  string
+	}
+	tests := []struct {
+		name               string
+		fieldsTodo         fields
+		iterationsTodo     int
+		iterationsWant     int
+		fieldsMostUsedWant fields
+	}{
+		{"Step 1", fields{10, 3, 5, "A", "B"}, 1, 1, fields{10, 3, 5, "A", "B"}},
+		{"Step 2", fields{20, 3, 5, "A", "B"}, 2, 2, fields{20, 3, 5, "A", "B"}},
+		{"Step 3", fields{20, 3, 5, "A", "B"}, 10, 12, fields{20, 3, 5, "A", "B"}},
+		{"Step 4", fields{20, 3, 5, "A", "B"}, 30, 42, fields{20, 3, 5, "A", "B"}},
+		{"Step 5", fields{30, 3, 5, "A", "B"}, 100, 100, fields{30, 3, 5, "A", "B"}},
+	}
+	// Get & reset statistics
+	statistics := NewStatistics()
+	// Run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Create request
+			request := NewRequest(tt.fieldsTodo.Limit, tt.fieldsTodo.Int1, tt.fieldsTodo.Int2, tt.fieldsTodo.Str1, tt.fieldsTodo.Str2)
+			// Records request multiple times
+			for i := 0; i < tt.iterationsTodo; i++ {
+				statistics.RecordStatistic(request)
+			}
+			// Check that total renderings recorded matches the total wanted
+			requestStatistic := statistics.GetStatistic(request)
+			if got := requestStatistic.Total; got != tt.iterationsWant {
+				t.Errorf("StatisticRecorder.RecordStatistic() = %v, want %v", got, tt.iterationsWant)
+			}
+			// Check that the most used request matches the most used request wanted
+			topRequestWant := NewRequest(tt.fieldsMostUsedWant.Limit, tt.fieldsMostUsedWant.Int1, tt.fieldsMostUsedWant.Int2, tt.fieldsMostUsedWant.Str1, tt.fieldsMostUsedWant.Str2)
+			topRequestStatistic := statistics.GetTopStatistic()
+			if got := topRequestStatistic.Request; !reflect.DeepEqual(got, *topRequestWant) {
+				t.Errorf("Renderer.Render() = %v, want %v", got, topRequestWant)
+			}
+		})
+	}
+}
+
+func TestStatistics_CanonicalStatistics(t *testing.T) {
+	// Create statistics
+	statistics := NewStatistics()
+	// Record equivalent requests
+	statistics.RecordStatistic(NewRequest(10, 3, 3, "A", "B"))
+	statistics.RecordStatistic(NewRequest(10, 3, 3, "AB", ""))
+	statistics.RecordStatistic(NewRequest(10, 3, 3, "", "AB"))
+	statistics.RecordStatistic(NewRequest(10, 5, 7, "C", "D"))
+	statistics.RecordStatistic(NewRequest(10, 5, 7, "C", "D"))
+	// Check raw view
+	if got := statistics.GetTopStatistic(); got.Total != 2 || got.Request != *NewRequest(10, 5, 7, "C", "D") {
+		t.Errorf("Statistics.GetTopStatistic() = %v, want %v", got, NewRequestStatistic(NewRequest(10, 5, 7, "C", "D"), 2))
+	}
+	// Check canonical view
+	canonical := statistics.CanonicalStatistics()
+	if got := canonical.GetTopStatistic(); got.Total != 3 || got.Request != *NewRequest(10, 3, 3, "AB", "") {
+		t.Errorf("Statistics.CanonicalStatistics().GetTopStatistic() = %v, want %v", got, NewRequestStatistic(NewRequest(10, 3, 3, "AB", ""), 3))
+	}
+	if got := canonical.GetStatistic(NewRequest(10, 3, 3, "A", "B")); got == nil || got.Total != 3 {
+		t.Errorf("Statistics.CanonicalStatistics().GetStatistic() = %v, want total 3", got)
+	}
+	// Check reset
+	statistics.ResetStatistics()
+	if got := canonical.GetTopStatistic(); got != nil {
+		t.Errorf("Statistics.CanonicalStatistics().GetTopStatistic() = %v, want nil", got)
+	}
+}
+
+func BenchmarkRenderer_GetTopStatistic(b *testing.B) {
+	// Create renderer
+	renderer := NewRenderer()
+	// Create request
+	request := NewRequest(100, 3, 5, "fizz", "buzz")
+	// record statistics
+	for i := 0; i < 1000; i++ {
+		// Create request
+		renderer.Render(context.TODO(), request)
+	}
+	// Reset timer
+	b.ResetTimer()
+	// Run benchmark
+	for i := 0; i < b.N; i++ {
+		// Create request
+		renderer.GetTopStatistic()
+	}
+}
+
+func TestStatistics_GetTopStatistics(t *testing.T) {
+	// Prepare tests data: totals of requests, with ties
+	totals := []struct {
+		request *Request
+		total   int
+	}{
+		{NewRequest(20, 3, 5, "A", "B"), 3},
+		{NewRequest(10, 3, 5, "A", "B"), 3},
+		{NewRequest(10, 3, 5, "A", "C"), 5},
+		{NewRequest(10, 3, 5, "", "C"), 1},
+		{NewRequest(10, 2, 5, "A", "C"), 3},
+	}
+	now := time.Date(2019, 10, 1, 12, 0, 30, 0, time.UTC)
+	want := []*RequestStatistic{
+		{Request: *NewRequest(10, 3, 5, "A", "C"), Total: 5, Rank: 1, Outcomes: succeeded(5, &now), FirstSeen: &now, LastSeen: &now},
+		{Request: *NewRequest(10, 2, 5, "A", "C"), Total: 3, Rank: 2, Outcomes: succeeded(3, &now), FirstSeen: &now, LastSeen: &now},
+		{Request: *NewRequest(10, 3, 5, "A", "B"), Total: 3, Rank: 3, Outcomes: succeeded(3, &now), FirstSeen: &now, LastSeen: &now},
+		{Request: *NewRequest(20, 3, 5, "A", "B"), Total: 3, Rank: 4, Outcomes: succeeded(3, &now), FirstSeen: &now, LastSeen: &now},
+		{Request: *NewRequest(10, 3, 5, "", "C"), Total: 1, Rank: 5, Outcomes: succeeded(1, &now), FirstSeen: &now, LastSeen: &now},
+	}
+	tests := []struct {
+		name    string
+		k       int
+		reverse bool
+		want    []*RequestStatistic
+	}{
+		{"k < 1", 0, false, []*RequestStatistic{}},
+		{"k == 1", 1, false, want[:1]},
+		{"k == 3", 3, false, want[:3]},
+		{"k == 3 reverse order", 3, true, want[:3]},
+		{"k == 5", 5, false, want},
+		{"k > 5 reverse order", 10, true, want},
+	}
+	// Run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Record statistics in the order of the test
+			statistics := NewStatistics()
+			setClock(statistics, &now)
+			for i := range totals {
+				if tt.reverse {
+					i = len(totals) - 1 - i
+				}
+				for j := 0; j < totals[i].total; j++ {
+					statistics.RecordStatistic(totals[i].request)
+				}
+			}
+			// Check that ranking is independent of the recording order
+			if got := statistics.GetTopStatistics(tt.k); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Statistics.GetTopStatistics() = %v, want %v", got, tt.want)
+			}
+			if got := statistics.GetTopStatistic(); got.Request != want[0].Request || got.Total != want[0].Total {
+				t.Errorf("Statistics.GetTopStatistic() = %v, want %v", got, want[0])
+			}
+		})
+	}
+}
+
+func TestStatistics_GetTopStatisticTie(t *testing.T) {
+	// Record tied requests in both orders
+	first, second := NewRequest(10, 3, 5, "A", "B"), NewRequest(10, 3, 5, "A", "C")
+	now := time.Date(2019, 10, 1, 12, 0, 30, 0, time.UTC)
+	statistics, statisticsReverse := NewStatistics(), NewStatistics()
+	setClock(statistics, &now)
+	setClock(statisticsReverse, &now)
+	statistics.RecordStatistic(first)
+	statistics.RecordStatistic(second)
+	statisticsReverse.RecordStatistic(second)
+	statisticsReverse.RecordStatistic(first)
+	// Check that the top request does not depend on the recording order
+	if got, gotReverse := statistics.GetTopStatistic(), statisticsReverse.GetTopStatistic(); !reflect.DeepEqual(got, gotReverse) || got.Request != *first {
+		t.Errorf("Statistics.GetTopStatistic() = %v and %v, want %v", got, gotReverse, first)
+	}
+}
+
+func TestStatistics_RecordOutcome(t *testing.T) {
+	// Record renderings of equivalent requests with outcomes and latencies, a minute apart
+	now := time.Date(2019, 10, 1, 12, 0, 30, 0, time.UTC)
+	start := now
+	statistics := NewStatistics()
+	setClock(statistics, &now)
+	request, equivalentRequest := NewRequest(5, 3, 3, "A", "B"), NewRequest(5, 3, 30, "AB", "C")
+	statistics.RecordOutcome(request, OutcomeSuccess, 2*time.Millisecond)
+	statistics.RecordOutcome(request, OutcomeSuccess, 4*time.Millisecond)
+	statistics.RecordOutcome(request, OutcomeInvalid, 9*time.Millisecond)
+	now = now.Add(time.Minute)
+	statistics.RecordStatistic(request)
+	statistics.RecordOutcome(equivalentRequest, OutcomeInvalid, 3*time.Millisecond)
+	end := now
+	for i := 0; i < 3; i++ {
+		statistics.RecordOutcome(NewRequest(0, 3, 5, "A", "B"), OutcomeInvalid, time.Millisecond)
+	}
+	// Check the breakdown by outcome
+	want := &RequestStatistic{
+		Request: *request,
+		Total:   4,
+		Outcomes: map[Outcome]*OutcomeStatistic{
+			OutcomeSuccess: {Total: 3, Latency: &LatencyStatistic{Count: 2, Mean: 3, Max: 4}, FirstSeen: &start, LastSeen: &end},
+			OutcomeInvalid: {Total: 1, Latency: &LatencyStatistic{Count: 1, Mean: 9, Max: 9}, FirstSeen: &start, LastSeen: &start},
+		},
+		Latency:   &LatencyStatistic{Count: 3, Mean: 5, Max: 9},
+		FirstSeen: &start,
+		LastSeen:  &end,
+	}
+	if got := statistics.GetStatistic(request); !reflect.DeepEqual(got, want) {
+		t.Errorf("Statistics.GetStatistic() = %+v, want %+v", got, want)
+	}
+	// Check the statistics of an outcome
+	success := statistics.OutcomeStatistics(OutcomeSuccess)
+	want = &RequestStatistic{Request: *request, Total: 3, Latency: &LatencyStatistic{Count: 2, Mean: 3, Max: 4}, FirstSeen: &start, LastSeen: &end}
+	if got := success.GetTopStatistic(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Statistics.OutcomeStatistics().GetTopStatistic() = %+v, want %+v", got, want)
+	}
+	if got := statistics.GetTopStatistic(); got.Request != *request {
+		t.Errorf("Statistics.GetTopStatistic() = %+v, want %+v", got.Request, request)
+	}
+	// Check the statistics of an outcome grouped by canonical requests
+	canonical := statistics.CanonicalStatistics().(OutcomeStatisticRecorder).OutcomeStatistics(OutcomeInvalid)
+	want = &RequestStatistic{Request: request.Canonical(), Total: 2, Latency: &LatencyStatistic{Count: 2, Mean: 6, Max: 9}, FirstSeen: &start, LastSeen: &end}
+	if got := canonical.GetStatistic(equivalentRequest); !reflect.DeepEqual(got, want) {
+		t.Errorf("Statistics.CanonicalStatistics().OutcomeStatistics().GetStatistic() = %+v, want %+v", got, want)
+	}
+	// Check that reset resets the statistics of the outcomes
+	statistics.ResetStatistics()
+	if got := success.GetTopStatistic(); got != nil {
+		t.Errorf("Statistics.OutcomeStatistics().GetTopStatistic() = %+v, want nil", got)
+	}
+}
+
+func TestStatistics_Windowed(t *testing.T) {
+	// Create statistics with fake clock
+	now := time.Date(2019, 10, 1, 12, 0, 30, 0, time.UTC)
+	statistics := NewStatistics()
+	setClock(statistics, &now)
+	old, recent := NewRequest(20, 3, 5, "A", "B"), NewRequest(20, 3, 3, "A", "B")
+	// Record old request a long time ago, and recent request during the last minutes
+	for i := 0; i < 10; i++ {
+		statistics.RecordStatistic(old)
+	}
+	now = now.Add(2 * time.Hour)
+	for i := 0; i < 3; i++ {
+		statistics.RecordStatistic(recent)
+		now = now.Add(time.Minute)
+	}
+	// Check top statistics of windows
+	tests := []struct {
+		name   string
+		window time.Duration
+		want   []*RequestStatistic
+	}{
+		{"Window 1m", time.Minute, []*RequestStatistic{}},
+		{"Window 2m", 2 * time.Minute, []*RequestStatistic{{Request: *recent, Total: 1, Rank: 1}}},
+		{"Window 5m", 5 * time.Minute, []*RequestStatistic{{Request: *recent, Total: 3, Rank: 1}}},
+		{"Window 24h", 24 * time.Hour, []*RequestStatistic{{Request: *old, Total: 10, Rank: 1}, {Request: *recent, Total: 3, Rank: 2}}},
+		{"Window 48h", 48 * time.Hour, []*RequestStatistic{{Request: *old, Total: 10, Rank: 1}, {Request: *recent, Total: 3, Rank: 2}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := statistics.GetWindowTopStatistics(tt.window, 10); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Statistics.GetWindowTopStatistics() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	// Check canonical statistics are also bucketed
+	canonical := statistics.CanonicalStatistics().(WindowedStatisticRecorder)
+	if got := canonical.GetWindowTopStatistics(5*time.Minute, 1); len(got) != 1 || got[0].Request != recent.Canonical() {
+		t.Errorf("Statistics.CanonicalStatistics().GetWindowTopStatistics() = %v, want %v", got, recent.Canonical())
+	}
+	// Check time series
+	timeSeries := statistics.GetTimeSeries(recent, 5*time.Minute)
+	totals := make([]int, 0)
+	for _, timeStatistic := range timeSeries.Series {
+		totals = append(totals, timeStatistic.Total)
+	}
+	if want := []int{0, 1, 1, 1, 0}; !reflect.DeepEqual(totals, want) {
+		t.Errorf("Statistics.GetTimeSeries() totals = %v, want %v", totals, want)
+	}
+	if got, want := timeSeries.Series[4].Time, time.Date(2019, 10, 1, 14, 3, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("Statistics.GetTimeSeries() last time = %v, want %v", got, want)
+	}
+	// Check that old minutes are evicted from the ring, while totals are kept
+	now = now.Add(23 * time.Hour)
+	if got := statistics.GetWindowTopStatistics(24*time.Hour, 10); !reflect.DeepEqual(got, []*RequestStatistic{{Request: *recent, Total: 3, Rank: 1}}) {
+		t.Errorf("Statistics.GetWindowTopStatistics() = %v, want only recent request", got)
+	}
+	now = now.Add(24 * time.Hour)
+	statistics.RecordStatistic(recent)
+	if got := statistics.GetWindowTopStatistics(24*time.Hour, 10); !reflect.DeepEqual(got, []*RequestStatistic{{Request: *recent, Total: 1, Rank: 1}}) {
+		t.Errorf("Statistics.GetWindowTopStatistics() = %v, want recent request once", got)
+	}
+	if got := statistics.GetTopStatistic(); got.Request != *old || got.Total != 10 {
+		t.Errorf("Statistics.GetTopStatistic() = %v, want %v", got, old)
+	}
+}
+
+func TestStatistics_MinutesAllocation(t *testing.T) {
+	// allocated returns the number of shards whose ring of minutes is allocated
+	allocated := func(statistics *Statistics) int {
+		count := 0
+		for i := range statistics.shards {
+			if statistics.shards[i].minutes != nil {
+				count++
+			}
+		}
+		return count
+	}
+	// Check that the rings of minutes are only allocated by the shards that record hits
+	statistics := NewStatistics()
+	if got := allocated(statistics) + allocated(statistics.canonical) + allocated(statistics.outcomes[OutcomeSuccess]); got != 0 {
+		t.Errorf("allocated rings = %d before any record, want 0", got)
+	}
+	statistics.RecordStatistic(NewRequest(20, 3, 5, "A", "B"))
+	if got := allocated(statistics) + allocated(statistics.canonical) + allocated(statistics.outcomes[OutcomeSuccess]) + allocated(statistics.outcomes[OutcomeError]); got != 3 {
+		t.Errorf("allocated rings = %d after a record, want 3", got)
+	}
+	statistics.ResetStatistics()
+	if got := allocated(statistics); got != 0 {
+		t.Errorf("allocated rings = %d after a reset, want 0", got)
+	}
+}
+
+func TestStatistics_RecordStatisticConcurrent(t *testing.T) {
+	// Prepare tests data
+	const calls, requests = 10000, 7
+	statistics := NewStatistics()
+	// Record statistics concurrently, request i is recorded calls/requests times (plus one for the first ones)
+	var wg sync.WaitGroup
+	wg.Add(calls)
+	for i := 0; i < calls; i++ {
+		go func(i int) {
+			defer wg.Done()
+			statistics.RecordStatistic(NewRequest(100, 3, 5, "A", fmt.Sprintf("B%d", i%requests)))
+		}(i)
+	}
+	// Read statistics concurrently
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			statistics.GetTopStatistic()
+			statistics.GetStatistic(NewRequest(100, 3, 5, "A", "B0"))
+		}
+	}()
+	wg.Wait()
+	<-done
+	// Check that totals are exact
+	sum := 0
+	for i := 0; i < requests; i++ {
+		want := calls / requests
+		if i < calls%requests {
+			want++
+		}
+		got := statistics.GetStatistic(NewRequest(100, 3, 5, "A", fmt.Sprintf("B%d", i)))
+		if got == nil || got.Total != want {
+			t.Errorf("Statistics.GetStatistic() = %v, want total %v", got, want)
+			continue
+		}
+		sum += got.Total
+	}
+	if sum != calls {
+		t.Errorf("Statistics totals sum = %v, want %v", sum, calls)
+	}
+	// Check that top statistic is consistent with totals
+	top := statistics.GetTopStatistic()
+	if got := statistics.GetStatistic(&top.Request); got == nil || got.Total != top.Total || top.Total != calls/requests+1 {
+		t.Errorf("Statistics.GetTopStatistic() = %v, want total %v", top, calls/requests+1)
+	}
+}
+
+func TestStatistics_ResetStatisticsConcurrent(t *testing.T) {
+	// Create statistics
+	statistics := NewStatistics()
+	request := NewRequest(100, 3, 5, "A", "B")
+	// Record and reset statistics concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			statistics.RecordStatistic(request)
+		}()
+		go func() {
+			defer wg.Done()
+			statistics.ResetStatistics()
+		}()
+	}
+	wg.Wait()
+	// Check that top statistic is consistent with totals
+	top, got := statistics.GetTopStatistic(), statistics.GetStatistic(request)
+	if !reflect.DeepEqual(top, got) {
+		t.Errorf("Statistics.GetTopStatistic() = %v, want %v", top, got)
+	}
+}
+
+func BenchmarkStatistics_GetTopStatistics(b *testing.B) {
+	// Create statistics
+	statistics := NewStatistics()
+	for i := 0; i < 10000; i++ {
+		statistics.RecordStatistic(NewRequest(100+i%1000, 3, 5, "fizz", "buzz"))
+	}
+	// Reset timer
+	b.ResetTimer()
+	// Run benchmark
+	for i := 0; i < b.N; i++ {
+		statistics.GetTopStatistics(10)
+	}
+}
+
+func BenchmarkStatistics_RecordStatisticParallel(b *testing.B) {
+	// Create statistics
+	statistics := NewStatistics()
+	// Run benchmark
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			statistics.RecordStatistic(NewRequest(100, 3, 5, "fizz", fmt.Sprintf("buzz%d", i%100)))
+			i++
+		}
+	})
+}
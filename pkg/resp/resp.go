@@ -0,0 +1,286 @@
+// Package resp implements a minimal client of the Redis serialization protocol (RESP)
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Error represents an error reply of the server
+type Error string
+
+// Error returns the message of the error reply
+func (e Error) Error() string {
+	return string(e)
+}
+
+// ErrUnexpectedReply is returned when a reply does not have the expected type
+var ErrUnexpectedReply = errors.New("resp: unexpected reply")
+
+// Client represents a client of a RESP server, with a pool of connections
+// Replies are decoded as:
+// - string for simple strings
+// - Error for errors
+// - int64 for integers
+// - []byte for bulk strings, nil for null bulk strings
+// - []interface{} for arrays, nil for null arrays
+type Client struct {
+	address string
+	timeout time.Duration
+	pool    chan *conn
+}
+
+// conn represents a connection to the server
+type conn struct {
+	net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+// NewClient is the Client factory, connections are opened on demand and at most poolSize idle connections are kept
+func NewClient(address string, timeout time.Duration, poolSize int) *Client {
+	return &Client{
+		address: address,
+		timeout: timeout,
+		pool:    make(chan *conn, poolSize),
+	}
+}
+
+// Do sends a command to the server and returns its reply
+func (c *Client) Do(args ...string) (interface{}, error) {
+	replies, err := c.Pipeline([][]string{args})
+	if err != nil {
+		return nil, err
+	}
+	if err, ok := replies[0].(Error); ok {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+// Pipeline sends commands to the server at once and returns their replies, in order
+// Error replies are returned in the replies, the error is only set when the connection failed
+func (c *Client) Pipeline(commands [][]string) ([]interface{}, error) {
+	cn, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	if err := cn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		cn.Close()
+		return nil, err
+	}
+	for _, args := range commands {
+		writeCommand(cn.writer, args)
+	}
+	if err := cn.writer.Flush(); err != nil {
+		cn.Close()
+		return nil, err
+	}
+	replies := make([]interface{}, len(commands))
+	for i := range commands {
+		if replies[i], err = readReply(cn.reader); err != nil {
+			cn.Close()
+			return nil, err
+		}
+	}
+	c.put(cn)
+	return replies, nil
+}
+
+// Close closes the idle connections of the pool
+func (c *Client) Close() error {
+	for {
+		select {
+		case cn := <-c.pool:
+			cn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// get returns an idle connection of the pool, or a new one
+func (c *Client) get() (*conn, error) {
+	select {
+	case cn := <-c.pool:
+		return cn, nil
+	default:
+	}
+	netConn, err := net.DialTimeout("tcp", c.address, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{
+		Conn:   netConn,
+		reader: bufio.NewReader(netConn),
+		writer: bufio.NewWriter(netConn),
+	}, nil
+}
+
+// put puts back a connection in the pool, or closes it if the pool is full
+func (c *Client) put(cn *conn) {
+	select {
+	case c.pool <- cn:
+	default:
+		cn.Close()
+	}
+}
+
+// writeCommand writes a command as an array of bulk strings
+func writeCommand(w *bufio.Writer, args []string) {
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+}
+
+// WriteReply writes a reply (see Client for the mapping of types)
+func WriteReply(w *bufio.Writer, reply interface{}) {
+	switch reply := reply.(type) {
+	case string:
+		fmt.Fprintf(w, "+%s\r\n", reply)
+	case Error:
+		fmt.Fprintf(w, "-%s\r\n", reply)
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", reply)
+	case []byte:
+		if reply == nil {
+			w.WriteString("$-1\r\n")
+			return
+		}
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(reply), reply)
+	case []interface{}:
+		if reply == nil {
+			w.WriteString("*-1\r\n")
+			return
+		}
+		fmt.Fprintf(w, "*%d\r\n", len(reply))
+		for _, item := range reply {
+			WriteReply(w, item)
+		}
+	default:
+		fmt.Fprintf(w, "-ERR unsupported reply type %T\r\n", reply)
+	}
+}
+
+// readLine reads a line terminated by CRLF, without its terminator
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("resp: invalid line %q", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+// readReply reads a reply (see Client for the mapping of types)
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("resp: empty line")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return Error(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < 0 {
+			return []byte(nil), err
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return data[:length], nil
+	case '*':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < 0 {
+			return []interface{}(nil), err
+		}
+		items := make([]interface{}, length)
+		for i := range items {
+			if items[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("resp: invalid reply type %q", line[0])
+}
+
+// ReadCommand reads a command sent as an array of bulk strings
+func ReadCommand(r *bufio.Reader) ([]string, error) {
+	reply, err := readReply(r)
+	if err != nil {
+		return nil, err
+	}
+	items, ok := reply.([]interface{})
+	if !ok {
+		return nil, ErrUnexpectedReply
+	}
+	args := make([]string, len(items))
+	for i, item := range items {
+		arg, ok := item.([]byte)
+		if !ok {
+			return nil, ErrUnexpectedReply
+		}
+		args[i] = string(arg)
+	}
+	return args, nil
+}
+
+// Int64 converts an integer reply
+func Int64(reply interface{}) (int64, error) {
+	switch reply := reply.(type) {
+	case int64:
+		return reply, nil
+	case []byte:
+		return strconv.ParseInt(string(reply), 10, 64)
+	}
+	return 0, ErrUnexpectedReply
+}
+
+// Float64 converts a bulk string reply holding a number, a null bulk string is converted to 0
+func Float64(reply interface{}) (float64, error) {
+	switch reply := reply.(type) {
+	case []byte:
+		if reply == nil {
+			return 0, nil
+		}
+		return strconv.ParseFloat(string(reply), 64)
+	case int64:
+		return float64(reply), nil
+	}
+	return 0, ErrUnexpectedReply
+}
+
+// Strings converts an array reply of bulk strings
+func Strings(reply interface{}) ([]string, error) {
+	items, ok := reply.([]interface{})
+	if !ok {
+		return nil, ErrUnexpectedReply
+	}
+	values := make([]string, len(items))
+	for i, item := range items {
+		value, ok := item.([]byte)
+		if !ok {
+			return nil, ErrUnexpectedReply
+		}
+		values[i] = string(value)
+	}
+	return values, nil
+}
@@ -0,0 +1,94 @@
+package resp_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jpraynaud/fizzbuzz-server/pkg/resp"
+	"github.com/jpraynaud/fizzbuzz-server/pkg/resp/resptest"
+)
+
+func TestClient_Do(t *testing.T) {
+	// Start fake server
+	server := resptest.NewServer()
+	defer server.Close()
+	client := resp.NewClient(server.Addr, time.Second, 2)
+	defer client.Close()
+	// Prepare tests data
+	tests := []struct {
+		name    string
+		args    []string
+		want    interface{}
+		wantErr bool
+	}{
+		{"Simple string", []string{"PING"}, "PONG", false},
+		{"Bulk string", []string{"ZINCRBY", "key", "2", "a\r\nb"}, []byte("2"), false},
+		{"Bulk string", []string{"ZINCRBY", "key", "1", "c"}, []byte("1"), false},
+		{"Null bulk string", []string{"ZSCORE", "key", "d"}, []byte(nil), false},
+		{"Integer", []string{"ZCARD", "key"}, int64(2), false},
+		{"Array", []string{"ZREVRANGE", "key", "0", "-1", "WITHSCORES"}, []interface{}{[]byte("a\r\nb"), []byte("2"), []byte("c"), []byte("1")}, false},
+		{"Empty array", []string{"ZRANGE", "other", "0", "-1"}, []interface{}{}, false},
+		{"Error", []string{"UNKNOWN"}, nil, true},
+	}
+	// Run tests
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := client.Do(tt.args...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Client.Do() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if _, ok := err.(resp.Error); tt.wantErr && !ok {
+				t.Errorf("Client.Do() error = %T, want resp.Error", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Client.Do() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClient_Pipeline(t *testing.T) {
+	// Start fake server
+	server := resptest.NewServer()
+	defer server.Close()
+	client := resp.NewClient(server.Addr, time.Second, 2)
+	defer client.Close()
+	// Send commands at once, with an error in the middle
+	replies, err := client.Pipeline([][]string{{"ZINCRBY", "key", "1", "a"}, {"UNKNOWN"}, {"ZINCRBY", "key", "1", "a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != 3 || !reflect.DeepEqual(replies[2], []byte("2")) {
+		t.Errorf("Client.Pipeline() = %#v, want 3 replies ending with score 2", replies)
+	}
+	if _, ok := replies[1].(resp.Error); !ok {
+		t.Errorf("Client.Pipeline() reply = %#v, want resp.Error", replies[1])
+	}
+}
+
+func TestClient_ConnectionFailure(t *testing.T) {
+	// Start and stop fake server
+	server := resptest.NewServer()
+	server.Close()
+	client := resp.NewClient(server.Addr, time.Second, 2)
+	// Check that connection fails
+	if _, err := client.Do("PING"); err == nil {
+		t.Errorf("Client.Do() error = %v, want connection error", err)
+	}
+}
+
+func TestConversions(t *testing.T) {
+	if got, err := resp.Int64([]byte("42")); err != nil || got != 42 {
+		t.Errorf("Int64() = %v, %v, want 42", got, err)
+	}
+	if got, err := resp.Float64([]byte(nil)); err != nil || got != 0 {
+		t.Errorf("Float64() = %v, %v, want 0", got, err)
+	}
+	if got, err := resp.Strings([]interface{}{[]byte("a"), []byte("b")}); err != nil || !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("Strings() = %v, %v, want [a b]", got, err)
+	}
+	if _, err := resp.Strings("a"); err != resp.ErrUnexpectedReply {
+		t.Errorf("Strings() error = %v, want %v", err, resp.ErrUnexpectedReply)
+	}
+}
@@ -0,0 +1,243 @@
+// Package resptest provides a fake in-memory RESP server for testing, that implements a subset of the Redis commands
+package resptest
+
+import (
+	"bufio"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jpraynaud/fizzbuzz-server/pkg/resp"
+)
+
+// Server represents a fake RESP server listening on a local address
+// Supported commands are PING, DEL, EXPIREAT, ZINCRBY, ZSCORE, ZCARD, ZREM, ZRANGE, ZREVRANGE and ZRANGEBYSCORE
+// Keys never expire: EXPIREAT only checks that the key exists
+type Server struct {
+	Addr     string
+	listener net.Listener
+	mutex    sync.Mutex
+	sets     map[string]map[string]float64
+	conns    map[net.Conn]struct{}
+	wg       sync.WaitGroup
+}
+
+// NewServer starts and returns a new Server, the caller should call Close when finished
+func NewServer() *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("resptest: failed to listen on a port: " + err.Error())
+	}
+	s := &Server{
+		Addr:     listener.Addr().String(),
+		listener: listener,
+		sets:     make(map[string]map[string]float64),
+		conns:    make(map[net.Conn]struct{}),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// Close shuts down the server and closes its connections
+func (s *Server) Close() {
+	s.listener.Close()
+	s.mutex.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+	s.wg.Wait()
+}
+
+// serve accepts connections until the listener is closed
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		s.conns[conn] = struct{}{}
+		s.mutex.Unlock()
+		s.wg.Add(1)
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn replies to the commands of a connection until it is closed
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.mutex.Unlock()
+		conn.Close()
+		s.wg.Done()
+	}()
+	reader, writer := bufio.NewReader(conn), bufio.NewWriter(conn)
+	for {
+		args, err := resp.ReadCommand(reader)
+		if err != nil {
+			return
+		}
+		resp.WriteReply(writer, s.execute(args))
+		if reader.Buffered() == 0 {
+			if err := writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// member represents a member of a sorted set with its score
+type member struct {
+	name  string
+	score float64
+}
+
+// sorted returns the members of a sorted set, ordered by score then name
+func (s *Server) sorted(key string) []member {
+	members := make([]member, 0, len(s.sets[key]))
+	for name, score := range s.sets[key] {
+		members = append(members, member{name, score})
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].score != members[j].score {
+			return members[i].score < members[j].score
+		}
+		return members[i].name < members[j].name
+	})
+	return members
+}
+
+// formatScore formats a score as a bulk string
+func formatScore(score float64) []byte {
+	return []byte(strconv.FormatFloat(score, 'f', -1, 64))
+}
+
+// rangeReply returns the reply of a range of members
+func rangeReply(members []member, withScores bool) []interface{} {
+	reply := make([]interface{}, 0)
+	for _, m := range members {
+		reply = append(reply, []byte(m.name))
+		if withScores {
+			reply = append(reply, formatScore(m.score))
+		}
+	}
+	return reply
+}
+
+// slice returns the members between start and stop indexes (inclusive, negative indexes count from the end)
+func slice(members []member, start, stop int) []member {
+	if start < 0 {
+		start += len(members)
+	}
+	if stop < 0 {
+		stop += len(members)
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= len(members) {
+		stop = len(members) - 1
+	}
+	if start > stop {
+		return nil
+	}
+	return members[start : stop+1]
+}
+
+// execute executes a command and returns its reply
+func (s *Server) execute(args []string) interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(args) == 0 {
+		return resp.Error("ERR empty command")
+	}
+	command, arity := strings.ToUpper(args[0]), map[string]int{
+		"PING": 1, "DEL": 2, "EXPIREAT": 3, "ZINCRBY": 4, "ZSCORE": 3, "ZCARD": 2, "ZREM": 3, "ZRANGE": 4, "ZREVRANGE": 4, "ZRANGEBYSCORE": 4,
+	}
+	if minimum, ok := arity[command]; !ok {
+		return resp.Error("ERR unknown command '" + args[0] + "'")
+	} else if len(args) < minimum {
+		return resp.Error("ERR wrong number of arguments for '" + args[0] + "' command")
+	}
+	switch command {
+	case "PING":
+		return "PONG"
+	case "DEL":
+		deleted := int64(0)
+		for _, key := range args[1:] {
+			if _, ok := s.sets[key]; ok {
+				delete(s.sets, key)
+				deleted++
+			}
+		}
+		return deleted
+	case "EXPIREAT":
+		if _, err := strconv.ParseInt(args[2], 10, 64); err != nil {
+			return resp.Error("ERR value is not an integer or out of range")
+		}
+		if _, ok := s.sets[args[1]]; ok {
+			return int64(1)
+		}
+		return int64(0)
+	case "ZINCRBY":
+		increment, err := strconv.ParseFloat(args[2], 64)
+		if err != nil {
+			return resp.Error("ERR value is not a valid float")
+		}
+		if s.sets[args[1]] == nil {
+			s.sets[args[1]] = make(map[string]float64)
+		}
+		s.sets[args[1]][args[3]] += increment
+		return formatScore(s.sets[args[1]][args[3]])
+	case "ZSCORE":
+		score, ok := s.sets[args[1]][args[2]]
+		if !ok {
+			return []byte(nil)
+		}
+		return formatScore(score)
+	case "ZCARD":
+		return int64(len(s.sets[args[1]]))
+	case "ZREM":
+		removed := int64(0)
+		for _, name := range args[2:] {
+			if _, ok := s.sets[args[1]][name]; ok {
+				delete(s.sets[args[1]], name)
+				removed++
+			}
+		}
+		return removed
+	case "ZRANGE", "ZREVRANGE":
+		start, err1 := strconv.Atoi(args[2])
+		stop, err2 := strconv.Atoi(args[3])
+		if err1 != nil || err2 != nil {
+			return resp.Error("ERR value is not an integer or out of range")
+		}
+		members := s.sorted(args[1])
+		if command == "ZREVRANGE" {
+			for i, j := 0, len(members)-1; i < j; i, j = i+1, j-1 {
+				members[i], members[j] = members[j], members[i]
+			}
+		}
+		return rangeReply(slice(members, start, stop), len(args) > 4 && strings.ToUpper(args[4]) == "WITHSCORES")
+	case "ZRANGEBYSCORE":
+		minScore, err1 := strconv.ParseFloat(args[2], 64)
+		maxScore, err2 := strconv.ParseFloat(args[3], 64)
+		if err1 != nil || err2 != nil {
+			return resp.Error("ERR min or max is not a float")
+		}
+		members := make([]member, 0)
+		for _, m := range s.sorted(args[1]) {
+			if m.score >= minScore && m.score <= maxScore {
+				members = append(members, m)
+			}
+		}
+		return rangeReply(members, len(args) > 4 && strings.ToUpper(args[4]) == "WITHSCORES")
+	}
+	return resp.Error("ERR unknown command '" + args[0] + "'")
+}
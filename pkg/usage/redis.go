@@ -0,0 +1,114 @@
+package usage
+
+import (
+	"strconv"
+
+	"github.com/jpraynaud/fizzbuzz-server/pkg/resp"
+)
+
+// RedisStore represents a Store that keeps the usage of the clients in a Redis server (or any server that speaks RESP),
+// so that several servers that share the same Redis server (and key prefix) meter the same global usage
+// The requests and the items of a period are the scores of the clients in two sorted sets, that expire with the retention of the period
+type RedisStore struct {
+	client *resp.Client
+	prefix string
+}
+
+// NewRedisStore is the RedisStore factory, its keys are prefixed by prefix
+func NewRedisStore(client *resp.Client, prefix string) *RedisStore {
+	return &RedisStore{
+		client: client,
+		prefix: prefix + "usage:",
+	}
+}
+
+// keys returns the keys of the sorted sets of the requests and of the items of a period
+func (rs *RedisStore) keys(period string) (string, string) {
+	return rs.prefix + period + ":requests", rs.prefix + period + ":items"
+}
+
+// replies returns the replies of a pipeline of commands, or the first error among them
+func (rs *RedisStore) replies(commands [][]string) ([]interface{}, error) {
+	replies, err := rs.client.Pipeline(commands)
+	if err != nil {
+		return nil, err
+	}
+	for _, reply := range replies {
+		if replyErr, ok := reply.(resp.Error); ok {
+			return nil, replyErr
+		}
+	}
+	return replies, nil
+}
+
+// usage decodes the usage of the scores of a client, a missing score being 0
+func usage(requests, items interface{}) (Usage, error) {
+	requestsTotal, err := resp.Float64(requests)
+	if err != nil {
+		return Usage{}, err
+	}
+	itemsTotal, err := resp.Float64(items)
+	if err != nil {
+		return Usage{}, err
+	}
+	return Usage{Requests: int64(requestsTotal), Items: int64(itemsTotal)}, nil
+}
+
+// Add adds a usage to the usage of a client during periods, and returns their usage afterwards
+func (rs *RedisStore) Add(client string, periods []string, added Usage) ([]Usage, error) {
+	commands := make([][]string, 0, 4*len(periods))
+	for _, period := range periods {
+		expiry, err := periodExpiry(period)
+		if err != nil {
+			return nil, err
+		}
+		at := strconv.FormatInt(expiry.Unix(), 10)
+		requestsKey, itemsKey := rs.keys(period)
+		commands = append(commands,
+			[]string{"ZINCRBY", requestsKey, strconv.FormatInt(added.Requests, 10), client},
+			[]string{"ZINCRBY", itemsKey, strconv.FormatInt(added.Items, 10), client},
+			[]string{"EXPIREAT", requestsKey, at},
+			[]string{"EXPIREAT", itemsKey, at})
+	}
+	replies, err := rs.replies(commands)
+	if err != nil {
+		return nil, err
+	}
+	totals := make([]Usage, len(periods))
+	for i := range periods {
+		if totals[i], err = usage(replies[4*i], replies[4*i+1]); err != nil {
+			return nil, err
+		}
+	}
+	return totals, nil
+}
+
+// Get returns the usage of a client during periods
+func (rs *RedisStore) Get(client string, periods []string) ([]Usage, error) {
+	commands := make([][]string, 0, 2*len(periods))
+	for _, period := range periods {
+		requestsKey, itemsKey := rs.keys(period)
+		commands = append(commands, []string{"ZSCORE", requestsKey, client}, []string{"ZSCORE", itemsKey, client})
+	}
+	replies, err := rs.replies(commands)
+	if err != nil {
+		return nil, err
+	}
+	totals := make([]Usage, len(periods))
+	for i := range periods {
+		if totals[i], err = usage(replies[2*i], replies[2*i+1]); err != nil {
+			return nil, err
+		}
+	}
+	return totals, nil
+}
+
+// Clients returns the clients that have a usage during a period
+func (rs *RedisStore) Clients(period string) ([]string, error) {
+	requestsKey, _ := rs.keys(period)
+	reply, err := rs.client.Do("ZRANGE", requestsKey, "0", "-1")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Strings(reply)
+}
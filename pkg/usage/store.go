@@ -0,0 +1,353 @@
+package usage
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// persistedSnapshotFile is the name of the snapshot file in the data directory
+	persistedSnapshotFile = "usage.snapshot.json"
+	// persistedLogPrefix is the prefix of the log files in the data directory, followed by their generation
+	persistedLogPrefix = "usage.log."
+	// persistedVersion is the version of the snapshot format
+	persistedVersion = 1
+)
+
+// persistedRecord represents a usage added to the usage of a client during periods, appended to the log
+type persistedRecord struct {
+	Client  string   `json:"client"`
+	Periods []string `json:"periods"`
+	Usage   Usage    `json:"usage"`
+}
+
+// persistedSnapshot represents a snapshot of the usage of the clients by period, that covers the logs of the generations prior to Generation
+type persistedSnapshot struct {
+	Version    int                          `json:"version"`
+	Generation int64                        `json:"generation"`
+	Time       time.Time                    `json:"time"`
+	Periods    map[string]map[string]*Usage `json:"periods"`
+}
+
+// MemoryStore represents a Store that keeps the usage of the clients in memory, and optionally persists it in a data directory
+// as the Persister of the statistics does: in periodic snapshots, and in a log of what is added between snapshots
+// It is safe for concurrent use
+type MemoryStore struct {
+	mutex      sync.Mutex
+	periods    map[string]map[string]*Usage
+	directory  string
+	logFile    *os.File
+	generation int64
+}
+
+// NewMemoryStore is the MemoryStore factory, that creates a store kept in memory only
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		periods: make(map[string]map[string]*Usage),
+	}
+}
+
+// OpenFileStore opens the data directory (created if missing), recovers the usage persisted in it and persists the usage from now on
+func OpenFileStore(directory string) (*MemoryStore, error) {
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, fmt.Errorf("usage data directory creation failed: %v", err)
+	}
+	s := NewMemoryStore()
+	s.directory = directory
+	generation, err := s.recover()
+	if err != nil {
+		return nil, err
+	}
+	s.generation = generation
+	if err := s.Snapshot(); err != nil {
+		return nil, err
+	}
+	log.WithFields(log.Fields{
+		"directory":  directory,
+		"generation": s.generation,
+	}).Info("Usage recovered")
+	return s, nil
+}
+
+// add adds a usage to the usage of a client during periods, and returns their usage afterwards
+// The caller must hold the mutex
+func (s *MemoryStore) add(client string, periods []string, usage Usage) []Usage {
+	totals := make([]Usage, len(periods))
+	for i, period := range periods {
+		clients, ok := s.periods[period]
+		if !ok {
+			clients = make(map[string]*Usage)
+			s.periods[period] = clients
+		}
+		total, ok := clients[client]
+		if !ok {
+			total = &Usage{}
+			clients[client] = total
+		}
+		total.Requests += usage.Requests
+		total.Items += usage.Items
+		totals[i] = *total
+	}
+	return totals
+}
+
+// Add adds a usage to the usage of a client during periods, and returns their usage afterwards
+// It is appended to the log if the store is persisted, failures are only logged as they must not prevent rendering
+func (s *MemoryStore) Add(client string, periods []string, usage Usage) ([]Usage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.logFile != nil {
+		line, err := json.Marshal(&persistedRecord{Client: client, Periods: periods, Usage: usage})
+		if err == nil {
+			_, err = s.logFile.Write(append(line, '\n'))
+		}
+		if err != nil {
+			log.Errorf("Usage record writing failed: %v", err)
+		}
+	}
+	return s.add(client, periods, usage), nil
+}
+
+// Get returns the usage of a client during periods
+func (s *MemoryStore) Get(client string, periods []string) ([]Usage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	totals := make([]Usage, len(periods))
+	for i, period := range periods {
+		if total, ok := s.periods[period][client]; ok {
+			totals[i] = *total
+		}
+	}
+	return totals, nil
+}
+
+// Clients returns the clients that have a usage during a period
+func (s *MemoryStore) Clients(period string) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	clients := make([]string, 0, len(s.periods[period]))
+	for client := range s.periods[period] {
+		clients = append(clients, client)
+	}
+	return clients, nil
+}
+
+// Prune removes the usage of the periods that are no longer retained at a time (92 days for days, 25 months for months),
+// and returns their number
+func (s *MemoryStore) Prune(now time.Time) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	pruned := 0
+	for period := range s.periods {
+		if expiry, err := periodExpiry(period); err != nil || !now.Before(expiry) {
+			delete(s.periods, period)
+			pruned++
+		}
+	}
+	return pruned
+}
+
+// Run prunes the usage, and writes snapshots if the store is persisted, periodically until the context is done
+func (s *MemoryStore) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.Prune(now)
+			if s.directory == "" {
+				continue
+			}
+			if err := s.Snapshot(); err != nil {
+				log.Errorf("Usage snapshot failed: %v", err)
+			}
+		}
+	}
+}
+
+// Snapshot writes a snapshot of the usage and starts a new generation of the log, the logs of the previous generations are then removed
+// The usage being small, the store is locked during the snapshot
+func (s *MemoryStore) Snapshot() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.directory == "" {
+		return errors.New("usage store is not persisted")
+	}
+	logFile, err := os.OpenFile(s.logPath(s.generation+1), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("usage log creation failed: %v", err)
+	}
+	if s.logFile != nil {
+		if err := closeFile(s.logFile); err != nil {
+			log.Errorf("Usage log closing failed: %v", err)
+		}
+	}
+	s.logFile, s.generation = logFile, s.generation+1
+	if err := s.writeSnapshot(); err != nil {
+		return err
+	}
+	return s.removeLogs()
+}
+
+// Close writes a final snapshot and closes the log, the usage is no longer persisted afterwards
+func (s *MemoryStore) Close() error {
+	if s.directory == "" {
+		return nil
+	}
+	err := s.Snapshot()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.logFile != nil {
+		if closeErr := closeFile(s.logFile); closeErr != nil && err == nil {
+			err = fmt.Errorf("usage log closing failed: %v", closeErr)
+		}
+		s.logFile = nil
+	}
+	return err
+}
+
+// recover restores the usage from the snapshot and the logs, and returns the last generation found
+func (s *MemoryStore) recover() (int64, error) {
+	generation := int64(0)
+	data, err := ioutil.ReadFile(filepath.Join(s.directory, persistedSnapshotFile))
+	if err != nil && !os.IsNotExist(err) {
+		return 0, fmt.Errorf("usage snapshot reading failed: %v", err)
+	}
+	if err == nil {
+		snapshot := &persistedSnapshot{}
+		if err := json.Unmarshal(data, snapshot); err != nil {
+			return 0, fmt.Errorf("usage snapshot decoding failed: %v", err)
+		}
+		if snapshot.Version != persistedVersion {
+			return 0, fmt.Errorf("usage snapshot version must be %d, version %d was found", persistedVersion, snapshot.Version)
+		}
+		if snapshot.Periods != nil {
+			s.periods = snapshot.Periods
+		}
+		generation = snapshot.Generation
+	}
+	generations, err := s.logGenerations()
+	if err != nil {
+		return 0, err
+	}
+	for _, logGeneration := range generations {
+		if logGeneration < generation {
+			continue
+		}
+		if err := s.replayLog(logGeneration); err != nil {
+			return 0, err
+		}
+		generation = logGeneration
+	}
+	return generation, nil
+}
+
+// writeSnapshot atomically replaces the snapshot file, the caller must hold the mutex
+func (s *MemoryStore) writeSnapshot() error {
+	data, err := json.Marshal(&persistedSnapshot{Version: persistedVersion, Generation: s.generation, Time: time.Now(), Periods: s.periods})
+	if err != nil {
+		return fmt.Errorf("usage snapshot encoding failed: %v", err)
+	}
+	path := filepath.Join(s.directory, persistedSnapshotFile)
+	file, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("usage snapshot writing failed: %v", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("usage snapshot writing failed: %v", err)
+	}
+	if err := closeFile(file); err != nil {
+		return fmt.Errorf("usage snapshot writing failed: %v", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("usage snapshot writing failed: %v", err)
+	}
+	return nil
+}
+
+// logPath returns the path of the log of a generation
+func (s *MemoryStore) logPath(generation int64) string {
+	return filepath.Join(s.directory, fmt.Sprintf("%s%020d", persistedLogPrefix, generation))
+}
+
+// logGenerations returns the generations of the logs in the data directory, in ascending order
+func (s *MemoryStore) logGenerations() ([]int64, error) {
+	files, err := ioutil.ReadDir(s.directory)
+	if err != nil {
+		return nil, fmt.Errorf("usage data directory reading failed: %v", err)
+	}
+	generations := make([]int64, 0)
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), persistedLogPrefix) {
+			continue
+		}
+		if generation, err := strconv.ParseInt(strings.TrimPrefix(file.Name(), persistedLogPrefix), 10, 64); err == nil {
+			generations = append(generations, generation)
+		}
+	}
+	// The names of the logs are zero padded, so they are listed in ascending order of generation
+	return generations, nil
+}
+
+// removeLogs removes the logs of the generations prior to the current one, the caller must hold the mutex
+func (s *MemoryStore) removeLogs() error {
+	generations, err := s.logGenerations()
+	if err != nil {
+		return err
+	}
+	for _, generation := range generations {
+		if generation >= s.generation {
+			continue
+		}
+		if err := os.Remove(s.logPath(generation)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("usage log removal failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// replayLog replays the records of the log of a generation, a truncated last record (after a crash) is skipped
+func (s *MemoryStore) replayLog(generation int64) error {
+	file, err := os.Open(s.logPath(generation))
+	if err != nil {
+		return fmt.Errorf("usage log reading failed: %v", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		record := &persistedRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			log.Warnf("Usage log record skipped: %v", err)
+			continue
+		}
+		s.add(record.Client, record.Periods, record.Usage)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("usage log reading failed: %v", err)
+	}
+	return nil
+}
+
+// closeFile syncs and closes a file
+func closeFile(file *os.File) error {
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
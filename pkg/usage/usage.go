@@ -0,0 +1,197 @@
+// Package usage meters the usage of the API by its clients (the requests they send and the items rendered for them) per day and per month,
+// so that they can be billed by volume, and enforces their quotas
+package usage
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	// dayLayout is the layout of the daily periods (in UTC)
+	dayLayout = "2006-01-02"
+	// monthLayout is the layout of the monthly periods (in UTC)
+	monthLayout = "2006-01"
+	// dayRetention is the number of days the daily usage is retained
+	dayRetention = 92
+	// monthRetention is the number of months the monthly usage is retained
+	monthRetention = 25
+)
+
+// Usage represents the usage of a client during a period: the number of requests it sent and of items rendered for it
+// As a quota, a zero field is unlimited
+type Usage struct {
+	Requests int64 `json:"requests"`
+	Items    int64 `json:"items"`
+}
+
+// exceeded returns the resource of a usage that exceeds a quota (requests or items), empty if none
+func (u Usage) exceeded(quota Usage) string {
+	switch {
+	case quota.Requests > 0 && u.Requests > quota.Requests:
+		return "requests"
+	case quota.Items > 0 && u.Items > quota.Items:
+		return "items"
+	}
+	return ""
+}
+
+// Quotas represents the daily and monthly quotas of each client
+type Quotas struct {
+	Daily   Usage
+	Monthly Usage
+}
+
+// Store represents the interface of a store of the usage of the clients by period (a day such as 2026-10-18, or a month such as 2026-10)
+type Store interface {
+	// Add adds a usage (negative to remove it) to the usage of a client during periods, and returns their usage afterwards
+	Add(client string, periods []string, usage Usage) ([]Usage, error)
+	// Get returns the usage of a client during periods
+	Get(client string, periods []string) ([]Usage, error)
+	// Clients returns the clients that have a usage during a period
+	Clients(period string) ([]string, error)
+}
+
+// PeriodUsage represents the usage of a client during a period, and its quota
+type PeriodUsage struct {
+	Period string `json:"period"`
+	Usage  Usage  `json:"usage"`
+	Quota  Usage  `json:"quota"`
+}
+
+// Report represents the usage of a client during a day and during its month
+type Report struct {
+	Client string       `json:"client"`
+	Day    *PeriodUsage `json:"day"`
+	Month  *PeriodUsage `json:"month"`
+}
+
+// QuotaError is returned when a usage would exceed a quota of a client, it can be retried after RetryAfter (at the end of the period)
+type QuotaError struct {
+	Period     string
+	Resource   string
+	Quota      int64
+	RetryAfter time.Duration
+}
+
+// Error returns the message of the error
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s %s quota of %d exceeded", e.Period, e.Resource, e.Quota)
+}
+
+// Meter meters the usage of the clients in a store, and enforces their quotas
+type Meter struct {
+	store  Store
+	quotas Quotas
+}
+
+// NewMeter is the Meter factory
+func NewMeter(store Store, quotas Quotas) *Meter {
+	return &Meter{
+		store:  store,
+		quotas: quotas,
+	}
+}
+
+// Quotas returns the quotas of each client
+func (m *Meter) Quotas() Quotas {
+	return m.quotas
+}
+
+// periods returns the day and the month of a time, in UTC
+func periods(now time.Time) []string {
+	now = now.UTC()
+	return []string{now.Format(dayLayout), now.Format(monthLayout)}
+}
+
+// periodStart returns the start of a period, and its end (the start of the next one)
+func periodStart(period string) (time.Time, time.Time, error) {
+	if start, err := time.Parse(dayLayout, period); err == nil {
+		return start, start.AddDate(0, 0, 1), nil
+	}
+	start, err := time.Parse(monthLayout, period)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("usage period must be a day or a month, value %s was given", period)
+	}
+	return start, start.AddDate(0, 1, 0), nil
+}
+
+// periodExpiry returns the time after which the usage of a period is no longer retained
+func periodExpiry(period string) (time.Time, error) {
+	start, end, err := periodStart(period)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if end.Sub(start) == 24*time.Hour {
+		return start.AddDate(0, 0, dayRetention), nil
+	}
+	return start.AddDate(0, monthRetention, 0), nil
+}
+
+// Take adds a usage of a client at a time to its daily and monthly usage, unless it would exceed a quota:
+// the usage is then removed and a *QuotaError is returned
+func (m *Meter) Take(client string, usage Usage, now time.Time) error {
+	keys := periods(now)
+	totals, err := m.store.Add(client, keys, usage)
+	if err != nil {
+		return err
+	}
+	for i, quota := range []Usage{m.quotas.Daily, m.quotas.Monthly} {
+		resource := totals[i].exceeded(quota)
+		if resource == "" {
+			continue
+		}
+		if err := m.Refund(client, usage, now); err != nil {
+			return err
+		}
+		_, end, _ := periodStart(keys[i])
+		quotaError := &QuotaError{Period: "daily", Resource: resource, Quota: quota.Requests, RetryAfter: end.Sub(now)}
+		if i == 1 {
+			quotaError.Period = "monthly"
+		}
+		if resource == "items" {
+			quotaError.Quota = quota.Items
+		}
+		return quotaError
+	}
+	return nil
+}
+
+// Refund removes a usage taken by a client at a time from its daily and monthly usage
+func (m *Meter) Refund(client string, usage Usage, now time.Time) error {
+	_, err := m.store.Add(client, periods(now), Usage{Requests: -usage.Requests, Items: -usage.Items})
+	return err
+}
+
+// Report returns the usage of a client during the day of a date and during its month
+func (m *Meter) Report(client string, date time.Time) (*Report, error) {
+	keys := periods(date)
+	totals, err := m.store.Get(client, keys)
+	if err != nil {
+		return nil, err
+	}
+	return &Report{
+		Client: client,
+		Day:    &PeriodUsage{Period: keys[0], Usage: totals[0], Quota: m.quotas.Daily},
+		Month:  &PeriodUsage{Period: keys[1], Usage: totals[1], Quota: m.quotas.Monthly},
+	}, nil
+}
+
+// Reports returns the usage of the clients of the month of a date, sorted by client
+func (m *Meter) Reports(date time.Time) ([]*Report, error) {
+	clients, err := m.store.Clients(periods(date)[1])
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(clients)
+	reports := make([]*Report, 0, len(clients))
+	for _, client := range clients {
+		report, err := m.Report(client, date)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
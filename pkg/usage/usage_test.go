@@ -0,0 +1,160 @@
+package usage_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jpraynaud/fizzbuzz-server/pkg/resp"
+	"github.com/jpraynaud/fizzbuzz-server/pkg/resp/resptest"
+	"github.com/jpraynaud/fizzbuzz-server/pkg/usage"
+)
+
+// testMeter is a helper that checks a meter over a store: its quotas, its rollbacks and its reports
+func testMeter(t *testing.T, store usage.Store) {
+	// A client may send 3 requests a day, and have 100 items rendered a month
+	meter := usage.NewMeter(store, usage.Quotas{Daily: usage.Usage{Requests: 3}, Monthly: usage.Usage{Items: 100}})
+	now := time.Date(2026, time.October, 31, 23, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		client  string
+		usage   usage.Usage
+		elapsed time.Duration
+		wantErr *usage.QuotaError
+	}{
+		{"Request", "a", usage.Usage{Requests: 1}, 0, nil},
+		{"Items", "a", usage.Usage{Requests: 1, Items: 60}, 0, nil},
+		{"Monthly items exceeded", "a", usage.Usage{Requests: 1, Items: 60}, 0, &usage.QuotaError{Period: "monthly", Resource: "items", Quota: 100, RetryAfter: time.Hour}},
+		{"Other client", "b", usage.Usage{Requests: 1, Items: 100}, 0, nil},
+		{"Last request", "a", usage.Usage{Requests: 1, Items: 40}, 30 * time.Minute, nil},
+		{"Daily requests exceeded", "a", usage.Usage{Requests: 1}, 30 * time.Minute, &usage.QuotaError{Period: "daily", Resource: "requests", Quota: 3, RetryAfter: 30 * time.Minute}},
+		{"Next day and month", "a", usage.Usage{Requests: 1, Items: 100}, time.Hour, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := meter.Take(tt.client, tt.usage, now.Add(tt.elapsed))
+			if tt.wantErr == nil && err != nil {
+				t.Errorf("Take() error = %v, want nil", err)
+			}
+			if tt.wantErr != nil && !reflect.DeepEqual(err, tt.wantErr) {
+				t.Errorf("Take() error = %#v, want %#v", err, tt.wantErr)
+			}
+		})
+	}
+	// Rejected usages were removed
+	want := &usage.Report{
+		Client: "a",
+		Day:    &usage.PeriodUsage{Period: "2026-10-31", Usage: usage.Usage{Requests: 3, Items: 100}, Quota: usage.Usage{Requests: 3}},
+		Month:  &usage.PeriodUsage{Period: "2026-10", Usage: usage.Usage{Requests: 3, Items: 100}, Quota: usage.Usage{Items: 100}},
+	}
+	if got, err := meter.Report("a", now); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Report() = %+v, %v, want %+v", got, err, want)
+	}
+	reports, err := meter.Reports(now)
+	if err != nil || len(reports) != 2 || reports[0].Client != "a" || reports[1].Client != "b" || reports[1].Month.Usage.Items != 100 {
+		t.Errorf("Reports() = %+v, %v, want the reports of a and b", reports, err)
+	}
+	if reports, err := meter.Reports(now.Add(time.Hour)); err != nil || len(reports) != 1 || reports[0].Day.Usage != (usage.Usage{Requests: 1, Items: 100}) {
+		t.Errorf("Reports() of the next month = %+v, %v, want the report of a only", reports, err)
+	}
+	if reports, err := meter.Reports(now.AddDate(1, 0, 0)); err != nil || len(reports) != 0 {
+		t.Errorf("Reports() of the next year = %+v, %v, want none", reports, err)
+	}
+	// Refunded usages are removed from the periods of their time
+	if err := meter.Refund("b", usage.Usage{Requests: 1}, now); err != nil {
+		t.Errorf("Refund() error = %v, want nil", err)
+	}
+	if got, err := meter.Report("b", now); err != nil || got.Day.Usage != (usage.Usage{Items: 100}) || got.Month.Usage != (usage.Usage{Items: 100}) {
+		t.Errorf("Report() after refund = %+v, %v, want the items of b only", got, err)
+	}
+}
+
+func TestMeter_MemoryStore(t *testing.T) {
+	testMeter(t, usage.NewMemoryStore())
+}
+
+func TestMeter_RedisStore(t *testing.T) {
+	server := resptest.NewServer()
+	defer server.Close()
+	client := resp.NewClient(server.Addr, time.Second, 4)
+	defer client.Close()
+	testMeter(t, usage.NewRedisStore(client, "test:"))
+	// Failures of the Redis server are returned
+	server.Close()
+	if _, err := usage.NewRedisStore(client, "test:").Get("a", []string{"2026-10"}); err == nil {
+		t.Errorf("Get() error = nil with the server closed, want an error")
+	}
+}
+
+func TestMemoryStore_Prune(t *testing.T) {
+	store := usage.NewMemoryStore()
+	store.Add("a", []string{"2026-01-01", "2026-01"}, usage.Usage{Requests: 1})
+	store.Add("a", []string{"2026-03-31", "2026-03"}, usage.Usage{Requests: 1})
+	// Days are retained for 92 days, months for 25 months
+	if got := store.Prune(time.Date(2026, time.April, 3, 0, 0, 0, 0, time.UTC)); got != 1 {
+		t.Errorf("Prune() = %d, want 1", got)
+	}
+	if got := store.Prune(time.Date(2028, time.February, 1, 0, 0, 0, 0, time.UTC)); got != 2 {
+		t.Errorf("Prune() = %d, want 2", got)
+	}
+	if clients, _ := store.Clients("2026-03"); len(clients) != 1 {
+		t.Errorf("Clients() = %v after Prune(), want a", clients)
+	}
+}
+
+func TestOpenFileStore(t *testing.T) {
+	directory, err := ioutil.TempDir("", "usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+	periods := []string{"2026-10-18", "2026-10"}
+	// Add usage before and after a snapshot, then crash (the store is not closed)
+	store, err := usage.OpenFileStore(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add("a", periods, usage.Usage{Requests: 1, Items: 10})
+	if err := store.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	store.Add("a", periods, usage.Usage{Requests: 1, Items: 20})
+	store.Add("b", periods[1:], usage.Usage{Requests: 1})
+	// The usage is recovered from the snapshot and the log, a truncated record is skipped
+	logs, err := filepath.Glob(filepath.Join(directory, "usage.log.*"))
+	if err != nil || len(logs) != 1 {
+		t.Fatalf("logs = %v, %v, want 1 log", logs, err)
+	}
+	file, err := os.OpenFile(logs[0], os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"client":"a","periods":["2026-10`)
+	file.Close()
+	recovered, err := usage.OpenFileStore(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := recovered.Get("a", periods); !reflect.DeepEqual(got, []usage.Usage{{Requests: 2, Items: 30}, {Requests: 2, Items: 30}}) {
+		t.Errorf("Get() = %+v after recovery, want 2 requests and 30 items", got)
+	}
+	// Once closed, the usage is recovered from the snapshot only
+	recovered.Add("b", periods[1:], usage.Usage{Requests: 1})
+	if err := recovered.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := usage.OpenFileStore(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if got, _ := reopened.Get("b", periods); !reflect.DeepEqual(got, []usage.Usage{{}, {Requests: 2}}) {
+		t.Errorf("Get() = %+v after reopening, want 2 requests in the month", got)
+	}
+	if logs, _ := filepath.Glob(filepath.Join(directory, "usage.log.*")); len(logs) != 1 {
+		t.Errorf("logs = %v, want the log of the current generation only", logs)
+	}
+}